@@ -2,48 +2,87 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"dni/internal/accounting"
 	"dni/internal/auth"
 	"dni/pkg/config"
 	"dni/pkg/datastore"
+	"dni/pkg/redisconn"
+	"dni/pkg/sqliteconn"
 	"dni/pkg/stream"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nats-io/nats.go"
 )
 
+// janitor runs background housekeeping on the stream backend
+type janitor interface {
+	Run(ctx context.Context)
+}
+
 // Dependencies holds all initialized handlers and clients
 type Dependencies struct {
 	AuthHandler *auth.Handler
 	AcctHandler *accounting.Handler
-	RedisClient *redis.Client
+	RedisClient redis.UniversalClient
+	Postgres    *pgxpool.Pool
+	SQLite      *sql.DB
+	Janitor     janitor
+	Kafka       *stream.KafkaStream
+	NATS        *nats.Conn
+	// SecretSource picks the shared secret of each RADIUS client
+	SecretSource *auth.ClientSecretSource
+	// Fanout is set when records are also written to secondary datastores
+	Fanout *datastore.FanoutStore
+	// Webhooks is set when session starts and stops are posted to HTTP endpoints
+	Webhooks  *stream.WebhookStream
+	WebhookDB *sql.DB
 }
 
 // InitializeDependencies sets up all required dependencies based on configuration
 func InitializeDependencies(cfg *config.Config) (*Dependencies, error) {
 	ctx := context.Background()
+	deps := &Dependencies{}
 
-	// Initialize Redis connection
-	redisAddr := fmt.Sprintf("%s:%d", cfg.RedisHost, cfg.RedisPort)
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Password: cfg.RedisPassword,
-		DB:       cfg.RedisDB,
-	})
-
-	// Test Redis connection
-	_, err := redisClient.Ping(ctx).Result()
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to Redis: %v", err)
+	retention := stream.RetentionPolicy{
+		MaxLen: cfg.StreamMaxLen,
+		MaxAge: cfg.StreamMaxAge,
 	}
 
-	log.Printf("Connected to Redis at %s", redisAddr)
-
-	// Initialize interface implementations
-	datastoreClient := datastore.NewRedisStore(redisClient)
-	streamClient := stream.NewRedisStream(redisClient)
+	var datastoreClient datastore.Datastore
+	var streamClient stream.Stream
+	var err error
+	switch {
+	case cfg.StreamBackend == config.StreamKafka:
+		datastoreClient, streamClient, err = deps.initializeKafka(ctx, cfg)
+	case cfg.StreamBackend == config.StreamNATS:
+		datastoreClient, streamClient, err = deps.initializeNATS(ctx, cfg, retention)
+	case cfg.DatastoreBackend == config.DatastoreSQLite:
+		datastoreClient, streamClient, err = deps.initializeSQLite(ctx, cfg, retention)
+	case cfg.DatastoreBackend == config.DatastoreMemory:
+		// Nothing leaves the process and streams are trimmed on publish, so there is no janitor
+		log.Printf("Keeping accounting records and events in memory, they are lost on exit")
+		datastoreClient = datastore.NewMemoryStore()
+		streamClient = stream.NewMemoryStreamWithRetention(retention)
+	default:
+		datastoreClient, streamClient, err = deps.initializeRedis(ctx, cfg, retention)
+	}
+	if err == nil && len(cfg.SecondaryBackends) > 0 {
+		datastoreClient, err = deps.initializeFanout(ctx, cfg, datastoreClient)
+	}
+	if err == nil && !cfg.WebhookRoutes().Empty() {
+		err = deps.initializeWebhooks(ctx, cfg)
+	}
+	if err != nil {
+		deps.Close()
+		return nil, err
+	}
 
 	// Get secret from configuration
 	secret := []byte(cfg.Secret)
@@ -51,16 +90,256 @@ func InitializeDependencies(cfg *config.Config) (*Dependencies, error) {
 	// Create handlers
 	authHandler := auth.NewHandler(secret, cfg.UserCredentials)
 	acctHandler := accounting.NewHandler(datastoreClient, streamClient, cfg.AccountingTTL)
+	acctHandler.RequestTimeout = cfg.RequestTimeout
+	acctHandler.HashTagKeys = cfg.HashTagKeys()
+	acctHandler.Topology = stream.PerUserTopology{HashTag: cfg.HashTagKeys()}
+	if cfg.StreamTopology == stream.TopologyPartitioned {
+		acctHandler.Topology = stream.PartitionedTopology{Partitions: cfg.StreamPartitions}
+		log.Printf("Publishing accounting events to %d partition streams", cfg.StreamPartitions)
+	}
+	if deps.Webhooks != nil {
+		acctHandler.Notifier = deps.Webhooks
+	}
+
+	deps.AuthHandler = authHandler
+	deps.AcctHandler = acctHandler
+	deps.SecretSource = auth.NewSecretSource(cfg.RadiusClients, secret)
+	if len(cfg.RadiusClients) > 0 {
+		log.Printf("Accepting requests from %d configured RADIUS clients", len(cfg.RadiusClients))
+	}
+	return deps, nil
+}
+
+// initializeRedis connects to Redis for the stream and, unless PostgreSQL is configured, the records
+func (d *Dependencies) initializeRedis(ctx context.Context, cfg *config.Config, retention stream.RetentionPolicy) (datastore.Datastore, stream.Stream, error) {
+	// Initialize Redis connection
+	redisOptions := cfg.RedisOptions()
+	redisClient, err := redisconn.NewClient(ctx, redisOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	d.RedisClient = redisClient
+
+	log.Printf("Connected to Redis (%s) at %s (TLS: %t)", cfg.RedisMode, strings.Join(redisOptions.Seeds(), ","), redisOptions.TLS.Enabled)
+
+	// Initialize interface implementations
+	streamClient := stream.NewRedisStreamWithRetention(redisClient, retention)
+	d.Janitor = stream.NewJanitor(redisClient, "radius:updates:*", retention, cfg.StreamIdleTTL, cfg.StreamJanitorInterval)
+
+	if cfg.DatastoreBackend == config.DatastorePostgres {
+		d.Postgres, err = datastore.ConnectPostgres(ctx, cfg.PostgresURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Storing accounting records in PostgreSQL")
+		return datastore.NewPostgresStore(d.Postgres), streamClient, nil
+	}
+
+	// Records and stream notifications share a client, so they are written in one transaction
+	return datastore.NewRedisStoreWithPublisher(redisClient, streamClient, cfg.HashTagKeys()), streamClient, nil
+}
+
+// initializeSQLite keeps records and the event log in one local file, without Redis
+func (d *Dependencies) initializeSQLite(ctx context.Context, cfg *config.Config, retention stream.RetentionPolicy) (datastore.Datastore, stream.Stream, error) {
+	db, err := sqliteconn.Open(ctx, cfg.SQLitePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	d.SQLite = db
+
+	streamClient, err := stream.NewSQLiteStreamWithRetention(ctx, db, retention)
+	if err != nil {
+		return nil, nil, err
+	}
+	d.Janitor = stream.NewSQLiteJanitor(streamClient, cfg.StreamIdleTTL, cfg.StreamJanitorInterval)
+
+	// Records and stream entries share the database, so they are written in one transaction
+	datastoreClient, err := datastore.NewSQLiteStoreWithPublisher(ctx, db, streamClient)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("Storing accounting records and events in SQLite at %s", cfg.SQLitePath)
+	return datastoreClient, streamClient, nil
+}
+
+// initializeKafka publishes events to Kafka and stores records in the datastore backend.
+// Records and events no longer share a backend, so they are written one after the other.
+func (d *Dependencies) initializeKafka(ctx context.Context, cfg *config.Config) (datastore.Datastore, stream.Stream, error) {
+	kafkaStream, err := stream.NewKafkaStream(cfg.KafkaBrokers, cfg.KafkaTopic)
+	if err != nil {
+		return nil, nil, err
+	}
+	d.Kafka = kafkaStream
+
+	// Retention is configured on the topic, so there is no janitor
+	log.Printf("Publishing accounting events to Kafka topic %s at %s", cfg.KafkaTopic, strings.Join(cfg.KafkaBrokers, ","))
+
+	datastoreClient, err := d.connectStore(ctx, cfg, cfg.DatastoreBackend)
+	if err != nil {
+		return nil, nil, err
+	}
+	return datastoreClient, kafkaStream, nil
+}
+
+// initializeNATS publishes events to NATS JetStream and stores records in the datastore backend
+func (d *Dependencies) initializeNATS(ctx context.Context, cfg *config.Config, retention stream.RetentionPolicy) (datastore.Datastore, stream.Stream, error) {
+	nc, err := nats.Connect(cfg.NATSURL, nats.Name("radius-api"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to NATS: %v", err)
+	}
+	d.NATS = nc
+
+	// JetStream enforces the retention limits itself, so there is no janitor
+	natsStream, err := stream.NewNATSStreamWithRetention(ctx, nc, retention)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Publishing accounting events to NATS JetStream stream %s at %s", stream.DefaultNATSStream, nc.ConnectedUrlRedacted())
+
+	datastoreClient, err := d.connectStore(ctx, cfg, cfg.DatastoreBackend)
+	if err != nil {
+		return nil, nil, err
+	}
+	return datastoreClient, natsStream, nil
+}
+
+// initializeFanout wraps the primary datastore in a FanoutStore writing to the secondary backends
+func (d *Dependencies) initializeFanout(ctx context.Context, cfg *config.Config, primary datastore.Datastore) (datastore.Datastore, error) {
+	var secondaries []datastore.NamedStore
+	for _, backend := range cfg.SecondaryBackends {
+		store, err := d.connectStore(ctx, cfg, backend)
+		if err != nil {
+			return nil, err
+		}
+		secondaries = append(secondaries, datastore.NamedStore{Name: backend, Store: store})
+	}
+
+	opts := datastore.DefaultFanoutOptions()
+	opts.Policy = cfg.FanoutPolicy
+	opts.QueueSize = cfg.FanoutQueueSize
+	opts.MaxAttempts = cfg.FanoutMaxAttempts
+	named := datastore.NamedStore{Name: cfg.DatastoreBackend, Store: primary}
+
+	log.Printf("Writing accounting records to %s and %s (policy: %s)", cfg.DatastoreBackend, strings.Join(cfg.SecondaryBackends, ","), cfg.FanoutPolicy)
 
-	return &Dependencies{
-		AuthHandler: authHandler,
-		AcctHandler: acctHandler,
-		RedisClient: redisClient,
-	}, nil
+	// Keep publishing in the same write as the primary record when the primary supports it
+	if _, ok := primary.(datastore.AtomicPublisher); ok {
+		fanout, err := datastore.NewPublishingFanoutStore(opts, named, secondaries...)
+		if err != nil {
+			return nil, err
+		}
+		d.Fanout = fanout.FanoutStore
+		return fanout, nil
+	}
+
+	fanout, err := datastore.NewFanoutStore(opts, named, secondaries...)
+	if err != nil {
+		return nil, err
+	}
+	d.Fanout = fanout
+	return fanout, nil
+}
+
+// initializeWebhooks opens the webhook delivery queue and starts delivering
+func (d *Dependencies) initializeWebhooks(ctx context.Context, cfg *config.Config) error {
+	db, err := sqliteconn.Open(ctx, cfg.WebhookQueuePath)
+	if err != nil {
+		return err
+	}
+	d.WebhookDB = db
+
+	opts := stream.DefaultWebhookOptions()
+	opts.Secret = cfg.WebhookSecret
+	opts.MaxAttempts = cfg.WebhookMaxAttempts
+	opts.Timeout = cfg.WebhookTimeout
+	d.Webhooks, err = stream.NewWebhookStream(ctx, db, cfg.WebhookRoutes(), opts)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Posting session starts and stops to %d user and %d NAS webhook routes, queued in %s", len(cfg.WebhookUserURLs), len(cfg.WebhookNASURLs), cfg.WebhookQueuePath)
+	return nil
+}
+
+// connectStore connects a datastore that does not publish events, reusing open connections
+func (d *Dependencies) connectStore(ctx context.Context, cfg *config.Config, backend string) (datastore.Datastore, error) {
+	var err error
+	switch backend {
+	case config.DatastorePostgres:
+		if d.Postgres == nil {
+			if d.Postgres, err = datastore.ConnectPostgres(ctx, cfg.PostgresURL); err != nil {
+				return nil, err
+			}
+		}
+		return datastore.NewPostgresStore(d.Postgres), nil
+	case config.DatastoreSQLite:
+		if d.SQLite == nil {
+			if d.SQLite, err = sqliteconn.Open(ctx, cfg.SQLitePath); err != nil {
+				return nil, err
+			}
+		}
+		return datastore.NewSQLiteStore(ctx, d.SQLite)
+	case config.DatastoreMemory:
+		log.Printf("Keeping accounting records in memory, they are lost on exit")
+		return datastore.NewMemoryStore(), nil
+	default:
+		if d.RedisClient == nil {
+			if d.RedisClient, err = redisconn.NewClient(ctx, cfg.RedisOptions()); err != nil {
+				return nil, err
+			}
+		}
+		return datastore.NewRedisStore(d.RedisClient, cfg.HashTagKeys()), nil
+	}
+}
+
+// Reconfigure applies the settings that can change while serving, see reloader
+func (d *Dependencies) Reconfigure(cfg *config.Config) {
+	d.SecretSource.Set(cfg.RadiusClients, []byte(cfg.Secret))
+	d.AuthHandler.SetUserCredentials(cfg.UserCredentials)
+	d.AcctHandler.SetPolicy(cfg.AccountingTTL, cfg.RequestTimeout)
+	if d.Webhooks != nil {
+		d.Webhooks.SetRoutes(cfg.WebhookRoutes())
+	}
 }
 
 // Close cleans up all resources
 func (d *Dependencies) Close() error {
+	if d.Webhooks != nil {
+		// Deliveries still queued are sent on the next start
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := d.Webhooks.Close(ctx); err != nil {
+			log.Printf("Failed to close webhooks: %v", err)
+		}
+		cancel()
+	}
+	if d.WebhookDB != nil {
+		if err := d.WebhookDB.Close(); err != nil {
+			log.Printf("Failed to close webhook queue: %v", err)
+		}
+	}
+	if d.Fanout != nil {
+		// Give queued secondary writes a moment to land before the connections go away
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := d.Fanout.Close(ctx); err != nil {
+			log.Printf("Failed to close datastore fan-out: %v", err)
+		}
+		cancel()
+	}
+	if d.Kafka != nil {
+		d.Kafka.Close()
+	}
+	if d.NATS != nil {
+		d.NATS.Close()
+	}
+	if d.Postgres != nil {
+		d.Postgres.Close()
+	}
+	if d.SQLite != nil {
+		if err := d.SQLite.Close(); err != nil {
+			log.Printf("Failed to close SQLite: %v", err)
+		}
+	}
 	if d.RedisClient != nil {
 		return d.RedisClient.Close()
 	}
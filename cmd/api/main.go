@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
 	"dni/pkg/config"
 
@@ -10,55 +18,170 @@ import (
 )
 
 func main() {
-	// Load configuration from environment variables
-	cfg, err := config.LoadConfig()
+	backend := flag.String("backend", "", "Datastore backend: redis, postgres, sqlite or memory (overrides DATASTORE_BACKEND)")
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file, or a file with KEY=VALUE settings")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration, print every error and exit")
+	watchInterval := flag.Duration("config-watch-interval", 5*time.Second, "How often the config file is checked for changes to reload, 0 disables")
+	flag.Parse()
+
+	// Only flags given on the command line override the environment and the config file
+	flagValues := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "backend" {
+			flagValues["DATASTORE_BACKEND"] = *backend
+		}
+	})
+	load := func() (*config.Config, error) {
+		return loadConfig(*configFile, flagValues)
+	}
+
+	cfg, err := load()
+	if *checkConfig {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("Configuration OK")
+		return
+	}
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
+	if *configFile != "" {
+		log.Printf("Loaded settings from %s", *configFile)
+	}
 
 	// Initialize all dependencies
 	deps, err := InitializeDependencies(cfg)
 	if err != nil {
 		log.Fatalf("Failed to initialize dependencies: %v", err)
 	}
-	defer deps.Close()
 
-	// Get secret from configuration
-	secret := []byte(cfg.Secret)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Reload clients, secrets, users and policies on SIGHUP or when the config file changes
+	reload := newReloader(cfg, deps, load)
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go reload.reloadOn(hupChan)
+	if *configFile != "" && *watchInterval > 0 {
+		go reload.watch(ctx, *configFile, *watchInterval)
+	}
+
+	// Trim streams and drop idle ones in the background
+	if deps.Janitor != nil {
+		go deps.Janitor.Run(ctx)
+	}
+
+	// Optional metrics endpoint for the datastore fan-out
+	var metricsServer *http.Server
+	if cfg.MetricsAddr != "" && deps.Fanout != nil {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			deps.Fanout.WriteMetrics(w)
+		})
+		metricsServer = &http.Server{
+			Addr:              cfg.MetricsAddr,
+			Handler:           mux,
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		go func() {
+			log.Printf("Serving metrics on %s", cfg.MetricsAddr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Metrics server error: %v", err)
+			}
+		}()
+	}
 
 	// Create servers using the initialized handlers
-	authServer := &radius.PacketServer{
+	authServer, acctServer := newServers(cfg, deps)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	// Start the servers, an error of either one shuts both down
+	serverErrs := make(chan error, 2)
+	serve := func(name string, server *radius.PacketServer) {
+		log.Printf("Starting %s server on %s", name, server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != radius.ErrServerShutdown {
+			serverErrs <- fmt.Errorf("%s server error: %v", name, err)
+		}
+	}
+	go serve("Authentication", authServer)
+	go serve("Accounting", acctServer)
+
+	var serverErr error
+	select {
+	case sig := <-sigChan:
+		log.Printf("Received signal %v, shutting down...", sig)
+	case serverErr = <-serverErrs:
+		log.Printf("%v, shutting down...", serverErr)
+	}
+
+	// Stop reading packets and wait for the requests in flight to finish their writes
+	shutdownServers(cfg.ShutdownTimeout, authServer, acctServer)
+
+	// Stop the background work, then drain the queued writes and close the backends
+	cancel()
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+	if err := deps.Close(); err != nil {
+		log.Printf("Failed to close dependencies: %v", err)
+	}
+	log.Printf("Shutdown complete")
+
+	if serverErr != nil {
+		os.Exit(1)
+	}
+}
+
+// newServers creates the authentication and accounting servers on the configured ports
+func newServers(cfg *config.Config, deps *Dependencies) (authServer, acctServer *radius.PacketServer) {
+	authServer = &radius.PacketServer{
 		Addr:         cfg.AuthPort,
-		Handler:      radius.HandlerFunc(deps.AcctHandler.Handle),
-		SecretSource: radius.StaticSecretSource(secret),
+		Handler:      radius.HandlerFunc(deps.AuthHandler.Handle),
+		SecretSource: deps.SecretSource,
 	}
 
-	acctServer := &radius.PacketServer{
+	acctServer = &radius.PacketServer{
 		Addr:         cfg.AcctPort,
 		Handler:      radius.HandlerFunc(deps.AcctHandler.Handle),
-		SecretSource: radius.StaticSecretSource(secret),
+		SecretSource: deps.SecretSource,
 	}
+	return authServer, acctServer
+}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	// Start authentication server
-	go func() {
-		defer wg.Done()
-		log.Printf("Starting Authentication server on %s", cfg.AuthPort)
-		if err := authServer.ListenAndServe(); err != nil {
-			log.Fatalf("Authentication server error: %v", err)
-		}
-	}()
-
-	// Start accounting server
-	go func() {
-		defer wg.Done()
-		log.Printf("Starting Accounting server on %s", cfg.AcctPort)
-		if err := acctServer.ListenAndServe(); err != nil {
-			log.Fatalf("Accounting server error: %v", err)
-		}
-	}()
+// shutdownServers stops the servers concurrently, giving requests in flight up to timeout
+func shutdownServers(timeout time.Duration, servers ...*radius.PacketServer) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *radius.PacketServer) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("Server on %s did not finish its requests in %v: %v", server.Addr, timeout, err)
+			}
+		}(server)
+	}
 	wg.Wait()
 }
+
+// loadConfig merges settings with the precedence flags > environment > config file > defaults
+func loadConfig(configFile string, flagValues map[string]string) (*config.Config, error) {
+	fileValues := map[string]string{}
+	var fileErr error
+	if configFile != "" {
+		fileValues, fileErr = config.ReadConfigFile(configFile)
+	}
+	cfg, err := config.LoadConfigFrom(config.Overrides(flagValues, config.Layered(
+		os.LookupEnv,
+		config.MapLookup(fileValues),
+	)))
+	return cfg, config.JoinValidationErrors(fileErr, err)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"dni/pkg/config"
+)
+
+// reloader re-reads the configuration and applies the settings that can change while
+// serving. The listening sockets and backend connections are kept, so no packets are lost.
+type reloader struct {
+	load func() (*config.Config, error)
+	deps *Dependencies
+
+	mu sync.Mutex
+	// current is the configuration in effect, settings that need a restart keep their startup value
+	current *config.Config
+}
+
+func newReloader(cfg *config.Config, deps *Dependencies, load func() (*config.Config, error)) *reloader {
+	return &reloader{load: load, deps: deps, current: cfg}
+}
+
+// Reload loads the configuration again and logs what changed. An invalid configuration
+// is logged and the current one stays in effect.
+func (r *reloader) Reload() {
+	cfg, err := r.load()
+	if err != nil {
+		log.Printf("[RELOAD] Keeping the current configuration: %v", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changes := config.Diff(r.current, cfg)
+	if len(changes) == 0 {
+		log.Printf("[RELOAD] Configuration unchanged")
+		return
+	}
+
+	next := r.reloadable(cfg)
+	applied := make(map[string]bool)
+	for _, change := range config.Diff(r.current, next) {
+		applied[change.Field] = true
+	}
+	for _, change := range changes {
+		if applied[change.Field] {
+			log.Printf("[RELOAD] %s", change)
+		} else {
+			log.Printf("[RELOAD] %s (needs a restart, ignored)", change)
+		}
+	}
+
+	r.deps.Reconfigure(next)
+	r.current = next
+}
+
+// reloadOn reloads the configuration for every signal received, until signals is closed
+func (r *reloader) reloadOn(signals <-chan os.Signal) {
+	for sig := range signals {
+		log.Printf("Received %v, reloading configuration", sig)
+		r.Reload()
+	}
+}
+
+// reloadable returns the current configuration with the settings of cfg that
+// Dependencies.Reconfigure applies while serving
+func (r *reloader) reloadable(cfg *config.Config) *config.Config {
+	next := *r.current
+	next.Secret = cfg.Secret
+	next.RadiusClients = cfg.RadiusClients
+	next.UserCredentials = cfg.UserCredentials
+	next.AccountingTTL = cfg.AccountingTTL
+	next.RequestTimeout = cfg.RequestTimeout
+	// Routes can change, but without a webhook queue at startup there is nothing to route to
+	if r.deps.Webhooks != nil {
+		next.WebhookUserURLs = cfg.WebhookUserURLs
+		next.WebhookNASURLs = cfg.WebhookNASURLs
+	}
+	return &next
+}
+
+// watch reloads the configuration whenever the modification time or size of path changes
+func (r *reloader) watch(ctx context.Context, path string, interval time.Duration) {
+	last, _ := os.Stat(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Editors often replace the file, so it may briefly be missing
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+		log.Printf("[RELOAD] %s changed, reloading configuration", path)
+		r.Reload()
+	}
+}
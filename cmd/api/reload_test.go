@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"dni/pkg/config"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+func TestReloader_SIGHUPAppliesNewUsers(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "radius.env")
+	writeConfig := func(users string) {
+		settings := "DATASTORE_BACKEND=memory\nRADIUS_SECRET=testing123\nUSER_CREDENTIALS=" + users + "\n"
+		if err := os.WriteFile(configFile, []byte(settings), 0o600); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+	}
+	writeConfig("alice:password1")
+
+	load := func() (*config.Config, error) {
+		return loadConfig(configFile, map[string]string{})
+	}
+	cfg, err := load()
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	deps, err := InitializeDependencies(cfg)
+	if err != nil {
+		t.Fatalf("Failed to initialize dependencies: %v", err)
+	}
+	defer deps.Close()
+
+	authServer, _ := newServers(cfg, deps)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go authServer.Serve(conn)
+	defer authServer.Shutdown(context.Background())
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+	go newReloader(cfg, deps, load).reloadOn(hupChan)
+
+	authenticate := func(username, password string) radius.Code {
+		t.Helper()
+		packet := radius.New(radius.CodeAccessRequest, []byte("testing123"))
+		rfc2865.UserName_SetString(packet, username)
+		rfc2865.UserPassword_SetString(packet, password)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		response, err := radius.Exchange(ctx, packet, conn.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("Access-Request for %s failed: %v", username, err)
+		}
+		return response.Code
+	}
+
+	if code := authenticate("alice", "password1"); code != radius.CodeAccessAccept {
+		t.Fatalf("Expected alice to be accepted before the reload, got %v", code)
+	}
+	if code := authenticate("bob", "password2"); code != radius.CodeAccessReject {
+		t.Fatalf("Expected bob to be rejected before the reload, got %v", code)
+	}
+
+	writeConfig("bob:password2")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("Failed to send SIGHUP: %v", err)
+	}
+
+	// The signal is handled asynchronously, so wait for the new users to take effect
+	deadline := time.Now().Add(5 * time.Second)
+	for authenticate("bob", "password2") != radius.CodeAccessAccept {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected bob to be accepted after the reload")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code := authenticate("alice", "password1"); code != radius.CodeAccessReject {
+		t.Errorf("Expected alice to be rejected after the reload, got %v", code)
+	}
+}
@@ -2,54 +2,175 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 
 	"dni/internal/consumer"
 	"dni/pkg/config"
+	"dni/pkg/datastore"
+	"dni/pkg/redisconn"
+	"dni/pkg/sqliteconn"
 	"dni/pkg/stream"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nats-io/nats.go"
 )
 
 // Dependencies holds all initialized consumer dependencies
 type Dependencies struct {
 	Consumer     *consumer.Consumer
-	RedisClient  *redis.Client
+	RedisClient  redis.UniversalClient
+	Postgres     *pgxpool.Pool
+	SQLite       *sql.DB
+	Kafka        *stream.KafkaStream
+	NATS         *nats.Conn
 	StreamClient stream.Stream
+	Sink         consumer.Sink
 }
 
 // InitializeDependencies sets up all required consumer dependencies
 func InitializeDependencies(cfg *config.ConsumerConfig) (*Dependencies, error) {
 	ctx := context.Background()
+	deps := &Dependencies{}
 
+	var datastoreClient datastore.Datastore
+	var err error
+	switch {
+	case cfg.StreamBackend == config.StreamKafka:
+		datastoreClient, err = deps.initializeKafka(ctx, cfg)
+	case cfg.StreamBackend == config.StreamNATS:
+		datastoreClient, err = deps.initializeNATS(ctx, cfg)
+	case cfg.DatastoreBackend == config.DatastoreSQLite:
+		datastoreClient, err = deps.initializeSQLite(ctx, cfg)
+	default:
+		datastoreClient, err = deps.initializeRedis(ctx, cfg)
+	}
+	if err != nil {
+		deps.Close()
+		return nil, err
+	}
+
+	// Initialize the configured sinks, enrichment reads records back from the datastore
+	sink, err := consumer.NewSinks(cfg, datastoreClient)
+	if err != nil {
+		deps.Close()
+		return nil, fmt.Errorf("failed to initialize sinks: %v", err)
+	}
+	deps.Sink = sink
+
+	// Create consumer with dependencies
+	deps.Consumer = consumer.New(cfg, deps.StreamClient, sink)
+
+	return deps, nil
+}
+
+// initializeRedis connects to Redis for the stream and, unless PostgreSQL is configured, the records
+func (d *Dependencies) initializeRedis(ctx context.Context, cfg *config.ConsumerConfig) (datastore.Datastore, error) {
 	// Initialize Redis connection
-	redisAddr := fmt.Sprintf("%s:%d", cfg.RedisHost, cfg.RedisPort)
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Password: "",
-		DB:       0, // default DB
-	})
-
-	// Test Redis connection
-	_, err := redisClient.Ping(ctx).Result()
+	redisOptions := cfg.RedisOptions()
+	redisClient, err := redisconn.NewClient(ctx, redisOptions)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to Redis: %v", err)
+		return nil, err
 	}
+	d.RedisClient = redisClient
 
-	log.Printf("Connected to Redis at %s", redisAddr)
+	log.Printf("Connected to Redis (%s) at %s (TLS: %t)", cfg.RedisMode, strings.Join(redisOptions.Seeds(), ","), redisOptions.TLS.Enabled)
 
 	// Initialize stream client
-	streamClient := stream.NewRedisStream(redisClient)
+	redisStream := stream.NewRedisStream(redisClient)
+	// Entries are acknowledged once the sinks accepted them, the rest stay pending
+	redisStream.ManualAck = true
+	d.StreamClient = redisStream
 
-	// Create consumer with dependencies
-	c := consumer.New(cfg, streamClient)
+	if cfg.DatastoreBackend == config.DatastorePostgres {
+		d.Postgres, err = datastore.ConnectPostgres(ctx, cfg.PostgresURL)
+		if err != nil {
+			return nil, err
+		}
+		return datastore.NewPostgresStore(d.Postgres), nil
+	}
+	return datastore.NewRedisStore(redisClient, cfg.HashTagKeys()), nil
+}
+
+// initializeSQLite tails the event log written by the API into the shared SQLite file
+func (d *Dependencies) initializeSQLite(ctx context.Context, cfg *config.ConsumerConfig) (datastore.Datastore, error) {
+	db, err := sqliteconn.Open(ctx, cfg.SQLitePath)
+	if err != nil {
+		return nil, err
+	}
+	d.SQLite = db
 
-	return &Dependencies{
-		Consumer:     c,
-		RedisClient:  redisClient,
-		StreamClient: streamClient,
-	}, nil
+	streamClient, err := stream.NewSQLiteStream(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	// Entries are acknowledged once the sinks accepted them, the rest stay pending
+	streamClient.ManualAck = true
+	d.StreamClient = streamClient
+
+	log.Printf("Reading events from SQLite at %s", cfg.SQLitePath)
+	return datastore.NewSQLiteStore(ctx, db)
+}
+
+// initializeKafka reads events from Kafka and enriches them from the datastore backend
+func (d *Dependencies) initializeKafka(ctx context.Context, cfg *config.ConsumerConfig) (datastore.Datastore, error) {
+	kafkaStream, err := stream.NewKafkaStream(cfg.KafkaBrokers, cfg.KafkaTopic)
+	if err != nil {
+		return nil, err
+	}
+	// Offsets are committed once the sinks accepted the records
+	kafkaStream.ManualAck = true
+	d.Kafka = kafkaStream
+	d.StreamClient = kafkaStream
+
+	log.Printf("Reading events from Kafka topic %s at %s", cfg.KafkaTopic, strings.Join(cfg.KafkaBrokers, ","))
+	return d.connectStore(ctx, cfg)
+}
+
+// initializeNATS reads events from NATS JetStream and enriches them from the datastore backend
+func (d *Dependencies) initializeNATS(ctx context.Context, cfg *config.ConsumerConfig) (datastore.Datastore, error) {
+	nc, err := nats.Connect(cfg.NATSURL, nats.Name("radius-consumer"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %v", err)
+	}
+	d.NATS = nc
+
+	natsStream, err := stream.NewNATSStream(ctx, nc)
+	if err != nil {
+		return nil, err
+	}
+	// Messages are acknowledged once the sinks accepted them, unacknowledged ones are
+	// redelivered after AckWait
+	natsStream.ManualAck = true
+	d.StreamClient = natsStream
+
+	log.Printf("Reading events from NATS JetStream stream %s at %s", stream.DefaultNATSStream, nc.ConnectedUrlRedacted())
+	return d.connectStore(ctx, cfg)
+}
+
+// connectStore connects the datastore backend used to enrich events from an external stream
+func (d *Dependencies) connectStore(ctx context.Context, cfg *config.ConsumerConfig) (datastore.Datastore, error) {
+	var err error
+	switch cfg.DatastoreBackend {
+	case config.DatastorePostgres:
+		if d.Postgres, err = datastore.ConnectPostgres(ctx, cfg.PostgresURL); err != nil {
+			return nil, err
+		}
+		return datastore.NewPostgresStore(d.Postgres), nil
+	case config.DatastoreSQLite:
+		if d.SQLite, err = sqliteconn.Open(ctx, cfg.SQLitePath); err != nil {
+			return nil, err
+		}
+		return datastore.NewSQLiteStore(ctx, d.SQLite)
+	default:
+		if d.RedisClient, err = redisconn.NewClient(ctx, cfg.RedisOptions()); err != nil {
+			return nil, err
+		}
+		return datastore.NewRedisStore(d.RedisClient, cfg.HashTagKeys()), nil
+	}
 }
 
 // Close cleans up all resources
@@ -57,6 +178,25 @@ func (d *Dependencies) Close() error {
 	if d.Consumer != nil {
 		d.Consumer.Stop()
 	}
+	if d.Sink != nil {
+		if err := d.Sink.Close(); err != nil {
+			log.Printf("Failed to close sinks: %v", err)
+		}
+	}
+	if d.Kafka != nil {
+		d.Kafka.Close()
+	}
+	if d.NATS != nil {
+		d.NATS.Close()
+	}
+	if d.Postgres != nil {
+		d.Postgres.Close()
+	}
+	if d.SQLite != nil {
+		if err := d.SQLite.Close(); err != nil {
+			log.Printf("Failed to close SQLite: %v", err)
+		}
+	}
 	if d.RedisClient != nil {
 		return d.RedisClient.Close()
 	}
@@ -2,58 +2,209 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"dni/internal/consumer"
 	"dni/pkg/config"
 )
 
-func main() {
-	cfg, err := config.LoadConsumerConfig()
-	if err != nil {
-		log.Fatalf("Failed to load consumer config: %v", err)
-	}
+// envFlag is a command line flag that overrides the environment variable of the same setting
+type envFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *envFlag) String() string     { return f.value }
+func (f *envFlag) Set(v string) error { f.value = v; return nil }
+func (f *envFlag) IsBoolFlag() bool   { return f.isBool }
 
-	consumerGroup := flag.String("group", cfg.ConsumerGroup, "Consumer Group")
-	consumerName := flag.String("name", cfg.ConsumerName, "Consumer Name")
-	username := flag.String("username", cfg.Username, "Username for the consumer")
+// consumerFlags maps each command line flag to the environment variable it overrides
+var consumerFlags = []struct {
+	name   string
+	env    string
+	usage  string
+	isBool bool
+}{
+	{name: "username", env: "USERNAME", usage: "Username for the consumer"},
+	{name: "usernames", env: "USERNAMES", usage: "Additional comma separated users to follow"},
+	{name: "pattern", env: "STREAM_PATTERN", usage: "Follow every stream matching this glob, e.g. radius:updates:*"},
+	{name: "stream-key", env: "STREAM_KEYS", usage: "Comma separated stream keys to read instead of the derived ones"},
+	{name: "group", env: "CONSUMER_GROUP", usage: "Consumer Group"},
+	{name: "name", env: "CONSUMER_NAME", usage: "Consumer Name"},
+	{name: "start", env: "CONSUMER_START_ID", usage: "Start position for a new consumer group: $, 0, a stream ID or an RFC 3339 timestamp"},
+	{name: "replay-from", env: "REPLAY_FROM", usage: "Replay history from this position and exit, without moving the group offset"},
+	{name: "replay-to", env: "REPLAY_TO", usage: "End of the replay range"},
+	{name: "partitions", env: "CONSUMER_PARTITIONS", usage: "Partitions to consume, comma separated or 'all' (partitioned topology)"},
+	{name: "filter", env: "USERNAME_FILTER", usage: "Only process events for these comma separated users (partitioned topology)"},
+	{name: "redis-mode", env: "REDIS_MODE", usage: "Redis deployment: standalone, sentinel or cluster"},
+	{name: "redis-addrs", env: "REDIS_ADDRS", usage: "Comma separated sentinel or cluster seed addresses"},
+	{name: "redis-master-name", env: "REDIS_MASTER_NAME", usage: "Sentinel master name"},
+	{name: "redis-host", env: "REDIS_HOST", usage: "Redis host"},
+	{name: "redis-port", env: "REDIS_PORT", usage: "Redis port"},
+	{name: "redis-username", env: "REDIS_USERNAME", usage: "Redis ACL username"},
+	{name: "redis-password", env: "REDIS_PASSWORD", usage: "Redis password"},
+	{name: "redis-db", env: "REDIS_DB", usage: "Redis database number"},
+	{name: "redis-tls", env: "REDIS_TLS", usage: "Connect to Redis over TLS", isBool: true},
+	{name: "redis-tls-ca-file", env: "REDIS_TLS_CA_FILE", usage: "CA bundle used to verify the Redis server"},
+	{name: "redis-tls-cert-file", env: "REDIS_TLS_CERT_FILE", usage: "Client certificate for Redis"},
+	{name: "redis-tls-key-file", env: "REDIS_TLS_KEY_FILE", usage: "Client certificate key for Redis"},
+	{name: "redis-tls-server-name", env: "REDIS_TLS_SERVER_NAME", usage: "Server name expected in the Redis certificate"},
+	{name: "datastore", env: "DATASTORE_BACKEND", usage: "Datastore used to enrich events: redis, postgres or sqlite (also reads events from SQLite)"},
+	{name: "postgres-url", env: "POSTGRES_URL", usage: "PostgreSQL connection string"},
+	{name: "sqlite-path", env: "SQLITE_PATH", usage: "SQLite database file shared with the API"},
+	{name: "stream-backend", env: "STREAM_BACKEND", usage: "Read events from kafka or nats instead of the datastore's stream"},
+	{name: "kafka-brokers", env: "KAFKA_BROKERS", usage: "Comma separated Kafka seed brokers"},
+	{name: "kafka-topic", env: "KAFKA_TOPIC", usage: "Kafka topic with the accounting events"},
+	{name: "nats-url", env: "NATS_URL", usage: "Comma separated NATS server URLs"},
+	{name: "batch-size", env: "BATCH_SIZE", usage: "Maximum events fetched per read"},
+	{name: "block-timeout-ms", env: "BLOCK_TIMEOUT_MS", usage: "How long a read blocks waiting for new events"},
+	{name: "workers", env: "WORKERS", usage: "Number of concurrent workers"},
+	{name: "sinks", env: "SINKS", usage: "Comma separated outputs: file, stdout, webhook, archive"},
+	{name: "log-file", env: "LOG_FILE", usage: "Output log file path"},
+	{name: "log-format", env: "LOG_FORMAT", usage: "Log format: text or json"},
+	{name: "health-addr", env: "HEALTH_ADDR", usage: "Listen address for health and metrics endpoints"},
+}
+
+// loadConfig merges settings with the precedence flags > environment > config file > defaults
+func loadConfig() (*config.ConsumerConfig, error) {
+	flags := make([]*envFlag, 0, len(consumerFlags))
+	for _, f := range consumerFlags {
+		ef := &envFlag{isBool: f.isBool}
+		flag.Var(ef, f.name, fmt.Sprintf("%s (overrides %s)", f.usage, f.env))
+		flags = append(flags, ef)
+	}
+	configFile := flag.String("config", os.Getenv("CONSUMER_CONFIG_FILE"), "YAML or TOML config file, or a file with KEY=VALUE settings")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration, print every error and exit")
 
 	flag.Parse()
 
-	if username != nil {
-		cfg.Username = *username
-		cfg.StreamKey = "radius:updates:" + cfg.Username
+	// Only flags given on the command line take part, so unset flags fall through to the
+	// environment. A flag that was given wins even when empty.
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	flagValues := make(map[string]string)
+	for i, f := range consumerFlags {
+		if set[f.name] {
+			flagValues[f.env] = flags[i].value
+		}
 	}
-	if consumerGroup != nil {
-		cfg.ConsumerGroup = *consumerGroup
+
+	fileValues := map[string]string{}
+	var fileErr error
+	if *configFile != "" {
+		fileValues, fileErr = config.ReadConfigFile(*configFile)
+	}
+
+	cfg, err := config.LoadConsumerConfigFrom(config.Overrides(flagValues, config.Layered(
+		os.LookupEnv,
+		config.MapLookup(fileValues),
+	)))
+	err = config.JoinValidationErrors(fileErr, err)
+	if *checkConfig {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("Configuration OK")
+		os.Exit(0)
+	}
+	if err == nil && *configFile != "" {
+		log.Printf("Loaded consumer settings from %s", *configFile)
+	}
+	return cfg, err
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
 	}
-	if consumerName != nil {
-		cfg.ConsumerName = *consumerName
+}
+
+// run starts the consumer and blocks until it stops. Errors are returned rather than
+// exiting, so the deferred Close calls flush and close the stream, sinks and log files.
+func run() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load consumer config: %v", err)
 	}
 
 	log.Printf("Starting Redis consumer with config:")
+	log.Printf("  Redis Mode: %s", cfg.RedisMode)
 	log.Printf("  Redis Host: %s", cfg.RedisHost)
 	log.Printf("  Redis Port: %d", cfg.RedisPort)
+	log.Printf("  Redis DB: %d", cfg.RedisDB)
+	log.Printf("  Redis TLS: %t", cfg.RedisTLS)
 	log.Printf("  Username: %s", cfg.Username)
 	log.Printf("  Log File: %s", cfg.LogFile)
-	log.Printf("  Stream Key: %s", cfg.StreamKey)
+	log.Printf("  Log Format: %s", cfg.LogFormat)
+	if cfg.LogMaxSize > 0 || cfg.LogRotateInterval > 0 {
+		log.Printf("  Log Rotation: max %d bytes, every %v, keep %d, compress %t", cfg.LogMaxSize, cfg.LogRotateInterval, cfg.LogKeep, cfg.LogCompress)
+	}
+	log.Printf("  Enrich Events: %t", cfg.EnrichEvents)
+	log.Printf("  Sinks: %s", strings.Join(cfg.Sinks, ", "))
+	log.Printf("  Stream Topology: %s", cfg.StreamTopology)
+	log.Printf("  Stream Keys: %s", strings.Join(cfg.StreamKeys, ", "))
+	if cfg.StreamPattern != "" {
+		log.Printf("  Stream Pattern: %s", cfg.StreamPattern)
+	}
+	if len(cfg.UsernameFilter) > 0 {
+		log.Printf("  Username Filter: %s", strings.Join(cfg.UsernameFilter, ", "))
+	}
 	log.Printf("  Consumer Group: %s", cfg.ConsumerGroup)
 	log.Printf("  Consumer Name: %s", cfg.ConsumerName)
+	log.Printf("  Start ID: %s", cfg.StartID)
 
 	// Initialize all dependencies
 	deps, err := InitializeDependencies(cfg)
 	if err != nil {
-		log.Fatalf("Failed to initialize dependencies: %v", err)
+		return fmt.Errorf("failed to initialize dependencies: %v", err)
 	}
 	defer deps.Close()
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	// SIGHUP reopens log files, so logrotate-style external rotation works
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			log.Printf("Received SIGHUP, reopening log files")
+			if err := consumer.Reopen(deps.Sink); err != nil {
+				log.Printf("Failed to reopen log files: %v", err)
+			}
+		}
+	}()
+
+	// Optional health and metrics endpoint
+	if cfg.HealthAddr != "" {
+		healthServer := &http.Server{
+			Addr:              cfg.HealthAddr,
+			Handler:           deps.Consumer.HealthHandler(),
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		go func() {
+			log.Printf("Serving health and metrics on %s", cfg.HealthAddr)
+			if err := healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Health server error: %v", err)
+			}
+		}()
+		defer healthServer.Close()
+	}
+
 	errChan := make(chan error, 1)
 	go func() {
+		if cfg.ReplayFrom != "" {
+			errChan <- deps.Consumer.Replay()
+			return
+		}
 		errChan <- deps.Consumer.Start()
 	}()
 
@@ -61,13 +212,17 @@ func main() {
 	case sig := <-sigChan:
 		log.Printf("Received signal %v, shutting down...", sig)
 		deps.Consumer.Stop()
+		// Stop cancels the blocking read, so the consumer loop exits promptly
+		if err := <-errChan; err != nil {
+			log.Printf("Consumer error: %v", err)
+		}
 	case err := <-errChan:
 		if err != nil {
-			log.Printf("Consumer error: %v", err)
 			deps.Consumer.Stop()
-			os.Exit(1)
+			return fmt.Errorf("consumer error: %v", err)
 		}
 	}
 
 	log.Printf("Consumer stopped")
+	return nil
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"dni/pkg/config"
+)
+
+// secrets manages the encrypted secrets file read through SECRETS_FILE and SECRETS_KEY_FILE:
+//
+//	secrets -generate-key > secrets.key
+//	secrets -key-file=secrets.key -encrypt < secrets.env > secrets.enc
+//	secrets -key-file=secrets.key -decrypt < secrets.enc
+func main() {
+	generateKey := flag.Bool("generate-key", false, "Print a new random key")
+	keyFile := flag.String("key-file", os.Getenv("SECRETS_KEY_FILE"), "File with the hex encoded key")
+	encrypt := flag.Bool("encrypt", false, "Encrypt KEY=VALUE lines from stdin to stdout")
+	decrypt := flag.Bool("decrypt", false, "Decrypt a secrets file from stdin to stdout")
+	flag.Parse()
+
+	if *generateKey {
+		key, err := config.GenerateSecretsKey()
+		if err != nil {
+			log.Fatalf("Failed to generate key: %v", err)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	if *encrypt == *decrypt {
+		log.Fatalf("Use one of -generate-key, -encrypt or -decrypt")
+	}
+	key, err := config.ReadSecretsKey(*keyFile)
+	if err != nil {
+		log.Fatalf("Failed to read key: %v", err)
+	}
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatalf("Failed to read stdin: %v", err)
+	}
+
+	var output []byte
+	if *encrypt {
+		output, err = config.EncryptSecrets(key, input)
+	} else {
+		output, err = config.DecryptSecrets(key, input)
+	}
+	if err != nil {
+		log.Fatalf("Failed to process secrets: %v", err)
+	}
+	os.Stdout.Write(output)
+}
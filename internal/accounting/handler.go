@@ -1,8 +1,11 @@
 package accounting
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
+	"sync"
 	"time"
 
 	"dni/pkg/datastore"
@@ -15,20 +18,64 @@ import (
 	"layeh.com/radius/rfc2866"
 )
 
+// DefaultRequestTimeout bounds the datastore and stream calls made for a single request
+const DefaultRequestTimeout = 2 * time.Second
+
 // Handler handles RADIUS accounting requests
 type Handler struct {
-	DataStore     datastore.Datastore
-	Stream        stream.Stream
-	AccountingTTL time.Duration
+	DataStore      datastore.Datastore
+	Stream         stream.Stream
+	Topology       stream.Topology
+	AccountingTTL  time.Duration
+	RequestTimeout time.Duration
+	// HashTagKeys wraps usernames in record keys in {} for Redis Cluster
+	HashTagKeys bool
+	// Notifier additionally receives every stored event with the record's attributes in
+	// the message Data, e.g. a stream.WebhookStream. Its failures are only logged.
+	Notifier stream.Stream
+
+	// mu guards AccountingTTL and RequestTimeout against SetPolicy
+	mu sync.RWMutex
 }
 
 // NewHandler creates a new accounting handler
 func NewHandler(dataStore datastore.Datastore, streamClient stream.Stream, accountingTTL time.Duration) *Handler {
 	return &Handler{
-		DataStore:     dataStore,
-		Stream:        streamClient,
-		AccountingTTL: accountingTTL,
+		DataStore:      dataStore,
+		Stream:         streamClient,
+		Topology:       stream.PerUserTopology{},
+		AccountingTTL:  accountingTTL,
+		RequestTimeout: DefaultRequestTimeout,
+	}
+}
+
+// SetPolicy replaces the record TTL and the request timeout, e.g. on a configuration
+// reload. Requests already being handled keep the previous values.
+func (h *Handler) SetPolicy(accountingTTL, requestTimeout time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.AccountingTTL = accountingTTL
+	h.RequestTimeout = requestTimeout
+}
+
+// requestID identifies a request by its sender, identifier and authenticator, which a
+// NAS keeps when it retransmits the same packet
+func requestID(r *radius.Request) string {
+	sender := ""
+	if r.RemoteAddr != nil {
+		sender = r.RemoteAddr.String()
+		if host, _, err := net.SplitHostPort(sender); err == nil {
+			sender = host
+		}
 	}
+	return fmt.Sprintf("%s/%d/%x", sender, r.Identifier, r.Authenticator)
+}
+
+// policy returns the record TTL and the request timeout
+func (h *Handler) policy() (time.Duration, time.Duration) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.AccountingTTL, h.RequestTimeout
 }
 
 // Handle processes accounting requests
@@ -64,6 +111,7 @@ func (h *Handler) Handle(w radius.ResponseWriter, r *radius.Request) {
 		CalledStationID:  calledStationId,
 		PacketType:       "Accounting-Request",
 		Timestamp:        fmt.Sprintf("%d", clock.Now().Unix()),
+		RequestID:        requestID(r),
 	}
 
 	if acctStatusType == rfc2866.AcctStatusType_Value_Stop {
@@ -82,27 +130,46 @@ func (h *Handler) Handle(w radius.ResponseWriter, r *radius.Request) {
 
 	response := r.Response(radius.CodeAccountingResponse)
 	w.Write(response)
-	err := h.storeAccountingData(record)
+
+	// The writes are not cancelled with the server's context on shutdown, so a request
+	// that was answered is also stored, bounded by the request timeout
+	accountingTTL, requestTimeout := h.policy()
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), requestTimeout)
+	defer cancel()
+
+	// Datastores sharing the stream's backend store and publish in a single write
+	if publisher, ok := h.DataStore.(datastore.AtomicPublisher); ok {
+		if err := h.storeAndPublish(ctx, publisher, record, accountingTTL); err != nil {
+			log.Printf("[REDIS] Error storing and publishing accounting data: %v", err)
+			return
+		}
+		h.notify(ctx, record)
+		log.Printf("[ACCT] Sent Accounting-Response to %v", r.RemoteAddr)
+		return
+	}
+
+	err := h.storeAccountingData(ctx, record, accountingTTL)
 	if err != nil {
 		log.Printf("[REDIS] Error storing accounting data: %v", err)
 		return
 	}
 
-	recordKey := fmt.Sprintf("radius:acct:%s:%s", username, acctSessionId)
-	err = h.publishStreamNotification(username, recordKey)
+	recordKey := datastore.RecordKey(username, acctSessionId, h.HashTagKeys)
+	err = h.publishStreamNotification(ctx, username, recordKey)
 	if err != nil {
 		log.Printf("[REDIS] Error publishing stream notification: %v", err)
 	}
+	h.notify(ctx, record)
 
 	log.Printf("[ACCT] Sent Accounting-Response to %v", r.RemoteAddr)
 }
 
-func (h *Handler) storeAccountingData(record datastore.AccountingRecord) error {
-	key := fmt.Sprintf("radius:acct:%s:%s", record.Username, record.AcctSessionID)
+func (h *Handler) storeAccountingData(ctx context.Context, record datastore.AccountingRecord, ttl time.Duration) error {
+	key := datastore.RecordKey(record.Username, record.AcctSessionID, h.HashTagKeys)
 
 	log.Printf("[DATASTORE] Storing accounting data with key: %s", key)
 
-	err := h.DataStore.Save(key, record, h.AccountingTTL)
+	err := h.DataStore.Save(ctx, key, record, ttl)
 	if err != nil {
 		return fmt.Errorf("failed to store accounting data: %v", err)
 	}
@@ -111,8 +178,28 @@ func (h *Handler) storeAccountingData(record datastore.AccountingRecord) error {
 	return nil
 }
 
-func (h *Handler) publishStreamNotification(username, key string) error {
-	streamKey := fmt.Sprintf("radius:updates:%s", username)
+func (h *Handler) storeAndPublish(ctx context.Context, publisher datastore.AtomicPublisher, record datastore.AccountingRecord, ttl time.Duration) error {
+	key := datastore.RecordKey(record.Username, record.AcctSessionID, h.HashTagKeys)
+	streamKey := h.Topology.StreamKey(record.Username)
+
+	message := stream.StreamMessage{
+		Key:      key,
+		Username: record.Username,
+	}
+
+	log.Printf("[DATASTORE] Storing accounting data with key %s and publishing to stream %s", key, streamKey)
+
+	err := publisher.SaveAndPublish(ctx, key, record, ttl, streamKey, message)
+	if err != nil {
+		return fmt.Errorf("failed to store accounting data: %v", err)
+	}
+
+	log.Printf("[DATASTORE] Successfully stored and published accounting data for key: %s", key)
+	return nil
+}
+
+func (h *Handler) publishStreamNotification(ctx context.Context, username, key string) error {
+	streamKey := h.Topology.StreamKey(username)
 
 	message := stream.StreamMessage{
 		Key:      key,
@@ -121,7 +208,7 @@ func (h *Handler) publishStreamNotification(username, key string) error {
 
 	log.Printf("[REDIS] Publishing to stream: %s", streamKey)
 
-	err := h.Stream.Push(streamKey, message)
+	err := h.Stream.Push(ctx, streamKey, message)
 	if err != nil {
 		return fmt.Errorf("failed to publish to stream %s: %v", streamKey, err)
 	}
@@ -129,3 +216,43 @@ func (h *Handler) publishStreamNotification(username, key string) error {
 	log.Printf("[REDIS] Successfully published notification to stream: %s", streamKey)
 	return nil
 }
+
+// notify passes a stored record to the Notifier, if any
+func (h *Handler) notify(ctx context.Context, record datastore.AccountingRecord) {
+	if h.Notifier == nil {
+		return
+	}
+
+	streamKey := h.Topology.StreamKey(record.Username)
+	message := stream.StreamMessage{
+		Key:      datastore.RecordKey(record.Username, record.AcctSessionID, h.HashTagKeys),
+		Username: record.Username,
+		Data:     recordAttributes(record),
+	}
+	if err := h.Notifier.Push(ctx, streamKey, message); err != nil {
+		log.Printf("[ACCT] Error notifying about %s: %v", message.Key, err)
+	}
+}
+
+// recordAttributes returns the accounting attributes of a record, leaving out unset counters
+func recordAttributes(record datastore.AccountingRecord) map[string]interface{} {
+	attributes := map[string]interface{}{
+		"nas_ip_address":     record.NASIPAddress,
+		"nas_port":           record.NASPort,
+		"acct_status_type":   record.AcctStatusType,
+		"acct_session_id":    record.AcctSessionID,
+		"framed_ip_address":  record.FramedIPAddress,
+		"calling_station_id": record.CallingStationID,
+		"called_station_id":  record.CalledStationID,
+	}
+	for name, value := range map[string]string{
+		"acct_input_octets":  record.AcctInputOctets,
+		"acct_output_octets": record.AcctOutputOctets,
+		"acct_session_time":  record.AcctSessionTime,
+	} {
+		if value != "" {
+			attributes[name] = value
+		}
+	}
+	return attributes
+}
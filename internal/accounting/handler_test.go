@@ -1,14 +1,20 @@
 package accounting
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"log"
 	"net"
+	"os"
+	"reflect"
 	"testing"
 	"time"
 
 	"dni/pkg/datastore"
 	"dni/pkg/stream"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis/v8"
 	"github.com/go-redis/redismock/v8"
 	"go.llib.dev/testcase/clock"
@@ -57,6 +63,14 @@ func createAccountingRequest(username, sessionID string, statusType rfc2866.Acct
 	}
 }
 
+// expectSessionIndex registers the session index update that RedisStore.Save queues after the record
+func expectSessionIndex(mock redismock.ClientMock, username, key string) {
+	index := datastore.SessionIndexKey(username, false)
+	mock.ExpectZAdd(index, &redis.Z{Score: float64(clock.Now().Unix()), Member: key}).SetVal(1)
+	mock.ExpectZRemRangeByScore(index, "-inf", fmt.Sprintf("(%d", clock.Now().Add(-time.Hour).Unix())).SetVal(0)
+	mock.ExpectExpire(index, time.Hour).SetVal(true)
+}
+
 func TestHandler_Handle_StartPacket(t *testing.T) {
 	// freezing time to avoid flaky tests
 	timecop.Travel(t, time.Unix(1, 0), timecop.Freeze)
@@ -64,11 +78,12 @@ func TestHandler_Handle_StartPacket(t *testing.T) {
 	redisClient, mock := redismock.NewClientMock()
 	defer redisClient.Close()
 
-	dataStore := datastore.NewRedisStore(redisClient)
+	dataStore := datastore.NewRedisStore(redisClient, false)
 	streamClient := stream.NewRedisStream(redisClient)
 
 	handler := NewHandler(dataStore, streamClient, time.Hour)
 
+	mock.ExpectTxPipeline()
 	mock.ExpectHMSet(
 		"radius:acct:testuser:session123",
 		"username", "testuser",
@@ -84,6 +99,8 @@ func TestHandler_Handle_StartPacket(t *testing.T) {
 	).SetVal(true)
 
 	mock.ExpectExpire("radius:acct:testuser:session123", time.Hour).SetVal(true)
+	expectSessionIndex(mock, "testuser", "radius:acct:testuser:session123")
+	mock.ExpectTxPipelineExec()
 
 	mock.ExpectXAdd(&redis.XAddArgs{
 		Stream: "radius:updates:testuser",
@@ -129,6 +146,7 @@ func TestHandler_Handle_Scenarios(t *testing.T) {
 			sessionID:  "session123",
 			statusType: rfc2866.AcctStatusType_Value_Start,
 			setupMock: func(mock redismock.ClientMock) {
+				mock.ExpectTxPipeline()
 				mock.ExpectHMSet(
 					"radius:acct:testuser:session123",
 					"username", "testuser",
@@ -144,6 +162,8 @@ func TestHandler_Handle_Scenarios(t *testing.T) {
 				).SetVal(true)
 
 				mock.ExpectExpire("radius:acct:testuser:session123", time.Hour).SetVal(true)
+				expectSessionIndex(mock, "testuser", "radius:acct:testuser:session123")
+				mock.ExpectTxPipelineExec()
 
 				mock.ExpectXAdd(&redis.XAddArgs{
 					Stream: "radius:updates:testuser",
@@ -162,6 +182,7 @@ func TestHandler_Handle_Scenarios(t *testing.T) {
 			sessionID:  "session456",
 			statusType: rfc2866.AcctStatusType_Value_Stop,
 			setupMock: func(mock redismock.ClientMock) {
+				mock.ExpectTxPipeline()
 				mock.ExpectHMSet(
 					"radius:acct:testuser:session456",
 					"username", "testuser",
@@ -180,6 +201,8 @@ func TestHandler_Handle_Scenarios(t *testing.T) {
 				).SetVal(true)
 
 				mock.ExpectExpire("radius:acct:testuser:session456", time.Hour).SetVal(true)
+				expectSessionIndex(mock, "testuser", "radius:acct:testuser:session456")
+				mock.ExpectTxPipelineExec()
 
 				mock.ExpectXAdd(&redis.XAddArgs{
 					Stream: "radius:updates:testuser",
@@ -198,6 +221,7 @@ func TestHandler_Handle_Scenarios(t *testing.T) {
 			sessionID:  "session789",
 			statusType: rfc2866.AcctStatusType_Value_Start,
 			setupMock: func(mock redismock.ClientMock) {
+				mock.ExpectTxPipeline()
 				mock.ExpectHMSet(
 					"radius:acct:testuser:session789",
 					"username", "testuser",
@@ -220,6 +244,7 @@ func TestHandler_Handle_Scenarios(t *testing.T) {
 			sessionID:  "session101",
 			statusType: rfc2866.AcctStatusType_Value_Start,
 			setupMock: func(mock redismock.ClientMock) {
+				mock.ExpectTxPipeline()
 				mock.ExpectHMSet(
 					"radius:acct:testuser:session101",
 					"username", "testuser",
@@ -243,6 +268,7 @@ func TestHandler_Handle_Scenarios(t *testing.T) {
 			sessionID:  "session202",
 			statusType: rfc2866.AcctStatusType_Value_Start,
 			setupMock: func(mock redismock.ClientMock) {
+				mock.ExpectTxPipeline()
 				mock.ExpectHMSet(
 					"radius:acct:testuser:session202",
 					"username", "testuser",
@@ -257,6 +283,8 @@ func TestHandler_Handle_Scenarios(t *testing.T) {
 					"timestamp", fmt.Sprintf("%d", clock.Now().Unix()),
 				).SetVal(true)
 				mock.ExpectExpire("radius:acct:testuser:session202", time.Hour).SetVal(true)
+				expectSessionIndex(mock, "testuser", "radius:acct:testuser:session202")
+				mock.ExpectTxPipelineExec()
 				mock.ExpectXAdd(&redis.XAddArgs{
 					Stream: "radius:updates:testuser",
 					Values: []interface{}{
@@ -274,6 +302,7 @@ func TestHandler_Handle_Scenarios(t *testing.T) {
 			sessionID:  "session303",
 			statusType: rfc2866.AcctStatusType_Value_Stop,
 			setupMock: func(mock redismock.ClientMock) {
+				mock.ExpectTxPipeline()
 				mock.ExpectHMSet(
 					"radius:acct:testuser:session303",
 					"username", "testuser",
@@ -299,6 +328,7 @@ func TestHandler_Handle_Scenarios(t *testing.T) {
 			sessionID:  "session404",
 			statusType: rfc2866.AcctStatusType_Value_Stop,
 			setupMock: func(mock redismock.ClientMock) {
+				mock.ExpectTxPipeline()
 				mock.ExpectHMSet(
 					"radius:acct:testuser:session404",
 					"username", "testuser",
@@ -316,6 +346,8 @@ func TestHandler_Handle_Scenarios(t *testing.T) {
 					"acct_session_time", "3600",
 				).SetVal(true)
 				mock.ExpectExpire("radius:acct:testuser:session404", time.Hour).SetVal(true)
+				expectSessionIndex(mock, "testuser", "radius:acct:testuser:session404")
+				mock.ExpectTxPipelineExec()
 				mock.ExpectXAdd(&redis.XAddArgs{
 					Stream: "radius:updates:testuser",
 					Values: []interface{}{
@@ -334,7 +366,7 @@ func TestHandler_Handle_Scenarios(t *testing.T) {
 			redisClient, mock := redismock.NewClientMock()
 			defer redisClient.Close()
 
-			dataStore := datastore.NewRedisStore(redisClient)
+			dataStore := datastore.NewRedisStore(redisClient, false)
 			streamClient := stream.NewRedisStream(redisClient)
 			handler := NewHandler(dataStore, streamClient, time.Hour)
 
@@ -359,3 +391,343 @@ func TestHandler_Handle_Scenarios(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_Handle_PartitionedTopology(t *testing.T) {
+	// freezing time to avoid flaky tests
+	timecop.Travel(t, time.Unix(1, 0), timecop.Freeze)
+
+	redisClient, mock := redismock.NewClientMock()
+	defer redisClient.Close()
+
+	dataStore := datastore.NewRedisStore(redisClient, false)
+	streamClient := stream.NewRedisStream(redisClient)
+
+	handler := NewHandler(dataStore, streamClient, time.Hour)
+	handler.Topology = stream.PartitionedTopology{Partitions: 4}
+
+	mock.ExpectTxPipeline()
+	mock.ExpectHMSet(
+		"radius:acct:testuser:session123",
+		"username", "testuser",
+		"nas_ip_address", "192.168.1.1",
+		"nas_port", "1234",
+		"acct_status_type", "1",
+		"acct_session_id", "session123",
+		"framed_ip_address", "10.0.0.1",
+		"calling_station_id", "00:11:22:33:44:55",
+		"called_station_id", "00:aa:bb:cc:dd:ee",
+		"packet_type", "Accounting-Request",
+		"timestamp", fmt.Sprintf("%d", clock.Now().Unix()),
+	).SetVal(true)
+
+	mock.ExpectExpire("radius:acct:testuser:session123", time.Hour).SetVal(true)
+	expectSessionIndex(mock, "testuser", "radius:acct:testuser:session123")
+	mock.ExpectTxPipelineExec()
+
+	mock.ExpectXAdd(&redis.XAddArgs{
+		Stream: stream.PartitionStreamKey(stream.PartitionFor("testuser", 4)),
+		Values: []interface{}{
+			"key", "radius:acct:testuser:session123",
+			"timestamp", clock.Now().Unix(),
+			"username", "testuser",
+		},
+	}).SetVal("1-0")
+
+	request := createAccountingRequest("testuser", "session123", rfc2866.AcctStatusType_Value_Start)
+	handler.Handle(&mockResponseWriter{}, request)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled Redis expectations: %s", err)
+	}
+}
+
+func TestHandler_Handle_InMemory(t *testing.T) {
+	// freezing time to avoid flaky tests
+	timecop.Travel(t, time.Unix(1, 0), timecop.Freeze)
+
+	dataStore := datastore.NewMemoryStore()
+	streamClient := stream.NewMemoryStream()
+	handler := NewHandler(dataStore, streamClient, time.Hour)
+
+	for _, statusType := range []rfc2866.AcctStatusType{rfc2866.AcctStatusType_Value_Start, rfc2866.AcctStatusType_Value_Stop} {
+		responseWriter := &mockResponseWriter{}
+		handler.Handle(responseWriter, createAccountingRequest("testuser", "session123", statusType))
+		if !responseWriter.written {
+			t.Fatal("Expected an Accounting-Response to be written")
+		}
+	}
+
+	record, err := dataStore.Get(context.Background(), "radius:acct:testuser:session123")
+	if err != nil {
+		t.Fatalf("Expected the record to be stored, got %v", err)
+	}
+	if record.AcctStatusType != "2" || record.AcctInputOctets != "1024" || record.AcctSessionTime != "3600" {
+		t.Errorf("Expected the stop record with counters, got %+v", record)
+	}
+
+	messages, err := streamClient.Pull(context.Background(), stream.ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:testuser"},
+		ConsumerGroup: "test-group",
+		StartID:       "0",
+	})
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected a notification per request, got %+v", messages)
+	}
+	for _, msg := range messages {
+		if msg.Key != "radius:acct:testuser:session123" || msg.Username != "testuser" {
+			t.Errorf("Unexpected notification %+v", msg)
+		}
+	}
+}
+
+func TestHandler_Handle_Notifier(t *testing.T) {
+	timecop.Travel(t, time.Unix(1, 0), timecop.Freeze)
+
+	redisClient := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	redisStream := stream.NewRedisStream(redisClient)
+
+	for _, tt := range []struct {
+		name  string
+		store datastore.Datastore
+	}{
+		{name: "save then publish", store: datastore.NewMemoryStore()},
+		{name: "save and publish", store: datastore.NewRedisStoreWithPublisher(redisClient, redisStream, false)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			notifier := stream.NewMemoryStream()
+			handler := NewHandler(tt.store, redisStream, time.Hour)
+			handler.Notifier = notifier
+
+			handler.Handle(&mockResponseWriter{}, createAccountingRequest("testuser", "session123", rfc2866.AcctStatusType_Value_Start))
+			handler.Handle(&mockResponseWriter{}, createAccountingRequest("testuser", "session123", rfc2866.AcctStatusType_Value_Stop))
+
+			messages, err := notifier.Pull(context.Background(), stream.ConsumerConfig{
+				StreamKeys:    []string{"radius:updates:testuser"},
+				ConsumerGroup: "test-group",
+				StartID:       "0",
+			})
+			if err != nil {
+				t.Fatalf("Pull returned error: %v", err)
+			}
+			if len(messages) != 2 {
+				t.Fatalf("Expected a notification per request, got %+v", messages)
+			}
+			for _, msg := range messages {
+				if msg.Key != "radius:acct:testuser:session123" || msg.Username != "testuser" {
+					t.Errorf("Unexpected notification %+v", msg)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordAttributes(t *testing.T) {
+	tests := []struct {
+		name     string
+		record   datastore.AccountingRecord
+		expected map[string]interface{}
+	}{
+		{
+			name:   "start without counters",
+			record: datastore.AccountingRecord{NASIPAddress: "192.168.1.1", AcctStatusType: "1", AcctSessionID: "s1"},
+			expected: map[string]interface{}{
+				"nas_ip_address": "192.168.1.1", "nas_port": "", "acct_status_type": "1", "acct_session_id": "s1",
+				"framed_ip_address": "", "calling_station_id": "", "called_station_id": "",
+			},
+		},
+		{
+			name:   "stop with counters",
+			record: datastore.AccountingRecord{AcctStatusType: "2", AcctSessionTime: "3600", AcctInputOctets: "1024"},
+			expected: map[string]interface{}{
+				"nas_ip_address": "", "nas_port": "", "acct_status_type": "2", "acct_session_id": "",
+				"framed_ip_address": "", "calling_station_id": "", "called_station_id": "",
+				"acct_session_time": "3600", "acct_input_octets": "1024",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if attributes := recordAttributes(tt.record); !reflect.DeepEqual(attributes, tt.expected) {
+				t.Errorf("Expected attributes %v, got %v", tt.expected, attributes)
+			}
+		})
+	}
+}
+
+func TestHandler_Handle_AtomicPublish(t *testing.T) {
+	// freezing time to avoid flaky tests
+	timecop.Travel(t, time.Unix(1, 0), timecop.Freeze)
+
+	tests := []struct {
+		name    string
+		xaddErr error
+	}{
+		{name: "record and notification in one transaction"},
+		{name: "transaction failure", xaddErr: fmt.Errorf("Stream publish failed")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redisClient, mock := redismock.NewClientMock()
+			defer redisClient.Close()
+
+			streamClient := stream.NewRedisStream(redisClient)
+			dataStore := datastore.NewRedisStoreWithPublisher(redisClient, streamClient, false)
+			handler := NewHandler(dataStore, streamClient, time.Hour)
+
+			mock.ExpectTxPipeline()
+			mock.ExpectHMSet(
+				"radius:acct:testuser:session123",
+				"username", "testuser",
+				"nas_ip_address", "192.168.1.1",
+				"nas_port", "1234",
+				"acct_status_type", "1",
+				"acct_session_id", "session123",
+				"framed_ip_address", "10.0.0.1",
+				"calling_station_id", "00:11:22:33:44:55",
+				"called_station_id", "00:aa:bb:cc:dd:ee",
+				"packet_type", "Accounting-Request",
+				"timestamp", fmt.Sprintf("%d", clock.Now().Unix()),
+			).SetVal(true)
+			mock.ExpectExpire("radius:acct:testuser:session123", time.Hour).SetVal(true)
+			expectSessionIndex(mock, "testuser", "radius:acct:testuser:session123")
+			xadd := mock.ExpectXAdd(&redis.XAddArgs{
+				Stream: "radius:updates:testuser",
+				Values: []interface{}{
+					"key", "radius:acct:testuser:session123",
+					"timestamp", clock.Now().Unix(),
+					"username", "testuser",
+				},
+			})
+			if tt.xaddErr != nil {
+				xadd.SetErr(tt.xaddErr)
+			} else {
+				xadd.SetVal("1-0")
+				mock.ExpectTxPipelineExec()
+			}
+
+			responseWriter := &mockResponseWriter{}
+			handler.Handle(responseWriter, createAccountingRequest("testuser", "session123", rfc2866.AcctStatusType_Value_Start))
+
+			if !responseWriter.written {
+				t.Error("Response was not written - handler should always respond per RADIUS protocol")
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("There were unfulfilled Redis expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestHandler_SetPolicy(t *testing.T) {
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+
+	store := datastore.NewMemoryStore()
+	handler := NewHandler(store, stream.NewMemoryStream(), time.Hour)
+	handler.Handle(&mockResponseWriter{}, createAccountingRequest("alice", "s1", rfc2866.AcctStatusType_Value_Start))
+
+	handler.SetPolicy(5*time.Minute, time.Second)
+	handler.Handle(&mockResponseWriter{}, createAccountingRequest("alice", "s2", rfc2866.AcctStatusType_Value_Start))
+
+	// The record saved after the reload expires with the new TTL, the earlier one with the old
+	timecop.Travel(t, 5*time.Minute)
+	if _, err := store.Get(context.Background(), "radius:acct:alice:s2"); err != datastore.ErrNotFound {
+		t.Errorf("Expected the record to expire after the reloaded TTL, got %v", err)
+	}
+	if _, err := store.Get(context.Background(), "radius:acct:alice:s1"); err != nil {
+		t.Errorf("Expected the record saved before the reload to keep its TTL, got %v", err)
+	}
+	timecop.Travel(t, 55*time.Minute)
+	if _, err := store.Get(context.Background(), "radius:acct:alice:s1"); err != datastore.ErrNotFound {
+		t.Errorf("Expected the record to expire after %v, got %v", time.Hour, err)
+	}
+}
+
+func TestHandler_Handle_ServerShutdown(t *testing.T) {
+	// MemoryStore fails writes whose context is done, like a network backend
+	memoryStore := datastore.NewMemoryStore()
+	handler := NewHandler(memoryStore, stream.NewMemoryStream(), time.Hour)
+
+	// PacketServer.Shutdown cancels the context of the requests in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	request := createAccountingRequest("alice", "s1", rfc2866.AcctStatusType_Value_Start).WithContext(ctx)
+
+	handler.Handle(&mockResponseWriter{}, request)
+	if _, err := memoryStore.Get(context.Background(), "radius:acct:alice:s1"); err != nil {
+		t.Errorf("Expected the answered request to be stored during shutdown, got %v", err)
+	}
+}
+
+// roundTripCounter counts requests sent to Redis, a pipeline or transaction is one round trip
+type roundTripCounter struct {
+	count int
+}
+
+func (r *roundTripCounter) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	r.count++
+	return ctx, nil
+}
+
+func (r *roundTripCounter) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (r *roundTripCounter) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	r.count++
+	return ctx, nil
+}
+
+func (r *roundTripCounter) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+// BenchmarkHandler_Handle runs the same record, index and stream writes as a transaction
+// followed by the stream publish, and as a single transaction
+func BenchmarkHandler_Handle(b *testing.B) {
+	server := miniredis.RunT(b)
+	redisClient := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer redisClient.Close()
+	roundTrips := &roundTripCounter{}
+	redisClient.AddHook(roundTrips)
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	streamClient := stream.NewRedisStreamWithRetention(redisClient, stream.RetentionPolicy{MaxLen: 1000})
+	stores := []struct {
+		name  string
+		store datastore.Datastore
+	}{
+		{name: "transactional save", store: datastore.NewRedisStore(redisClient, false)},
+		{name: "save and publish", store: datastore.NewRedisStoreWithPublisher(redisClient, streamClient, false)},
+	}
+
+	for _, s := range stores {
+		b.Run(s.name, func(b *testing.B) {
+			server.FlushAll()
+			handler := NewHandler(s.store, streamClient, time.Hour)
+			request := createAccountingRequest("testuser", "session123", rfc2866.AcctStatusType_Value_Start)
+			responseWriter := &mockResponseWriter{}
+
+			roundTrips.count = 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				handler.Handle(responseWriter, request)
+			}
+			b.ReportMetric(float64(roundTrips.count)/float64(b.N), "roundtrips/op")
+
+			// Every variant writes the record, its session index and the stream entry
+			b.StopTimer()
+			expected := []string{"radius:acct:testuser:session123", "radius:sessions:testuser", "radius:updates:testuser"}
+			if keys := server.Keys(); !reflect.DeepEqual(keys, expected) {
+				b.Fatalf("Expected keys %v, got %v", expected, keys)
+			}
+		})
+	}
+}
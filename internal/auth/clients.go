@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"dni/pkg/config"
+)
+
+// ClientSecretSource returns the shared secret of the RADIUS client a request comes from.
+// When clients are listed, requests from other addresses are dropped by the server,
+// otherwise every client uses the shared secret. It implements radius.SecretSource.
+type ClientSecretSource struct {
+	mu      sync.RWMutex
+	clients []config.RadiusClient
+	secret  []byte
+}
+
+// NewSecretSource creates a secret source for the configured clients and shared secret
+func NewSecretSource(clients []config.RadiusClient, secret []byte) *ClientSecretSource {
+	s := &ClientSecretSource{}
+	s.Set(clients, secret)
+	return s
+}
+
+// Set replaces the clients and shared secret, requests already being handled keep their secret
+func (s *ClientSecretSource) Set(clients []config.RadiusClient, secret []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients = clients
+	s.secret = secret
+}
+
+// RADIUSSecret implements radius.SecretSource, the most specific matching network wins
+func (s *ClientSecretSource) RADIUSSecret(ctx context.Context, remoteAddr net.Addr) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.clients) == 0 {
+		return s.secret, nil
+	}
+
+	var ip net.IP
+	switch addr := remoteAddr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		host, _, err := net.SplitHostPort(remoteAddr.String())
+		if err != nil {
+			return nil, fmt.Errorf("unknown RADIUS client %s", remoteAddr)
+		}
+		ip = net.ParseIP(host)
+	}
+
+	var secret []byte
+	bestPrefix := -1
+	for _, client := range s.clients {
+		if !client.Network.Contains(ip) {
+			continue
+		}
+		if prefix, _ := client.Network.Mask.Size(); prefix > bestPrefix {
+			secret, bestPrefix = []byte(client.Secret), prefix
+		}
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("unknown RADIUS client %s", remoteAddr)
+	}
+	return secret, nil
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"dni/pkg/config"
+)
+
+func TestClientSecretSource(t *testing.T) {
+	clients, err := config.ParseRadiusClients("10.0.0.0/8=wide,10.1.2.3=narrow,2001:db8::/32=v6")
+	if err != nil {
+		t.Fatalf("ParseRadiusClients returned error: %v", err)
+	}
+	source := NewSecretSource(clients, []byte("shared"))
+
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"10.1.2.3", "narrow"},
+		{"10.9.9.9", "wide"},
+		{"2001:db8::1", "v6"},
+		{"192.168.1.1", ""},
+	}
+
+	for _, tt := range tests {
+		secret, err := source.RADIUSSecret(context.Background(), &net.UDPAddr{IP: net.ParseIP(tt.ip), Port: 1812})
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("Expected %s to be rejected, got secret %q", tt.ip, secret)
+			}
+			continue
+		}
+		if err != nil || string(secret) != tt.expected {
+			t.Errorf("Expected secret %q for %s, got %q (%v)", tt.expected, tt.ip, secret, err)
+		}
+	}
+
+	// Without clients every request uses the shared secret
+	source.Set(nil, []byte("reloaded"))
+	secret, err := source.RADIUSSecret(context.Background(), &net.UDPAddr{IP: net.ParseIP("192.168.1.1")})
+	if err != nil || string(secret) != "reloaded" {
+		t.Errorf("Expected the shared secret, got %q (%v)", secret, err)
+	}
+}
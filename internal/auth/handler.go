@@ -2,6 +2,7 @@ package auth
 
 import (
 	"log"
+	"sync"
 
 	"layeh.com/radius"
 	"layeh.com/radius/rfc2865"
@@ -11,6 +12,9 @@ import (
 type Handler struct {
 	Secret          []byte
 	UserCredentials map[string]string
+
+	// mu guards UserCredentials against SetUserCredentials
+	mu sync.RWMutex
 }
 
 // NewHandler creates a new authentication handler
@@ -21,6 +25,13 @@ func NewHandler(secret []byte, userCredentials map[string]string) *Handler {
 	}
 }
 
+// SetUserCredentials replaces the known users, e.g. on a configuration reload
+func (h *Handler) SetUserCredentials(userCredentials map[string]string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.UserCredentials = userCredentials
+}
+
 // Handle processes authentication requests
 func (h *Handler) Handle(w radius.ResponseWriter, r *radius.Request) {
 	username := rfc2865.UserName_GetString(r.Packet)
@@ -30,8 +41,12 @@ func (h *Handler) Handle(w radius.ResponseWriter, r *radius.Request) {
 
 	var code radius.Code
 
+	h.mu.RLock()
+	expectedPassword, exists := h.UserCredentials[username]
+	h.mu.RUnlock()
+
 	// Check if username exists and password matches
-	if expectedPassword, exists := h.UserCredentials[username]; exists && expectedPassword == password {
+	if exists && expectedPassword == password {
 		code = radius.CodeAccessAccept
 		log.Printf("[AUTH] Access granted for user: %s", username)
 	} else {
@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	clock "go.llib.dev/testcase/clock"
@@ -15,102 +17,287 @@ import (
 
 type Consumer struct {
 	streamClient stream.Stream
+	sink         Sink
 	username     string
+	label        string
 	logFile      string
-	streamKey    string
+	streamKeys   []string
+	usernames    []string
 	groupName    string
 	consumerName string
-	ctx          context.Context
-	cancel       context.CancelFunc
+	startID      string
+	replayFrom   string
+	replayTo     string
+
+	// worker pool and read sizing
+	workers      int
+	maxInFlight  int
+	batchSize    int64
+	blockTimeout time.Duration
+	claimIdle    time.Duration
+
+	// pattern subscriptions are re-scanned every discoveryInterval
+	pattern           string
+	discoveryInterval time.Duration
+	nextDiscovery     time.Time
+
+	// health and metrics state
+	metrics    *Metrics
+	running    atomic.Bool
+	keysMu     sync.RWMutex
+	activeKeys []string
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-// New creates a new Consumer with provided Redis client and stream client
-func New(cfg *config.ConsumerConfig, streamClient stream.Stream) *Consumer {
+// New creates a new Consumer reading from streamClient and delivering events to sink
+func New(cfg *config.ConsumerConfig, streamClient stream.Stream, sink Sink) *Consumer {
 	ctx, cancel := context.WithCancel(context.Background())
 
+	// Partitioned and multi-user consumers have no single username to tag their logs with
+	label := cfg.Username
+	if label == "" || len(cfg.Usernames) > 0 || cfg.StreamPattern != "" {
+		label = cfg.ConsumerGroup
+	}
+
 	return &Consumer{
 		streamClient: streamClient,
+		sink:         sink,
 		username:     cfg.Username,
+		label:        label,
 		logFile:      cfg.LogFile,
-		streamKey:    cfg.StreamKey,
+		streamKeys:   cfg.StreamKeys,
+		usernames:    cfg.UsernameFilter,
 		groupName:    cfg.ConsumerGroup,
 		consumerName: cfg.ConsumerName,
-		ctx:          ctx,
-		cancel:       cancel,
-	}
-}
+		startID:      cfg.StartID,
+		replayFrom:   cfg.ReplayFrom,
+		replayTo:     cfg.ReplayTo,
 
-func (c *Consumer) writeLog(message string) error {
-	logDir := "/var/log"
-	if _, err := os.Stat(logDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(logDir, 0755); err != nil {
-			return fmt.Errorf("failed to create log directory: %v", err)
-		}
-	}
+		workers:      cfg.Workers,
+		maxInFlight:  cfg.MaxInFlight,
+		batchSize:    cfg.BatchSize,
+		blockTimeout: cfg.BlockTimeout,
+		claimIdle:    cfg.ClaimIdle,
 
-	file, err := os.OpenFile(c.logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open log file: %v", err)
-	}
-	defer file.Close()
+		pattern:           cfg.StreamPattern,
+		discoveryInterval: cfg.DiscoveryInterval,
 
-	timestamp := clock.Now().Format("2006-01-02 15:04:05.000000")
-	logEntry := fmt.Sprintf("%s - %s\n", timestamp, message)
+		metrics:    &Metrics{},
+		activeKeys: cfg.StreamKeys,
 
-	if _, err := file.WriteString(logEntry); err != nil {
-		return fmt.Errorf("failed to write to log file: %v", err)
+		ctx:    ctx,
+		cancel: cancel,
 	}
+}
 
-	return nil
+// Metrics returns the consumer's counters
+func (c *Consumer) Metrics() *Metrics {
+	return c.metrics
 }
 
-func (c *Consumer) processKeys(keys []string) error {
-	for _, key := range keys {
-		logMessage := fmt.Sprintf("Received update for key: %s", key)
-		if err := c.writeLog(logMessage); err != nil {
-			return fmt.Errorf("failed to write log: %v", err)
-		}
-		log.Printf("[%s] %s", c.username, logMessage)
+// activeStreamKeys returns the streams currently being read
+func (c *Consumer) activeStreamKeys() []string {
+	c.keysMu.RLock()
+	defer c.keysMu.RUnlock()
+	return c.activeKeys
+}
+
+// processMessage hands msg to the sink. ctx is not cancelled by Stop, so messages
+// drained while shutting down still reach the sinks.
+func (c *Consumer) processMessage(ctx context.Context, msg stream.Message) (err error) {
+	start := time.Now()
+	defer func() {
+		c.metrics.ObserveProcessed(time.Since(start), err)
+	}()
+
+	event := Event{
+		Key:        msg.Key,
+		Username:   msg.Username,
+		Consumer:   c.label,
+		ReceivedAt: clock.Now(),
 	}
+	if err := c.sink.Write(ctx, event); err != nil {
+		return fmt.Errorf("failed to write event: %v", err)
+	}
+	log.Printf("[%s] Received update for key: %s", c.label, msg.Key)
 	return nil
 }
 
 func (c *Consumer) Start() error {
-	log.Printf("Starting Redis consumer for username: %s", c.username)
-	log.Printf("Stream key: %s", c.streamKey)
+	log.Printf("Starting Redis consumer for: %s", c.label)
+	log.Printf("Stream keys: %s", strings.Join(c.streamKeys, ", "))
+	if c.pattern != "" {
+		log.Printf("Stream pattern: %s", c.pattern)
+	}
 	log.Printf("Log file: %s", c.logFile)
 
 	config := stream.ConsumerConfig{
-		StreamKey:     c.streamKey,
+		StreamKeys:    c.streamKeys,
 		ConsumerGroup: c.groupName,
 		ConsumerName:  c.consumerName,
+		Usernames:     c.usernames,
+		StartID:       c.startID,
+		BatchSize:     c.batchSize,
+		BlockTimeout:  c.blockTimeout,
+		ClaimIdle:     c.claimIdle,
 	}
 
 	log.Printf("Consumer group '%s' ready", c.groupName)
+	log.Printf("Workers: %d, max in flight: %d, batch size: %d", c.workers, c.maxInFlight, c.batchSize)
+
+	c.running.Store(true)
+	defer c.running.Store(false)
+
+	// Messages already read are processed and acknowledged even while shutting down
+	drainCtx := context.WithoutCancel(c.ctx)
+
+	// Streams that track acknowledgements keep failed messages pending, to be delivered
+	// again once they were idle for ClaimIdle
+	acker, acks := c.streamClient.(stream.Acker)
+	pool := newWorkerPool(c.workers, c.maxInFlight, func(msg stream.Message) {
+		if err := c.processMessage(drainCtx, msg); err != nil {
+			log.Printf("Error processing message %s: %v", msg.ID, err)
+			return
+		}
+		if acks {
+			if _, err := acker.Ack(drainCtx, msg.StreamKey, c.groupName, msg.ID); err != nil {
+				log.Printf("Error acknowledging message %s: %v", msg.ID, err)
+			}
+		}
+	})
 
 	for {
 		select {
 		case <-c.ctx.Done():
 			log.Printf("Consumer shutting down...")
+			// Let the workers finish what was already handed to them
+			pool.Close()
 			return nil
 		default:
-			keys, err := c.streamClient.Pull(config)
+			c.discoverStreams(&config)
+			if len(config.StreamKeys) == 0 {
+				// Nothing matched the pattern yet, wait for streams to appear
+				c.wait(time.Second)
+				continue
+			}
+
+			// Pull blocks on the consumer context so Stop interrupts it immediately
+			messages, err := c.streamClient.Pull(c.ctx, config)
 			if err != nil {
+				if c.ctx.Err() != nil {
+					continue
+				}
 				log.Printf("Error reading from stream: %v", err)
-				time.Sleep(time.Second * 5)
+				c.metrics.ObserveReadError()
+				c.wait(time.Second * 5)
 				continue
 			}
 
-			if len(keys) > 0 {
-				if err := c.processKeys(keys); err != nil {
-					log.Printf("Error processing keys: %v", err)
+			// Submit blocks while the pool is full, which throttles the next read.
+			// A stop does not cut the batch short, it was delivered to this consumer.
+			for _, msg := range messages {
+				pool.Submit(drainCtx, msg)
+			}
+		}
+	}
+}
+
+// Replay re-reads the configured range of every subscribed stream and processes
+// the keys without affecting the consumer group's offset
+func (c *Consumer) Replay() error {
+	replayer, ok := c.streamClient.(stream.Replayer)
+	if !ok {
+		return fmt.Errorf("stream backend does not support replay")
+	}
+
+	config := stream.ConsumerConfig{StreamKeys: c.streamKeys}
+	c.discoverStreams(&config)
+
+	log.Printf("Replaying %s to %s from %d streams", c.replayFrom, c.replayTo, len(config.StreamKeys))
+
+	for _, streamKey := range config.StreamKeys {
+		start := c.replayFrom
+		for start != "" {
+			select {
+			case <-c.ctx.Done():
+				return nil
+			default:
+			}
+
+			messages, next, err := replayer.Replay(c.ctx, streamKey, start, c.replayTo, 100, c.usernames)
+			if err != nil {
+				return fmt.Errorf("failed to replay stream %s: %v", streamKey, err)
+			}
+			for _, msg := range messages {
+				if err := c.processMessage(c.ctx, msg); err != nil {
+					return fmt.Errorf("failed to process replayed message %s: %v", msg.ID, err)
 				}
 			}
+			start = next
+		}
+	}
+
+	log.Printf("Replay finished")
+	return nil
+}
 
-			// Small delay to prevent busy waiting
-			time.Sleep(100 * time.Millisecond)
+// discoverStreams adds streams matching the subscription pattern to the read set
+func (c *Consumer) discoverStreams(config *stream.ConsumerConfig) {
+	if c.pattern == "" || clock.Now().Before(c.nextDiscovery) {
+		return
+	}
+	c.nextDiscovery = clock.Now().Add(c.discoveryInterval)
+
+	discoverer, ok := c.streamClient.(stream.Discoverer)
+	if !ok {
+		log.Printf("Stream backend does not support pattern subscriptions, ignoring pattern %s", c.pattern)
+		c.pattern = ""
+		return
+	}
+
+	found, err := discoverer.Discover(c.ctx, c.pattern)
+	if err != nil {
+		log.Printf("Error discovering streams: %v", err)
+		return
+	}
+
+	// A per-user pattern like radius:updates:* also matches the partition streams,
+	// which carry the same events a second time
+	partitions := stream.IsPartitionStreamKey(c.pattern)
+
+	keys := append([]string{}, c.streamKeys...)
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		seen[key] = true
+	}
+	var discovered []string
+	for _, key := range found {
+		if !seen[key] && stream.IsPartitionStreamKey(key) == partitions {
+			seen[key] = true
+			keys = append(keys, key)
+			discovered = append(discovered, key)
 		}
 	}
+
+	if len(keys) != len(config.StreamKeys) {
+		log.Printf("Following %d streams", len(keys))
+	}
+	config.StreamKeys = keys
+	config.DiscoveredKeys = discovered
+
+	c.keysMu.Lock()
+	c.activeKeys = keys
+	c.keysMu.Unlock()
+}
+
+// wait sleeps for d or until the consumer is stopped
+func (c *Consumer) wait(d time.Duration) {
+	select {
+	case <-c.ctx.Done():
+	case <-time.After(d):
+	}
 }
 
 func (c *Consumer) Stop() {
@@ -1,45 +1,41 @@
 package consumer
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"dni/pkg/config"
 	"dni/pkg/stream"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
 )
 
-// mockStream implements stream.Stream interface for testing
-type mockStream struct {
-	pullResults [][]string // each pullResult is a slice of message keys
-	pullErrors  []error
-	callCount   int
+// failingStream fails every read and ping, like an unreachable backend
+type failingStream struct {
+	*stream.MemoryStream
+	err error
 }
 
-func (m *mockStream) Push(streamKey string, message stream.StreamMessage) error {
-	return nil
+func (f *failingStream) Pull(ctx context.Context, config stream.ConsumerConfig) ([]stream.Message, error) {
+	return nil, f.err
 }
 
-func (m *mockStream) Pull(config stream.ConsumerConfig) ([]string, error) {
-	if m.callCount >= len(m.pullResults) {
-		return []string{}, nil
-	}
-
-	result := m.pullResults[m.callCount]
-	var err error
-	if m.callCount < len(m.pullErrors) {
-		err = m.pullErrors[m.callCount]
-	}
-
-	m.callCount++
-	return result, err
+func (f *failingStream) Ping(ctx context.Context) error {
+	return f.err
 }
 
-func (m *mockStream) CreateConsumerGroup(streamKey, groupName string) error {
-	return nil
+// publish adds an entry per record key to an in-memory stream
+func publish(s *stream.MemoryStream, streamKey string, keys ...string) {
+	for _, key := range keys {
+		s.Push(context.Background(), streamKey, stream.StreamMessage{Key: key, Username: "testuser"})
+	}
 }
 
 func TestConsumer_StartStop(t *testing.T) {
@@ -55,17 +51,12 @@ func TestConsumer_StartStop(t *testing.T) {
 		cfg := &config.ConsumerConfig{
 			Username:      "testuser",
 			LogFile:       logFile,
-			StreamKey:     "radius:updates:testuser",
+			StreamKeys:    []string{"radius:updates:testuser"},
 			ConsumerGroup: "test-group",
 			ConsumerName:  "test-consumer",
 		}
 
-		mockStreamClient := &mockStream{
-			pullResults: [][]string{{}}, // Empty result to avoid infinite loop
-			pullErrors:  []error{nil},
-		}
-
-		consumer := New(cfg, mockStreamClient)
+		consumer := New(cfg, stream.NewMemoryStream(), NewFileSink(cfg.LogFile, RotationPolicy{}))
 
 		done := make(chan error, 1)
 		go func() {
@@ -87,33 +78,55 @@ func TestConsumer_StartStop(t *testing.T) {
 	})
 }
 
+func TestConsumer_StopInterruptsBlockingPull(t *testing.T) {
+	cfg := &config.ConsumerConfig{
+		Username:      "testuser",
+		LogFile:       filepath.Join(t.TempDir(), "test.log"),
+		StreamKeys:    []string{"radius:updates:testuser"},
+		ConsumerGroup: "test-group",
+		ConsumerName:  "test-consumer",
+		BlockTimeout:  time.Minute,
+	}
+
+	consumer := New(cfg, stream.NewMemoryStream(), NewFileSink(cfg.LogFile, RotationPolicy{}))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- consumer.Start()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	consumer.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Consumer.Start() returned error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Consumer did not interrupt the blocking pull on Stop")
+	}
+}
+
 func TestConsumer_MessageProcessing(t *testing.T) {
 	tests := []struct {
 		name             string
-		pullResults      [][]string
-		pullErrors       []error
+		published        []string
+		pullErr          error
 		expectedLogParts []string
 		expectLogFile    bool
 	}{
 		{
-			name: "single message processing",
-			pullResults: [][]string{
-				{"radius:acct:testuser:session123"},
-				{}, // Empty to stop the loop
-			},
-			pullErrors: []error{nil, nil},
+			name:      "single message processing",
+			published: []string{"radius:acct:testuser:session123"},
 			expectedLogParts: []string{
 				"Received update for key: radius:acct:testuser:session123",
 			},
 			expectLogFile: true,
 		},
 		{
-			name: "multiple messages processing",
-			pullResults: [][]string{
-				{"radius:acct:testuser:session123", "radius:acct:testuser:session456"},
-				{}, // Empty to stop the loop
-			},
-			pullErrors: []error{nil, nil},
+			name:      "multiple messages processing",
+			published: []string{"radius:acct:testuser:session123", "radius:acct:testuser:session456"},
 			expectedLogParts: []string{
 				"Received update for key: radius:acct:testuser:session123",
 				"Received update for key: radius:acct:testuser:session456",
@@ -121,22 +134,13 @@ func TestConsumer_MessageProcessing(t *testing.T) {
 			expectLogFile: true,
 		},
 		{
-			name: "stream pull error handling",
-			pullResults: [][]string{
-				{}, // Empty result when error occurs
-			},
-			pullErrors: []error{
-				fmt.Errorf("Redis connection failed"),
-			},
+			name:             "stream pull error handling",
+			pullErr:          fmt.Errorf("Redis connection failed"),
 			expectedLogParts: []string{},
 			expectLogFile:    false,
 		},
 		{
-			name: "no messages",
-			pullResults: [][]string{
-				{}, // Empty result
-			},
-			pullErrors:       []error{nil},
+			name:             "no messages",
 			expectedLogParts: []string{},
 			expectLogFile:    false,
 		},
@@ -155,17 +159,20 @@ func TestConsumer_MessageProcessing(t *testing.T) {
 			cfg := &config.ConsumerConfig{
 				Username:      "testuser",
 				LogFile:       logFile,
-				StreamKey:     "radius:updates:testuser",
+				StreamKeys:    []string{"radius:updates:testuser"},
 				ConsumerGroup: "test-group",
 				ConsumerName:  "test-consumer",
+				StartID:       "0",
 			}
 
-			mockStreamClient := &mockStream{
-				pullResults: tt.pullResults,
-				pullErrors:  tt.pullErrors,
+			memoryStream := stream.NewMemoryStream()
+			publish(memoryStream, "radius:updates:testuser", tt.published...)
+			var streamClient stream.Stream = memoryStream
+			if tt.pullErr != nil {
+				streamClient = &failingStream{MemoryStream: memoryStream, err: tt.pullErr}
 			}
 
-			consumer := New(cfg, mockStreamClient)
+			consumer := New(cfg, streamClient, NewFileSink(cfg.LogFile, RotationPolicy{}))
 
 			done := make(chan error, 1)
 			go func() {
@@ -219,3 +226,398 @@ func TestConsumer_MessageProcessing(t *testing.T) {
 		})
 	}
 }
+
+func TestConsumer_PatternSubscription(t *testing.T) {
+	tempDir := t.TempDir()
+
+	cfg := &config.ConsumerConfig{
+		Usernames:         []string{"testuser-1"},
+		StreamPattern:     "radius:updates:*",
+		DiscoveryInterval: time.Minute,
+		LogFile:           filepath.Join(tempDir, "test.log"),
+		StreamKeys:        []string{"radius:updates:testuser-1"},
+		ConsumerGroup:     "consumer-group-radius:updates:*",
+		ConsumerName:      "test-consumer",
+		StartID:           "0",
+	}
+
+	streamClient := stream.NewMemoryStream()
+	publish(streamClient, "radius:updates:testuser-1", "radius:acct:testuser-1:session1")
+	publish(streamClient, "radius:updates:testuser-2", "radius:acct:testuser-2:session1")
+	publish(streamClient, "other:updates", "radius:acct:other:session1")
+	publish(streamClient, stream.PartitionStreamKey(0), "radius:acct:testuser-3:session1")
+
+	consumer := New(cfg, streamClient, NewFileSink(cfg.LogFile, RotationPolicy{}))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- consumer.Start()
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	consumer.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Consumer.Start() returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Consumer did not stop within timeout")
+	}
+
+	// Both matching streams were read, the one outside the pattern was not
+	content, err := os.ReadFile(cfg.LogFile)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	for _, key := range []string{"radius:acct:testuser-1:session1", "radius:acct:testuser-2:session1"} {
+		if !strings.Contains(string(content), key) {
+			t.Errorf("Expected log to contain %s, got:\n%s", key, content)
+		}
+	}
+	if strings.Contains(string(content), "radius:acct:other:session1") {
+		t.Errorf("Expected streams outside the pattern to be ignored, got:\n%s", content)
+	}
+	if strings.Contains(string(content), "radius:acct:testuser-3:session1") {
+		t.Errorf("Expected partition streams to be ignored by a per-user pattern, got:\n%s", content)
+	}
+}
+
+func TestConsumer_Replay(t *testing.T) {
+	tempDir := t.TempDir()
+	logFile := filepath.Join(tempDir, "test.log")
+
+	var history []string
+	for i := 0; i < 150; i++ {
+		history = append(history, fmt.Sprintf("radius:acct:testuser:session%d", i))
+	}
+
+	cfg := &config.ConsumerConfig{
+		Username:      "testuser",
+		LogFile:       logFile,
+		StreamKeys:    []string{"radius:updates:testuser"},
+		ConsumerGroup: "test-group",
+		ConsumerName:  "test-consumer",
+		ReplayFrom:    "0",
+		ReplayTo:      "+",
+	}
+
+	streamClient := stream.NewMemoryStream()
+	publish(streamClient, "radius:updates:testuser", history...)
+
+	if err := New(cfg, streamClient, NewFileSink(cfg.LogFile, RotationPolicy{})).Replay(); err != nil {
+		t.Fatalf("Replay returned error: %v", err)
+	}
+
+	content, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != len(history) {
+		t.Errorf("Expected %d replayed log lines, got %d", len(history), len(lines))
+	}
+	if _, err := streamClient.GroupStatus(context.Background(), "radius:updates:testuser", "test-group"); err != stream.ErrGroupNotFound {
+		t.Errorf("Replay should not read through the consumer group, got %v", err)
+	}
+}
+
+// rejectingSink fails the events of one record key and accepts the rest
+type rejectingSink struct {
+	key string
+}
+
+func (s rejectingSink) Write(ctx context.Context, event Event) error {
+	if event.Key == s.key {
+		return fmt.Errorf("sink unavailable")
+	}
+	return nil
+}
+
+func (s rejectingSink) Close() error { return nil }
+
+func TestConsumer_AcksProcessedMessages(t *testing.T) {
+	cfg := &config.ConsumerConfig{
+		Username:      "testuser",
+		StreamKeys:    []string{"radius:updates:testuser"},
+		ConsumerGroup: "test-group",
+		ConsumerName:  "test-consumer",
+		StartID:       "0",
+		Workers:       1,
+		MaxInFlight:   10,
+		BlockTimeout:  10 * time.Millisecond,
+	}
+
+	streamClient := stream.NewMemoryStream()
+	streamClient.ManualAck = true
+	publish(streamClient, "radius:updates:testuser", "radius:acct:testuser:ok", "radius:acct:testuser:failed")
+
+	consumer := New(cfg, streamClient, rejectingSink{key: "radius:acct:testuser:failed"})
+	done := make(chan error, 1)
+	go func() {
+		done <- consumer.Start()
+	}()
+
+	// Only the failed event stays pending, so a backend with redelivery hands it out again
+	var pending []stream.PendingEntry
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		pending, _ = streamClient.Pending(context.Background(), "radius:updates:testuser", "test-group")
+		if len(pending) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	consumer.Stop()
+	<-done
+
+	entries, _, _ := streamClient.Replay(context.Background(), "radius:updates:testuser", "-", "+", 10, nil)
+	if len(pending) != 1 || pending[0].ID != entries[1].ID {
+		t.Errorf("Expected only the failed event %s to stay pending, got %+v", entries[1].ID, pending)
+	}
+}
+
+func TestConsumer_RedisKeepsFailedMessagesPending(t *testing.T) {
+	cfg := &config.ConsumerConfig{
+		Username:      "testuser",
+		StreamKeys:    []string{"radius:updates:testuser"},
+		ConsumerGroup: "test-group",
+		ConsumerName:  "test-consumer",
+		StartID:       "0",
+		Workers:       1,
+		MaxInFlight:   10,
+		BlockTimeout:  10 * time.Millisecond,
+	}
+
+	redisClient := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	defer redisClient.Close()
+	streamClient := stream.NewRedisStream(redisClient)
+	streamClient.ManualAck = true
+
+	ctx := context.Background()
+	for _, key := range []string{"radius:acct:testuser:ok", "radius:acct:testuser:failed"} {
+		if err := streamClient.Push(ctx, "radius:updates:testuser", stream.StreamMessage{Key: key, Username: "testuser"}); err != nil {
+			t.Fatalf("Failed to publish: %v", err)
+		}
+	}
+
+	consumer := New(cfg, streamClient, rejectingSink{key: "radius:acct:testuser:failed"})
+	done := make(chan error, 1)
+	go func() {
+		done <- consumer.Start()
+	}()
+
+	// The processed entry is acknowledged, the failed one stays in the pending entries list
+	var pending []redis.XPendingExt
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		pending, _ = redisClient.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: "radius:updates:testuser",
+			Group:  "test-group",
+			Start:  "-",
+			End:    "+",
+			Count:  10,
+		}).Result()
+		if len(pending) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	consumer.Stop()
+	<-done
+
+	entries, _ := redisClient.XRange(ctx, "radius:updates:testuser", "-", "+").Result()
+	if len(entries) != 2 || len(pending) != 1 || pending[0].ID != entries[1].ID {
+		t.Errorf("Expected only the failed event to stay pending, got %+v", pending)
+	}
+}
+
+// blockingSink holds the first write until release is closed and records the events it
+// wrote, failing writes whose context is already cancelled like the webhook sink
+type blockingSink struct {
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+
+	mu      sync.Mutex
+	written []string
+}
+
+func (s *blockingSink) Write(ctx context.Context, event Event) error {
+	s.once.Do(func() {
+		close(s.entered)
+		<-s.release
+	})
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written = append(s.written, event.Key)
+	return nil
+}
+
+func (s *blockingSink) Close() error { return nil }
+
+func TestConsumer_StopDrainsMessagesInFlight(t *testing.T) {
+	cfg := &config.ConsumerConfig{
+		Username:      "testuser",
+		StreamKeys:    []string{"radius:updates:testuser"},
+		ConsumerGroup: "test-group",
+		ConsumerName:  "test-consumer",
+		StartID:       "0",
+		Workers:       1,
+		MaxInFlight:   10,
+		BlockTimeout:  10 * time.Millisecond,
+	}
+
+	streamClient := stream.NewMemoryStream()
+	streamClient.ManualAck = true
+	publish(streamClient, "radius:updates:testuser", "radius:acct:testuser:first", "radius:acct:testuser:second")
+
+	sink := &blockingSink{entered: make(chan struct{}), release: make(chan struct{})}
+	consumer := New(cfg, streamClient, sink)
+	done := make(chan error, 1)
+	go func() {
+		done <- consumer.Start()
+	}()
+
+	// Stop while both messages were read but not written yet
+	select {
+	case <-sink.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The sink was never called")
+	}
+	consumer.Stop()
+	close(sink.release)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Consumer.Start() returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Consumer did not stop within timeout")
+	}
+
+	expected := "radius:acct:testuser:first,radius:acct:testuser:second"
+	if got := strings.Join(sink.written, ","); got != expected {
+		t.Errorf("Expected the messages in flight to be written, got %s", got)
+	}
+	if pending, _ := streamClient.Pending(context.Background(), "radius:updates:testuser", "test-group"); len(pending) != 0 {
+		t.Errorf("Expected the drained messages to be acknowledged, got %+v", pending)
+	}
+}
+
+// flakySink fails the first write of every record key and accepts it when delivered again
+type flakySink struct {
+	mu       sync.Mutex
+	attempts map[string]int
+	written  []string
+}
+
+func (s *flakySink) Write(ctx context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts[event.Key]++
+	if s.attempts[event.Key] == 1 {
+		return fmt.Errorf("sink unavailable")
+	}
+	s.written = append(s.written, event.Key)
+	return nil
+}
+
+func (s *flakySink) Close() error { return nil }
+
+func (s *flakySink) writtenKeys() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.Join(s.written, ",")
+}
+
+func TestConsumer_RedisRedeliversFailedMessages(t *testing.T) {
+	tests := []struct {
+		name      string
+		claimIdle time.Duration
+		restart   bool
+	}{
+		{
+			// The failed entry is claimed again once it was idle for ClaimIdle
+			name:      "claimed after idle time",
+			claimIdle: 50 * time.Millisecond,
+		},
+		{
+			// A restarted consumer reads its own pending entries before new ones
+			name:      "read back after restart",
+			claimIdle: time.Hour,
+			restart:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.ConsumerConfig{
+				Username:      "testuser",
+				StreamKeys:    []string{"radius:updates:testuser"},
+				ConsumerGroup: "test-group",
+				ConsumerName:  "test-consumer",
+				StartID:       "0",
+				Workers:       1,
+				MaxInFlight:   10,
+				BlockTimeout:  10 * time.Millisecond,
+				ClaimIdle:     tt.claimIdle,
+			}
+
+			redisClient := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+			defer redisClient.Close()
+			newStream := func() *stream.RedisStream {
+				streamClient := stream.NewRedisStream(redisClient)
+				streamClient.ManualAck = true
+				return streamClient
+			}
+			streamClient := newStream()
+
+			ctx := context.Background()
+			if err := streamClient.Push(ctx, "radius:updates:testuser", stream.StreamMessage{Key: "radius:acct:testuser:s1", Username: "testuser"}); err != nil {
+				t.Fatalf("Failed to publish: %v", err)
+			}
+
+			sink := &flakySink{attempts: make(map[string]int)}
+			run := func(consumer *Consumer, until func() bool) {
+				done := make(chan error, 1)
+				go func() {
+					done <- consumer.Start()
+				}()
+				deadline := time.Now().Add(5 * time.Second)
+				for time.Now().Before(deadline) && !until() {
+					time.Sleep(10 * time.Millisecond)
+				}
+				consumer.Stop()
+				<-done
+			}
+
+			failed := func() bool {
+				sink.mu.Lock()
+				defer sink.mu.Unlock()
+				return sink.attempts["radius:acct:testuser:s1"] > 0
+			}
+			written := func() bool { return sink.writtenKeys() != "" }
+
+			if tt.restart {
+				run(New(cfg, streamClient, sink), failed)
+				streamClient = newStream()
+			}
+			run(New(cfg, streamClient, sink), written)
+
+			if got := sink.writtenKeys(); got != "radius:acct:testuser:s1" {
+				t.Errorf("Expected the failed event to be delivered again and written once, got %q", got)
+			}
+			pending, err := redisClient.XPending(ctx, "radius:updates:testuser", "test-group").Result()
+			if err != nil || pending.Count != 0 {
+				t.Errorf("Expected nothing pending after the redelivery, got %+v (%v)", pending, err)
+			}
+		})
+	}
+}
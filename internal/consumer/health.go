@@ -0,0 +1,106 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"dni/pkg/stream"
+)
+
+// readinessTimeout bounds the backend checks made by /readyz and /metrics
+const readinessTimeout = 2 * time.Second
+
+// HealthHandler serves /healthz, /readyz and /metrics for orchestrators and scrapers
+func (c *Consumer) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", c.handleHealthz)
+	mux.HandleFunc("/readyz", c.handleReadyz)
+	mux.HandleFunc("/metrics", c.handleMetrics)
+	return mux
+}
+
+// handleHealthz reports whether the consume loop is running
+func (c *Consumer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if !c.running.Load() {
+		http.Error(w, "consumer not running", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether the backend is reachable and the group exists on every stream
+func (c *Consumer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	inspector, ok := c.streamClient.(stream.GroupInspector)
+	if !ok {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	if err := inspector.Ping(ctx); err != nil {
+		http.Error(w, fmt.Sprintf("stream backend unreachable: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	for _, streamKey := range c.activeStreamKeys() {
+		if _, err := inspector.GroupStatus(ctx, streamKey, c.groupName); err != nil {
+			http.Error(w, fmt.Sprintf("group %s not ready on %s: %v", c.groupName, streamKey, err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// handleMetrics writes the consumer metrics in the Prometheus text format
+func (c *Consumer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	snap := c.metrics.Snapshot()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP radius_consumer_messages_processed_total Messages the sinks accepted.")
+	fmt.Fprintln(w, "# TYPE radius_consumer_messages_processed_total counter")
+	fmt.Fprintf(w, "radius_consumer_messages_processed_total %d\n", snap.Processed)
+
+	fmt.Fprintln(w, "# HELP radius_consumer_errors_total Failed sink writes and stream reads.")
+	fmt.Fprintln(w, "# TYPE radius_consumer_errors_total counter")
+	fmt.Fprintf(w, "radius_consumer_errors_total{stage=\"process\"} %d\n", snap.ProcessErrors)
+	fmt.Fprintf(w, "radius_consumer_errors_total{stage=\"read\"} %d\n", snap.ReadErrors)
+
+	fmt.Fprintln(w, "# HELP radius_consumer_processing_seconds Time spent processing a message.")
+	fmt.Fprintln(w, "# TYPE radius_consumer_processing_seconds summary")
+	fmt.Fprintf(w, "radius_consumer_processing_seconds_sum %g\n", snap.LatencySum.Seconds())
+	fmt.Fprintf(w, "radius_consumer_processing_seconds_count %d\n", snap.Processed+snap.ProcessErrors)
+
+	inspector, ok := c.streamClient.(stream.GroupInspector)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	fmt.Fprintln(w, "# HELP radius_consumer_group_lag Entries not yet delivered to the consumer group.")
+	fmt.Fprintln(w, "# TYPE radius_consumer_group_lag gauge")
+	fmt.Fprintln(w, "# HELP radius_consumer_group_pending Delivered entries not yet acknowledged.")
+	fmt.Fprintln(w, "# TYPE radius_consumer_group_pending gauge")
+	for _, streamKey := range c.activeStreamKeys() {
+		status, err := inspector.GroupStatus(ctx, streamKey, c.groupName)
+		if errors.Is(err, stream.ErrGroupNotFound) {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(w, "# error reading group status for %s: %v\n", streamKey, err)
+			continue
+		}
+		if status.Lag >= 0 {
+			fmt.Fprintf(w, "radius_consumer_group_lag{stream=%q,group=%q} %d\n", streamKey, c.groupName, status.Lag)
+		}
+		fmt.Fprintf(w, "radius_consumer_group_pending{stream=%q,group=%q} %d\n", streamKey, c.groupName, status.Pending)
+	}
+}
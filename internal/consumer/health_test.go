@@ -0,0 +1,111 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"dni/pkg/config"
+	"dni/pkg/stream"
+)
+
+// laggingStream returns a stream where test-group has 1 pending and 2 undelivered entries
+func laggingStream() *stream.MemoryStream {
+	s := stream.NewMemoryStream()
+	s.ManualAck = true
+	publish(s, "radius:updates:testuser", "k1", "k2", "k3")
+	s.Pull(context.Background(), stream.ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:testuser"},
+		ConsumerGroup: "test-group",
+		StartID:       "0",
+		BatchSize:     1,
+	})
+	return s
+}
+
+func TestConsumer_HealthHandler(t *testing.T) {
+	cfg := &config.ConsumerConfig{
+		Username:      "testuser",
+		StreamKeys:    []string{"radius:updates:testuser"},
+		ConsumerGroup: "test-group",
+		ConsumerName:  "test-consumer",
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		running      bool
+		stream       stream.Stream
+		expectedCode int
+		expectedBody []string
+	}{
+		{
+			name:         "healthz while running",
+			path:         "/healthz",
+			running:      true,
+			stream:       stream.NewMemoryStream(),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "healthz before start",
+			path:         "/healthz",
+			stream:       stream.NewMemoryStream(),
+			expectedCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:         "readyz with group present",
+			path:         "/readyz",
+			stream:       laggingStream(),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "readyz with backend down",
+			path:         "/readyz",
+			stream:       &failingStream{MemoryStream: stream.NewMemoryStream(), err: errors.New("connection refused")},
+			expectedCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:         "readyz with missing group",
+			path:         "/readyz",
+			stream:       stream.NewMemoryStream(),
+			expectedCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:         "metrics include group lag",
+			path:         "/metrics",
+			stream:       laggingStream(),
+			expectedCode: http.StatusOK,
+			expectedBody: []string{
+				"radius_consumer_messages_processed_total 1\n",
+				`radius_consumer_errors_total{stage="process"} 1`,
+				"radius_consumer_processing_seconds_count 2",
+				`radius_consumer_group_lag{stream="radius:updates:testuser",group="test-group"} 2`,
+				`radius_consumer_group_pending{stream="radius:updates:testuser",group="test-group"} 1`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumer := New(cfg, tt.stream, newWriterSink(&strings.Builder{}))
+			consumer.running.Store(tt.running)
+			consumer.Metrics().ObserveProcessed(0, nil)
+			consumer.Metrics().ObserveProcessed(0, errors.New("sink failed"))
+
+			rec := httptest.NewRecorder()
+			consumer.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.expectedCode {
+				t.Errorf("Expected status %d, got %d: %s", tt.expectedCode, rec.Code, rec.Body.String())
+			}
+			for _, want := range tt.expectedBody {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("Expected body to contain %q, got:\n%s", want, rec.Body.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package consumer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics counts the work done by a consumer. All methods are safe for concurrent use.
+type Metrics struct {
+	processed       atomic.Int64
+	processErrors   atomic.Int64
+	readErrors      atomic.Int64
+	latencyNanosSum atomic.Int64
+}
+
+// ObserveProcessed records one message handed to the sinks and how long it took.
+// It counts as processed only if err is nil and as a process error otherwise.
+func (m *Metrics) ObserveProcessed(latency time.Duration, err error) {
+	m.latencyNanosSum.Add(int64(latency))
+	if err != nil {
+		m.processErrors.Add(1)
+		return
+	}
+	m.processed.Add(1)
+}
+
+// ObserveReadError records a failed read from the stream
+func (m *Metrics) ObserveReadError() {
+	m.readErrors.Add(1)
+}
+
+// MetricsSnapshot is a point in time copy of Metrics
+type MetricsSnapshot struct {
+	// Processed counts the messages the sinks accepted
+	Processed int64
+	// ProcessErrors counts the messages a sink failed to write
+	ProcessErrors int64
+	ReadErrors    int64
+	LatencySum    time.Duration
+}
+
+// Snapshot returns the current counter values
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		Processed:     m.processed.Load(),
+		ProcessErrors: m.processErrors.Load(),
+		ReadErrors:    m.readErrors.Load(),
+		LatencySum:    time.Duration(m.latencyNanosSum.Load()),
+	}
+}
@@ -0,0 +1,70 @@
+package consumer
+
+import (
+	"context"
+	"sync"
+
+	"dni/pkg/stream"
+)
+
+// workerPool processes messages concurrently while keeping each user's messages in order.
+// Messages for the same username always go to the same worker, and at most maxInFlight
+// messages are queued or being processed at any time.
+type workerPool struct {
+	queues []chan stream.Message
+	slots  chan struct{}
+	handle func(stream.Message)
+	wg     sync.WaitGroup
+}
+
+func newWorkerPool(workers, maxInFlight int, handle func(stream.Message)) *workerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+
+	p := &workerPool{
+		queues: make([]chan stream.Message, workers),
+		slots:  make(chan struct{}, maxInFlight),
+		handle: handle,
+	}
+
+	for i := range p.queues {
+		// A queue never holds more than maxInFlight messages, so sends never block
+		p.queues[i] = make(chan stream.Message, maxInFlight)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+
+	return p
+}
+
+// Submit queues msg, blocking while the pool is full. It returns false if ctx ends first.
+func (p *workerPool) Submit(ctx context.Context, msg stream.Message) bool {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+
+	p.queues[stream.PartitionFor(msg.Username, len(p.queues))] <- msg
+	return true
+}
+
+// Close waits for queued messages to be processed and stops the workers
+func (p *workerPool) Close() {
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+}
+
+func (p *workerPool) work(queue <-chan stream.Message) {
+	defer p.wg.Done()
+	for msg := range queue {
+		p.handle(msg)
+		<-p.slots
+	}
+}
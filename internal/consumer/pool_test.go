@@ -0,0 +1,90 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dni/pkg/stream"
+)
+
+func TestWorkerPool_PerUserOrdering(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string][]int)
+
+	pool := newWorkerPool(4, 8, func(msg stream.Message) {
+		var seq int
+		fmt.Sscanf(msg.ID, "%d-0", &seq)
+
+		// uneven processing time to shake out reordering
+		time.Sleep(time.Duration(seq%3) * time.Millisecond)
+
+		mu.Lock()
+		seen[msg.Username] = append(seen[msg.Username], seq)
+		mu.Unlock()
+	})
+
+	users := []string{"alice", "bob", "carol", "dave", "erin"}
+	for seq := 0; seq < 100; seq++ {
+		msg := stream.Message{
+			ID:       fmt.Sprintf("%d-0", seq),
+			Username: users[seq%len(users)],
+		}
+		if !pool.Submit(context.Background(), msg) {
+			t.Fatal("Submit rejected a message")
+		}
+	}
+	pool.Close()
+
+	for user, seqs := range seen {
+		if len(seqs) != 20 {
+			t.Errorf("Expected 20 messages for %s, got %d", user, len(seqs))
+		}
+		for i := 1; i < len(seqs); i++ {
+			if seqs[i] < seqs[i-1] {
+				t.Errorf("Messages for %s processed out of order: %v", user, seqs)
+				break
+			}
+		}
+	}
+}
+
+func TestWorkerPool_BoundedInFlight(t *testing.T) {
+	const maxInFlight = 3
+
+	var inFlight, peak int32
+	release := make(chan struct{})
+
+	pool := newWorkerPool(8, maxInFlight, func(msg stream.Message) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&inFlight, -1)
+	})
+
+	for i := 0; i < maxInFlight; i++ {
+		pool.Submit(context.Background(), stream.Message{Username: fmt.Sprintf("user-%d", i)})
+	}
+
+	// The pool is full, so another submit must wait
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if pool.Submit(ctx, stream.Message{Username: "user-extra"}) {
+		t.Error("Expected Submit to block while the pool is full")
+	}
+
+	close(release)
+	pool.Close()
+
+	if peak > maxInFlight {
+		t.Errorf("Expected at most %d messages in flight, saw %d", maxInFlight, peak)
+	}
+}
@@ -0,0 +1,244 @@
+package consumer
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	clock "go.llib.dev/testcase/clock"
+)
+
+// rotatedSuffixLayout is appended to the log path when a file is rotated out
+const rotatedSuffixLayout = "20060102T150405.000000"
+
+// RotationPolicy controls when the consumer log is rotated and how many old files are kept.
+// A zero value never rotates.
+type RotationPolicy struct {
+	// MaxSize rotates once the file would grow beyond this many bytes
+	MaxSize int64
+	// Interval rotates files that have been open for longer than this
+	Interval time.Duration
+	// Keep is the number of rotated files retained, 0 keeps all of them
+	Keep int
+	// Compress gzips rotated files
+	Compress bool
+}
+
+// RotatingFile is an append-only file that rotates itself according to a RotationPolicy.
+// The file is opened lazily on the first write.
+type RotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	policy   RotationPolicy
+	file     *os.File
+	size     int64
+	openedAt time.Time
+
+	// compression of rotated files runs in the background, one rotation at a time
+	// so pruning never sees a file that is still being compressed
+	wg      sync.WaitGroup
+	cleanMu sync.Mutex
+}
+
+// NewRotatingFile creates a RotatingFile for path
+func NewRotatingFile(path string, policy RotationPolicy) *RotatingFile {
+	return &RotatingFile{path: path, policy: policy}
+}
+
+// Write appends p, rotating first if the policy requires it
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if r.shouldRotate(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Reopen closes and reopens the file at the same path, so a file moved away
+// by an external tool such as logrotate is replaced by a fresh one
+func (r *RotatingFile) Reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %v", err)
+	}
+	r.file = nil
+	return r.open()
+}
+
+// Close closes the file and waits for pending compressions
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+	if r.file != nil {
+		err = r.file.Close()
+		r.file = nil
+	}
+	r.wg.Wait()
+	return err
+}
+
+func (r *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return fmt.Errorf("failed to create log directory: %v", err)
+	}
+
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %v", err)
+	}
+
+	r.file = file
+	r.size = info.Size()
+	r.openedAt = clock.Now()
+	return nil
+}
+
+func (r *RotatingFile) shouldRotate(incoming int64) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.policy.MaxSize > 0 && r.size+incoming > r.policy.MaxSize {
+		return true
+	}
+	return r.policy.Interval > 0 && clock.Now().Sub(r.openedAt) >= r.policy.Interval
+}
+
+// rotate renames the current file with a timestamp suffix and opens a new one
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %v", err)
+	}
+	r.file = nil
+
+	rotated := r.path + "." + clock.Now().Format(rotatedSuffixLayout)
+	if err := os.Rename(r.path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate log file: %v", err)
+	}
+
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.cleanMu.Lock()
+		defer r.cleanMu.Unlock()
+
+		if r.policy.Compress {
+			if err := compressFile(rotated); err != nil {
+				log.Printf("Failed to compress rotated log %s: %v", rotated, err)
+			}
+		}
+		if err := r.prune(); err != nil {
+			log.Printf("Failed to prune rotated logs: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// prune removes the oldest rotated files beyond the retention count. Only files named
+// by rotate, with or without the .gz of compressFile, count as rotated.
+func (r *RotatingFile) prune() error {
+	if r.policy.Keep <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(r.path))
+	if err != nil {
+		return err
+	}
+
+	prefix := filepath.Base(r.path) + "."
+	var rotated []string
+	for _, entry := range entries {
+		suffix, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(rotatedSuffixLayout, strings.TrimSuffix(suffix, ".gz")); err != nil {
+			continue
+		}
+		rotated = append(rotated, filepath.Join(filepath.Dir(r.path), entry.Name()))
+	}
+
+	// The timestamp suffix sorts chronologically
+	sort.Strings(rotated)
+	for len(rotated) > r.policy.Keep {
+		if err := os.Remove(rotated[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// compressFile gzips path into path.gz and removes the original
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
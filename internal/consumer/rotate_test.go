@@ -0,0 +1,152 @@
+package consumer
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.llib.dev/testcase/clock/timecop"
+)
+
+func TestRotatingFile_SizeRotation(t *testing.T) {
+	timecop.Travel(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), timecop.Freeze)
+
+	path := filepath.Join(t.TempDir(), "updates.log")
+	file := NewRotatingFile(path, RotationPolicy{MaxSize: 50, Keep: 2, Compress: true})
+
+	for i := 0; i < 5; i++ {
+		if _, err := file.Write([]byte(strings.Repeat("x", 29) + "\n")); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+		// distinct rotation timestamps
+		timecop.Travel(t, time.Second, timecop.Freeze)
+	}
+
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 2 {
+		t.Fatalf("Expected 2 retained rotated files, got %v", rotated)
+	}
+	for _, name := range rotated {
+		if !strings.HasSuffix(name, ".gz") {
+			t.Errorf("Expected rotated file %s to be compressed", name)
+		}
+	}
+
+	// The newest rotated file holds the fourth line
+	if !strings.HasSuffix(rotated[1], "20250101T000004.000000.gz") {
+		t.Errorf("Unexpected newest rotated file %s", rotated[1])
+	}
+	f, err := os.Open(rotated[1])
+	if err != nil {
+		t.Fatalf("Failed to open rotated file: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Rotated file is not gzip: %v", err)
+	}
+	content, _ := io.ReadAll(gz)
+	if len(content) != 30 {
+		t.Errorf("Expected one 30 byte line in rotated file, got %d bytes", len(content))
+	}
+
+	current, _ := os.ReadFile(path)
+	if len(current) != 30 {
+		t.Errorf("Expected one 30 byte line in current file, got %d bytes", len(current))
+	}
+}
+
+func TestRotatingFile_PruneKeepsOtherFiles(t *testing.T) {
+	timecop.Travel(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), timecop.Freeze)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "updates.log")
+	others := []string{"updates.log.bak", "updates.log.1", "updates.log.20240101T000000.000000.gz.tmp"}
+	for _, name := range others {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("keep\n"), 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+
+	file := NewRotatingFile(path, RotationPolicy{MaxSize: 10, Keep: 1, Compress: true})
+	for i := 0; i < 4; i++ {
+		if _, err := file.Write([]byte("line 000\n")); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+		timecop.Travel(t, time.Second, timecop.Freeze)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	for _, name := range others {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s to be left alone, got %v", name, err)
+		}
+	}
+	rotated, _ := filepath.Glob(path + ".2025*")
+	if len(rotated) != 1 || !strings.HasSuffix(rotated[0], "20250101T000003.000000.gz") {
+		t.Errorf("Expected only the newest rotated file, got %v", rotated)
+	}
+}
+
+func TestRotatingFile_TimeRotation(t *testing.T) {
+	timecop.Travel(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), timecop.Freeze)
+
+	path := filepath.Join(t.TempDir(), "updates.log")
+	file := NewRotatingFile(path, RotationPolicy{Interval: time.Hour})
+	defer file.Close()
+
+	file.Write([]byte("first\n"))
+	timecop.Travel(t, 30*time.Minute, timecop.Freeze)
+	file.Write([]byte("second\n"))
+	timecop.Travel(t, 31*time.Minute, timecop.Freeze)
+	file.Write([]byte("third\n"))
+
+	content, err := os.ReadFile(path + ".20250101T010100.000000")
+	if err != nil {
+		t.Fatalf("Expected rotated file: %v", err)
+	}
+	if string(content) != "first\nsecond\n" {
+		t.Errorf("Unexpected rotated content %q", content)
+	}
+
+	current, _ := os.ReadFile(path)
+	if string(current) != "third\n" {
+		t.Errorf("Unexpected current content %q", current)
+	}
+}
+
+func TestRotatingFile_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "updates.log")
+	file := NewRotatingFile(path, RotationPolicy{})
+	defer file.Close()
+
+	file.Write([]byte("before\n"))
+
+	// simulate logrotate moving the file away
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("Failed to move log file: %v", err)
+	}
+	if err := file.Reopen(); err != nil {
+		t.Fatalf("Reopen returned error: %v", err)
+	}
+	file.Write([]byte("after\n"))
+
+	current, _ := os.ReadFile(path)
+	if string(current) != "after\n" {
+		t.Errorf("Expected reopened file to contain only new writes, got %q", current)
+	}
+	moved, _ := os.ReadFile(path + ".1")
+	if string(moved) != "before\n" {
+		t.Errorf("Expected moved file to keep old writes, got %q", moved)
+	}
+}
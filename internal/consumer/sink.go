@@ -0,0 +1,145 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"dni/pkg/config"
+	"dni/pkg/datastore"
+)
+
+const (
+	SinkFile    = "file"
+	SinkStdout  = "stdout"
+	SinkWebhook = "webhook"
+	SinkArchive = "archive"
+)
+
+// Event is a single accounting update handed to sinks
+type Event struct {
+	Key        string    `json:"key"`
+	Username   string    `json:"username,omitempty"`
+	Consumer   string    `json:"consumer"`
+	ReceivedAt time.Time `json:"received_at"`
+	// Record is only set when enrichment is enabled
+	Record *datastore.AccountingRecord `json:"record,omitempty"`
+}
+
+// jsonFlushInterval is how often buffered JSON log lines reach the file
+const jsonFlushInterval = time.Second
+
+// Sink receives every event processed by the consumer
+type Sink interface {
+	Write(ctx context.Context, event Event) error
+	Close() error
+}
+
+// MultiSink fans events out to several sinks
+type MultiSink []Sink
+
+// Write delivers the event to every sink, reporting all failures
+func (m MultiSink) Write(ctx context.Context, event Event) error {
+	var errs []error
+	for _, sink := range m {
+		if err := sink.Write(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every sink, reporting all failures
+func (m MultiSink) Close() error {
+	var errs []error
+	for _, sink := range m {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Reopener is implemented by sinks that hold files which may be rotated externally
+type Reopener interface {
+	Reopen() error
+}
+
+// Reopen reopens the sink's files if it supports it
+func Reopen(sink Sink) error {
+	if r, ok := sink.(Reopener); ok {
+		return r.Reopen()
+	}
+	return nil
+}
+
+// Reopen reopens the files of every sink, reporting all failures
+func (m MultiSink) Reopen() error {
+	var errs []error
+	for _, sink := range m {
+		if err := Reopen(sink); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// NewSinks builds the sinks selected in the consumer configuration.
+// When enrichment is enabled every event is first completed from store.
+func NewSinks(cfg *config.ConsumerConfig, store datastore.Datastore) (Sink, error) {
+	if len(cfg.Sinks) == 0 {
+		return nil, fmt.Errorf("no sinks configured")
+	}
+
+	var sinks MultiSink
+	for _, name := range cfg.Sinks {
+		switch name {
+		case SinkFile:
+			rotation := RotationPolicy{
+				MaxSize:  cfg.LogMaxSize,
+				Interval: cfg.LogRotateInterval,
+				Keep:     cfg.LogKeep,
+				Compress: cfg.LogCompress,
+			}
+			if cfg.LogFormat == config.LogFormatJSON {
+				sinks = append(sinks, NewJSONFileSink(cfg.LogFile, rotation, jsonFlushInterval))
+			} else {
+				sinks = append(sinks, NewFileSink(cfg.LogFile, rotation))
+			}
+		case SinkStdout:
+			sinks = append(sinks, NewStdoutSink())
+		case SinkWebhook:
+			if cfg.WebhookURL == "" {
+				sinks.Close()
+				return nil, fmt.Errorf("webhook sink requires a webhook URL")
+			}
+			sinks = append(sinks, NewWebhookSink(cfg.WebhookURL, cfg.WebhookMaxRetries, cfg.WebhookTimeout))
+		case SinkArchive:
+			archive, err := NewArchiveSink(cfg.ArchiveFile)
+			if err != nil {
+				sinks.Close()
+				return nil, err
+			}
+			sinks = append(sinks, archive)
+		default:
+			sinks.Close()
+			return nil, fmt.Errorf("unknown sink %q", name)
+		}
+	}
+
+	var sink Sink = sinks
+	if len(sinks) == 1 {
+		sink = sinks[0]
+	}
+
+	if cfg.EnrichEvents {
+		if store == nil {
+			sink.Close()
+			return nil, fmt.Errorf("event enrichment requires a datastore")
+		}
+		sink = NewEnrichingSink(store, sink)
+	}
+
+	return sink, nil
+}
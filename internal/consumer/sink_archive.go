@@ -0,0 +1,75 @@
+package consumer
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ArchiveSink keeps a local CSV archive of every event
+type ArchiveSink struct {
+	mu     sync.Mutex
+	file   *os.File
+	writer *csv.Writer
+}
+
+// NewArchiveSink opens (or creates) the CSV archive at path
+func NewArchiveSink(path string) (*ArchiveSink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %v", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive file: %v", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat archive file: %v", err)
+	}
+
+	a := &ArchiveSink{file: file, writer: csv.NewWriter(file)}
+
+	// Only a fresh archive gets a header row
+	if info.Size() == 0 {
+		if err := a.writeRow([]string{"received_at", "consumer", "key"}); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// Write appends the event as a CSV row
+func (a *ArchiveSink) Write(ctx context.Context, event Event) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.writeRow([]string{event.ReceivedAt.Format(time.RFC3339Nano), event.Consumer, event.Key})
+}
+
+func (a *ArchiveSink) writeRow(row []string) error {
+	if err := a.writer.Write(row); err != nil {
+		return fmt.Errorf("failed to write archive row: %v", err)
+	}
+	a.writer.Flush()
+	if err := a.writer.Error(); err != nil {
+		return fmt.Errorf("failed to flush archive: %v", err)
+	}
+	return nil
+}
+
+// Close closes the archive file
+func (a *ArchiveSink) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.file.Close()
+}
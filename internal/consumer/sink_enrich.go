@@ -0,0 +1,45 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"dni/pkg/datastore"
+)
+
+// EnrichingSink loads the full accounting record for each event before passing it on
+type EnrichingSink struct {
+	store datastore.Datastore
+	next  Sink
+}
+
+// NewEnrichingSink wraps next so its events carry the stored accounting record
+func NewEnrichingSink(store datastore.Datastore, next Sink) *EnrichingSink {
+	return &EnrichingSink{store: store, next: next}
+}
+
+// Write attaches the record to the event, records that expired are delivered without one
+func (e *EnrichingSink) Write(ctx context.Context, event Event) error {
+	record, err := e.store.Get(ctx, event.Key)
+	switch {
+	case err == nil:
+		event.Record = &record
+	case errors.Is(err, datastore.ErrNotFound):
+		log.Printf("Record %s expired before it could be enriched", event.Key)
+	default:
+		log.Printf("Failed to enrich %s: %v", event.Key, err)
+	}
+
+	return e.next.Write(ctx, event)
+}
+
+// Reopen reopens the wrapped sink's files
+func (e *EnrichingSink) Reopen() error {
+	return Reopen(e.next)
+}
+
+// Close closes the wrapped sink
+func (e *EnrichingSink) Close() error {
+	return e.next.Close()
+}
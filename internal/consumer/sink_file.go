@@ -0,0 +1,38 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+)
+
+// FileSink appends a human readable line per event to a log file
+type FileSink struct {
+	file *RotatingFile
+}
+
+// NewFileSink creates a FileSink writing to path, rotated according to policy
+func NewFileSink(path string, policy RotationPolicy) *FileSink {
+	return &FileSink{file: NewRotatingFile(path, policy)}
+}
+
+// Write appends the event to the log file
+func (f *FileSink) Write(ctx context.Context, event Event) error {
+	timestamp := event.ReceivedAt.Format("2006-01-02 15:04:05.000000")
+	logEntry := fmt.Sprintf("%s - Received update for key: %s\n", timestamp, event.Key)
+
+	if _, err := f.file.Write([]byte(logEntry)); err != nil {
+		return fmt.Errorf("failed to write to log file: %v", err)
+	}
+
+	return nil
+}
+
+// Reopen reopens the log file after external rotation
+func (f *FileSink) Reopen() error {
+	return f.file.Reopen()
+}
+
+// Close closes the log file
+func (f *FileSink) Close() error {
+	return f.file.Close()
+}
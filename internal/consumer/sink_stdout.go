@@ -0,0 +1,41 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// StdoutSink writes one JSON object per event to standard output
+type StdoutSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewStdoutSink creates a StdoutSink
+func NewStdoutSink() *StdoutSink {
+	return newWriterSink(os.Stdout)
+}
+
+func newWriterSink(w io.Writer) *StdoutSink {
+	return &StdoutSink{enc: json.NewEncoder(w)}
+}
+
+// Write encodes the event as a JSON line
+func (s *StdoutSink) Write(ctx context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.enc.Encode(event); err != nil {
+		return fmt.Errorf("failed to write event to stdout: %v", err)
+	}
+	return nil
+}
+
+// Close is a no-op
+func (s *StdoutSink) Close() error {
+	return nil
+}
@@ -0,0 +1,312 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dni/pkg/config"
+	"dni/pkg/datastore"
+
+	"go.llib.dev/testcase/clock/timecop"
+)
+
+func testEvent() Event {
+	return Event{
+		Key:        "radius:acct:testuser:session123",
+		Consumer:   "testuser",
+		ReceivedAt: time.Unix(1, 0).UTC(),
+	}
+}
+
+func TestWebhookSink_Write(t *testing.T) {
+	tests := []struct {
+		name          string
+		statuses      []int
+		maxRetries    int
+		expectErr     bool
+		expectedCalls int32
+	}{
+		{
+			name:          "delivered first time",
+			statuses:      []int{http.StatusOK},
+			maxRetries:    3,
+			expectedCalls: 1,
+		},
+		{
+			name:          "retries server errors",
+			statuses:      []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusNoContent},
+			maxRetries:    3,
+			expectedCalls: 3,
+		},
+		{
+			name:          "gives up after max retries",
+			statuses:      []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError},
+			maxRetries:    2,
+			expectErr:     true,
+			expectedCalls: 3,
+		},
+		{
+			name:          "does not retry client errors",
+			statuses:      []int{http.StatusBadRequest},
+			maxRetries:    3,
+			expectErr:     true,
+			expectedCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&calls, 1)
+
+				var event Event
+				if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+					t.Errorf("Failed to decode webhook body: %v", err)
+				}
+				if event.Key != testEvent().Key {
+					t.Errorf("Expected key %s, got %s", testEvent().Key, event.Key)
+				}
+
+				w.WriteHeader(tt.statuses[n-1])
+			}))
+			defer server.Close()
+
+			sink := NewWebhookSink(server.URL, tt.maxRetries, time.Second)
+			sink.backoff = time.Millisecond
+
+			err := sink.Write(context.Background(), testEvent())
+			if tt.expectErr && err == nil {
+				t.Error("Expected delivery error, got nil")
+			}
+			if !tt.expectErr && err != nil {
+				t.Errorf("Unexpected delivery error: %v", err)
+			}
+			if calls != tt.expectedCalls {
+				t.Errorf("Expected %d webhook calls, got %d", tt.expectedCalls, calls)
+			}
+		})
+	}
+}
+
+func TestArchiveSink_Write(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive", "updates.csv")
+
+	for i := 0; i < 2; i++ {
+		sink, err := NewArchiveSink(path)
+		if err != nil {
+			t.Fatalf("NewArchiveSink returned error: %v", err)
+		}
+		if err := sink.Write(context.Background(), testEvent()); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+		sink.Close()
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+
+	expected := "received_at,consumer,key\n" +
+		"1970-01-01T00:00:01Z,testuser,radius:acct:testuser:session123\n" +
+		"1970-01-01T00:00:01Z,testuser,radius:acct:testuser:session123\n"
+	if string(content) != expected {
+		t.Errorf("Unexpected archive content:\n%s", content)
+	}
+}
+
+func TestStdoutSink_Write(t *testing.T) {
+	enriched := testEvent()
+	enriched.Record = &datastore.AccountingRecord{
+		Username:        "testuser",
+		NASIPAddress:    "192.168.1.1",
+		NASPort:         "1234",
+		AcctStatusType:  "2",
+		AcctSessionID:   "session123",
+		PacketType:      "Accounting-Request",
+		Timestamp:       "1",
+		AcctSessionTime: "3600",
+	}
+
+	tests := []struct {
+		name     string
+		event    Event
+		expected string
+	}{
+		{
+			name:     "plain event",
+			event:    testEvent(),
+			expected: `{"key":"radius:acct:testuser:session123","consumer":"testuser","received_at":"1970-01-01T00:00:01Z"}`,
+		},
+		{
+			name:  "enriched event",
+			event: enriched,
+			expected: `{"key":"radius:acct:testuser:session123","consumer":"testuser","received_at":"1970-01-01T00:00:01Z",` +
+				`"record":{"username":"testuser","nas_ip_address":"192.168.1.1","nas_port":"1234","acct_status_type":"2",` +
+				`"acct_session_id":"session123","framed_ip_address":"","calling_station_id":"","called_station_id":"",` +
+				`"packet_type":"Accounting-Request","timestamp":"1","acct_session_time":"3600"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			sink := newWriterSink(&buf)
+
+			if err := sink.Write(context.Background(), tt.event); err != nil {
+				t.Fatalf("Write returned error: %v", err)
+			}
+
+			if strings.TrimSpace(buf.String()) != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestNewSinks(t *testing.T) {
+	tempDir := t.TempDir()
+
+	cfg := &config.ConsumerConfig{
+		LogFile:     filepath.Join(tempDir, "updates.log"),
+		ArchiveFile: filepath.Join(tempDir, "updates.csv"),
+		Sinks:       []string{SinkFile, SinkArchive},
+	}
+
+	sink, err := NewSinks(cfg, nil)
+	if err != nil {
+		t.Fatalf("NewSinks returned error: %v", err)
+	}
+	defer sink.Close()
+
+	if err := sink.Write(context.Background(), testEvent()); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	for _, path := range []string{cfg.LogFile, cfg.ArchiveFile} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected %s to be written: %v", path, err)
+		}
+	}
+
+	cfg.Sinks = []string{SinkWebhook}
+	if _, err := NewSinks(cfg, nil); err == nil {
+		t.Error("Expected webhook sink without URL to be rejected")
+	}
+}
+
+func TestJSONFileSink_Enriched(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "updates.log")
+
+	store := datastore.NewMemoryStore()
+	store.Save(context.Background(), "radius:acct:testuser:session123", datastore.AccountingRecord{
+		Username:         "testuser",
+		NASIPAddress:     "192.168.1.1",
+		NASPort:          "1234",
+		AcctStatusType:   "2",
+		AcctSessionID:    "session123",
+		FramedIPAddress:  "10.0.0.1",
+		CallingStationID: "00:11:22:33:44:55",
+		CalledStationID:  "00:aa:bb:cc:dd:ee",
+		PacketType:       "Accounting-Request",
+		Timestamp:        "1",
+		AcctInputOctets:  "1024",
+		AcctOutputOctets: "2048",
+		AcctSessionTime:  "3600",
+	}, time.Hour)
+
+	sink := NewEnrichingSink(store, NewJSONFileSink(path, RotationPolicy{}, time.Hour))
+
+	expired := testEvent()
+	expired.Key = "radius:acct:testuser:expired"
+
+	for _, event := range []Event{testEvent(), expired} {
+		if err := sink.Write(context.Background(), event); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+	}
+
+	// Nothing reaches the file before a flush
+	if content, _ := os.ReadFile(path); len(content) != 0 {
+		t.Errorf("Expected buffered writes, file already has %q", content)
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	expected := []string{
+		`{"time":"1970-01-01T00:00:01Z","consumer":"testuser","key":"radius:acct:testuser:session123","user":"testuser","session":"session123","status":"Stop","nas_ip_address":"192.168.1.1","nas_port":1234,"framed_ip_address":"10.0.0.1","calling_station_id":"00:11:22:33:44:55","called_station_id":"00:aa:bb:cc:dd:ee","input_octets":1024,"output_octets":2048,"session_time":3600,"event_time":1}`,
+		`{"time":"1970-01-01T00:00:01Z","consumer":"testuser","key":"radius:acct:testuser:expired"}`,
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %d: %s", len(expected), len(lines), content)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("Line %d:\nexpected %s\ngot      %s", i, expected[i], lines[i])
+		}
+	}
+}
+
+func TestJSONFileSink_RotatesBetweenLines(t *testing.T) {
+	timecop.Travel(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), timecop.Freeze)
+
+	path := filepath.Join(t.TempDir(), "updates.log")
+	// Much smaller than the write buffer, so every flush of a batch rotates the file
+	sink := NewJSONFileSink(path, RotationPolicy{MaxSize: 1000}, time.Hour)
+
+	const events = 200
+	for i := 0; i < events; i++ {
+		event := testEvent()
+		event.Key = fmt.Sprintf("radius:acct:testuser:session%d", i)
+		if err := sink.Write(context.Background(), event); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+		// distinct rotation timestamps
+		timecop.Travel(t, time.Second, timecop.Freeze)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) < 2 {
+		t.Fatalf("Expected the log to rotate several times, got %v", rotated)
+	}
+
+	keys := make(map[string]bool)
+	for _, name := range append(rotated, path) {
+		content, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Failed to read log file: %v", err)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+			var entry jsonLogEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("%s holds a partial line %q: %v", name, line, err)
+			}
+			keys[entry.Key] = true
+		}
+	}
+	if len(keys) != events {
+		t.Errorf("Expected %d events across all files, got %d", events, len(keys))
+	}
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// RadiusClient is a NAS allowed to send requests, identified by its address or network
+type RadiusClient struct {
+	Network *net.IPNet
+	Secret  string
+}
+
+// ParseRadiusClients parses "address=secret,address=secret,..." where address is an IP
+// or a CIDR network. Every malformed entry is reported.
+func ParseRadiusClients(value string) ([]RadiusClient, error) {
+	var clients []RadiusClient
+	var problems []string
+	for i, entry := range SplitList(value) {
+		address, secret, ok := strings.Cut(entry, "=")
+		address, secret = strings.TrimSpace(address), strings.TrimSpace(secret)
+		if !ok || secret == "" {
+			problems = append(problems, fmt.Sprintf("client %d is not address=secret", i+1))
+			continue
+		}
+		network, err := parseClientAddress(address)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("client %d: %v", i+1, err))
+			continue
+		}
+		clients = append(clients, RadiusClient{Network: network, Secret: secret})
+	}
+	if len(problems) > 0 {
+		return clients, errors.New(strings.Join(problems, ", "))
+	}
+	return clients, nil
+}
+
+// parseClientAddress accepts a CIDR network or a single IP, which becomes a /32 or /128
+func parseClientAddress(address string) (*net.IPNet, error) {
+	if strings.Contains(address, "/") {
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR network", address)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address or CIDR network", address)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
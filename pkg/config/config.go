@@ -1,187 +1,719 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+
+	"dni/pkg/stream"
 )
 
 // Config holds all configuration values loaded from environment variables
 type Config struct {
 	// Redis configuration
-	RedisHost     string
-	RedisPort     int
-	RedisPassword string
-	RedisDB       int
+	RedisConfig
+
+	// Datastore configuration
+	DatastoreConfig
+	FanoutConfig
+
+	// Stream backend configuration
+	StreamBackendConfig
+
+	// Webhook notifications
+	WebhookConfig
 
 	// RADIUS server configuration
 	AuthPort string
 	AcctPort string
 	Secret   string
+	// RadiusClients have their own shared secret, when set other clients are ignored
+	RadiusClients []RadiusClient
 
 	// Data retention configuration
 	AccountingTTL time.Duration
 
+	// RequestTimeout bounds the datastore and stream calls made per RADIUS request
+	RequestTimeout time.Duration
+
+	// ShutdownTimeout is how long requests in flight may take to finish on shutdown
+	ShutdownTimeout time.Duration
+
+	// Stream topology configuration
+	StreamTopology   string
+	StreamPartitions int
+
+	// Stream retention configuration
+	StreamMaxLen          int64
+	StreamMaxAge          time.Duration
+	StreamIdleTTL         time.Duration
+	StreamJanitorInterval time.Duration
+
 	// Server configuration
 	ServerHost string
 
+	// MetricsAddr is the listen address of the metrics server, empty disables it
+	MetricsAddr string
+
 	// User credentials for authentication
 	UserCredentials map[string]string
 }
 
 // LoadConfig reads environment variables and returns a populated Config struct
 func LoadConfig() (*Config, error) {
+	return LoadConfigFrom(os.LookupEnv)
+}
+
+// LoadConfigFrom builds a Config from lookup, which lets flags and config files
+// layer over the environment
+func LoadConfigFrom(lookup Lookup) (*Config, error) {
+	var errs errorList
+
+	// Secrets read from files
+	lookup = loadSecrets(lookup, &errs)
+	getenv := func(key string) string {
+		value, _ := lookup(key)
+		return value
+	}
+
 	config := &Config{
 		// Default values
-		RedisHost:     "localhost",
-		RedisPort:     6379,
-		RedisPassword: "",
-		RedisDB:       0,
-		AuthPort:      ":1812",
-		AcctPort:      ":1813",
-		Secret:        "testing123",
-		AccountingTTL: 10 * time.Minute,
-		ServerHost:    "",
+		RedisConfig:     defaultRedisConfig(),
+		DatastoreConfig: defaultDatastoreConfig(),
+		FanoutConfig:    defaultFanoutConfig(),
+		AuthPort:        ":1812",
+		AcctPort:        ":1813",
+		Secret:          "testing123",
+		AccountingTTL:   10 * time.Minute,
+		RequestTimeout:  2 * time.Second,
+		ShutdownTimeout: 10 * time.Second,
+		ServerHost:      "",
+
+		StreamTopology:   stream.TopologyPerUser,
+		StreamPartitions: 16,
+
+		StreamMaxLen:          10000,
+		StreamMaxAge:          0,
+		StreamIdleTTL:         24 * time.Hour,
+		StreamJanitorInterval: time.Minute,
+
+		StreamBackendConfig: defaultStreamBackendConfig(),
+		WebhookConfig:       defaultWebhookConfig(),
 	}
 
-	// Redis Host
-	if host := os.Getenv("REDIS_HOST"); host != "" {
-		config.RedisHost = host
+	// Redis connection
+	loadRedisConfig(getenv, &config.RedisConfig, &errs)
+
+	// Datastore backend
+	loadDatastoreConfig(getenv, &config.DatastoreConfig, &errs)
+
+	// Secondary datastores
+	loadFanoutConfig(getenv, config.DatastoreConfig, &config.FanoutConfig, &errs)
+
+	// Stream backend
+	loadStreamBackendConfig(getenv, &config.StreamBackendConfig, &errs)
+
+	// Webhook notifications
+	loadWebhookConfig(getenv, &config.WebhookConfig, &errs)
+
+	// Auth Port
+	if port := getenv("AUTH_PORT"); port != "" {
+		if _, _, err := net.SplitHostPort(port); err != nil {
+			errs.addf("AUTH_PORT", "invalid AUTH_PORT: %s (expected host:port or :port)", port)
+		} else {
+			config.AuthPort = port
+		}
 	}
 
-	// Redis Port
-	if portStr := os.Getenv("REDIS_PORT"); portStr != "" {
-		port, err := strconv.Atoi(portStr)
-		if err != nil {
-			return nil, fmt.Errorf("invalid REDIS_PORT: %v", err)
+	// Accounting Port
+	if port := getenv("ACCT_PORT"); port != "" {
+		if _, _, err := net.SplitHostPort(port); err != nil {
+			errs.addf("ACCT_PORT", "invalid ACCT_PORT: %s (expected host:port or :port)", port)
+		} else {
+			config.AcctPort = port
 		}
-		config.RedisPort = port
 	}
 
-	// Redis Password
-	if password := os.Getenv("REDIS_PASSWORD"); password != "" {
-		config.RedisPassword = password
+	// RADIUS Secret
+	if secret := getenv("RADIUS_SECRET"); secret != "" {
+		config.Secret = secret
 	}
 
-	// Redis DB
-	if dbStr := os.Getenv("REDIS_DB"); dbStr != "" {
-		db, err := strconv.Atoi(dbStr)
+	// Accounting TTL
+	if ttlStr := getenv("ACCOUNTING_TTL_MINUTES"); ttlStr != "" {
+		ttlMinutes, err := strconv.Atoi(ttlStr)
 		if err != nil {
-			return nil, fmt.Errorf("invalid REDIS_DB: %v", err)
+			errs.addf("ACCOUNTING_TTL_MINUTES", "invalid ACCOUNTING_TTL_MINUTES: %v", err)
+		} else {
+			config.AccountingTTL = time.Duration(ttlMinutes) * time.Minute
 		}
-		config.RedisDB = db
 	}
 
-	// Auth Port
-	if port := os.Getenv("AUTH_PORT"); port != "" {
-		config.AuthPort = port
+	// Per-request timeout
+	if timeoutStr := getenv("REQUEST_TIMEOUT_MS"); timeoutStr != "" {
+		timeoutMs, err := strconv.Atoi(timeoutStr)
+		if err != nil || timeoutMs <= 0 {
+			errs.addf("REQUEST_TIMEOUT_MS", "invalid REQUEST_TIMEOUT_MS: %s", timeoutStr)
+		} else {
+			config.RequestTimeout = time.Duration(timeoutMs) * time.Millisecond
+		}
 	}
 
-	// Accounting Port
-	if port := os.Getenv("ACCT_PORT"); port != "" {
-		config.AcctPort = port
+	// Shutdown deadline
+	if timeoutStr := getenv("SHUTDOWN_TIMEOUT_SECONDS"); timeoutStr != "" {
+		timeoutSeconds, err := strconv.Atoi(timeoutStr)
+		if err != nil || timeoutSeconds <= 0 {
+			errs.addf("SHUTDOWN_TIMEOUT_SECONDS", "invalid SHUTDOWN_TIMEOUT_SECONDS: %s", timeoutStr)
+		} else {
+			config.ShutdownTimeout = time.Duration(timeoutSeconds) * time.Second
+		}
 	}
 
-	// RADIUS Secret
-	if secret := os.Getenv("RADIUS_SECRET"); secret != "" {
-		config.Secret = secret
+	// Stream topology
+	loadStreamTopology(getenv, &config.StreamTopology, &config.StreamPartitions, &errs)
+
+	// Stream max length (0 disables length trimming)
+	if maxLenStr := getenv("STREAM_MAX_LEN"); maxLenStr != "" {
+		maxLen, err := strconv.ParseInt(maxLenStr, 10, 64)
+		if err != nil {
+			errs.addf("STREAM_MAX_LEN", "invalid STREAM_MAX_LEN: %v", err)
+		} else {
+			config.StreamMaxLen = maxLen
+		}
 	}
 
-	// Accounting TTL
-	if ttlStr := os.Getenv("ACCOUNTING_TTL_MINUTES"); ttlStr != "" {
-		ttlMinutes, err := strconv.Atoi(ttlStr)
+	// Stream max age (0 disables age trimming)
+	if ageStr := getenv("STREAM_MAX_AGE_MINUTES"); ageStr != "" {
+		ageMinutes, err := strconv.Atoi(ageStr)
+		if err != nil {
+			errs.addf("STREAM_MAX_AGE_MINUTES", "invalid STREAM_MAX_AGE_MINUTES: %v", err)
+		} else {
+			config.StreamMaxAge = time.Duration(ageMinutes) * time.Minute
+		}
+	}
+
+	// Stream idle TTL (0 never deletes idle streams)
+	if idleStr := getenv("STREAM_IDLE_TTL_MINUTES"); idleStr != "" {
+		idleMinutes, err := strconv.Atoi(idleStr)
 		if err != nil {
-			return nil, fmt.Errorf("invalid ACCOUNTING_TTL_MINUTES: %v", err)
+			errs.addf("STREAM_IDLE_TTL_MINUTES", "invalid STREAM_IDLE_TTL_MINUTES: %v", err)
+		} else {
+			config.StreamIdleTTL = time.Duration(idleMinutes) * time.Minute
+		}
+	}
+
+	// Stream janitor interval
+	if intervalStr := getenv("STREAM_JANITOR_INTERVAL_SECONDS"); intervalStr != "" {
+		intervalSeconds, err := strconv.Atoi(intervalStr)
+		if err != nil || intervalSeconds <= 0 {
+			errs.addf("STREAM_JANITOR_INTERVAL_SECONDS", "invalid STREAM_JANITOR_INTERVAL_SECONDS: %s", intervalStr)
+		} else {
+			config.StreamJanitorInterval = time.Duration(intervalSeconds) * time.Second
 		}
-		config.AccountingTTL = time.Duration(ttlMinutes) * time.Minute
 	}
 
 	// Server Host
-	if host := os.Getenv("SERVER_HOST"); host != "" {
+	if host := getenv("SERVER_HOST"); host != "" {
 		config.ServerHost = host
 	}
 
-	// Load user credentials from environment variables
-	config.UserCredentials = make(map[string]string)
+	// Metrics server
+	config.MetricsAddr = getenv("METRICS_ADDR")
+
+	// RADIUS clients with their own shared secret
+	clients, err := ParseRadiusClients(getenv("RADIUS_CLIENTS"))
+	if err != nil {
+		errs.addf("RADIUS_CLIENTS", "invalid RADIUS_CLIENTS: %v", err)
+	}
+	config.RadiusClients = clients
 
 	// Load user credentials in format "username:password,username:password,..."
-	if credentialsStr := os.Getenv("USER_CREDENTIALS"); credentialsStr != "" {
-		pairs := strings.Split(credentialsStr, ",")
-		for _, pair := range pairs {
-			pair = strings.TrimSpace(pair)
-			if pair == "" {
-				continue
-			}
-			parts := strings.SplitN(pair, ":", 2)
-			if len(parts) == 2 {
-				username := strings.TrimSpace(parts[0])
-				password := strings.TrimSpace(parts[1])
-				if username != "" && password != "" {
-					config.UserCredentials[username] = password
-				}
-			}
-		}
+	credentials, err := ParseUserCredentials(getenv("USER_CREDENTIALS"))
+	if err != nil {
+		errs.addf("USER_CREDENTIALS", "invalid USER_CREDENTIALS: %v", err)
 	}
+	config.UserCredentials = credentials
 
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
 
+// ParseUserCredentials parses "username:password,username:password,..." into a map.
+// Every malformed or repeated pair is reported.
+func ParseUserCredentials(value string) (map[string]string, error) {
+	credentials := make(map[string]string)
+	var problems []string
+	for i, pair := range SplitList(value) {
+		username, password, ok := strings.Cut(pair, ":")
+		username, password = strings.TrimSpace(username), strings.TrimSpace(password)
+		switch {
+		case !ok || username == "" || password == "":
+			problems = append(problems, fmt.Sprintf("pair %d is not username:password", i+1))
+		case credentials[username] != "":
+			problems = append(problems, fmt.Sprintf("user %s is listed twice", username))
+		default:
+			credentials[username] = password
+		}
+	}
+	if len(problems) > 0 {
+		return credentials, errors.New(strings.Join(problems, ", "))
+	}
+	return credentials, nil
+}
+
+const (
+	// LogFormatText writes a timestamped line per event
+	LogFormatText = "text"
+	// LogFormatJSON writes one JSON object per event
+	LogFormatJSON = "json"
+)
+
 // ConsumerConfig holds all configuration values for the Redis consumer
 type ConsumerConfig struct {
 	// Redis configuration
-	RedisHost string
-	RedisPort int
+	RedisConfig
+
+	// Datastore configuration, used to enrich events with their accounting record
+	DatastoreConfig
+
+	// Stream backend configuration
+	StreamBackendConfig
 
 	// Consumer configuration
-	Username string
-	LogFile  string
+	Username  string
+	LogFile   string
+	LogFormat string
+
+	// Log rotation, zero values disable size or time based rotation and retention
+	LogMaxSize        int64
+	LogRotateInterval time.Duration
+	LogKeep           int
+	LogCompress       bool
+
+	// EnrichEvents loads the full accounting record for every event
+	EnrichEvents bool
+
+	// Sink configuration, Sinks lists the enabled outputs (file, stdout, webhook, archive)
+	Sinks             []string
+	WebhookURL        string
+	WebhookMaxRetries int
+	WebhookTimeout    time.Duration
+	ArchiveFile       string
+
+	// Multi-user subscriptions: per-user streams for every name in Usernames plus
+	// any stream matching StreamPattern, rediscovered every DiscoveryInterval
+	Usernames         []string
+	StreamPattern     string
+	DiscoveryInterval time.Duration
+
+	// Topology configuration, partitioned consumers read the partitions listed
+	// in ConsumerPartitions and optionally only keep events for UsernameFilter
+	StreamTopology     string
+	StreamPartitions   int
+	ConsumerPartitions []int
+	UsernameFilter     []string
 
 	// Stream configuration
-	StreamKey     string
+	StreamKeys    []string
 	ConsumerGroup string
 	ConsumerName  string
+
+	// StartID is where a newly created consumer group starts reading
+	StartID string
+
+	// HealthAddr is the listen address of the health and metrics server, empty disables it
+	HealthAddr string
+
+	// Processing configuration, messages of one user are always handled by the same worker
+	Workers      int
+	MaxInFlight  int
+	BatchSize    int64
+	BlockTimeout time.Duration
+	// ClaimIdle is how long a delivered event stays unacknowledged before it is delivered again
+	ClaimIdle time.Duration
+
+	// Replay mode re-reads [ReplayFrom, ReplayTo] without moving the group offset
+	ReplayFrom string
+	ReplayTo   string
 }
 
 // LoadConsumerConfig reads environment variables and returns a populated ConsumerConfig struct
 func LoadConsumerConfig() (*ConsumerConfig, error) {
+	return LoadConsumerConfigFrom(os.LookupEnv)
+}
+
+// LoadConsumerConfigFrom builds a ConsumerConfig from settings named like the environment
+// variables, so command line flags and config files can be layered with Layered
+func LoadConsumerConfigFrom(lookup Lookup) (*ConsumerConfig, error) {
+	var errs errorList
+
+	// Secrets read from files
+	lookup = loadSecrets(lookup, &errs)
+	getenv := func(key string) string {
+		value, _ := lookup(key)
+		return value
+	}
+
 	config := &ConsumerConfig{
 		// Default values
-		RedisHost: "localhost",
-		RedisPort: 6379,
-		LogFile:   "/var/log/radius_updates.log",
+		RedisConfig:       defaultRedisConfig(),
+		DatastoreConfig:   defaultDatastoreConfig(),
+		LogFile:           "/var/log/radius_updates.log",
+		LogFormat:         LogFormatText,
+		Sinks:             []string{"file"},
+		WebhookMaxRetries: 3,
+		WebhookTimeout:    5 * time.Second,
+		ArchiveFile:       "/var/log/radius_updates.csv",
+		StreamTopology:    stream.TopologyPerUser,
+		StreamPartitions:  16,
+		DiscoveryInterval: 30 * time.Second,
+		StartID:           "$",
+		Workers:           4,
+		MaxInFlight:       100,
+		BatchSize:         100,
+		BlockTimeout:      5 * time.Second,
+		ClaimIdle:         stream.DefaultClaimIdle,
+		ReplayTo:          "+",
+
+		StreamBackendConfig: defaultStreamBackendConfig(),
 	}
 
-	// Redis Host
-	if host := os.Getenv("REDIS_HOST"); host != "" {
-		config.RedisHost = host
+	// Redis connection
+	loadRedisConfig(getenv, &config.RedisConfig, &errs)
+
+	// Datastore backend
+	loadDatastoreConfig(getenv, &config.DatastoreConfig, &errs)
+	if config.DatastoreBackend == DatastoreMemory {
+		errs.addf("DATASTORE_BACKEND", "DATASTORE_BACKEND=%s only lives inside the API process, consumers cannot read it", DatastoreMemory)
 	}
 
-	// Redis Port
-	if portStr := os.Getenv("REDIS_PORT"); portStr != "" {
-		port, err := strconv.Atoi(portStr)
-		if err != nil {
-			return nil, fmt.Errorf("invalid REDIS_PORT: %v", err)
+	// Stream backend
+	loadStreamBackendConfig(getenv, &config.StreamBackendConfig, &errs)
+
+	// Stream topology
+	loadStreamTopology(getenv, &config.StreamTopology, &config.StreamPartitions, &errs)
+
+	// Additional users and stream pattern for multi-user consumers
+	config.Usernames = SplitList(getenv("USERNAMES"))
+	config.StreamPattern = getenv("STREAM_PATTERN")
+
+	if intervalStr := getenv("STREAM_DISCOVERY_INTERVAL_SECONDS"); intervalStr != "" {
+		intervalSeconds, err := strconv.Atoi(intervalStr)
+		if err != nil || intervalSeconds <= 0 {
+			errs.addf("STREAM_DISCOVERY_INTERVAL_SECONDS", "invalid STREAM_DISCOVERY_INTERVAL_SECONDS: %s", intervalStr)
+		} else {
+			config.DiscoveryInterval = time.Duration(intervalSeconds) * time.Second
 		}
-		config.RedisPort = port
 	}
 
-	// Username (required)
-	config.Username = os.Getenv("USERNAME")
-	if config.Username == "" {
-		return nil, fmt.Errorf("USERNAME environment variable is required")
+	// Explicit stream keys replace the ones derived from usernames or partitions
+	explicitKeys := SplitList(getenv("STREAM_KEYS"))
+
+	// Username (required for per-user topology unless other subscriptions are given)
+	config.Username = getenv("USERNAME")
+	if config.Username == "" && config.StreamTopology == stream.TopologyPerUser &&
+		len(config.Usernames) == 0 && config.StreamPattern == "" && len(explicitKeys) == 0 {
+		errs.addf("USERNAME", "USERNAME is required (set it with -username or the USERNAME environment variable)")
+	}
+
+	// Partitions to consume, defaults to all of them
+	partitions, err := ParsePartitions(getenv("CONSUMER_PARTITIONS"), config.StreamPartitions)
+	if err != nil {
+		errs.addf("CONSUMER_PARTITIONS", "invalid CONSUMER_PARTITIONS: %v", err)
+	} else {
+		config.ConsumerPartitions = partitions
 	}
 
+	// Username filter for partitioned consumers
+	config.UsernameFilter = SplitList(getenv("USERNAME_FILTER"))
+
 	// Log File
-	if logFile := os.Getenv("LOG_FILE"); logFile != "" {
+	if logFile := getenv("LOG_FILE"); logFile != "" {
 		config.LogFile = logFile
 	}
 
-	// Generate stream-related configuration based on username
-	config.StreamKey = fmt.Sprintf("radius:updates:%s", config.Username)
-	config.ConsumerGroup = fmt.Sprintf("consumer-group-%s", config.Username)
-	config.ConsumerName = fmt.Sprintf("consumer-%s-%d", config.Username, os.Getpid())
+	// Log rotation
+	if sizeStr := getenv("LOG_MAX_SIZE_MB"); sizeStr != "" {
+		sizeMB, err := strconv.Atoi(sizeStr)
+		if err != nil || sizeMB < 0 {
+			errs.addf("LOG_MAX_SIZE_MB", "invalid LOG_MAX_SIZE_MB: %s", sizeStr)
+		} else {
+			config.LogMaxSize = int64(sizeMB) * 1024 * 1024
+		}
+	}
+	if intervalStr := getenv("LOG_ROTATE_INTERVAL_MINUTES"); intervalStr != "" {
+		intervalMinutes, err := strconv.Atoi(intervalStr)
+		if err != nil || intervalMinutes < 0 {
+			errs.addf("LOG_ROTATE_INTERVAL_MINUTES", "invalid LOG_ROTATE_INTERVAL_MINUTES: %s", intervalStr)
+		} else {
+			config.LogRotateInterval = time.Duration(intervalMinutes) * time.Minute
+		}
+	}
+	if keepStr := getenv("LOG_KEEP"); keepStr != "" {
+		keep, err := strconv.Atoi(keepStr)
+		if err != nil || keep < 0 {
+			errs.addf("LOG_KEEP", "invalid LOG_KEEP: %s", keepStr)
+		} else {
+			config.LogKeep = keep
+		}
+	}
+	if compressStr := getenv("LOG_COMPRESS"); compressStr != "" {
+		compress, err := strconv.ParseBool(compressStr)
+		if err != nil {
+			errs.addf("LOG_COMPRESS", "invalid LOG_COMPRESS: %v", err)
+		} else {
+			config.LogCompress = compress
+		}
+	}
+
+	// Log format, JSON logs are enriched with the accounting record unless disabled
+	if format := getenv("LOG_FORMAT"); format != "" {
+		if format != LogFormatText && format != LogFormatJSON {
+			errs.addf("LOG_FORMAT", "invalid LOG_FORMAT: %s (expected %s or %s)", format, LogFormatText, LogFormatJSON)
+		} else {
+			config.LogFormat = format
+		}
+	}
+	config.EnrichEvents = config.LogFormat == LogFormatJSON
+	if enrichStr := getenv("ENRICH_EVENTS"); enrichStr != "" {
+		enrich, err := strconv.ParseBool(enrichStr)
+		if err != nil {
+			errs.addf("ENRICH_EVENTS", "invalid ENRICH_EVENTS: %v", err)
+		} else {
+			config.EnrichEvents = enrich
+		}
+	}
+
+	// Sinks
+	if sinks := SplitList(getenv("SINKS")); len(sinks) > 0 {
+		config.Sinks = sinks
+	}
+	config.WebhookURL = getenv("WEBHOOK_URL")
+	if retriesStr := getenv("WEBHOOK_MAX_RETRIES"); retriesStr != "" {
+		retries, err := strconv.Atoi(retriesStr)
+		if err != nil || retries < 0 {
+			errs.addf("WEBHOOK_MAX_RETRIES", "invalid WEBHOOK_MAX_RETRIES: %s", retriesStr)
+		} else {
+			config.WebhookMaxRetries = retries
+		}
+	}
+	if timeoutStr := getenv("WEBHOOK_TIMEOUT_SECONDS"); timeoutStr != "" {
+		timeoutSeconds, err := strconv.Atoi(timeoutStr)
+		if err != nil || timeoutSeconds <= 0 {
+			errs.addf("WEBHOOK_TIMEOUT_SECONDS", "invalid WEBHOOK_TIMEOUT_SECONDS: %s", timeoutStr)
+		} else {
+			config.WebhookTimeout = time.Duration(timeoutSeconds) * time.Second
+		}
+	}
+	if archiveFile := getenv("ARCHIVE_FILE"); archiveFile != "" {
+		config.ArchiveFile = archiveFile
+	}
+
+	// Health and metrics server
+	config.HealthAddr = getenv("HEALTH_ADDR")
+
+	// Worker pool and read sizing
+	if workersStr := getenv("WORKERS"); workersStr != "" {
+		workers, err := strconv.Atoi(workersStr)
+		if err != nil || workers <= 0 {
+			errs.addf("WORKERS", "invalid WORKERS: %s", workersStr)
+		} else {
+			config.Workers = workers
+		}
+	}
+	if inFlightStr := getenv("MAX_IN_FLIGHT"); inFlightStr != "" {
+		inFlight, err := strconv.Atoi(inFlightStr)
+		if err != nil || inFlight <= 0 {
+			errs.addf("MAX_IN_FLIGHT", "invalid MAX_IN_FLIGHT: %s", inFlightStr)
+		} else {
+			config.MaxInFlight = inFlight
+		}
+	}
+	if batchStr := getenv("BATCH_SIZE"); batchStr != "" {
+		batch, err := strconv.ParseInt(batchStr, 10, 64)
+		if err != nil || batch <= 0 {
+			errs.addf("BATCH_SIZE", "invalid BATCH_SIZE: %s", batchStr)
+		} else {
+			config.BatchSize = batch
+		}
+	}
+	if blockStr := getenv("BLOCK_TIMEOUT_MS"); blockStr != "" {
+		blockMs, err := strconv.Atoi(blockStr)
+		if err != nil || blockMs <= 0 {
+			errs.addf("BLOCK_TIMEOUT_MS", "invalid BLOCK_TIMEOUT_MS: %s", blockStr)
+		} else {
+			config.BlockTimeout = time.Duration(blockMs) * time.Millisecond
+		}
+	}
+	if claimStr := getenv("CLAIM_IDLE_SECONDS"); claimStr != "" {
+		claimSeconds, err := strconv.Atoi(claimStr)
+		if err != nil || claimSeconds <= 0 {
+			errs.addf("CLAIM_IDLE_SECONDS", "invalid CLAIM_IDLE_SECONDS: %s", claimStr)
+		} else {
+			config.ClaimIdle = time.Duration(claimSeconds) * time.Second
+		}
+	}
+
+	// Consumer group start position, XGROUP CREATE rejects the range bounds - and +
+	if startID := getenv("CONSUMER_START_ID"); startID != "" {
+		id, err := stream.ParsePosition(startID)
+		switch {
+		case err != nil:
+			errs.addf("CONSUMER_START_ID", "invalid CONSUMER_START_ID: %v", err)
+		case id == "-" || id == "+":
+			errs.addf("CONSUMER_START_ID", "invalid CONSUMER_START_ID: %s only bounds a replay, use 0 to start from the full history", startID)
+		default:
+			config.StartID = id
+		}
+	}
+
+	// Replay range
+	if from := getenv("REPLAY_FROM"); from != "" {
+		id, err := stream.ParsePosition(from)
+		if err != nil {
+			errs.addf("REPLAY_FROM", "invalid REPLAY_FROM: %v", err)
+		} else {
+			config.ReplayFrom = id
+		}
+	}
+	if to := getenv("REPLAY_TO"); to != "" {
+		id, err := stream.ParsePosition(to)
+		if err != nil {
+			errs.addf("REPLAY_TO", "invalid REPLAY_TO: %v", err)
+		} else {
+			config.ReplayTo = id
+		}
+	}
 
+	// Generate stream-related configuration based on username or partitions
+	if len(explicitKeys) > 0 {
+		config.StreamKeys = explicitKeys
+	} else {
+		config.ResolveStreamKeys()
+	}
+	name := config.identity()
+	config.ConsumerGroup = fmt.Sprintf("consumer-group-%s", name)
+	if group := getenv("CONSUMER_GROUP"); group != "" {
+		config.ConsumerGroup = group
+	}
+	config.ConsumerName = fmt.Sprintf("consumer-%s-%d", name, os.Getpid())
+	if consumerName := getenv("CONSUMER_NAME"); consumerName != "" {
+		config.ConsumerName = consumerName
+	}
+
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
+
+// ResolveStreamKeys derives the static stream keys to read from the usernames or the consumed partitions.
+// Streams matching StreamPattern are discovered at runtime by the consumer.
+func (c *ConsumerConfig) ResolveStreamKeys() {
+	if c.StreamTopology == stream.TopologyPartitioned {
+		c.StreamKeys = make([]string, 0, len(c.ConsumerPartitions))
+		for _, p := range c.ConsumerPartitions {
+			c.StreamKeys = append(c.StreamKeys, stream.PartitionStreamKey(p))
+		}
+		return
+	}
+
+	c.StreamKeys = nil
+	for _, username := range c.allUsernames() {
+		c.StreamKeys = append(c.StreamKeys, stream.PerUserTopology{HashTag: c.HashTagKeys()}.StreamKey(username))
+	}
+}
+
+// allUsernames returns Username followed by Usernames without duplicates
+func (c *ConsumerConfig) allUsernames() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range append([]string{c.Username}, c.Usernames...) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// identity names the default consumer group and consumer for this subscription
+func (c *ConsumerConfig) identity() string {
+	if c.StreamTopology == stream.TopologyPartitioned {
+		// Filtered consumers need their own group so they don't steal each other's events
+		if len(c.UsernameFilter) > 0 {
+			return strings.Join(c.UsernameFilter, "-")
+		}
+		return "partitioned"
+	}
+
+	if c.StreamPattern != "" {
+		return c.StreamPattern
+	}
+	if names := c.allUsernames(); len(names) > 0 {
+		return strings.Join(names, "-")
+	}
+	return strings.Join(c.StreamKeys, "-")
+}
+
+// ParsePartitions parses "all" or a comma separated list of partition indexes
+func ParsePartitions(value string, partitions int) ([]int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "all" {
+		all := make([]int, partitions)
+		for i := range all {
+			all[i] = i
+		}
+		return all, nil
+	}
+
+	var result []int
+	for _, item := range SplitList(value) {
+		p, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid partition %q: %v", item, err)
+		}
+		if p < 0 || p >= partitions {
+			return nil, fmt.Errorf("partition %d out of range [0, %d)", p, partitions)
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+// loadStreamTopology reads STREAM_TOPOLOGY and STREAM_PARTITIONS
+func loadStreamTopology(getenv func(string) string, topology *string, partitions *int, errs *errorList) {
+	if t := getenv("STREAM_TOPOLOGY"); t != "" {
+		if t != stream.TopologyPerUser && t != stream.TopologyPartitioned {
+			errs.addf("STREAM_TOPOLOGY", "invalid STREAM_TOPOLOGY: %s (expected %s or %s)", t, stream.TopologyPerUser, stream.TopologyPartitioned)
+		} else {
+			*topology = t
+		}
+	}
+
+	if partitionsStr := getenv("STREAM_PARTITIONS"); partitionsStr != "" {
+		p, err := strconv.Atoi(partitionsStr)
+		if err != nil || p <= 0 {
+			errs.addf("STREAM_PARTITIONS", "invalid STREAM_PARTITIONS: %s", partitionsStr)
+		} else {
+			*partitions = p
+		}
+	}
+}
+
+// SplitList splits a comma separated value, dropping empty entries
+func SplitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,441 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConsumerConfigFrom_Precedence(t *testing.T) {
+	flags := map[string]string{
+		"USERNAME":       "flag-user",
+		"BATCH_SIZE":     "50",
+		"REDIS_PASSWORD": "",
+	}
+	env := map[string]string{
+		"USERNAME":       "env-user",
+		"REDIS_HOST":     "env-redis",
+		"BATCH_SIZE":     "",
+		"REDIS_PASSWORD": "env-secret",
+	}
+	file := map[string]string{
+		"REDIS_HOST":     "file-redis",
+		"REDIS_DB":       "3",
+		"BATCH_SIZE":     "25",
+		"REDIS_PASSWORD": "file-secret",
+	}
+
+	cfg, err := LoadConsumerConfigFrom(Overrides(flags, Layered(MapLookup(env), MapLookup(file))))
+	if err != nil {
+		t.Fatalf("LoadConsumerConfigFrom returned error: %v", err)
+	}
+
+	if cfg.Username != "flag-user" {
+		t.Errorf("Expected flag to win for USERNAME, got %s", cfg.Username)
+	}
+	if cfg.RedisHost != "env-redis" {
+		t.Errorf("Expected env to win over file for REDIS_HOST, got %s", cfg.RedisHost)
+	}
+	if cfg.RedisDB != 3 {
+		t.Errorf("Expected REDIS_DB from file, got %d", cfg.RedisDB)
+	}
+	if cfg.BatchSize != 50 {
+		t.Errorf("Expected BATCH_SIZE 50, got %d", cfg.BatchSize)
+	}
+	if cfg.RedisPassword != "" {
+		t.Errorf("Expected the empty flag to clear REDIS_PASSWORD, got %s", cfg.RedisPassword)
+	}
+	if !reflect.DeepEqual(cfg.StreamKeys, []string{"radius:updates:flag-user"}) {
+		t.Errorf("Expected stream key derived from flag username, got %v", cfg.StreamKeys)
+	}
+	if cfg.ConsumerGroup != "consumer-group-flag-user" {
+		t.Errorf("Expected default consumer group, got %s", cfg.ConsumerGroup)
+	}
+}
+
+func TestLoadConsumerConfigFrom_Subscriptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		values        map[string]string
+		expectErr     bool
+		expectedKeys  []string
+		expectedGroup string
+		expectedName  string
+	}{
+		{
+			name:      "username required",
+			values:    map[string]string{},
+			expectErr: true,
+		},
+		{
+			name: "explicit stream keys",
+			values: map[string]string{
+				"STREAM_KEYS": "radius:updates:a, radius:updates:b",
+			},
+			expectedKeys:  []string{"radius:updates:a", "radius:updates:b"},
+			expectedGroup: "consumer-group-radius:updates:a-radius:updates:b",
+		},
+		{
+			name: "hash tagged stream keys in cluster mode",
+			values: map[string]string{
+				"USERNAME":   "testuser",
+				"REDIS_MODE": "cluster",
+			},
+			expectedKeys:  []string{"radius:updates:{testuser}"},
+			expectedGroup: "consumer-group-testuser",
+		},
+		{
+			name: "sentinel requires a master name",
+			values: map[string]string{
+				"USERNAME":   "testuser",
+				"REDIS_MODE": "sentinel",
+			},
+			expectErr: true,
+		},
+		{
+			name: "group and name from settings",
+			values: map[string]string{
+				"USERNAME":       "testuser",
+				"CONSUMER_GROUP": "my-group",
+				"CONSUMER_NAME":  "my-consumer",
+			},
+			expectedKeys:  []string{"radius:updates:testuser"},
+			expectedGroup: "my-group",
+			expectedName:  "my-consumer",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConsumerConfigFrom(MapLookup(tt.values))
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConsumerConfigFrom returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(cfg.StreamKeys, tt.expectedKeys) {
+				t.Errorf("Expected stream keys %v, got %v", tt.expectedKeys, cfg.StreamKeys)
+			}
+			if cfg.ConsumerGroup != tt.expectedGroup {
+				t.Errorf("Expected consumer group %s, got %s", tt.expectedGroup, cfg.ConsumerGroup)
+			}
+			if tt.expectedName != "" && cfg.ConsumerName != tt.expectedName {
+				t.Errorf("Expected consumer name %s, got %s", tt.expectedName, cfg.ConsumerName)
+			}
+		})
+	}
+}
+
+func TestReadEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "consumer.env")
+	content := `# consumer settings
+USERNAME=testuser
+export REDIS_HOST = redis.internal
+REDIS_PASSWORD="p@ss word"
+SINKS='file,stdout'
+`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	values, err := ReadEnvFile(path)
+	if err != nil {
+		t.Fatalf("ReadEnvFile returned error: %v", err)
+	}
+
+	expected := map[string]string{
+		"USERNAME":       "testuser",
+		"REDIS_HOST":     "redis.internal",
+		"REDIS_PASSWORD": "p@ss word",
+		"SINKS":          "file,stdout",
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Expected %v, got %v", expected, values)
+	}
+
+	if err := os.WriteFile(path, []byte("not a setting\n"), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if _, err := ReadEnvFile(path); err == nil {
+		t.Error("Expected an error for a malformed line")
+	}
+}
+
+func TestLoadConsumerConfigFrom_Datastore(t *testing.T) {
+	tests := []struct {
+		name            string
+		values          map[string]string
+		expectErr       bool
+		expectedBackend string
+		expectedPath    string
+	}{
+		{
+			name:            "defaults to redis",
+			values:          map[string]string{"USERNAME": "alice"},
+			expectedBackend: DatastoreRedis,
+			expectedPath:    "radius.db",
+		},
+		{
+			name:            "sqlite with a custom path",
+			values:          map[string]string{"USERNAME": "alice", "DATASTORE_BACKEND": "sqlite", "SQLITE_PATH": "/var/lib/radius/radius.db"},
+			expectedBackend: DatastoreSQLite,
+			expectedPath:    "/var/lib/radius/radius.db",
+		},
+		{
+			name:      "postgres requires a URL",
+			values:    map[string]string{"USERNAME": "alice", "DATASTORE_BACKEND": "postgres"},
+			expectErr: true,
+		},
+		{
+			name:      "unknown backend",
+			values:    map[string]string{"USERNAME": "alice", "DATASTORE_BACKEND": "bolt"},
+			expectErr: true,
+		},
+		{
+			name:      "memory only lives in the API",
+			values:    map[string]string{"USERNAME": "alice", "DATASTORE_BACKEND": "memory"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConsumerConfigFrom(MapLookup(tt.values))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConsumerConfigFrom returned error: %v", err)
+			}
+			if cfg.DatastoreBackend != tt.expectedBackend {
+				t.Errorf("Expected backend %s, got %s", tt.expectedBackend, cfg.DatastoreBackend)
+			}
+			if cfg.SQLitePath != tt.expectedPath {
+				t.Errorf("Expected SQLite path %s, got %s", tt.expectedPath, cfg.SQLitePath)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFrom_Fanout(t *testing.T) {
+	tests := []struct {
+		name                string
+		values              map[string]string
+		expectErr           bool
+		expectedSecondaries []string
+		expectedPolicy      string
+	}{
+		{
+			name:           "no secondaries by default",
+			values:         map[string]string{},
+			expectedPolicy: "primary",
+		},
+		{
+			name:                "postgres next to redis",
+			values:              map[string]string{"DATASTORE_SECONDARY": "postgres, sqlite", "POSTGRES_URL": "postgres://localhost/radius", "DATASTORE_FANOUT_POLICY": "async"},
+			expectedSecondaries: []string{"postgres", "sqlite"},
+			expectedPolicy:      "async",
+		},
+		{
+			name:      "secondary postgres requires a URL",
+			values:    map[string]string{"DATASTORE_SECONDARY": "postgres"},
+			expectErr: true,
+		},
+		{
+			name:      "secondary repeats the primary",
+			values:    map[string]string{"DATASTORE_SECONDARY": "redis"},
+			expectErr: true,
+		},
+		{
+			name:      "memory is not a secondary",
+			values:    map[string]string{"DATASTORE_SECONDARY": "memory"},
+			expectErr: true,
+		},
+		{
+			name:      "unknown policy",
+			values:    map[string]string{"DATASTORE_SECONDARY": "sqlite", "DATASTORE_FANOUT_POLICY": "quorum"},
+			expectErr: true,
+		},
+		{
+			name:      "invalid retry attempts",
+			values:    map[string]string{"DATASTORE_SECONDARY": "sqlite", "DATASTORE_RETRY_ATTEMPTS": "0"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfigFrom(MapLookup(tt.values))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfigFrom returned error: %v", err)
+			}
+			if !reflect.DeepEqual(cfg.SecondaryBackends, tt.expectedSecondaries) {
+				t.Errorf("Expected secondaries %v, got %v", tt.expectedSecondaries, cfg.SecondaryBackends)
+			}
+			if cfg.FanoutPolicy != tt.expectedPolicy {
+				t.Errorf("Expected policy %s, got %s", tt.expectedPolicy, cfg.FanoutPolicy)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFrom_Webhooks(t *testing.T) {
+	tests := []struct {
+		name          string
+		values        map[string]string
+		expectErr     bool
+		expectedUsers map[string][]string
+		expectedNAS   map[string][]string
+	}{
+		{
+			name:          "disabled by default",
+			values:        map[string]string{},
+			expectedUsers: map[string][]string{},
+			expectedNAS:   map[string][]string{},
+		},
+		{
+			name: "user and NAS routes",
+			values: map[string]string{
+				"WEBHOOK_USER_URLS": "*=https://billing.example/hook, alice=http://partner.example/a, alice=https://partner.example/b",
+				"WEBHOOK_NAS_URLS":  "10.0.0.1=https://nas.example/hook",
+				"WEBHOOK_SECRET":    "s3cret",
+			},
+			expectedUsers: map[string][]string{
+				"*":     {"https://billing.example/hook"},
+				"alice": {"http://partner.example/a", "https://partner.example/b"},
+			},
+			expectedNAS: map[string][]string{"10.0.0.1": {"https://nas.example/hook"}},
+		},
+		{
+			name:      "routes require a secret",
+			values:    map[string]string{"WEBHOOK_USER_URLS": "alice=https://partner.example/a"},
+			expectErr: true,
+		},
+		{
+			name:      "route without a key",
+			values:    map[string]string{"WEBHOOK_USER_URLS": "https://partner.example/a", "WEBHOOK_SECRET": "s3cret"},
+			expectErr: true,
+		},
+		{
+			name:      "route to a non HTTP URL",
+			values:    map[string]string{"WEBHOOK_NAS_URLS": "10.0.0.1=ftp://nas.example", "WEBHOOK_SECRET": "s3cret"},
+			expectErr: true,
+		},
+		{
+			name:      "invalid timeout",
+			values:    map[string]string{"WEBHOOK_TIMEOUT_MS": "soon"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfigFrom(MapLookup(tt.values))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfigFrom returned error: %v", err)
+			}
+			if !reflect.DeepEqual(cfg.WebhookUserURLs, tt.expectedUsers) {
+				t.Errorf("Expected user routes %v, got %v", tt.expectedUsers, cfg.WebhookUserURLs)
+			}
+			if !reflect.DeepEqual(cfg.WebhookNASURLs, tt.expectedNAS) {
+				t.Errorf("Expected NAS routes %v, got %v", tt.expectedNAS, cfg.WebhookNASURLs)
+			}
+			if cfg.WebhookQueuePath != "webhooks.db" || cfg.WebhookMaxAttempts != 10 || cfg.WebhookTimeout != 5*time.Second {
+				t.Errorf("Unexpected delivery settings %+v", cfg.WebhookConfig)
+			}
+		})
+	}
+}
+
+func TestLoadConsumerConfigFrom_StreamBackend(t *testing.T) {
+	tests := []struct {
+		name            string
+		values          map[string]string
+		expectErr       bool
+		expectedBackend string
+		expectedBrokers []string
+		expectedTopic   string
+		expectedNATSURL string
+	}{
+		{
+			name:            "follows the datastore by default",
+			values:          map[string]string{"USERNAME": "alice"},
+			expectedTopic:   "radius-accounting",
+			expectedNATSURL: "nats://127.0.0.1:4222",
+		},
+		{
+			name:            "kafka with a custom topic",
+			values:          map[string]string{"USERNAME": "alice", "STREAM_BACKEND": "kafka", "KAFKA_BROKERS": "kafka-1:9092, kafka-2:9092", "KAFKA_TOPIC": "acct"},
+			expectedBackend: StreamKafka,
+			expectedBrokers: []string{"kafka-1:9092", "kafka-2:9092"},
+			expectedTopic:   "acct",
+			expectedNATSURL: "nats://127.0.0.1:4222",
+		},
+		{
+			name:            "nats",
+			values:          map[string]string{"USERNAME": "alice", "STREAM_BACKEND": "nats", "NATS_URL": "nats://nats-1:4222,nats://nats-2:4222"},
+			expectedBackend: StreamNATS,
+			expectedTopic:   "radius-accounting",
+			expectedNATSURL: "nats://nats-1:4222,nats://nats-2:4222",
+		},
+		{
+			name:      "kafka requires brokers",
+			values:    map[string]string{"USERNAME": "alice", "STREAM_BACKEND": "kafka"},
+			expectErr: true,
+		},
+		{
+			name:      "unknown stream backend",
+			values:    map[string]string{"USERNAME": "alice", "STREAM_BACKEND": "pulsar"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConsumerConfigFrom(MapLookup(tt.values))
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConsumerConfigFrom returned error: %v", err)
+			}
+			if cfg.StreamBackend != tt.expectedBackend {
+				t.Errorf("Expected stream backend %q, got %q", tt.expectedBackend, cfg.StreamBackend)
+			}
+			if !reflect.DeepEqual(cfg.KafkaBrokers, tt.expectedBrokers) {
+				t.Errorf("Expected brokers %v, got %v", tt.expectedBrokers, cfg.KafkaBrokers)
+			}
+			if cfg.KafkaTopic != tt.expectedTopic {
+				t.Errorf("Expected topic %s, got %s", tt.expectedTopic, cfg.KafkaTopic)
+			}
+			if cfg.NATSURL != tt.expectedNATSURL {
+				t.Errorf("Expected NATS URL %s, got %s", tt.expectedNATSURL, cfg.NATSURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Change is a setting that differs between two configurations
+type Change struct {
+	// Field is the name of the Config field, e.g. "AccountingTTL"
+	Field string
+	// Detail describes the change without revealing secrets
+	Detail string
+}
+
+func (c Change) String() string {
+	return c.Field + ": " + c.Detail
+}
+
+// secretFields are only reported as changed, their values never appear in a Change
+var secretFields = map[string]bool{
+	"Secret":                true,
+	"RedisPassword":         true,
+	"RedisSentinelPassword": true,
+	"PostgresURL":           true,
+	"WebhookSecret":         true,
+}
+
+// Diff lists the settings that differ between old and new in field order
+func Diff(old, new *Config) []Change {
+	var changes []Change
+	diffFields(reflect.ValueOf(*old), reflect.ValueOf(*new), &changes)
+	return changes
+}
+
+func diffFields(old, new reflect.Value, changes *[]Change) {
+	for i := 0; i < old.NumField(); i++ {
+		field := old.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			diffFields(old.Field(i), new.Field(i), changes)
+			continue
+		}
+
+		oldValue, newValue := old.Field(i).Interface(), new.Field(i).Interface()
+		if reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+
+		var detail string
+		switch {
+		case field.Name == "UserCredentials":
+			detail = diffSecrets(oldValue.(map[string]string), newValue.(map[string]string), "password")
+		case field.Name == "RadiusClients":
+			detail = diffSecrets(clientSecrets(oldValue.([]RadiusClient)), clientSecrets(newValue.([]RadiusClient)), "secret")
+		case secretFields[field.Name]:
+			detail = "changed"
+		default:
+			detail = fmt.Sprintf("%v -> %v", oldValue, newValue)
+		}
+		*changes = append(*changes, Change{Field: field.Name, Detail: detail})
+	}
+}
+
+// diffSecrets describes which names were added, removed or given a new secret
+func diffSecrets(old, new map[string]string, secretName string) string {
+	var added, removed, changed []string
+	for name, secret := range new {
+		oldSecret, ok := old[name]
+		switch {
+		case !ok:
+			added = append(added, name)
+		case oldSecret != secret:
+			changed = append(changed, name)
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+
+	var parts []string
+	for _, group := range []struct {
+		label string
+		names []string
+	}{
+		{"added", added},
+		{"removed", removed},
+		{"new " + secretName + " for", changed},
+	} {
+		if len(group.names) > 0 {
+			sort.Strings(group.names)
+			parts = append(parts, group.label+" "+strings.Join(group.names, ", "))
+		}
+	}
+	if len(parts) == 0 {
+		return "reordered"
+	}
+	return strings.Join(parts, "; ")
+}
+
+func clientSecrets(clients []RadiusClient) map[string]string {
+	secrets := make(map[string]string, len(clients))
+	for _, client := range clients {
+		secrets[client.Network.String()] = client.Secret
+	}
+	return secrets
+}
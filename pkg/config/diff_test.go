@@ -0,0 +1,52 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	old, err := LoadConfigFrom(MapLookup(map[string]string{
+		"RADIUS_SECRET":    "old-secret",
+		"RADIUS_CLIENTS":   "10.0.0.1=a,10.0.0.2=b",
+		"USER_CREDENTIALS": "alice:one,bob:two",
+		"AUTH_PORT":        ":1812",
+	}))
+	if err != nil {
+		t.Fatalf("LoadConfigFrom returned error: %v", err)
+	}
+	new, err := LoadConfigFrom(MapLookup(map[string]string{
+		"RADIUS_SECRET":          "new-secret",
+		"RADIUS_CLIENTS":         "10.0.0.1=changed,10.0.0.0/8=c",
+		"USER_CREDENTIALS":       "alice:three,carol:four",
+		"AUTH_PORT":              ":1812",
+		"ACCOUNTING_TTL_MINUTES": "60",
+	}))
+	if err != nil {
+		t.Fatalf("LoadConfigFrom returned error: %v", err)
+	}
+
+	var lines []string
+	for _, change := range Diff(old, new) {
+		lines = append(lines, change.String())
+	}
+	expected := []string{
+		"Secret: changed",
+		"RadiusClients: added 10.0.0.0/8; removed 10.0.0.2/32; new secret for 10.0.0.1/32",
+		"AccountingTTL: 10m0s -> 1h0m0s",
+		"UserCredentials: added carol; removed bob; new password for alice",
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected changes %q, got %q", expected, lines)
+	}
+	for _, secret := range []string{"old-secret", "new-secret", "three"} {
+		if strings.Contains(strings.Join(lines, "\n"), secret) {
+			t.Errorf("Expected %q to stay out of the diff", secret)
+		}
+	}
+
+	if changes := Diff(old, old); len(changes) != 0 {
+		t.Errorf("Expected no changes, got %v", changes)
+	}
+}
@@ -0,0 +1,514 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// fileSetting is a leaf of the config file schema, decode turns its value into
+// the format of the environment variable key and reports problems under path
+type fileSetting struct {
+	key    string
+	decode func(path string, value interface{}, errs *errorList) (string, bool)
+}
+
+// fileSection is a table of the config file schema, its values are fileSection or fileSetting
+type fileSection map[string]interface{}
+
+// fileSchema describes every setting of a config file by the environment variable it sets.
+// Environment variables and flags override the file, unset settings keep their defaults.
+var fileSchema = fileSection{
+	"listeners": fileSection{
+		"auth":             fileSetting{"AUTH_PORT", decodeString},
+		"accounting":       fileSetting{"ACCT_PORT", decodeString},
+		"host":             fileSetting{"SERVER_HOST", decodeString},
+		"metrics":          fileSetting{"METRICS_ADDR", decodeString},
+		"health":           fileSetting{"HEALTH_ADDR", decodeString},
+		"shutdown_timeout": fileSetting{"SHUTDOWN_TIMEOUT_SECONDS", decodeDuration(time.Second)},
+	},
+	"secret":       fileSetting{"RADIUS_SECRET", decodeString},
+	"secret_file":  fileSetting{"RADIUS_SECRET_FILE", decodeString},
+	"clients":      fileSetting{"RADIUS_CLIENTS", decodeClients},
+	"clients_file": fileSetting{"RADIUS_CLIENTS_FILE", decodeString},
+	"users":        fileSetting{"USER_CREDENTIALS", decodeUsers},
+	"users_file":   fileSetting{"USER_CREDENTIALS_FILE", decodeString},
+	"secrets": fileSection{
+		"file":     fileSetting{"SECRETS_FILE", decodeString},
+		"key_file": fileSetting{"SECRETS_KEY_FILE", decodeString},
+	},
+	"ttl": fileSection{
+		"accounting":      fileSetting{"ACCOUNTING_TTL_MINUTES", decodeDuration(time.Minute)},
+		"request_timeout": fileSetting{"REQUEST_TIMEOUT_MS", decodeDuration(time.Millisecond)},
+	},
+	"redis": fileSection{
+		"mode":                   fileSetting{"REDIS_MODE", decodeString},
+		"addrs":                  fileSetting{"REDIS_ADDRS", decodeList},
+		"master_name":            fileSetting{"REDIS_MASTER_NAME", decodeString},
+		"sentinel_password":      fileSetting{"REDIS_SENTINEL_PASSWORD", decodeString},
+		"sentinel_password_file": fileSetting{"REDIS_SENTINEL_PASSWORD_FILE", decodeString},
+		"host":                   fileSetting{"REDIS_HOST", decodeString},
+		"port":                   fileSetting{"REDIS_PORT", decodeInt},
+		"username":               fileSetting{"REDIS_USERNAME", decodeString},
+		"password":               fileSetting{"REDIS_PASSWORD", decodeString},
+		"password_file":          fileSetting{"REDIS_PASSWORD_FILE", decodeString},
+		"db":                     fileSetting{"REDIS_DB", decodeInt},
+		"tls": fileSection{
+			"enabled":     fileSetting{"REDIS_TLS", decodeBool},
+			"ca_file":     fileSetting{"REDIS_TLS_CA_FILE", decodeString},
+			"cert_file":   fileSetting{"REDIS_TLS_CERT_FILE", decodeString},
+			"key_file":    fileSetting{"REDIS_TLS_KEY_FILE", decodeString},
+			"server_name": fileSetting{"REDIS_TLS_SERVER_NAME", decodeString},
+		},
+	},
+	"datastore": fileSection{
+		"backend":           fileSetting{"DATASTORE_BACKEND", decodeString},
+		"postgres_url":      fileSetting{"POSTGRES_URL", decodeString},
+		"postgres_url_file": fileSetting{"POSTGRES_URL_FILE", decodeString},
+		"sqlite_path":       fileSetting{"SQLITE_PATH", decodeString},
+		"secondary":         fileSetting{"DATASTORE_SECONDARY", decodeList},
+		"fanout_policy":     fileSetting{"DATASTORE_FANOUT_POLICY", decodeString},
+		"retry_queue_size":  fileSetting{"DATASTORE_RETRY_QUEUE_SIZE", decodeInt},
+		"retry_attempts":    fileSetting{"DATASTORE_RETRY_ATTEMPTS", decodeInt},
+	},
+	"stream": fileSection{
+		"backend":          fileSetting{"STREAM_BACKEND", decodeString},
+		"topology":         fileSetting{"STREAM_TOPOLOGY", decodeString},
+		"partitions":       fileSetting{"STREAM_PARTITIONS", decodeInt},
+		"max_len":          fileSetting{"STREAM_MAX_LEN", decodeInt},
+		"max_age":          fileSetting{"STREAM_MAX_AGE_MINUTES", decodeDuration(time.Minute)},
+		"idle_ttl":         fileSetting{"STREAM_IDLE_TTL_MINUTES", decodeDuration(time.Minute)},
+		"janitor_interval": fileSetting{"STREAM_JANITOR_INTERVAL_SECONDS", decodeDuration(time.Second)},
+		"kafka": fileSection{
+			"brokers": fileSetting{"KAFKA_BROKERS", decodeList},
+			"topic":   fileSetting{"KAFKA_TOPIC", decodeString},
+		},
+		"nats": fileSection{
+			"url": fileSetting{"NATS_URL", decodeString},
+		},
+	},
+	"webhooks": fileSection{
+		"users":        fileSetting{"WEBHOOK_USER_URLS", decodeWebhookURLs},
+		"nas":          fileSetting{"WEBHOOK_NAS_URLS", decodeWebhookURLs},
+		"secret":       fileSetting{"WEBHOOK_SECRET", decodeString},
+		"secret_file":  fileSetting{"WEBHOOK_SECRET_FILE", decodeString},
+		"queue_path":   fileSetting{"WEBHOOK_QUEUE_PATH", decodeString},
+		"max_attempts": fileSetting{"WEBHOOK_MAX_ATTEMPTS", decodeInt},
+		"timeout":      fileSetting{"WEBHOOK_TIMEOUT_MS", decodeDuration(time.Millisecond)},
+	},
+	"consumer": fileSection{
+		"username":           fileSetting{"USERNAME", decodeString},
+		"usernames":          fileSetting{"USERNAMES", decodeList},
+		"pattern":            fileSetting{"STREAM_PATTERN", decodeString},
+		"discovery_interval": fileSetting{"STREAM_DISCOVERY_INTERVAL_SECONDS", decodeDuration(time.Second)},
+		"stream_keys":        fileSetting{"STREAM_KEYS", decodeList},
+		"group":              fileSetting{"CONSUMER_GROUP", decodeString},
+		"name":               fileSetting{"CONSUMER_NAME", decodeString},
+		"start":              fileSetting{"CONSUMER_START_ID", decodeString},
+		"partitions":         fileSetting{"CONSUMER_PARTITIONS", decodeList},
+		"username_filter":    fileSetting{"USERNAME_FILTER", decodeList},
+		"workers":            fileSetting{"WORKERS", decodeInt},
+		"max_in_flight":      fileSetting{"MAX_IN_FLIGHT", decodeInt},
+		"batch_size":         fileSetting{"BATCH_SIZE", decodeInt},
+		"block_timeout":      fileSetting{"BLOCK_TIMEOUT_MS", decodeDuration(time.Millisecond)},
+		"claim_idle":         fileSetting{"CLAIM_IDLE_SECONDS", decodeDuration(time.Second)},
+		"enrich_events":      fileSetting{"ENRICH_EVENTS", decodeBool},
+		"sinks":              fileSetting{"SINKS", decodeList},
+		"archive_file":       fileSetting{"ARCHIVE_FILE", decodeString},
+		"replay_from":        fileSetting{"REPLAY_FROM", decodeString},
+		"replay_to":          fileSetting{"REPLAY_TO", decodeString},
+		"webhook": fileSection{
+			"url":         fileSetting{"WEBHOOK_URL", decodeString},
+			"max_retries": fileSetting{"WEBHOOK_MAX_RETRIES", decodeInt},
+			"timeout":     fileSetting{"WEBHOOK_TIMEOUT_SECONDS", decodeDuration(time.Second)},
+		},
+	},
+	"logging": fileSection{
+		"file":            fileSetting{"LOG_FILE", decodeString},
+		"format":          fileSetting{"LOG_FORMAT", decodeString},
+		"max_size_mb":     fileSetting{"LOG_MAX_SIZE_MB", decodeInt},
+		"rotate_interval": fileSetting{"LOG_ROTATE_INTERVAL_MINUTES", decodeDuration(time.Minute)},
+		"keep":            fileSetting{"LOG_KEEP", decodeInt},
+		"compress":        fileSetting{"LOG_COMPRESS", decodeBool},
+	},
+}
+
+// settingPaths maps environment variable names to their path in a config file,
+// so that errors point at the setting whichever way it was given
+var settingPaths = schemaPaths(fileSchema, "", map[string]string{})
+
+func schemaPaths(section fileSection, prefix string, paths map[string]string) map[string]string {
+	for name, schema := range section {
+		switch schema := schema.(type) {
+		case fileSection:
+			schemaPaths(schema, joinPath(prefix, name), paths)
+		case fileSetting:
+			paths[schema.key] = joinPath(prefix, name)
+		}
+	}
+	return paths
+}
+
+// ReadConfigFile reads settings keyed by environment variable name from a YAML (.yaml, .yml)
+// or TOML (.toml) config file, other files are read with ReadEnvFile. Unknown settings and
+// values of the wrong type are returned as a *ValidationError along with the valid settings.
+func ReadConfigFile(path string) (map[string]string, error) {
+	var unmarshal func([]byte, interface{}) error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		unmarshal = yaml.Unmarshal
+	case ".toml":
+		unmarshal = toml.Unmarshal
+	default:
+		return ReadEnvFile(path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %v", err)
+	}
+	tree := make(map[string]interface{})
+	if err := unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	var errs errorList
+	values := make(map[string]string)
+	decodeSection(fileSchema, "", tree, values, &errs)
+	return values, errs.err()
+}
+
+// JoinValidationErrors combines the validation errors of a config file and of the settings
+// loaded from it. Other errors, such as an unreadable file, are returned as they are.
+func JoinValidationErrors(errs ...error) error {
+	var joined ValidationError
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			return err
+		}
+		joined.Errors = append(joined.Errors, validationErr.Errors...)
+	}
+	if len(joined.Errors) == 0 {
+		return nil
+	}
+	return &joined
+}
+
+func decodeSection(section fileSection, prefix string, node interface{}, values map[string]string, errs *errorList) {
+	table, ok := node.(map[string]interface{})
+	if !ok {
+		errs.addPath(prefix, fmt.Errorf("expected a table, got %s", describeValue(node)))
+		return
+	}
+	for _, name := range sortedKeys(table) {
+		path := joinPath(prefix, name)
+		value := table[name]
+		if value == nil {
+			continue
+		}
+		switch schema := section[name].(type) {
+		case fileSection:
+			decodeSection(schema, path, value, values, errs)
+		case fileSetting:
+			if decoded, ok := schema.decode(path, value, errs); ok {
+				values[schema.key] = decoded
+			}
+		default:
+			errs.addPath(path, errors.New("unknown setting"))
+		}
+	}
+}
+
+func decodeString(path string, value interface{}, errs *errorList) (string, bool) {
+	s, ok := value.(string)
+	if !ok {
+		errs.addPath(path, fmt.Errorf("expected a string, got %s", describeValue(value)))
+	}
+	return s, ok
+}
+
+func decodeInt(path string, value interface{}, errs *errorList) (string, bool) {
+	switch n := value.(type) {
+	case int:
+		return strconv.Itoa(n), true
+	case int64:
+		return strconv.FormatInt(n, 10), true
+	}
+	errs.addPath(path, fmt.Errorf("expected an integer, got %s", describeValue(value)))
+	return "", false
+}
+
+func decodeBool(path string, value interface{}, errs *errorList) (string, bool) {
+	b, ok := value.(bool)
+	if !ok {
+		errs.addPath(path, fmt.Errorf("expected true or false, got %s", describeValue(value)))
+	}
+	return strconv.FormatBool(b), ok
+}
+
+// decodeList accepts a list of strings or integers and joins it with commas
+func decodeList(path string, value interface{}, errs *errorList) (string, bool) {
+	items, ok := listValue(value)
+	if !ok {
+		errs.addPath(path, fmt.Errorf("expected a list, got %s", describeValue(value)))
+		return "", false
+	}
+	parts := make([]string, 0, len(items))
+	valid := true
+	for i, item := range items {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		var part string
+		switch item := item.(type) {
+		case string:
+			part = item
+		case int, int64:
+			part = fmt.Sprint(item)
+		default:
+			errs.addPath(itemPath, fmt.Errorf("expected a string, got %s", describeValue(item)))
+			valid = false
+			continue
+		}
+		if !checkListItem(itemPath, part, errs) {
+			valid = false
+			continue
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ","), valid
+}
+
+// decodeDuration accepts a duration string such as "90s" or "1h" and converts it to
+// a whole number of units
+func decodeDuration(unit time.Duration) func(string, interface{}, *errorList) (string, bool) {
+	return func(path string, value interface{}, errs *errorList) (string, bool) {
+		s, ok := value.(string)
+		if !ok {
+			errs.addPath(path, fmt.Errorf("expected a duration such as \"30s\", got %s", describeValue(value)))
+			return "", false
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			errs.addPath(path, fmt.Errorf("invalid duration %q", s))
+			return "", false
+		}
+		if d%unit != 0 {
+			errs.addPath(path, fmt.Errorf("%s is not a whole number of %s", s, unitName(unit)))
+			return "", false
+		}
+		return strconv.FormatInt(int64(d/unit), 10), true
+	}
+}
+
+// decodeUsers accepts a table of usernames to passwords, passwords are never echoed in errors
+func decodeUsers(path string, value interface{}, errs *errorList) (string, bool) {
+	table, ok := value.(map[string]interface{})
+	if !ok {
+		errs.addPath(path, fmt.Errorf("expected a table of usernames to passwords, got %s", describeValue(value)))
+		return "", false
+	}
+	pairs := make([]string, 0, len(table))
+	valid := true
+	for _, username := range sortedKeys(table) {
+		userPath := joinPath(path, username)
+		password, ok := table[username].(string)
+		switch {
+		case !ok:
+			errs.addPath(userPath, fmt.Errorf("expected a password string, got %s", describeValue(table[username])))
+		case password == "":
+			errs.addPath(userPath, errors.New("password is empty"))
+		case strings.ContainsAny(username, ":,"):
+			errs.addPath(userPath, errors.New("username must not contain ':' or ','"))
+		case strings.Contains(password, ","):
+			errs.addPath(userPath, errors.New("password must not contain ','"))
+		default:
+			pairs = append(pairs, username+":"+password)
+			continue
+		}
+		valid = false
+	}
+	return strings.Join(pairs, ","), valid
+}
+
+// decodeClients accepts a list of tables with the address and secret of each RADIUS client
+func decodeClients(path string, value interface{}, errs *errorList) (string, bool) {
+	items, ok := listValue(value)
+	if !ok {
+		errs.addPath(path, fmt.Errorf("expected a list of clients, got %s", describeValue(value)))
+		return "", false
+	}
+	entries := make([]string, 0, len(items))
+	valid := true
+	for i, item := range items {
+		clientPath := fmt.Sprintf("%s[%d]", path, i)
+		table, ok := item.(map[string]interface{})
+		if !ok {
+			errs.addPath(clientPath, fmt.Errorf("expected a table with address and secret, got %s", describeValue(item)))
+			valid = false
+			continue
+		}
+
+		var address, secret string
+		clientValid := true
+		for _, name := range sortedKeys(table) {
+			fieldPath := joinPath(clientPath, name)
+			field, isString := table[name].(string)
+			switch {
+			case name != "address" && name != "secret":
+				errs.addPath(fieldPath, errors.New("unknown setting"))
+			case !isString:
+				errs.addPath(fieldPath, fmt.Errorf("expected a string, got %s", describeValue(table[name])))
+			case name == "address":
+				if _, err := parseClientAddress(field); err != nil {
+					errs.addPath(fieldPath, err)
+				} else {
+					address = field
+					continue
+				}
+			case strings.Contains(field, ","):
+				errs.addPath(fieldPath, errors.New("secret must not contain ','"))
+			default:
+				secret = field
+				continue
+			}
+			clientValid = false
+		}
+		if clientValid && address == "" {
+			errs.addPath(joinPath(clientPath, "address"), errors.New("address is required"))
+			clientValid = false
+		}
+		if clientValid && secret == "" {
+			errs.addPath(joinPath(clientPath, "secret"), errors.New("secret is required"))
+			clientValid = false
+		}
+		if !clientValid {
+			valid = false
+			continue
+		}
+		entries = append(entries, address+"="+secret)
+	}
+	return strings.Join(entries, ","), valid
+}
+
+// decodeWebhookURLs accepts a table of keys to a URL or a list of URLs
+func decodeWebhookURLs(path string, value interface{}, errs *errorList) (string, bool) {
+	table, ok := value.(map[string]interface{})
+	if !ok {
+		errs.addPath(path, fmt.Errorf("expected a table of names to URLs, got %s", describeValue(value)))
+		return "", false
+	}
+	var pairs []string
+	valid := true
+	for _, key := range sortedKeys(table) {
+		keyPath := joinPath(path, key)
+		if strings.ContainsAny(key, "=,") {
+			errs.addPath(keyPath, errors.New("name must not contain '=' or ','"))
+			valid = false
+			continue
+		}
+		urls := []interface{}{table[key]}
+		if list, ok := listValue(table[key]); ok {
+			urls = list
+		}
+		for i, rawURL := range urls {
+			urlPath := keyPath
+			if len(urls) > 1 {
+				urlPath = fmt.Sprintf("%s[%d]", keyPath, i)
+			}
+			s, ok := rawURL.(string)
+			if !ok {
+				errs.addPath(urlPath, fmt.Errorf("expected a URL string, got %s", describeValue(rawURL)))
+				valid = false
+				continue
+			}
+			if !checkListItem(urlPath, s, errs) {
+				valid = false
+				continue
+			}
+			pairs = append(pairs, key+"="+s)
+		}
+	}
+	return strings.Join(pairs, ","), valid
+}
+
+// checkListItem rejects values that would be split when joined into a comma separated list
+func checkListItem(path, value string, errs *errorList) bool {
+	if strings.Contains(value, ",") {
+		errs.addPath(path, errors.New("must not contain ','"))
+		return false
+	}
+	return true
+}
+
+// listValue returns the items of a YAML sequence or a TOML array
+func listValue(value interface{}) ([]interface{}, bool) {
+	switch list := value.(type) {
+	case []interface{}:
+		return list, true
+	case []map[string]interface{}:
+		items := make([]interface{}, len(list))
+		for i, table := range list {
+			items[i] = table
+		}
+		return items, true
+	}
+	return nil, false
+}
+
+// describeValue names the type of a decoded value without echoing it, values may be secrets
+func describeValue(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case int, int64:
+		return "an integer"
+	case float64:
+		return "a number"
+	case map[string]interface{}:
+		return "a table"
+	case []interface{}, []map[string]interface{}:
+		return "a list"
+	case time.Time:
+		return "a date"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func unitName(unit time.Duration) string {
+	switch unit {
+	case time.Millisecond:
+		return "milliseconds"
+	case time.Second:
+		return "seconds"
+	}
+	return "minutes"
+}
+
+func joinPath(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+func sortedKeys(table map[string]interface{}) []string {
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
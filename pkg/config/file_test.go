@@ -0,0 +1,277 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+// fieldPaths returns the paths of a *ValidationError
+func fieldPaths(t *testing.T, err error) []string {
+	t.Helper()
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a *ValidationError, got %v", err)
+	}
+	paths := make([]string, len(validationErr.Errors))
+	for i, fieldErr := range validationErr.Errors {
+		paths[i] = fieldErr.Path
+	}
+	return paths
+}
+
+func TestReadConfigFile(t *testing.T) {
+	yamlFile := `
+listeners:
+  auth: ":11812"
+  accounting: ":11813"
+secret: shared
+clients:
+  - address: 10.0.0.0/8
+    secret: nas-secret
+  - address: 192.168.1.10
+    secret: other
+users:
+  alice: wonderland
+  bob: builder
+ttl:
+  accounting: 2h
+  request_timeout: 1500ms
+redis:
+  port: 6380
+  tls:
+    enabled: true
+datastore:
+  secondary: [postgres]
+  postgres_url: postgres://localhost/radius
+stream:
+  max_age: 30m
+webhooks:
+  users:
+    "*": https://hooks.example.com/all
+    alice: [https://a.example.com, https://b.example.com]
+  secret: hook-secret
+logging:
+  keep: 3
+`
+	tomlFile := `
+secret = "shared"
+
+[listeners]
+auth = ":11812"
+accounting = ":11813"
+
+[[clients]]
+address = "10.0.0.0/8"
+secret = "nas-secret"
+
+[[clients]]
+address = "192.168.1.10"
+secret = "other"
+
+[users]
+alice = "wonderland"
+bob = "builder"
+
+[ttl]
+accounting = "2h"
+request_timeout = "1500ms"
+
+[redis]
+port = 6380
+tls = { enabled = true }
+
+[datastore]
+secondary = ["postgres"]
+postgres_url = "postgres://localhost/radius"
+
+[stream]
+max_age = "30m"
+
+[webhooks]
+secret = "hook-secret"
+users = { "*" = "https://hooks.example.com/all", alice = ["https://a.example.com", "https://b.example.com"] }
+
+[logging]
+keep = 3
+`
+	expected := map[string]string{
+		"AUTH_PORT":              ":11812",
+		"ACCT_PORT":              ":11813",
+		"RADIUS_SECRET":          "shared",
+		"RADIUS_CLIENTS":         "10.0.0.0/8=nas-secret,192.168.1.10=other",
+		"USER_CREDENTIALS":       "alice:wonderland,bob:builder",
+		"ACCOUNTING_TTL_MINUTES": "120",
+		"REQUEST_TIMEOUT_MS":     "1500",
+		"REDIS_PORT":             "6380",
+		"REDIS_TLS":              "true",
+		"DATASTORE_SECONDARY":    "postgres",
+		"POSTGRES_URL":           "postgres://localhost/radius",
+		"STREAM_MAX_AGE_MINUTES": "30",
+		"WEBHOOK_USER_URLS":      "*=https://hooks.example.com/all,alice=https://a.example.com,alice=https://b.example.com",
+		"WEBHOOK_SECRET":         "hook-secret",
+		"LOG_KEEP":               "3",
+	}
+
+	for name, content := range map[string]string{"radius.yaml": yamlFile, "radius.toml": tomlFile} {
+		values, err := ReadConfigFile(writeConfigFile(t, name, content))
+		if err != nil {
+			t.Fatalf("ReadConfigFile(%s) returned error: %v", name, err)
+		}
+		if !reflect.DeepEqual(values, expected) {
+			t.Errorf("Expected %s to give %v, got %v", name, expected, values)
+		}
+	}
+
+	// Environment variables override the file
+	values, _ := ReadConfigFile(writeConfigFile(t, "radius.yml", yamlFile))
+	cfg, err := LoadConfigFrom(Layered(MapLookup(map[string]string{"AUTH_PORT": ":1812"}), MapLookup(values)))
+	if err != nil {
+		t.Fatalf("LoadConfigFrom returned error: %v", err)
+	}
+	if cfg.AuthPort != ":1812" || cfg.AcctPort != ":11813" || cfg.AccountingTTL != 2*time.Hour || cfg.RequestTimeout != 1500*time.Millisecond {
+		t.Errorf("Unexpected listeners or TTLs: %s %s %v %v", cfg.AuthPort, cfg.AcctPort, cfg.AccountingTTL, cfg.RequestTimeout)
+	}
+	if len(cfg.RadiusClients) != 2 || cfg.RadiusClients[1].Secret != "other" || cfg.UserCredentials["bob"] != "builder" {
+		t.Errorf("Unexpected clients %v or users %v", cfg.RadiusClients, cfg.UserCredentials)
+	}
+	if !reflect.DeepEqual(cfg.WebhookUserURLs["alice"], []string{"https://a.example.com", "https://b.example.com"}) {
+		t.Errorf("Unexpected webhook routes %v", cfg.WebhookUserURLs)
+	}
+
+	// Other extensions are read as KEY=VALUE files
+	values, err = ReadConfigFile(writeConfigFile(t, "radius.env", "AUTH_PORT=:1645\n"))
+	if err != nil || values["AUTH_PORT"] != ":1645" {
+		t.Errorf("Expected the env file to be read, got %v (%v)", values, err)
+	}
+}
+
+func TestReadConfigFile_Errors(t *testing.T) {
+	path := writeConfigFile(t, "radius.yaml", `
+listener:
+  auth: ":1812"
+clients:
+  - address: 10.0.0.1
+    secret: ok
+  - address: not-an-ip
+    secret: s3cret
+  - address: 10.0.0.3
+users:
+  alice: 42
+redis:
+  port: "6380"
+  tls: yes
+stream:
+  max_age: 90s
+  kafka:
+    brokers: [a, "b,c"]
+`)
+
+	values, err := ReadConfigFile(path)
+	expected := []string{
+		"clients[1].address",
+		"clients[2].secret",
+		"listener",
+		"redis.port",
+		"redis.tls",
+		"stream.kafka.brokers[1]",
+		"stream.max_age",
+		"users.alice",
+	}
+	if paths := fieldPaths(t, err); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected errors at %v, got %v:\n%v", expected, paths, err)
+	}
+	if strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("Expected secrets to stay out of errors, got %v", err)
+	}
+	if len(values) != 0 {
+		t.Errorf("Expected no valid settings, got %v", values)
+	}
+
+	if _, err := ReadConfigFile(writeConfigFile(t, "radius.toml", "secret = \n")); err == nil {
+		t.Error("Expected a syntax error")
+	}
+	if _, err := ReadConfigFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func TestLoadConfigFrom_Validation(t *testing.T) {
+	_, err := LoadConfigFrom(MapLookup(map[string]string{
+		"AUTH_PORT":        "1812",
+		"REDIS_PORT":       "70000",
+		"REDIS_DB":         "-1",
+		"USER_CREDENTIALS": "alice:secret1,bob,alice:secret2",
+		"RADIUS_CLIENTS":   "10.0.0.1=s,example.com=t",
+	}))
+
+	expected := []string{"redis.port", "redis.db", "listeners.auth", "clients", "users"}
+	if paths := fieldPaths(t, err); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected errors at %v, got %v:\n%v", expected, paths, err)
+	}
+	for _, detail := range []string{"5 invalid settings", "pair 2 is not username:password", "user alice is listed twice", `"example.com" is not an IP address`} {
+		if !strings.Contains(err.Error(), detail) {
+			t.Errorf("Expected %q in %v", detail, err)
+		}
+	}
+	if strings.Contains(err.Error(), "secret1") {
+		t.Errorf("Expected passwords to stay out of errors, got %v", err)
+	}
+
+	// File and settings errors are reported together
+	joined := JoinValidationErrors(&ValidationError{Errors: []FieldError{{Path: "listener", Err: errors.New("unknown setting")}}}, err)
+	if paths := fieldPaths(t, joined); len(paths) != 6 || paths[0] != "listener" {
+		t.Errorf("Expected the file error first, got %v", paths)
+	}
+	if JoinValidationErrors(nil, nil) != nil {
+		t.Error("Expected no error without errors")
+	}
+}
+
+func TestLoadConsumerConfigFrom_StartPosition(t *testing.T) {
+	tests := []struct {
+		startID  string
+		expected string
+	}{
+		{startID: "$", expected: "$"},
+		{startID: "0", expected: "0"},
+		{startID: "1700000000000-1", expected: "1700000000000-1"},
+		{startID: "-"},
+		{startID: "+"},
+		{startID: "yesterday"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.startID, func(t *testing.T) {
+			cfg, err := LoadConsumerConfigFrom(MapLookup(map[string]string{
+				"USERNAME":          "testuser",
+				"CONSUMER_START_ID": tt.startID,
+			}))
+			if tt.expected == "" {
+				if paths := fieldPaths(t, err); !reflect.DeepEqual(paths, []string{"consumer.start"}) {
+					t.Errorf("Expected an error at consumer.start, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConsumerConfigFrom returned error: %v", err)
+			}
+			if cfg.StartID != tt.expected {
+				t.Errorf("Expected start ID %s, got %s", tt.expected, cfg.StartID)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"strconv"
+
+	"dni/pkg/redisconn"
+)
+
+// RedisConfig holds the Redis connection settings shared by the server and the consumer
+type RedisConfig struct {
+	// RedisMode is standalone, sentinel or cluster
+	RedisMode string
+	// RedisAddrs lists the sentinels or cluster seed nodes, defaults to RedisHost:RedisPort
+	RedisAddrs []string
+	// RedisMasterName and RedisSentinelPassword are used in sentinel mode
+	RedisMasterName       string
+	RedisSentinelPassword string
+
+	RedisHost     string
+	RedisPort     int
+	RedisUsername string
+	RedisPassword string
+	RedisDB       int
+
+	// TLS is enabled by RedisTLS or implicitly by any of the certificate files
+	RedisTLS           bool
+	RedisTLSCAFile     string
+	RedisTLSCertFile   string
+	RedisTLSKeyFile    string
+	RedisTLSServerName string
+}
+
+func defaultRedisConfig() RedisConfig {
+	return RedisConfig{
+		RedisMode: redisconn.ModeStandalone,
+		RedisHost: "localhost",
+		RedisPort: 6379,
+	}
+}
+
+// RedisOptions converts the settings for redisconn.NewClient
+func (c RedisConfig) RedisOptions() redisconn.Options {
+	return redisconn.Options{
+		Mode:             c.RedisMode,
+		Addrs:            c.RedisAddrs,
+		MasterName:       c.RedisMasterName,
+		SentinelPassword: c.RedisSentinelPassword,
+		Host:             c.RedisHost,
+		Port:             c.RedisPort,
+		Username:         c.RedisUsername,
+		Password:         c.RedisPassword,
+		DB:               c.RedisDB,
+		TLS: redisconn.TLSOptions{
+			Enabled:    c.RedisTLS,
+			CAFile:     c.RedisTLSCAFile,
+			CertFile:   c.RedisTLSCertFile,
+			KeyFile:    c.RedisTLSKeyFile,
+			ServerName: c.RedisTLSServerName,
+		},
+	}
+}
+
+// HashTagKeys reports whether keys must carry hash tags so that a user's
+// records, indexes and stream land on the same cluster slot
+func (c RedisConfig) HashTagKeys() bool {
+	return c.RedisMode == redisconn.ModeCluster
+}
+
+// loadRedisConfig reads the REDIS_* connection settings
+func loadRedisConfig(getenv func(string) string, config *RedisConfig, errs *errorList) {
+	// Redis deployment mode
+	if mode := getenv("REDIS_MODE"); mode != "" {
+		if mode != redisconn.ModeStandalone && mode != redisconn.ModeSentinel && mode != redisconn.ModeCluster {
+			errs.addf("REDIS_MODE", "invalid REDIS_MODE: %s (expected %s, %s or %s)", mode, redisconn.ModeStandalone, redisconn.ModeSentinel, redisconn.ModeCluster)
+		} else {
+			config.RedisMode = mode
+		}
+	}
+	config.RedisAddrs = SplitList(getenv("REDIS_ADDRS"))
+	config.RedisMasterName = getenv("REDIS_MASTER_NAME")
+	config.RedisSentinelPassword = getenv("REDIS_SENTINEL_PASSWORD")
+	if config.RedisMode == redisconn.ModeSentinel && config.RedisMasterName == "" {
+		errs.addf("REDIS_MASTER_NAME", "REDIS_MASTER_NAME is required in sentinel mode")
+	}
+
+	// Redis Host
+	if host := getenv("REDIS_HOST"); host != "" {
+		config.RedisHost = host
+	}
+
+	// Redis Port
+	if portStr := getenv("REDIS_PORT"); portStr != "" {
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port > 65535 {
+			errs.addf("REDIS_PORT", "invalid REDIS_PORT: %s", portStr)
+		} else {
+			config.RedisPort = port
+		}
+	}
+
+	// Redis ACL username and password
+	if username := getenv("REDIS_USERNAME"); username != "" {
+		config.RedisUsername = username
+	}
+	if password := getenv("REDIS_PASSWORD"); password != "" {
+		config.RedisPassword = password
+	}
+
+	// Redis DB
+	if dbStr := getenv("REDIS_DB"); dbStr != "" {
+		db, err := strconv.Atoi(dbStr)
+		if err != nil || db < 0 {
+			errs.addf("REDIS_DB", "invalid REDIS_DB: %s", dbStr)
+		} else {
+			config.RedisDB = db
+		}
+	}
+
+	// Redis TLS
+	if tlsStr := getenv("REDIS_TLS"); tlsStr != "" {
+		enabled, err := strconv.ParseBool(tlsStr)
+		if err != nil {
+			errs.addf("REDIS_TLS", "invalid REDIS_TLS: %s", tlsStr)
+		} else {
+			config.RedisTLS = enabled
+		}
+	}
+	config.RedisTLSCAFile = getenv("REDIS_TLS_CA_FILE")
+	config.RedisTLSCertFile = getenv("REDIS_TLS_CERT_FILE")
+	config.RedisTLSKeyFile = getenv("REDIS_TLS_KEY_FILE")
+	config.RedisTLSServerName = getenv("REDIS_TLS_SERVER_NAME")
+	if config.RedisTLSCAFile != "" || config.RedisTLSCertFile != "" {
+		config.RedisTLS = true
+	}
+	if (config.RedisTLSCertFile == "") != (config.RedisTLSKeyFile == "") {
+		errs.addf("REDIS_TLS_KEY_FILE", "REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE must be set together")
+	}
+}
@@ -0,0 +1,210 @@
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// secretKeys are the settings that can also be read from a file named by KEY_FILE,
+// e.g. a Docker or Kubernetes secret, or from the encrypted SECRETS_FILE
+var secretKeys = []string{
+	"RADIUS_SECRET",
+	"RADIUS_CLIENTS",
+	"USER_CREDENTIALS",
+	"REDIS_PASSWORD",
+	"REDIS_SENTINEL_PASSWORD",
+	"POSTGRES_URL",
+	"WEBHOOK_SECRET",
+}
+
+// secretsHeader starts every encrypted secrets file and authenticates its version
+const secretsHeader = "dni-secrets:v1"
+
+// SecretsKeySize is the length of the AES-256 key unlocking a secrets file
+const SecretsKeySize = 32
+
+// loadSecrets returns lookup extended with the secrets read from KEY_FILE settings and
+// the encrypted SECRETS_FILE. A secret set both directly and from a file is an error.
+func loadSecrets(lookup Lookup, errs *errorList) Lookup {
+	getenv := func(key string) string {
+		value, _ := lookup(key)
+		return value
+	}
+
+	secrets := make(map[string]string)
+	if path := getenv("SECRETS_FILE"); path != "" {
+		values, err := ReadSecretsFile(path, getenv("SECRETS_KEY_FILE"))
+		if err != nil {
+			errs.addf("SECRETS_FILE", "invalid SECRETS_FILE: %v", err)
+		}
+		for _, key := range sortedStringKeys(values) {
+			if !isSecretKey(key) {
+				errs.addf("SECRETS_FILE", "invalid SECRETS_FILE: %s is not one of %s", key, strings.Join(secretKeys, ", "))
+				continue
+			}
+			secrets[key] = values[key]
+		}
+	} else if getenv("SECRETS_KEY_FILE") != "" {
+		errs.addf("SECRETS_FILE", "SECRETS_FILE is required with SECRETS_KEY_FILE")
+	}
+
+	for _, key := range secretKeys {
+		fileKey := key + "_FILE"
+		path := getenv(fileKey)
+		if path == "" {
+			continue
+		}
+		if _, ok := secrets[key]; ok {
+			errs.addf(fileKey, "%s and SECRETS_FILE both set %s, remove one of them", fileKey, key)
+			continue
+		}
+		value, err := readSecretFile(path)
+		if err != nil {
+			errs.addf(fileKey, "invalid %s: %v", fileKey, err)
+			continue
+		}
+		secrets[key] = value
+	}
+
+	for _, key := range sortedStringKeys(secrets) {
+		if getenv(key) != "" {
+			errs.addf(key, "%s is also read from a file, remove one of them", key)
+		}
+	}
+	return Layered(MapLookup(secrets), lookup)
+}
+
+// readSecretFile returns the content of a secret file without its trailing newline
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret: %v", err)
+	}
+	value := strings.TrimRight(string(data), "\r\n")
+	if value == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return value, nil
+}
+
+// ReadSecretsFile decrypts a secrets file made by EncryptSecrets with the hex encoded key
+// in keyPath. The decrypted content holds KEY=VALUE lines like ReadEnvFile.
+func ReadSecretsFile(path, keyPath string) (map[string]string, error) {
+	if keyPath == "" {
+		return nil, errors.New("SECRETS_KEY_FILE is required to decrypt it")
+	}
+	key, err := ReadSecretsKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets file: %v", err)
+	}
+	plaintext, err := DecryptSecrets(key, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return parseEnvFile(bytes.NewReader(plaintext), path)
+}
+
+// ReadSecretsKey reads a hex encoded AES-256 key, as written by GenerateSecretsKey
+func ReadSecretsKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets key: %v", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != SecretsKeySize {
+		return nil, fmt.Errorf("%s does not hold a hex encoded %d byte key", path, SecretsKeySize)
+	}
+	return key, nil
+}
+
+// GenerateSecretsKey returns a random hex encoded key for EncryptSecrets
+func GenerateSecretsKey() (string, error) {
+	key := make([]byte, SecretsKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate key: %v", err)
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// EncryptSecrets seals plaintext with AES-256-GCM. The result is a header line followed
+// by the base64 encoded nonce and ciphertext, so it can be kept in text based stores.
+func EncryptSecrets(key, plaintext []byte) ([]byte, error) {
+	gcm, err := secretsCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	sealed := gcm.Seal(nonce, nonce, plaintext, []byte(secretsHeader))
+	return []byte(secretsHeader + "\n" + base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+// DecryptSecrets opens the output of EncryptSecrets
+func DecryptSecrets(key, data []byte) ([]byte, error) {
+	header, body, _ := strings.Cut(string(data), "\n")
+	if strings.TrimSpace(header) != secretsHeader {
+		return nil, errors.New("not a secrets file")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(body))
+	if err != nil {
+		return nil, errors.New("secrets file is corrupted")
+	}
+
+	gcm, err := secretsCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("secrets file is corrupted")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(secretsHeader))
+	if err != nil {
+		return nil, errors.New("wrong key or corrupted secrets file")
+	}
+	return plaintext, nil
+}
+
+func secretsCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != SecretsKeySize {
+		return nil, fmt.Errorf("secrets key must be %d bytes, got %d", SecretsKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func isSecretKey(key string) bool {
+	for _, secretKey := range secretKeys {
+		if key == secretKey {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedStringKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
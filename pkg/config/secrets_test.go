@@ -0,0 +1,157 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeSecretsFile encrypts content with a new key and returns the secrets and key file paths
+func writeSecretsFile(t *testing.T, content string) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	hexKey, err := GenerateSecretsKey()
+	if err != nil {
+		t.Fatalf("GenerateSecretsKey returned error: %v", err)
+	}
+	keyPath := filepath.Join(dir, "secrets.key")
+	if err := os.WriteFile(keyPath, []byte(hexKey+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	key, err := ReadSecretsKey(keyPath)
+	if err != nil {
+		t.Fatalf("ReadSecretsKey returned error: %v", err)
+	}
+	sealed, err := EncryptSecrets(key, []byte(content))
+	if err != nil {
+		t.Fatalf("EncryptSecrets returned error: %v", err)
+	}
+	path := filepath.Join(dir, "secrets.enc")
+	if err := os.WriteFile(path, sealed, 0600); err != nil {
+		t.Fatalf("Failed to write secrets: %v", err)
+	}
+	return path, keyPath
+}
+
+func TestLoadConfigFrom_SecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	secretPath := filepath.Join(dir, "radius_secret")
+	usersPath := filepath.Join(dir, "users")
+	os.WriteFile(secretPath, []byte("from-file\n"), 0600)
+	os.WriteFile(usersPath, []byte("alice:one,bob:two"), 0600)
+
+	cfg, err := LoadConfigFrom(MapLookup(map[string]string{
+		"RADIUS_SECRET_FILE":    secretPath,
+		"USER_CREDENTIALS_FILE": usersPath,
+	}))
+	if err != nil {
+		t.Fatalf("LoadConfigFrom returned error: %v", err)
+	}
+	if cfg.Secret != "from-file" {
+		t.Errorf("Expected the secret without its newline, got %q", cfg.Secret)
+	}
+	if !reflect.DeepEqual(cfg.UserCredentials, map[string]string{"alice": "one", "bob": "two"}) {
+		t.Errorf("Unexpected users %v", cfg.UserCredentials)
+	}
+
+	// The consumer reads the same variants
+	consumerCfg, err := LoadConsumerConfigFrom(MapLookup(map[string]string{
+		"USERNAME":            "alice",
+		"REDIS_PASSWORD_FILE": secretPath,
+	}))
+	if err != nil {
+		t.Fatalf("LoadConsumerConfigFrom returned error: %v", err)
+	}
+	if consumerCfg.RedisPassword != "from-file" {
+		t.Errorf("Expected the Redis password from the file, got %q", consumerCfg.RedisPassword)
+	}
+
+	_, err = LoadConfigFrom(MapLookup(map[string]string{
+		"RADIUS_SECRET":       "direct",
+		"RADIUS_SECRET_FILE":  secretPath,
+		"REDIS_PASSWORD_FILE": filepath.Join(dir, "missing"),
+	}))
+	expected := []string{"redis.password_file", "secret"}
+	if paths := fieldPaths(t, err); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected errors at %v, got %v:\n%v", expected, paths, err)
+	}
+}
+
+func TestLoadConfigFrom_SecretsFile(t *testing.T) {
+	path, keyPath := writeSecretsFile(t, "RADIUS_SECRET=encrypted\nREDIS_PASSWORD=\"p@ss word\"\n")
+
+	cfg, err := LoadConfigFrom(MapLookup(map[string]string{
+		"SECRETS_FILE":     path,
+		"SECRETS_KEY_FILE": keyPath,
+	}))
+	if err != nil {
+		t.Fatalf("LoadConfigFrom returned error: %v", err)
+	}
+	if cfg.Secret != "encrypted" || cfg.RedisPassword != "p@ss word" {
+		t.Errorf("Expected the decrypted secrets, got %q and %q", cfg.Secret, cfg.RedisPassword)
+	}
+
+	tests := []struct {
+		name     string
+		values   map[string]string
+		expected string
+	}{
+		{
+			name:     "missing key file",
+			values:   map[string]string{"SECRETS_FILE": path},
+			expected: "SECRETS_KEY_FILE is required",
+		},
+		{
+			name:     "set twice",
+			values:   map[string]string{"SECRETS_FILE": path, "SECRETS_KEY_FILE": keyPath, "RADIUS_SECRET": "direct"},
+			expected: "RADIUS_SECRET is also read from a file",
+		},
+		{
+			name:     "wrong key",
+			values:   map[string]string{"SECRETS_FILE": path, "SECRETS_KEY_FILE": func() string { _, other := writeSecretsFile(t, ""); return other }()},
+			expected: "wrong key or corrupted secrets file",
+		},
+		{
+			name: "not a secret",
+			values: func() map[string]string {
+				path, keyPath := writeSecretsFile(t, "REDIS_HOST=redis\n")
+				return map[string]string{"SECRETS_FILE": path, "SECRETS_KEY_FILE": keyPath}
+			}(),
+			expected: "REDIS_HOST is not one of",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfigFrom(MapLookup(tt.values))
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("Expected an error containing %q, got %v", tt.expected, err)
+			}
+			if err != nil && strings.Contains(err.Error(), "encrypted") {
+				t.Errorf("Expected secrets to stay out of errors, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDecryptSecrets_Tampered(t *testing.T) {
+	path, keyPath := writeSecretsFile(t, "RADIUS_SECRET=encrypted\n")
+	key, _ := ReadSecretsKey(keyPath)
+	sealed, _ := os.ReadFile(path)
+
+	if plaintext, err := DecryptSecrets(key, sealed); err != nil || string(plaintext) != "RADIUS_SECRET=encrypted\n" {
+		t.Fatalf("Expected the plaintext back, got %q (%v)", plaintext, err)
+	}
+
+	header, body, _ := strings.Cut(string(sealed), "\n")
+	flipped := []byte(body)
+	flipped[len(flipped)/2] ^= 'A' ^ 'B'
+	if _, err := DecryptSecrets(key, []byte(header+"\n"+string(flipped))); err == nil {
+		t.Error("Expected a tampered file to be rejected")
+	}
+	if _, err := DecryptSecrets(key, []byte("RADIUS_SECRET=plain\n")); err == nil {
+		t.Error("Expected a plain file to be rejected")
+	}
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Lookup returns the value of a setting by its environment variable name
+type Lookup func(key string) (string, bool)
+
+// Layered combines lookups, the first one with a non-empty value for a key wins
+func Layered(lookups ...Lookup) Lookup {
+	return func(key string) (string, bool) {
+		for _, lookup := range lookups {
+			if value, ok := lookup(key); ok && value != "" {
+				return value, true
+			}
+		}
+		return "", false
+	}
+}
+
+// Overrides serves the settings in values before falling back to lookup. Unlike a layer of
+// Layered, a key present in values wins even when empty, so a flag given on the command line
+// as -redis-password= clears a password set in the environment or the config file.
+func Overrides(values map[string]string, lookup Lookup) Lookup {
+	return func(key string) (string, bool) {
+		if value, ok := values[key]; ok {
+			return value, true
+		}
+		return lookup(key)
+	}
+}
+
+// MapLookup serves settings from a map
+func MapLookup(values map[string]string) Lookup {
+	return func(key string) (string, bool) {
+		value, ok := values[key]
+		return value, ok
+	}
+}
+
+// ReadEnvFile reads KEY=VALUE settings from a file using the environment variable names.
+// Blank lines and lines starting with # are ignored, values may be quoted and lines may
+// start with "export ".
+func ReadEnvFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %v", err)
+	}
+	defer file.Close()
+
+	return parseEnvFile(file, path)
+}
+
+// parseEnvFile reads the KEY=VALUE lines of ReadEnvFile, errors name the line but never
+// show it, as it may hold a secret
+func parseEnvFile(r io.Reader, path string) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, lineNo)
+		}
+
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			if value[0] == '"' {
+				unquoted, err := strconv.Unquote(value)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid quoted value: %v", path, lineNo, err)
+				}
+				value = unquoted
+			} else {
+				value = value[1 : len(value)-1]
+			}
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	return values, nil
+}
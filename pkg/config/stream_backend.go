@@ -0,0 +1,53 @@
+package config
+
+import "dni/pkg/stream"
+
+const (
+	// StreamKafka publishes accounting events to a Kafka topic instead of the datastore's stream
+	StreamKafka = "kafka"
+	// StreamNATS publishes accounting events to NATS JetStream subjects
+	StreamNATS = "nats"
+)
+
+// StreamBackendConfig selects where accounting events are published. By default they go
+// to the stream of the datastore backend: Redis streams, or the SQLite event log.
+type StreamBackendConfig struct {
+	StreamBackend string
+	// KafkaBrokers are the seed brokers, e.g. kafka-1:9092
+	KafkaBrokers []string
+	KafkaTopic   string
+	// NATSURL is a comma separated list of NATS server URLs
+	NATSURL string
+}
+
+func defaultStreamBackendConfig() StreamBackendConfig {
+	return StreamBackendConfig{
+		KafkaTopic: stream.DefaultKafkaTopic,
+		NATSURL:    "nats://127.0.0.1:4222",
+	}
+}
+
+// loadStreamBackendConfig reads STREAM_BACKEND, KAFKA_BROKERS, KAFKA_TOPIC and NATS_URL
+func loadStreamBackendConfig(getenv func(string) string, config *StreamBackendConfig, errs *errorList) {
+	if backend := getenv("STREAM_BACKEND"); backend != "" {
+		switch backend {
+		case StreamKafka, StreamNATS:
+			config.StreamBackend = backend
+		default:
+			errs.addf("STREAM_BACKEND", "invalid STREAM_BACKEND: %s (expected %s or %s, or unset to follow DATASTORE_BACKEND)", backend, StreamKafka, StreamNATS)
+		}
+	}
+
+	config.KafkaBrokers = SplitList(getenv("KAFKA_BROKERS"))
+	if config.StreamBackend == StreamKafka && len(config.KafkaBrokers) == 0 {
+		errs.addf("KAFKA_BROKERS", "KAFKA_BROKERS is required with STREAM_BACKEND=%s", StreamKafka)
+	}
+
+	if topic := getenv("KAFKA_TOPIC"); topic != "" {
+		config.KafkaTopic = topic
+	}
+
+	if url := getenv("NATS_URL"); url != "" {
+		config.NATSURL = url
+	}
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldError is one invalid setting. Path locates it in a config file, e.g.
+// "redis.port", and Key names its environment variable when it has one.
+type FieldError struct {
+	Path string
+	Key  string
+	Err  error
+}
+
+func (e FieldError) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+// ValidationError reports every invalid setting of a configuration, not just the first
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Errors) == 1 {
+		return e.Errors[0].Error()
+	}
+	lines := make([]string, len(e.Errors))
+	for i, fieldErr := range e.Errors {
+		lines[i] = "  " + fieldErr.Error()
+	}
+	return fmt.Sprintf("%d invalid settings:\n%s", len(e.Errors), strings.Join(lines, "\n"))
+}
+
+// errorList collects the errors found while loading a configuration
+type errorList struct {
+	errors []FieldError
+}
+
+// add records an invalid setting by its environment variable name
+func (l *errorList) add(key string, err error) {
+	l.errors = append(l.errors, FieldError{Path: settingPaths[key], Key: key, Err: err})
+}
+
+// addf records an invalid setting with a formatted message
+func (l *errorList) addf(key, format string, args ...interface{}) {
+	l.add(key, fmt.Errorf(format, args...))
+}
+
+// addPath records an invalid config file value that has no environment variable of its own
+func (l *errorList) addPath(path string, err error) {
+	l.errors = append(l.errors, FieldError{Path: path, Err: err})
+}
+
+// err returns a *ValidationError with the collected errors, nil when there are none
+func (l *errorList) err() error {
+	if len(l.errors) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: l.errors}
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"dni/pkg/stream"
+)
+
+// WebhookConfig lists the HTTP endpoints notified when sessions start or stop
+type WebhookConfig struct {
+	// WebhookUserURLs and WebhookNASURLs map usernames ("*" for everyone) and NAS-IP-Addresses to URLs
+	WebhookUserURLs map[string][]string
+	WebhookNASURLs  map[string][]string
+	// WebhookSecret signs the request bodies with HMAC-SHA256
+	WebhookSecret string
+	// WebhookQueuePath is the SQLite file holding deliveries until they succeed
+	WebhookQueuePath   string
+	WebhookMaxAttempts int
+	WebhookTimeout     time.Duration
+}
+
+func defaultWebhookConfig() WebhookConfig {
+	defaults := stream.DefaultWebhookOptions()
+	return WebhookConfig{
+		WebhookQueuePath:   "webhooks.db",
+		WebhookMaxAttempts: defaults.MaxAttempts,
+		WebhookTimeout:     defaults.Timeout,
+	}
+}
+
+// WebhookRoutes returns the configured routes for stream.NewWebhookStream
+func (c WebhookConfig) WebhookRoutes() stream.WebhookRoutes {
+	return stream.WebhookRoutes{Users: c.WebhookUserURLs, NAS: c.WebhookNASURLs}
+}
+
+// loadWebhookConfig reads WEBHOOK_USER_URLS, WEBHOOK_NAS_URLS, WEBHOOK_SECRET,
+// WEBHOOK_QUEUE_PATH, WEBHOOK_MAX_ATTEMPTS and WEBHOOK_TIMEOUT_MS
+func loadWebhookConfig(getenv func(string) string, config *WebhookConfig, errs *errorList) {
+	var err error
+	if config.WebhookUserURLs, err = parseWebhookURLs("WEBHOOK_USER_URLS", getenv("WEBHOOK_USER_URLS")); err != nil {
+		errs.add("WEBHOOK_USER_URLS", err)
+	}
+	if config.WebhookNASURLs, err = parseWebhookURLs("WEBHOOK_NAS_URLS", getenv("WEBHOOK_NAS_URLS")); err != nil {
+		errs.add("WEBHOOK_NAS_URLS", err)
+	}
+
+	config.WebhookSecret = getenv("WEBHOOK_SECRET")
+	if config.WebhookSecret == "" && !config.WebhookRoutes().Empty() {
+		errs.addf("WEBHOOK_SECRET", "WEBHOOK_SECRET is required with WEBHOOK_USER_URLS or WEBHOOK_NAS_URLS")
+	}
+
+	if path := getenv("WEBHOOK_QUEUE_PATH"); path != "" {
+		config.WebhookQueuePath = path
+	}
+
+	if attemptsStr := getenv("WEBHOOK_MAX_ATTEMPTS"); attemptsStr != "" {
+		attempts, err := strconv.Atoi(attemptsStr)
+		if err != nil || attempts <= 0 {
+			errs.addf("WEBHOOK_MAX_ATTEMPTS", "invalid WEBHOOK_MAX_ATTEMPTS: %s", attemptsStr)
+		} else {
+			config.WebhookMaxAttempts = attempts
+		}
+	}
+
+	if timeoutStr := getenv("WEBHOOK_TIMEOUT_MS"); timeoutStr != "" {
+		timeoutMs, err := strconv.Atoi(timeoutStr)
+		if err != nil || timeoutMs <= 0 {
+			errs.addf("WEBHOOK_TIMEOUT_MS", "invalid WEBHOOK_TIMEOUT_MS: %s", timeoutStr)
+		} else {
+			config.WebhookTimeout = time.Duration(timeoutMs) * time.Millisecond
+		}
+	}
+}
+
+// parseWebhookURLs parses "key=url,key=url,..." where a key may be repeated to notify several URLs
+func parseWebhookURLs(name, value string) (map[string][]string, error) {
+	routes := make(map[string][]string)
+	for _, pair := range SplitList(value) {
+		key, rawURL, ok := strings.Cut(pair, "=")
+		key, rawURL = strings.TrimSpace(key), strings.TrimSpace(rawURL)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid %s: %q is not key=url", name, pair)
+		}
+		parsed, err := url.Parse(rawURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid %s: %q is not an http or https URL", name, rawURL)
+		}
+		routes[key] = append(routes[key], rawURL)
+	}
+	return routes, nil
+}
@@ -1,26 +1,63 @@
 package datastore
 
-import "time"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"dni/pkg/stream"
+)
+
+// ErrNotFound is returned when a record does not exist or has expired
+var ErrNotFound = errors.New("record not found")
 
 // AccountingRecord represents accounting data to be stored
 type AccountingRecord struct {
-	Username         string
-	NASIPAddress     string
-	NASPort          string
-	AcctStatusType   string
-	AcctSessionID    string
-	FramedIPAddress  string
-	CallingStationID string
-	CalledStationID  string
-	PacketType       string
-	Timestamp        string
+	Username         string `json:"username"`
+	NASIPAddress     string `json:"nas_ip_address"`
+	NASPort          string `json:"nas_port"`
+	AcctStatusType   string `json:"acct_status_type"`
+	AcctSessionID    string `json:"acct_session_id"`
+	FramedIPAddress  string `json:"framed_ip_address"`
+	CallingStationID string `json:"calling_station_id"`
+	CalledStationID  string `json:"called_station_id"`
+	PacketType       string `json:"packet_type"`
+	Timestamp        string `json:"timestamp"`
+	// RequestID identifies the RADIUS request by client address, packet identifier and
+	// request authenticator, so retransmissions of a request share it. Only PostgreSQL keeps it.
+	RequestID string `json:"request_id,omitempty"`
 	// Optional session metrics for STOP records
-	AcctInputOctets  string
-	AcctOutputOctets string
-	AcctSessionTime  string
+	AcctInputOctets  string `json:"acct_input_octets,omitempty"`
+	AcctOutputOctets string `json:"acct_output_octets,omitempty"`
+	AcctSessionTime  string `json:"acct_session_time,omitempty"`
 }
 
-// Datastore interface defines methods for storing accounting records
+// Datastore interface defines methods for storing and loading accounting records
 type Datastore interface {
-	Save(key string, record AccountingRecord, ttl time.Duration) error
+	Save(ctx context.Context, key string, record AccountingRecord, ttl time.Duration) error
+	Get(ctx context.Context, key string) (AccountingRecord, error)
+}
+
+// AtomicPublisher is implemented by datastores that can store a record and publish
+// its stream notification in a single write
+type AtomicPublisher interface {
+	SaveAndPublish(ctx context.Context, key string, record AccountingRecord, ttl time.Duration, streamKey string, message stream.StreamMessage) error
+}
+
+// RecordKey returns the key of a session's accounting record. With hashTag the username
+// is wrapped in {} so all of a user's keys land on the same Redis Cluster slot.
+func RecordKey(username, sessionID string, hashTag bool) string {
+	if hashTag {
+		return fmt.Sprintf("radius:acct:{%s}:%s", username, sessionID)
+	}
+	return fmt.Sprintf("radius:acct:%s:%s", username, sessionID)
+}
+
+// SessionIndexKey returns the key of the sorted set indexing a user's record keys by last update
+func SessionIndexKey(username string, hashTag bool) string {
+	if hashTag {
+		return fmt.Sprintf("radius:sessions:{%s}", username)
+	}
+	return fmt.Sprintf("radius:sessions:%s", username)
 }
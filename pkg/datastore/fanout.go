@@ -0,0 +1,400 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dni/pkg/stream"
+)
+
+const (
+	// FanoutAll fails a Save when any backend fails
+	FanoutAll = "all"
+	// FanoutPrimary fails a Save only when the primary fails, secondary errors are counted and logged
+	FanoutPrimary = "primary"
+	// FanoutAsync writes the primary within the request and queues secondary writes, retrying them with backoff
+	FanoutAsync = "async"
+)
+
+// FanoutOptions configures how a FanoutStore writes to its secondaries
+type FanoutOptions struct {
+	Policy string
+	// QueueSize bounds the async writes waiting per secondary, writes beyond it are dropped
+	QueueSize int
+	// MaxAttempts is how often an async write is tried before it is dropped
+	MaxAttempts int
+	// RetryBackoff is the delay before the first retry, doubling up to MaxBackoff
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+	// WriteTimeout bounds each async write attempt
+	WriteTimeout time.Duration
+}
+
+// DefaultFanoutOptions returns the options used for unset FanoutOptions fields
+func DefaultFanoutOptions() FanoutOptions {
+	return FanoutOptions{
+		Policy:       FanoutPrimary,
+		QueueSize:    1000,
+		MaxAttempts:  5,
+		RetryBackoff: 100 * time.Millisecond,
+		MaxBackoff:   10 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	}
+}
+
+// NamedStore is a backend of a FanoutStore, Name labels its metrics and log lines
+type NamedStore struct {
+	Name  string
+	Store Datastore
+}
+
+// BackendStats are the counters of one FanoutStore backend
+type BackendStats struct {
+	Name    string
+	Writes  int64
+	Errors  int64
+	Retries int64
+	Dropped int64
+	// Queued is the number of async writes waiting, always 0 for the primary
+	Queued int64
+}
+
+type fanoutBackend struct {
+	NamedStore
+	writes  atomic.Int64
+	errors  atomic.Int64
+	retries atomic.Int64
+	dropped atomic.Int64
+	queue   chan fanoutWrite
+}
+
+type fanoutWrite struct {
+	key    string
+	record AccountingRecord
+	ttl    time.Duration
+}
+
+// FanoutStore writes every record to a primary and a set of secondary datastores, e.g.
+// Redis for real-time consumers and PostgreSQL for billing. Reads go to the primary and
+// fall back to the secondaries when it fails.
+type FanoutStore struct {
+	primary     *fanoutBackend
+	secondaries []*fanoutBackend
+	opts        FanoutOptions
+
+	workers sync.WaitGroup
+	// closeMu guards the queues against writes racing Close
+	closeMu sync.RWMutex
+	closed  bool
+	// abort stops async retries once Close runs out of time
+	abort     chan struct{}
+	abortOnce sync.Once
+}
+
+// NewFanoutStore creates a FanoutStore. With the async policy a worker per secondary
+// drains its queue until Close.
+func NewFanoutStore(opts FanoutOptions, primary NamedStore, secondaries ...NamedStore) (*FanoutStore, error) {
+	defaults := DefaultFanoutOptions()
+	if opts.Policy == "" {
+		opts.Policy = defaults.Policy
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaults.QueueSize
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaults.MaxAttempts
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = defaults.RetryBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaults.MaxBackoff
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = defaults.WriteTimeout
+	}
+
+	switch opts.Policy {
+	case FanoutAll, FanoutPrimary, FanoutAsync:
+	default:
+		return nil, fmt.Errorf("invalid fan-out policy %q (expected %s, %s or %s)", opts.Policy, FanoutAll, FanoutPrimary, FanoutAsync)
+	}
+
+	fs := &FanoutStore{
+		primary: &fanoutBackend{NamedStore: primary},
+		opts:    opts,
+		abort:   make(chan struct{}),
+	}
+	for _, s := range secondaries {
+		backend := &fanoutBackend{NamedStore: s}
+		if opts.Policy == FanoutAsync {
+			backend.queue = make(chan fanoutWrite, opts.QueueSize)
+			fs.workers.Add(1)
+			go fs.drain(backend)
+		}
+		fs.secondaries = append(fs.secondaries, backend)
+	}
+
+	return fs, nil
+}
+
+// Save stores record in the primary and the secondaries according to the policy
+func (fs *FanoutStore) Save(ctx context.Context, key string, record AccountingRecord, ttl time.Duration) error {
+	return fs.fanout(ctx, key, record, ttl, func(ctx context.Context) error {
+		return fs.primary.Store.Save(ctx, key, record, ttl)
+	})
+}
+
+// fanout runs writePrimary and saves record in the secondaries. With the all policy
+// every backend is written concurrently and any failure fails the call; nothing is rolled back.
+func (fs *FanoutStore) fanout(ctx context.Context, key string, record AccountingRecord, ttl time.Duration, writePrimary func(ctx context.Context) error) error {
+	if fs.opts.Policy == FanoutAsync {
+		if err := fs.primary.observe(writePrimary(ctx)); err != nil {
+			return err
+		}
+		for _, backend := range fs.secondaries {
+			fs.enqueue(backend, fanoutWrite{key: key, record: record, ttl: ttl})
+		}
+		return nil
+	}
+
+	errs := make([]error, len(fs.secondaries))
+	var wg sync.WaitGroup
+	for i, backend := range fs.secondaries {
+		wg.Add(1)
+		go func(i int, backend *fanoutBackend) {
+			defer wg.Done()
+			errs[i] = backend.observe(backend.Store.Save(ctx, key, record, ttl))
+		}(i, backend)
+	}
+
+	// Secondaries are written concurrently with the primary, so the slowest backend sets the latency
+	primaryErr := fs.primary.observe(writePrimary(ctx))
+	wg.Wait()
+
+	var failed []string
+	if primaryErr != nil {
+		failed = append(failed, fmt.Sprintf("%s: %v", fs.primary.Name, primaryErr))
+	}
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if fs.opts.Policy == FanoutPrimary {
+			log.Printf("[DATASTORE] Failed to store %s in secondary %s: %v", key, fs.secondaries[i].Name, err)
+			continue
+		}
+		failed = append(failed, fmt.Sprintf("%s: %v", fs.secondaries[i].Name, err))
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to store data in %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Get loads a record from the primary, falling back to the secondaries when the primary
+// fails. A record missing from the primary is reported as missing.
+func (fs *FanoutStore) Get(ctx context.Context, key string) (AccountingRecord, error) {
+	record, err := fs.primary.Store.Get(ctx, key)
+	if err == nil || errors.Is(err, ErrNotFound) {
+		return record, err
+	}
+
+	for _, backend := range fs.secondaries {
+		if record, secondaryErr := backend.Store.Get(ctx, key); secondaryErr == nil {
+			log.Printf("[DATASTORE] Loaded %s from secondary %s, primary failed: %v", key, backend.Name, err)
+			return record, nil
+		}
+	}
+	return AccountingRecord{}, err
+}
+
+// enqueue hands an async write to a secondary's worker, dropping it when the queue is full
+func (fs *FanoutStore) enqueue(backend *fanoutBackend, write fanoutWrite) {
+	fs.closeMu.RLock()
+	defer fs.closeMu.RUnlock()
+
+	if fs.closed {
+		backend.dropped.Add(1)
+		log.Printf("[DATASTORE] Datastore closed, dropped write of %s to %s", write.key, backend.Name)
+		return
+	}
+
+	select {
+	case backend.queue <- write:
+	default:
+		backend.dropped.Add(1)
+		log.Printf("[DATASTORE] Retry queue of %s is full, dropped %s", backend.Name, write.key)
+	}
+}
+
+// drain writes queued records to backend until its queue is closed
+func (fs *FanoutStore) drain(backend *fanoutBackend) {
+	defer fs.workers.Done()
+
+	for write := range backend.queue {
+		select {
+		case <-fs.abort:
+			backend.dropped.Add(1)
+			continue
+		default:
+		}
+		fs.deliver(backend, write)
+	}
+}
+
+// deliver tries write up to MaxAttempts times with exponential backoff
+func (fs *FanoutStore) deliver(backend *fanoutBackend, write fanoutWrite) {
+	backoff := fs.opts.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), fs.opts.WriteTimeout)
+		err := backend.observe(backend.Store.Save(ctx, write.key, write.record, write.ttl))
+		cancel()
+		if err == nil {
+			return
+		}
+
+		if attempt >= fs.opts.MaxAttempts {
+			backend.dropped.Add(1)
+			log.Printf("[DATASTORE] Giving up on storing %s in %s after %d attempts: %v", write.key, backend.Name, attempt, err)
+			return
+		}
+
+		select {
+		case <-fs.abort:
+			backend.dropped.Add(1)
+			return
+		case <-time.After(backoff):
+		}
+		backend.retries.Add(1)
+		backoff *= 2
+		if backoff > fs.opts.MaxBackoff {
+			backoff = fs.opts.MaxBackoff
+		}
+	}
+}
+
+// Close stops accepting async writes and waits for the queues to drain. When ctx ends
+// first, pending retries are abandoned and counted as dropped.
+func (fs *FanoutStore) Close(ctx context.Context) error {
+	fs.closeMu.Lock()
+	if !fs.closed {
+		fs.closed = true
+		for _, backend := range fs.secondaries {
+			if backend.queue != nil {
+				close(backend.queue)
+			}
+		}
+	}
+	fs.closeMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		fs.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		fs.abortOnce.Do(func() { close(fs.abort) })
+		<-done
+		return fmt.Errorf("failed to drain datastore retry queues: %v", ctx.Err())
+	}
+}
+
+// Stats returns the counters of the primary followed by the secondaries
+func (fs *FanoutStore) Stats() []BackendStats {
+	stats := []BackendStats{fs.primary.stats()}
+	for _, backend := range fs.secondaries {
+		stats = append(stats, backend.stats())
+	}
+	return stats
+}
+
+// WriteMetrics writes the backend counters in the Prometheus text format
+func (fs *FanoutStore) WriteMetrics(w io.Writer) {
+	stats := fs.Stats()
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value func(BackendStats) int64
+	}{
+		{"radius_datastore_writes_total", "counter", "Records stored per backend.", func(s BackendStats) int64 { return s.Writes }},
+		{"radius_datastore_errors_total", "counter", "Failed writes per backend, including retried ones.", func(s BackendStats) int64 { return s.Errors }},
+		{"radius_datastore_retries_total", "counter", "Async writes retried per backend.", func(s BackendStats) int64 { return s.Retries }},
+		{"radius_datastore_dropped_total", "counter", "Async writes given up on per backend.", func(s BackendStats) int64 { return s.Dropped }},
+		{"radius_datastore_queue_depth", "gauge", "Async writes waiting per backend.", func(s BackendStats) int64 { return s.Queued }},
+	}
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+		for _, s := range stats {
+			fmt.Fprintf(w, "%s{backend=%q} %d\n", m.name, s.Name, m.value(s))
+		}
+	}
+}
+
+// observe counts the outcome of a write and passes err through
+func (b *fanoutBackend) observe(err error) error {
+	if err != nil {
+		b.errors.Add(1)
+		return err
+	}
+	b.writes.Add(1)
+	return nil
+}
+
+func (b *fanoutBackend) stats() BackendStats {
+	return BackendStats{
+		Name:    b.Name,
+		Writes:  b.writes.Load(),
+		Errors:  b.errors.Load(),
+		Retries: b.retries.Load(),
+		Dropped: b.dropped.Load(),
+		Queued:  int64(len(b.queue)),
+	}
+}
+
+// PublishingFanoutStore is a FanoutStore whose primary stores records and publishes
+// their stream notifications in a single write
+type PublishingFanoutStore struct {
+	*FanoutStore
+	publisher AtomicPublisher
+}
+
+// NewPublishingFanoutStore creates a FanoutStore on a primary that implements AtomicPublisher
+func NewPublishingFanoutStore(opts FanoutOptions, primary NamedStore, secondaries ...NamedStore) (*PublishingFanoutStore, error) {
+	publisher, ok := primary.Store.(AtomicPublisher)
+	if !ok {
+		return nil, fmt.Errorf("primary datastore %s cannot publish stream notifications", primary.Name)
+	}
+
+	fs, err := NewFanoutStore(opts, primary, secondaries...)
+	if err != nil {
+		return nil, err
+	}
+	return &PublishingFanoutStore{
+		FanoutStore: fs,
+		publisher:   publisher,
+	}, nil
+}
+
+// SaveAndPublish stores record and publishes message through the primary, then fans the
+// record out to the secondaries like Save
+func (pf *PublishingFanoutStore) SaveAndPublish(ctx context.Context, key string, record AccountingRecord, ttl time.Duration, streamKey string, message stream.StreamMessage) error {
+	return pf.fanout(ctx, key, record, ttl, func(ctx context.Context) error {
+		return pf.publisher.SaveAndPublish(ctx, key, record, ttl, streamKey, message)
+	})
+}
@@ -0,0 +1,292 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"dni/pkg/stream"
+)
+
+// failingStore is a MemoryStore whose next failures calls to Save and Get return an error
+type failingStore struct {
+	*MemoryStore
+	mu       sync.Mutex
+	failures int
+	// started receives the key of every Save before release is awaited, when set
+	started chan string
+	release chan struct{}
+}
+
+func newFailingStore(failures int) *failingStore {
+	return &failingStore{MemoryStore: NewMemoryStore(), failures: failures}
+}
+
+func (fs *failingStore) fail() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.failures == 0 {
+		return nil
+	}
+	fs.failures--
+	return errors.New("connection refused")
+}
+
+func (fs *failingStore) Save(ctx context.Context, key string, record AccountingRecord, ttl time.Duration) error {
+	if fs.started != nil {
+		fs.started <- key
+		<-fs.release
+	}
+	if err := fs.fail(); err != nil {
+		return err
+	}
+	return fs.MemoryStore.Save(ctx, key, record, ttl)
+}
+
+func (fs *failingStore) Get(ctx context.Context, key string) (AccountingRecord, error) {
+	if err := fs.fail(); err != nil {
+		return AccountingRecord{}, err
+	}
+	return fs.MemoryStore.Get(ctx, key)
+}
+
+func TestFanoutStore_Policies(t *testing.T) {
+	tests := []struct {
+		name             string
+		policy           string
+		primaryFailures  int
+		secondaryFailure int
+		expectErr        bool
+	}{
+		{name: "all succeed", policy: FanoutAll},
+		{name: "all fails on a secondary error", policy: FanoutAll, secondaryFailure: 1, expectErr: true},
+		{name: "primary ignores a secondary error", policy: FanoutPrimary, secondaryFailure: 1},
+		{name: "primary fails on a primary error", policy: FanoutPrimary, primaryFailures: 1, expectErr: true},
+		{name: "async fails on a primary error", policy: FanoutAsync, primaryFailures: 1, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			primary := newFailingStore(tt.primaryFailures)
+			secondary := newFailingStore(tt.secondaryFailure)
+
+			fs, err := NewFanoutStore(FanoutOptions{Policy: tt.policy, MaxAttempts: 1},
+				NamedStore{Name: "redis", Store: primary},
+				NamedStore{Name: "postgres", Store: secondary})
+			if err != nil {
+				t.Fatalf("NewFanoutStore returned error: %v", err)
+			}
+
+			key := RecordKey("alice", "s1", false)
+			err = fs.Save(ctx, key, AccountingRecord{Username: "alice"}, time.Hour)
+			if tt.expectErr != (err != nil) {
+				t.Errorf("Expected error %t, got %v", tt.expectErr, err)
+			}
+			if err := fs.Close(ctx); err != nil {
+				t.Fatalf("Close returned error: %v", err)
+			}
+
+			_, primaryErr := primary.MemoryStore.Get(ctx, key)
+			if (tt.primaryFailures == 0) != (primaryErr == nil) {
+				t.Errorf("Unexpected primary state: %v", primaryErr)
+			}
+			stats := fs.Stats()
+			if stats[0].Errors != int64(tt.primaryFailures) {
+				t.Errorf("Expected %d primary errors, got %+v", tt.primaryFailures, stats[0])
+			}
+			// The async policy never reaches the secondaries when the primary fails
+			if tt.policy != FanoutAsync && stats[1].Errors != int64(tt.secondaryFailure) {
+				t.Errorf("Expected %d secondary errors, got %+v", tt.secondaryFailure, stats[1])
+			}
+		})
+	}
+
+	if _, err := NewFanoutStore(FanoutOptions{Policy: "quorum"}, NamedStore{Name: "redis", Store: NewMemoryStore()}); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestFanoutStore_AsyncRetry(t *testing.T) {
+	ctx := context.Background()
+	secondary := newFailingStore(2)
+
+	fs, err := NewFanoutStore(FanoutOptions{Policy: FanoutAsync, MaxAttempts: 3, RetryBackoff: time.Millisecond},
+		NamedStore{Name: "redis", Store: NewMemoryStore()},
+		NamedStore{Name: "postgres", Store: secondary})
+	if err != nil {
+		t.Fatalf("NewFanoutStore returned error: %v", err)
+	}
+
+	key := RecordKey("alice", "s1", false)
+	if err := fs.Save(ctx, key, AccountingRecord{Username: "alice"}, time.Hour); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if err := fs.Close(ctx); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	if _, err := secondary.MemoryStore.Get(ctx, key); err != nil {
+		t.Errorf("Expected the retried write to reach the secondary, got %v", err)
+	}
+	expected := BackendStats{Name: "postgres", Writes: 1, Errors: 2, Retries: 2}
+	if stats := fs.Stats()[1]; stats != expected {
+		t.Errorf("Expected secondary stats %+v, got %+v", expected, stats)
+	}
+
+	// Writes after Close are dropped instead of panicking on the closed queue
+	if err := fs.Save(ctx, key, AccountingRecord{Username: "alice"}, time.Hour); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if dropped := fs.Stats()[1].Dropped; dropped != 1 {
+		t.Errorf("Expected the write after Close to be dropped, got %d", dropped)
+	}
+}
+
+func TestFanoutStore_AsyncQueueFull(t *testing.T) {
+	ctx := context.Background()
+	secondary := newFailingStore(0)
+	secondary.started = make(chan string, 3)
+	secondary.release = make(chan struct{})
+
+	fs, err := NewFanoutStore(FanoutOptions{Policy: FanoutAsync, QueueSize: 1},
+		NamedStore{Name: "redis", Store: NewMemoryStore()},
+		NamedStore{Name: "sqlite", Store: secondary})
+	if err != nil {
+		t.Fatalf("NewFanoutStore returned error: %v", err)
+	}
+
+	// The worker blocks on s1, s2 waits in the queue and s3 finds it full
+	fs.Save(ctx, RecordKey("alice", "s1", false), AccountingRecord{Username: "alice"}, time.Hour)
+	<-secondary.started
+	fs.Save(ctx, RecordKey("alice", "s2", false), AccountingRecord{Username: "alice"}, time.Hour)
+	fs.Save(ctx, RecordKey("alice", "s3", false), AccountingRecord{Username: "alice"}, time.Hour)
+
+	if stats := fs.Stats()[1]; stats.Queued != 1 || stats.Dropped != 1 {
+		t.Errorf("Expected 1 queued and 1 dropped write, got %+v", stats)
+	}
+
+	close(secondary.release)
+	if err := fs.Close(ctx); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	sessions, _ := secondary.Sessions(ctx, "alice")
+	if len(sessions) != 2 {
+		t.Errorf("Expected the two accepted writes in the secondary, got %v", sessions)
+	}
+}
+
+func TestFanoutStore_CloseTimeout(t *testing.T) {
+	secondary := newFailingStore(100)
+
+	fs, err := NewFanoutStore(FanoutOptions{Policy: FanoutAsync, MaxAttempts: 100, RetryBackoff: time.Hour},
+		NamedStore{Name: "redis", Store: NewMemoryStore()},
+		NamedStore{Name: "postgres", Store: secondary})
+	if err != nil {
+		t.Fatalf("NewFanoutStore returned error: %v", err)
+	}
+	fs.Save(context.Background(), RecordKey("alice", "s1", false), AccountingRecord{Username: "alice"}, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := fs.Close(ctx); err == nil {
+		t.Error("Expected an error when the retries outlast Close")
+	}
+	if dropped := fs.Stats()[1].Dropped; dropped != 1 {
+		t.Errorf("Expected the abandoned write to be dropped, got %d", dropped)
+	}
+}
+
+func TestFanoutStore_GetFallback(t *testing.T) {
+	ctx := context.Background()
+	primary := newFailingStore(0)
+	secondary := NewMemoryStore()
+
+	fs, err := NewFanoutStore(FanoutOptions{Policy: FanoutAll},
+		NamedStore{Name: "redis", Store: primary},
+		NamedStore{Name: "postgres", Store: secondary})
+	if err != nil {
+		t.Fatalf("NewFanoutStore returned error: %v", err)
+	}
+
+	key := RecordKey("alice", "s1", false)
+	fs.Save(ctx, key, AccountingRecord{Username: "alice", AcctStatusType: "1"}, time.Hour)
+
+	primary.failures = 1
+	record, err := fs.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Expected the secondary to answer when the primary fails, got %v", err)
+	}
+	if record.AcctStatusType != "1" {
+		t.Errorf("Expected the stored record, got %+v", record)
+	}
+
+	// A record the primary does not have is missing, even if a secondary still has it
+	primary.MemoryStore = NewMemoryStore()
+	if _, err := fs.Get(ctx, key); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestFanoutStore_WriteMetrics(t *testing.T) {
+	ctx := context.Background()
+	fs, err := NewFanoutStore(FanoutOptions{Policy: FanoutPrimary},
+		NamedStore{Name: "redis", Store: NewMemoryStore()},
+		NamedStore{Name: "postgres", Store: newFailingStore(1)})
+	if err != nil {
+		t.Fatalf("NewFanoutStore returned error: %v", err)
+	}
+	fs.Save(ctx, RecordKey("alice", "s1", false), AccountingRecord{Username: "alice"}, time.Hour)
+	fs.Save(ctx, RecordKey("alice", "s2", false), AccountingRecord{Username: "alice"}, time.Hour)
+
+	var buf bytes.Buffer
+	fs.WriteMetrics(&buf)
+	for _, line := range []string{
+		`radius_datastore_writes_total{backend="redis"} 2`,
+		`radius_datastore_writes_total{backend="postgres"} 1`,
+		`radius_datastore_errors_total{backend="postgres"} 1`,
+		`radius_datastore_queue_depth{backend="postgres"} 0`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestPublishingFanoutStore_SaveAndPublish(t *testing.T) {
+	ctx := context.Background()
+	primary := newTestSQLiteStore(t)
+	secondary := NewMemoryStore()
+
+	if _, err := NewPublishingFanoutStore(FanoutOptions{}, NamedStore{Name: "memory", Store: secondary}); err == nil {
+		t.Error("Expected an error for a primary that cannot publish")
+	}
+
+	pf, err := NewPublishingFanoutStore(FanoutOptions{Policy: FanoutAll},
+		NamedStore{Name: "sqlite", Store: primary},
+		NamedStore{Name: "memory", Store: secondary})
+	if err != nil {
+		t.Fatalf("NewPublishingFanoutStore returned error: %v", err)
+	}
+
+	key := RecordKey("alice", "s1", false)
+	message := stream.StreamMessage{Key: key, Username: "alice"}
+	if err := pf.SaveAndPublish(ctx, key, AccountingRecord{Username: "alice"}, time.Hour, "radius:updates:alice", message); err != nil {
+		t.Fatalf("SaveAndPublish returned error: %v", err)
+	}
+
+	if _, err := secondary.Get(ctx, key); err != nil {
+		t.Errorf("Expected the record in the secondary, got %v", err)
+	}
+	messages, _, err := primary.appender.(stream.Replayer).Replay(ctx, "radius:updates:alice", "-", "+", 10, nil)
+	if err != nil {
+		t.Fatalf("Replay returned error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Key != key {
+		t.Errorf("Expected the notification in the primary stream, got %+v", messages)
+	}
+}
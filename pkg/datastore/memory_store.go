@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	clock "go.llib.dev/testcase/clock"
+)
+
+// MemoryStore implements the Datastore interface in process memory, for tests and development.
+// Records expire after their TTL on the testcase clock, so tests can travel past it.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	records map[string]memoryRecord
+}
+
+type memoryRecord struct {
+	record    AccountingRecord
+	updatedAt time.Time
+	expiresAt time.Time
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		records: make(map[string]memoryRecord),
+	}
+}
+
+// Save stores an accounting record that expires after ttl. Like HMSET, session metrics
+// already stored are kept when the new record does not carry them.
+func (ms *MemoryStore) Save(ctx context.Context, key string, record AccountingRecord, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := clock.Now()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// Drop records that have expired since, like the Redis index trimming on save
+	for k, r := range ms.records {
+		if !now.Before(r.expiresAt) {
+			delete(ms.records, k)
+		}
+	}
+
+	if existing, ok := ms.records[key]; ok {
+		if record.AcctInputOctets == "" {
+			record.AcctInputOctets = existing.record.AcctInputOctets
+		}
+		if record.AcctOutputOctets == "" {
+			record.AcctOutputOctets = existing.record.AcctOutputOctets
+		}
+		if record.AcctSessionTime == "" {
+			record.AcctSessionTime = existing.record.AcctSessionTime
+		}
+	}
+
+	ms.records[key] = memoryRecord{
+		record:    record,
+		updatedAt: now,
+		expiresAt: now.Add(ttl),
+	}
+	return nil
+}
+
+// Get loads an accounting record stored by Save, expired records are not found
+func (ms *MemoryStore) Get(ctx context.Context, key string) (AccountingRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return AccountingRecord{}, err
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	r, ok := ms.records[key]
+	if !ok || !clock.Now().Before(r.expiresAt) {
+		return AccountingRecord{}, ErrNotFound
+	}
+	return r.record, nil
+}
+
+// Sessions returns the keys of a user's unexpired records, most recently updated first
+func (ms *MemoryStore) Sessions(ctx context.Context, username string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	now := clock.Now()
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	type session struct {
+		key       string
+		updatedAt time.Time
+	}
+	var sessions []session
+	for k, r := range ms.records {
+		if r.record.Username == username && now.Before(r.expiresAt) {
+			sessions = append(sessions, session{key: k, updatedAt: r.updatedAt})
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].updatedAt.Equal(sessions[j].updatedAt) {
+			return sessions[i].updatedAt.After(sessions[j].updatedAt)
+		}
+		return sessions[i].key < sessions[j].key
+	})
+
+	keys := make([]string, 0, len(sessions))
+	for _, s := range sessions {
+		keys = append(keys, s.key)
+	}
+	return keys, nil
+}
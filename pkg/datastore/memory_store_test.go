@@ -0,0 +1,64 @@
+package datastore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.llib.dev/testcase/clock/timecop"
+)
+
+func TestMemoryStore_SaveGet(t *testing.T) {
+	// freezing time to avoid flaky tests
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	key := RecordKey("alice", "s1", false)
+	stop := AccountingRecord{Username: "alice", AcctStatusType: "2", AcctInputOctets: "1024", AcctOutputOctets: "2048", AcctSessionTime: "60"}
+	if err := store.Save(ctx, key, stop, time.Hour); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+
+	// A later update without counters keeps the ones already stored, like HMSET
+	if err := store.Save(ctx, key, AccountingRecord{Username: "alice", AcctStatusType: "3"}, time.Hour); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+
+	got, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	expected := stop
+	expected.AcctStatusType = "3"
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected record %+v, got %+v", expected, got)
+	}
+
+	timecop.Travel(t, time.Hour, timecop.Freeze)
+	if _, err := store.Get(ctx, key); err != ErrNotFound {
+		t.Errorf("Expected the record to expire after its TTL, got %v", err)
+	}
+}
+
+func TestMemoryStore_Sessions(t *testing.T) {
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	for _, session := range []string{"s1", "s2", "s3"} {
+		store.Save(ctx, RecordKey("alice", session, false), AccountingRecord{Username: "alice"}, 150*time.Second)
+		timecop.Travel(t, time.Minute, timecop.Freeze)
+	}
+	store.Save(ctx, RecordKey("bob", "s1", false), AccountingRecord{Username: "bob"}, time.Hour)
+
+	sessions, err := store.Sessions(ctx, "alice")
+	if err != nil {
+		t.Fatalf("Sessions returned error: %v", err)
+	}
+	expected := []string{"radius:acct:alice:s3", "radius:acct:alice:s2"}
+	if !reflect.DeepEqual(sessions, expected) {
+		t.Errorf("Expected live sessions newest first %v, got %v", expected, sessions)
+	}
+}
@@ -0,0 +1,43 @@
+-- Latest state of every accounting session, one row per record key
+CREATE TABLE accounting_sessions (
+    session_key        TEXT PRIMARY KEY,
+    username           TEXT NOT NULL,
+    acct_session_id    TEXT NOT NULL,
+    nas_ip_address     TEXT NOT NULL DEFAULT '',
+    nas_port           BIGINT,
+    framed_ip_address  TEXT NOT NULL DEFAULT '',
+    calling_station_id TEXT NOT NULL DEFAULT '',
+    called_station_id  TEXT NOT NULL DEFAULT '',
+    acct_status_type   INTEGER NOT NULL,
+    started_at         TIMESTAMPTZ,
+    stopped_at         TIMESTAMPTZ,
+    updated_at         TIMESTAMPTZ NOT NULL,
+    input_octets       BIGINT,
+    output_octets      BIGINT,
+    session_time       BIGINT
+);
+
+CREATE INDEX accounting_sessions_username_idx ON accounting_sessions (username, updated_at DESC);
+
+-- Every accounting request as received, retransmissions of a request are stored once
+CREATE TABLE accounting_events (
+    id                 BIGSERIAL PRIMARY KEY,
+    session_key        TEXT NOT NULL,
+    request_id         TEXT NOT NULL,
+    username           TEXT NOT NULL,
+    acct_session_id    TEXT NOT NULL,
+    acct_status_type   INTEGER NOT NULL,
+    nas_ip_address     TEXT NOT NULL DEFAULT '',
+    nas_port           BIGINT,
+    framed_ip_address  TEXT NOT NULL DEFAULT '',
+    calling_station_id TEXT NOT NULL DEFAULT '',
+    called_station_id  TEXT NOT NULL DEFAULT '',
+    packet_type        TEXT NOT NULL DEFAULT '',
+    event_time         TIMESTAMPTZ NOT NULL,
+    input_octets       BIGINT,
+    output_octets      BIGINT,
+    session_time       BIGINT,
+    UNIQUE (session_key, request_id)
+);
+
+CREATE INDEX accounting_events_username_idx ON accounting_events (username, event_time);
@@ -0,0 +1,230 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresStore implements the Datastore interface on PostgreSQL for long-term history.
+// Every request is appended to accounting_events and folded into accounting_sessions.
+type PostgresStore struct {
+	pool *pgxpool.Pool
+}
+
+// NewPostgresStore creates a PostgresStore on an existing pool
+func NewPostgresStore(pool *pgxpool.Pool) *PostgresStore {
+	return &PostgresStore{
+		pool: pool,
+	}
+}
+
+// ConnectPostgres opens a pool for url, checks the connection and applies pending migrations
+func ConnectPostgres(ctx context.Context, url string) (*pgxpool.Pool, error) {
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure PostgreSQL: %v", err)
+	}
+
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to connect to PostgreSQL: %v", err)
+	}
+
+	if err := Migrate(ctx, pool); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return pool, nil
+}
+
+const insertEventSQL = `
+INSERT INTO accounting_events (
+	session_key, request_id, username, acct_session_id, acct_status_type, nas_ip_address, nas_port,
+	framed_ip_address, calling_station_id, called_station_id, packet_type, event_time,
+	input_octets, output_octets, session_time
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+ON CONFLICT (session_key, request_id) DO NOTHING`
+
+// upsertSessionSQL keeps the newest state of a session, older requests arriving late
+// don't overwrite newer ones. Start and stop times are merged by mergeSessionTimesSQL.
+const upsertSessionSQL = `
+INSERT INTO accounting_sessions (
+	session_key, username, acct_session_id, nas_ip_address, nas_port, framed_ip_address,
+	calling_station_id, called_station_id, acct_status_type, started_at, stopped_at,
+	updated_at, input_octets, output_octets, session_time
+) VALUES (
+	$1, $2, $3, $4, $5, $6, $7, $8, $9,
+	CASE WHEN $9::integer = 1 THEN $10::timestamptz END,
+	CASE WHEN $9::integer = 2 THEN $10::timestamptz END,
+	$10, $11, $12, $13
+)
+ON CONFLICT (session_key) DO UPDATE SET
+	nas_ip_address     = EXCLUDED.nas_ip_address,
+	nas_port           = EXCLUDED.nas_port,
+	framed_ip_address  = EXCLUDED.framed_ip_address,
+	calling_station_id = EXCLUDED.calling_station_id,
+	called_station_id  = EXCLUDED.called_station_id,
+	acct_status_type   = EXCLUDED.acct_status_type,
+	updated_at         = EXCLUDED.updated_at,
+	input_octets       = COALESCE(EXCLUDED.input_octets, accounting_sessions.input_octets),
+	output_octets      = COALESCE(EXCLUDED.output_octets, accounting_sessions.output_octets),
+	session_time       = COALESCE(EXCLUDED.session_time, accounting_sessions.session_time)
+WHERE accounting_sessions.updated_at <= EXCLUDED.updated_at`
+
+// mergeSessionTimesSQL fills in the start (status 1) or stop (status 2) time of a session.
+// They are only ever filled in, also by requests older than the session's latest state,
+// so a Start arriving after the Stop still records when the session began.
+const mergeSessionTimesSQL = `
+UPDATE accounting_sessions SET
+	started_at = COALESCE(started_at, CASE WHEN $2::integer = 1 THEN $3::timestamptz END),
+	stopped_at = COALESCE(stopped_at, CASE WHEN $2::integer = 2 THEN $3::timestamptz END)
+WHERE session_key = $1`
+
+// Save appends the request to the event log and upserts its session. Saving the same
+// request twice is a no-op. The TTL is ignored, PostgreSQL keeps the full history.
+func (ps *PostgresStore) Save(ctx context.Context, key string, record AccountingRecord, ttl time.Duration) error {
+	row, err := newPostgresRow(record)
+	if err != nil {
+		return fmt.Errorf("invalid accounting record %s: %v", key, err)
+	}
+
+	err = pgx.BeginFunc(ctx, ps.pool, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, insertEventSQL,
+			key, row.requestID, record.Username, record.AcctSessionID, row.statusType, record.NASIPAddress, row.nasPort,
+			record.FramedIPAddress, record.CallingStationID, record.CalledStationID, record.PacketType, row.eventTime,
+			row.inputOctets, row.outputOctets, row.sessionTime,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert accounting event: %v", err)
+		}
+
+		_, err = tx.Exec(ctx, upsertSessionSQL,
+			key, record.Username, record.AcctSessionID, record.NASIPAddress, row.nasPort, record.FramedIPAddress,
+			record.CallingStationID, record.CalledStationID, row.statusType, row.eventTime,
+			row.inputOctets, row.outputOctets, row.sessionTime,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to upsert accounting session: %v", err)
+		}
+
+		if row.statusType == 1 || row.statusType == 2 {
+			if _, err := tx.Exec(ctx, mergeSessionTimesSQL, key, row.statusType, row.eventTime); err != nil {
+				return fmt.Errorf("failed to update accounting session times: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store data in PostgreSQL: %v", err)
+	}
+
+	return nil
+}
+
+// Get loads the latest state of a session
+func (ps *PostgresStore) Get(ctx context.Context, key string) (AccountingRecord, error) {
+	var (
+		record                                          AccountingRecord
+		statusType                                      int
+		updatedAt                                       time.Time
+		nasPort, inputOctets, outputOctets, sessionTime *int64
+	)
+
+	err := ps.pool.QueryRow(ctx, `
+		SELECT username, acct_session_id, nas_ip_address, nas_port, framed_ip_address,
+			calling_station_id, called_station_id, acct_status_type, updated_at,
+			input_octets, output_octets, session_time
+		FROM accounting_sessions WHERE session_key = $1`, key,
+	).Scan(
+		&record.Username, &record.AcctSessionID, &record.NASIPAddress, &nasPort, &record.FramedIPAddress,
+		&record.CallingStationID, &record.CalledStationID, &statusType, &updatedAt,
+		&inputOctets, &outputOctets, &sessionTime,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return AccountingRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return AccountingRecord{}, fmt.Errorf("failed to load data from PostgreSQL: %v", err)
+	}
+
+	record.AcctStatusType = strconv.Itoa(statusType)
+	record.PacketType = "Accounting-Request"
+	record.Timestamp = strconv.FormatInt(updatedAt.Unix(), 10)
+	record.NASPort = formatOptional(nasPort)
+	record.AcctInputOctets = formatOptional(inputOctets)
+	record.AcctOutputOctets = formatOptional(outputOctets)
+	record.AcctSessionTime = formatOptional(sessionTime)
+	return record, nil
+}
+
+// postgresRow holds the typed columns parsed from the string fields of an AccountingRecord
+type postgresRow struct {
+	statusType                                      int
+	eventTime                                       time.Time
+	requestID                                       string
+	nasPort, inputOctets, outputOctets, sessionTime *int64
+}
+
+func newPostgresRow(record AccountingRecord) (postgresRow, error) {
+	var row postgresRow
+	var err error
+
+	if row.statusType, err = strconv.Atoi(record.AcctStatusType); err != nil {
+		return row, fmt.Errorf("acct_status_type: %v", err)
+	}
+
+	seconds, err := strconv.ParseInt(record.Timestamp, 10, 64)
+	if err != nil {
+		return row, fmt.Errorf("timestamp: %v", err)
+	}
+	row.eventTime = time.Unix(seconds, 0).UTC()
+
+	// Records that do not come from a RADIUS request are told apart by status and time
+	row.requestID = record.RequestID
+	if row.requestID == "" {
+		row.requestID = fmt.Sprintf("%d@%d", row.statusType, seconds)
+	}
+
+	for _, field := range []struct {
+		name  string
+		value string
+		dst   **int64
+	}{
+		{"nas_port", record.NASPort, &row.nasPort},
+		{"acct_input_octets", record.AcctInputOctets, &row.inputOctets},
+		{"acct_output_octets", record.AcctOutputOctets, &row.outputOctets},
+		{"acct_session_time", record.AcctSessionTime, &row.sessionTime},
+	} {
+		if *field.dst, err = parseOptional(field.value); err != nil {
+			return row, fmt.Errorf("%s: %v", field.name, err)
+		}
+	}
+
+	return row, nil
+}
+
+// parseOptional parses a numeric field, an empty string is NULL
+func parseOptional(value string) (*int64, error) {
+	if value == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func formatOptional(value *int64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatInt(*value, 10)
+}
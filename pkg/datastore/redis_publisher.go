@@ -0,0 +1,48 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"dni/pkg/stream"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// StreamArgsBuilder builds the XADD for a stream notification, implemented by stream.RedisStream
+type StreamArgsBuilder interface {
+	AddArgs(streamKey string, message stream.StreamMessage) *redis.XAddArgs
+}
+
+// PublishingRedisStore is a RedisStore that also publishes stream notifications
+// in the transaction that stores the record
+type PublishingRedisStore struct {
+	*RedisStore
+	streamArgs StreamArgsBuilder
+}
+
+// NewRedisStoreWithPublisher creates a RedisStore whose SaveAndPublish writes the record,
+// its index and the stream entry in one round trip
+func NewRedisStoreWithPublisher(client redis.UniversalClient, streamArgs StreamArgsBuilder, hashTag bool) *PublishingRedisStore {
+	return &PublishingRedisStore{
+		RedisStore: NewRedisStore(client, hashTag),
+		streamArgs: streamArgs,
+	}
+}
+
+// SaveAndPublish stores record and publishes message to streamKey in one MULTI/EXEC.
+// In a cluster the transaction is split per slot, so the stream entry is only atomic
+// with the record when both keys share a hash tag.
+func (ps *PublishingRedisStore) SaveAndPublish(ctx context.Context, key string, record AccountingRecord, ttl time.Duration, streamKey string, message stream.StreamMessage) error {
+	_, err := ps.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		ps.queueSave(ctx, pipe, key, record, ttl)
+		pipe.XAdd(ctx, ps.streamArgs.AddArgs(streamKey, message))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store and publish data in Redis: %v", err)
+	}
+
+	return nil
+}
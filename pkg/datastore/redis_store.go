@@ -5,25 +5,44 @@ import (
 	"fmt"
 	"time"
 
+	clock "go.llib.dev/testcase/clock"
+
 	"github.com/go-redis/redis/v8"
 )
 
 // RedisStore implements the Datastore interface using Redis hashes
 type RedisStore struct {
-	client *redis.Client
-	ctx    context.Context
+	client redis.UniversalClient
+
+	// hashTag names the session indexes like the hash tagged record keys used in a cluster
+	hashTag bool
 }
 
-// NewRedisStore creates a new RedisStore instance
-func NewRedisStore(client *redis.Client) *RedisStore {
+// NewRedisStore creates a new RedisStore instance on a standalone, sentinel or cluster client.
+// hashTag must match the record keys written to it, see RecordKey.
+func NewRedisStore(client redis.UniversalClient, hashTag bool) *RedisStore {
 	return &RedisStore{
-		client: client,
-		ctx:    context.Background(),
+		client:  client,
+		hashTag: hashTag,
 	}
 }
 
-// Save stores an accounting record as a Redis hash with TTL
-func (rs *RedisStore) Save(key string, record AccountingRecord, ttl time.Duration) error {
+// Save stores an accounting record as a Redis hash with TTL and indexes it under its user.
+// All writes go out in one MULTI/EXEC, so a record never exists without its TTL.
+func (rs *RedisStore) Save(ctx context.Context, key string, record AccountingRecord, ttl time.Duration) error {
+	_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		rs.queueSave(ctx, pipe, key, record, ttl)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store data in Redis: %v", err)
+	}
+
+	return nil
+}
+
+// queueSave adds the commands storing record to pipe
+func (rs *RedisStore) queueSave(ctx context.Context, pipe redis.Pipeliner, key string, record AccountingRecord, ttl time.Duration) {
 	// Convert AccountingRecord to map for Redis hash storage
 	data := []interface{}{
 		"username", record.Username,
@@ -49,17 +68,44 @@ func (rs *RedisStore) Save(key string, record AccountingRecord, ttl time.Duratio
 		data = append(data, "acct_session_time", record.AcctSessionTime)
 	}
 
-	// Store as hash object
-	err := rs.client.HMSet(rs.ctx, key, data).Err()
-	if err != nil {
-		return fmt.Errorf("failed to store data in Redis: %v", err)
+	// Store as hash object with TTL
+	pipe.HMSet(ctx, key, data)
+	pipe.Expire(ctx, key, ttl)
+
+	// Index the record under its user, dropping entries that have expired since
+	if record.Username == "" {
+		return
 	}
+	now := clock.Now()
+	index := SessionIndexKey(record.Username, rs.hashTag)
+	pipe.ZAdd(ctx, index, &redis.Z{Score: float64(now.Unix()), Member: key})
+	pipe.ZRemRangeByScore(ctx, index, "-inf", fmt.Sprintf("(%d", now.Add(-ttl).Unix()))
+	pipe.Expire(ctx, index, ttl)
+}
 
-	// Set TTL
-	err = rs.client.Expire(rs.ctx, key, ttl).Err()
+// Get loads an accounting record stored by Save
+func (rs *RedisStore) Get(ctx context.Context, key string) (AccountingRecord, error) {
+	fields, err := rs.client.HGetAll(ctx, key).Result()
 	if err != nil {
-		return fmt.Errorf("failed to set TTL for key %s: %v", key, err)
+		return AccountingRecord{}, fmt.Errorf("failed to load data from Redis: %v", err)
+	}
+	if len(fields) == 0 {
+		return AccountingRecord{}, ErrNotFound
 	}
 
-	return nil
+	return AccountingRecord{
+		Username:         fields["username"],
+		NASIPAddress:     fields["nas_ip_address"],
+		NASPort:          fields["nas_port"],
+		AcctStatusType:   fields["acct_status_type"],
+		AcctSessionID:    fields["acct_session_id"],
+		FramedIPAddress:  fields["framed_ip_address"],
+		CallingStationID: fields["calling_station_id"],
+		CalledStationID:  fields["called_station_id"],
+		PacketType:       fields["packet_type"],
+		Timestamp:        fields["timestamp"],
+		AcctInputOctets:  fields["acct_input_octets"],
+		AcctOutputOctets: fields["acct_output_octets"],
+		AcctSessionTime:  fields["acct_session_time"],
+	}, nil
 }
@@ -0,0 +1,57 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"dni/pkg/stream"
+)
+
+// StreamAppender appends a stream entry within a transaction, implemented by stream.SQLiteStream
+type StreamAppender interface {
+	AppendTx(ctx context.Context, tx *sql.Tx, streamKey string, message stream.StreamMessage) error
+}
+
+// PublishingSQLiteStore is a SQLiteStore that also appends stream notifications
+// in the transaction that stores the record
+type PublishingSQLiteStore struct {
+	*SQLiteStore
+	appender StreamAppender
+}
+
+// NewSQLiteStoreWithPublisher creates a SQLiteStore whose SaveAndPublish writes the record
+// and the stream entry in one transaction. The appender must use the same database.
+func NewSQLiteStoreWithPublisher(ctx context.Context, db *sql.DB, appender StreamAppender) (*PublishingSQLiteStore, error) {
+	store, err := NewSQLiteStore(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PublishingSQLiteStore{
+		SQLiteStore: store,
+		appender:    appender,
+	}, nil
+}
+
+// SaveAndPublish stores record and appends message to streamKey in one transaction
+func (ps *PublishingSQLiteStore) SaveAndPublish(ctx context.Context, key string, record AccountingRecord, ttl time.Duration, streamKey string, message stream.StreamMessage) error {
+	tx, err := ps.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to store and publish data in SQLite: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := ps.saveTx(ctx, tx, key, record, ttl); err != nil {
+		return err
+	}
+	if err := ps.appender.AppendTx(ctx, tx, streamKey, message); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to store and publish data in SQLite: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	clock "go.llib.dev/testcase/clock"
+)
+
+// Times are Unix milliseconds. The username index serves Sessions and the expiry
+// index lets every Save drop expired records cheaply.
+const sqliteStoreSchema = `
+CREATE TABLE IF NOT EXISTS accounting_records (
+	record_key         TEXT PRIMARY KEY,
+	username           TEXT NOT NULL,
+	nas_ip_address     TEXT NOT NULL,
+	nas_port           TEXT NOT NULL,
+	acct_status_type   TEXT NOT NULL,
+	acct_session_id    TEXT NOT NULL,
+	framed_ip_address  TEXT NOT NULL,
+	calling_station_id TEXT NOT NULL,
+	called_station_id  TEXT NOT NULL,
+	packet_type        TEXT NOT NULL,
+	timestamp          TEXT NOT NULL,
+	acct_input_octets  TEXT NOT NULL,
+	acct_output_octets TEXT NOT NULL,
+	acct_session_time  TEXT NOT NULL,
+	updated_at         INTEGER NOT NULL,
+	expires_at         INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS accounting_records_username ON accounting_records (username, updated_at DESC);
+CREATE INDEX IF NOT EXISTS accounting_records_expires ON accounting_records (expires_at);
+`
+
+// upsertRecordSQL stores a record like HMSET: the session metrics are only
+// overwritten when the new request carries them
+const upsertRecordSQL = `
+INSERT INTO accounting_records (
+	record_key, username, nas_ip_address, nas_port, acct_status_type, acct_session_id,
+	framed_ip_address, calling_station_id, called_station_id, packet_type, timestamp,
+	acct_input_octets, acct_output_octets, acct_session_time, updated_at, expires_at
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (record_key) DO UPDATE SET
+	username           = excluded.username,
+	nas_ip_address     = excluded.nas_ip_address,
+	nas_port           = excluded.nas_port,
+	acct_status_type   = excluded.acct_status_type,
+	acct_session_id    = excluded.acct_session_id,
+	framed_ip_address  = excluded.framed_ip_address,
+	calling_station_id = excluded.calling_station_id,
+	called_station_id  = excluded.called_station_id,
+	packet_type        = excluded.packet_type,
+	timestamp          = excluded.timestamp,
+	acct_input_octets  = COALESCE(NULLIF(excluded.acct_input_octets, ''), accounting_records.acct_input_octets),
+	acct_output_octets = COALESCE(NULLIF(excluded.acct_output_octets, ''), accounting_records.acct_output_octets),
+	acct_session_time  = COALESCE(NULLIF(excluded.acct_session_time, ''), accounting_records.acct_session_time),
+	updated_at         = excluded.updated_at,
+	expires_at         = excluded.expires_at`
+
+// SQLiteStore implements the Datastore interface in a local SQLite file for
+// single-node deployments without Redis. Records expire after their TTL like Redis keys.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore creates the record table in db if needed
+func NewSQLiteStore(ctx context.Context, db *sql.DB) (*SQLiteStore, error) {
+	if _, err := db.ExecContext(ctx, sqliteStoreSchema); err != nil {
+		return nil, fmt.Errorf("failed to create accounting tables: %v", err)
+	}
+
+	return &SQLiteStore{
+		db: db,
+	}, nil
+}
+
+// Save stores an accounting record that expires after ttl
+func (ss *SQLiteStore) Save(ctx context.Context, key string, record AccountingRecord, ttl time.Duration) error {
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to store data in SQLite: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := ss.saveTx(ctx, tx, key, record, ttl); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to store data in SQLite: %v", err)
+	}
+	return nil
+}
+
+// saveTx stores record within tx, dropping records that have expired since
+func (ss *SQLiteStore) saveTx(ctx context.Context, tx *sql.Tx, key string, record AccountingRecord, ttl time.Duration) error {
+	now := clock.Now()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM accounting_records WHERE expires_at <= ?`, now.UnixMilli()); err != nil {
+		return fmt.Errorf("failed to expire records in SQLite: %v", err)
+	}
+
+	_, err := tx.ExecContext(ctx, upsertRecordSQL,
+		key,
+		record.Username,
+		record.NASIPAddress,
+		record.NASPort,
+		record.AcctStatusType,
+		record.AcctSessionID,
+		record.FramedIPAddress,
+		record.CallingStationID,
+		record.CalledStationID,
+		record.PacketType,
+		record.Timestamp,
+		record.AcctInputOctets,
+		record.AcctOutputOctets,
+		record.AcctSessionTime,
+		now.UnixMilli(),
+		now.Add(ttl).UnixMilli(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store data in SQLite: %v", err)
+	}
+
+	return nil
+}
+
+// Get loads an accounting record stored by Save, expired records are not found
+func (ss *SQLiteStore) Get(ctx context.Context, key string) (AccountingRecord, error) {
+	var record AccountingRecord
+	err := ss.db.QueryRowContext(ctx, `
+SELECT username, nas_ip_address, nas_port, acct_status_type, acct_session_id, framed_ip_address,
+	calling_station_id, called_station_id, packet_type, timestamp,
+	acct_input_octets, acct_output_octets, acct_session_time
+FROM accounting_records WHERE record_key = ? AND expires_at > ?`,
+		key, clock.Now().UnixMilli(),
+	).Scan(
+		&record.Username,
+		&record.NASIPAddress,
+		&record.NASPort,
+		&record.AcctStatusType,
+		&record.AcctSessionID,
+		&record.FramedIPAddress,
+		&record.CallingStationID,
+		&record.CalledStationID,
+		&record.PacketType,
+		&record.Timestamp,
+		&record.AcctInputOctets,
+		&record.AcctOutputOctets,
+		&record.AcctSessionTime,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return AccountingRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return AccountingRecord{}, fmt.Errorf("failed to load data from SQLite: %v", err)
+	}
+
+	return record, nil
+}
+
+// Sessions returns the keys of a user's unexpired records, most recently updated first
+func (ss *SQLiteStore) Sessions(ctx context.Context, username string) ([]string, error) {
+	rows, err := ss.db.QueryContext(ctx, `
+SELECT record_key FROM accounting_records
+WHERE username = ? AND expires_at > ?
+ORDER BY updated_at DESC`,
+		username, clock.Now().UnixMilli(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions of %s: %v", username, err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("failed to list sessions of %s: %v", username, err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list sessions of %s: %v", username, err)
+	}
+	return keys, nil
+}
@@ -0,0 +1,168 @@
+package datastore
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"dni/pkg/sqliteconn"
+	"dni/pkg/stream"
+
+	"go.llib.dev/testcase/clock/timecop"
+)
+
+func newTestSQLiteStore(t *testing.T) *PublishingSQLiteStore {
+	t.Helper()
+	ctx := context.Background()
+
+	db, err := sqliteconn.Open(ctx, filepath.Join(t.TempDir(), "radius.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	streamClient, err := stream.NewSQLiteStream(ctx, db)
+	if err != nil {
+		t.Fatalf("NewSQLiteStream returned error: %v", err)
+	}
+	store, err := NewSQLiteStoreWithPublisher(ctx, db, streamClient)
+	if err != nil {
+		t.Fatalf("NewSQLiteStoreWithPublisher returned error: %v", err)
+	}
+	return store
+}
+
+func TestSQLiteStore_SaveGet(t *testing.T) {
+	// freezing time to avoid flaky tests
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	key := RecordKey("alice", "s1", false)
+	start := AccountingRecord{
+		Username:       "alice",
+		NASIPAddress:   "10.0.0.1",
+		NASPort:        "1",
+		AcctStatusType: "1",
+		AcctSessionID:  "s1",
+		PacketType:     "Accounting-Request",
+		Timestamp:      "100000",
+	}
+	if err := store.Save(ctx, key, start, time.Hour); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+
+	stop := start
+	stop.AcctStatusType = "2"
+	stop.AcctInputOctets = "1024"
+	stop.AcctOutputOctets = "2048"
+	stop.AcctSessionTime = "60"
+	if err := store.Save(ctx, key, stop, time.Hour); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+
+	// A late interim update without counters keeps the ones already stored, like HMSET
+	interim := start
+	interim.AcctStatusType = "3"
+	if err := store.Save(ctx, key, interim, time.Hour); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+
+	got, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	expected := stop
+	expected.AcctStatusType = "3"
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected record %+v, got %+v", expected, got)
+	}
+
+	if _, err := store.Get(ctx, RecordKey("alice", "missing", false)); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a missing record, got %v", err)
+	}
+}
+
+func TestSQLiteStore_Expiry(t *testing.T) {
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	for _, session := range []string{"s1", "s2"} {
+		record := AccountingRecord{Username: "alice", AcctSessionID: session}
+		if err := store.Save(ctx, RecordKey("alice", session, false), record, time.Hour); err != nil {
+			t.Fatalf("Save returned error: %v", err)
+		}
+		timecop.Travel(t, 40*time.Minute, timecop.Freeze)
+	}
+	store.Save(ctx, RecordKey("bob", "s1", false), AccountingRecord{Username: "bob"}, time.Hour)
+
+	// s1 expired after an hour, s2 is still live
+	if _, err := store.Get(ctx, RecordKey("alice", "s1", false)); err != ErrNotFound {
+		t.Errorf("Expected the expired record to be gone, got %v", err)
+	}
+
+	sessions, err := store.Sessions(ctx, "alice")
+	if err != nil {
+		t.Fatalf("Sessions returned error: %v", err)
+	}
+	if !reflect.DeepEqual(sessions, []string{"radius:acct:alice:s2"}) {
+		t.Errorf("Expected only the live session, got %v", sessions)
+	}
+
+	// Saving drops expired rows from the table, not just from reads
+	var rows int
+	if err := store.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM accounting_records`).Scan(&rows); err != nil {
+		t.Fatalf("Failed to count records: %v", err)
+	}
+	if rows != 2 {
+		t.Errorf("Expected 2 stored records after expiry, got %d", rows)
+	}
+}
+
+func TestSQLiteStore_Sessions_Order(t *testing.T) {
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	for _, session := range []string{"s1", "s2", "s1"} {
+		store.Save(ctx, RecordKey("alice", session, false), AccountingRecord{Username: "alice"}, time.Hour)
+		timecop.Travel(t, time.Second, timecop.Freeze)
+	}
+
+	sessions, err := store.Sessions(ctx, "alice")
+	if err != nil {
+		t.Fatalf("Sessions returned error: %v", err)
+	}
+	expected := []string{"radius:acct:alice:s1", "radius:acct:alice:s2"}
+	if !reflect.DeepEqual(sessions, expected) {
+		t.Errorf("Expected most recently updated first %v, got %v", expected, sessions)
+	}
+}
+
+func TestSQLiteStore_SaveAndPublish(t *testing.T) {
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+	ctx := context.Background()
+	store := newTestSQLiteStore(t)
+
+	key := RecordKey("alice", "s1", false)
+	message := stream.StreamMessage{Key: key, Username: "alice"}
+	if err := store.SaveAndPublish(ctx, key, AccountingRecord{Username: "alice"}, time.Hour, "radius:updates:alice", message); err != nil {
+		t.Fatalf("SaveAndPublish returned error: %v", err)
+	}
+
+	if _, err := store.Get(ctx, key); err != nil {
+		t.Errorf("Expected the record to be stored, got %v", err)
+	}
+
+	replayer := store.appender.(stream.Replayer)
+	messages, _, err := replayer.Replay(ctx, "radius:updates:alice", "-", "+", 10, nil)
+	if err != nil {
+		t.Fatalf("Replay returned error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Key != key {
+		t.Errorf("Expected the stream entry for %s, got %+v", key, messages)
+	}
+}
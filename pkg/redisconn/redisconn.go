@@ -0,0 +1,162 @@
+package redisconn
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// ModeStandalone connects to a single Redis server
+	ModeStandalone = "standalone"
+	// ModeSentinel discovers the current master through Redis Sentinel
+	ModeSentinel = "sentinel"
+	// ModeCluster connects to a Redis Cluster
+	ModeCluster = "cluster"
+)
+
+// Options describes how to reach and authenticate against Redis
+type Options struct {
+	// Mode selects standalone (default), sentinel or cluster
+	Mode string
+
+	Host string
+	Port int
+
+	// Addrs are the sentinels or cluster seed nodes, Host:Port is used when empty
+	Addrs []string
+
+	// MasterName and SentinelPassword are used in sentinel mode
+	MasterName       string
+	SentinelPassword string
+
+	// Username selects a Redis 6 ACL user, empty authenticates as the default user
+	Username string
+	Password string
+	DB       int
+
+	TLS TLSOptions
+}
+
+// TLSOptions configures an encrypted connection. CAFile verifies the server with a
+// private CA instead of the system pool, CertFile and KeyFile enable client certificates.
+type TLSOptions struct {
+	Enabled    bool
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+}
+
+// Addr returns the host:port to dial
+func (o Options) Addr() string {
+	return fmt.Sprintf("%s:%d", o.Host, o.Port)
+}
+
+// Seeds returns the addresses to dial first, Addrs or Host:Port
+func (o Options) Seeds() []string {
+	if len(o.Addrs) > 0 {
+		return o.Addrs
+	}
+	return []string{o.Addr()}
+}
+
+// NewClient creates a Redis client for the configured mode and checks that the server answers
+func NewClient(ctx context.Context, opts Options) (redis.UniversalClient, error) {
+	var tlsConfig *tls.Config
+	if opts.TLS.Enabled {
+		var err error
+		if tlsConfig, err = NewTLSConfig(opts.TLS); err != nil {
+			return nil, err
+		}
+	}
+
+	var client redis.UniversalClient
+	switch opts.Mode {
+	case "", ModeStandalone:
+		client = redis.NewClient(&redis.Options{
+			Addr:      opts.Addr(),
+			Username:  opts.Username,
+			Password:  opts.Password,
+			DB:        opts.DB,
+			TLSConfig: tlsConfig,
+		})
+	case ModeSentinel:
+		if opts.MasterName == "" {
+			return nil, fmt.Errorf("sentinel mode requires a master name")
+		}
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       opts.MasterName,
+			SentinelAddrs:    opts.Seeds(),
+			SentinelPassword: opts.SentinelPassword,
+			Username:         opts.Username,
+			Password:         opts.Password,
+			DB:               opts.DB,
+			TLSConfig:        tlsConfig,
+		})
+	case ModeCluster:
+		if opts.DB != 0 {
+			return nil, fmt.Errorf("cluster mode only supports DB 0")
+		}
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     opts.Seeds(),
+			Username:  opts.Username,
+			Password:  opts.Password,
+			TLSConfig: tlsConfig,
+		})
+	default:
+		return nil, fmt.Errorf("unknown Redis mode %q", opts.Mode)
+	}
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis (%s) at %s: %v", opts.modeName(), strings.Join(opts.Seeds(), ","), err)
+	}
+
+	return client, nil
+}
+
+func (o Options) modeName() string {
+	if o.Mode == "" {
+		return ModeStandalone
+	}
+	return o.Mode
+}
+
+// NewTLSConfig builds the client TLS configuration from opts
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: opts.ServerName,
+	}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Redis CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in Redis CA file %s", opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return nil, fmt.Errorf("both a Redis client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Redis client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
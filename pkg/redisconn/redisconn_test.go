@@ -0,0 +1,120 @@
+package redisconn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSigned writes a self-signed certificate and its key to dir
+func writeSelfSigned(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redis.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSigned(t, dir)
+	notPEM := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		opts        TLSOptions
+		expectErr   bool
+		expectCA    bool
+		expectCerts int
+	}{
+		{
+			name: "system roots",
+			opts: TLSOptions{Enabled: true, ServerName: "redis.test"},
+		},
+		{
+			name:        "private CA and client certificate",
+			opts:        TLSOptions{Enabled: true, CAFile: certFile, CertFile: certFile, KeyFile: keyFile},
+			expectCA:    true,
+			expectCerts: 1,
+		},
+		{
+			name:      "missing CA file",
+			opts:      TLSOptions{Enabled: true, CAFile: filepath.Join(dir, "missing.pem")},
+			expectErr: true,
+		},
+		{
+			name:      "CA file without certificates",
+			opts:      TLSOptions{Enabled: true, CAFile: notPEM},
+			expectErr: true,
+		},
+		{
+			name:      "certificate without key",
+			opts:      TLSOptions{Enabled: true, CertFile: certFile},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := NewTLSConfig(tt.opts)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewTLSConfig returned error: %v", err)
+			}
+
+			if tlsConfig.ServerName != tt.opts.ServerName {
+				t.Errorf("Expected server name %q, got %q", tt.opts.ServerName, tlsConfig.ServerName)
+			}
+			if (tlsConfig.RootCAs != nil) != tt.expectCA {
+				t.Errorf("Expected custom CA pool: %t", tt.expectCA)
+			}
+			if len(tlsConfig.Certificates) != tt.expectCerts {
+				t.Errorf("Expected %d client certificates, got %d", tt.expectCerts, len(tlsConfig.Certificates))
+			}
+		})
+	}
+}
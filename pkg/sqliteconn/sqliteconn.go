@@ -0,0 +1,36 @@
+package sqliteconn
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	// Registers the pure Go "sqlite" driver, so no cgo toolchain is needed
+	_ "modernc.org/sqlite"
+)
+
+// dsnOptions are applied to every connection. WAL journaling lets the consumer read the
+// event log while the API writes to it, busy_timeout makes the processes wait for each
+// other's write locks instead of failing. Transactions take the write lock when they
+// begin, so one that reads before writing cannot lose a race to another process; plain
+// queries outside a transaction only read and never wait for it.
+const dsnOptions = "_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)&_txlock=immediate"
+
+// Open opens the SQLite database at path, creating the file if it does not exist.
+// Tables are created by the datastore and stream that use the database.
+func Open(ctx context.Context, path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?%s", path, dsnOptions))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database %s: %v", path, err)
+	}
+
+	// SQLite has a single writer per file, one connection serialises writes within the process
+	db.SetMaxOpenConns(1)
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open SQLite database %s: %v", path, err)
+	}
+
+	return db, nil
+}
@@ -0,0 +1,108 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// clusterSlots is the number of hash slots in a Redis Cluster
+const clusterSlots = 16384
+
+// scanStreams returns the stream keys matching pattern. A cluster is scanned
+// master by master because SCAN only covers the node it is sent to.
+func scanStreams(ctx context.Context, client redis.UniversalClient, pattern string) ([]string, error) {
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return scanNode(ctx, client, pattern)
+	}
+
+	var mu sync.Mutex
+	var keys []string
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		found, err := scanNode(ctx, node, pattern)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		keys = append(keys, found...)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// scanNode runs a full SCAN over a single node
+func scanNode(ctx context.Context, client redis.Cmdable, pattern string) ([]string, error) {
+	var keys []string
+	var cursor uint64
+	for {
+		batch, next, err := client.ScanType(ctx, cursor, pattern, 100, "stream").Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan streams matching %s: %v", pattern, err)
+		}
+		keys = append(keys, batch...)
+
+		cursor = next
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+// groupBySlot splits keys into groups that share a cluster hash slot, keeping their order
+func groupBySlot(keys []string) [][]string {
+	index := make(map[int]int)
+	var groups [][]string
+	for _, key := range keys {
+		slot := hashSlot(key)
+		i, ok := index[slot]
+		if !ok {
+			i = len(groups)
+			index[slot] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], key)
+	}
+	return groups
+}
+
+// hashSlot returns the Redis Cluster slot of key, honouring {hash tags}
+func hashSlot(key string) int {
+	for start := 0; start < len(key); start++ {
+		if key[start] != '{' {
+			continue
+		}
+		for end := start + 1; end < len(key); end++ {
+			if key[end] == '}' {
+				if end > start+1 {
+					key = key[start+1 : end]
+				}
+				return int(crc16(key)) % clusterSlots
+			}
+		}
+		break
+	}
+	return int(crc16(key)) % clusterSlots
+}
+
+// crc16 implements CRC-16/XMODEM as used by Redis Cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
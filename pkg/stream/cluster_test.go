@@ -0,0 +1,88 @@
+package stream
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/go-redis/redismock/v8"
+)
+
+func TestHashSlot(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected int
+	}{
+		{key: "123456789", expected: 12739},
+		{key: "foo", expected: 12182},
+		{key: "{foo}:bar", expected: 12182},
+		{key: "radius:acct:{foo}:session1", expected: 12182},
+	}
+
+	for _, tt := range tests {
+		if got := hashSlot(tt.key); got != tt.expected {
+			t.Errorf("hashSlot(%q) = %d, expected %d", tt.key, got, tt.expected)
+		}
+	}
+
+	if hashSlot("{}foo") == hashSlot("foo") {
+		t.Error("Expected an empty hash tag to hash the whole key")
+	}
+}
+
+func TestGroupBySlot(t *testing.T) {
+	keys := []string{"radius:updates:{a}", "radius:acct:{b}:1", "radius:acct:{a}:1"}
+	expected := [][]string{
+		{"radius:updates:{a}", "radius:acct:{a}:1"},
+		{"radius:acct:{b}:1"},
+	}
+
+	if got := groupBySlot(keys); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestRedisStream_Pull_AcrossClusterSlots(t *testing.T) {
+	redisClient, mock := redismock.NewClientMock()
+	defer redisClient.Close()
+
+	keyA, keyB := "radius:updates:{a}", "radius:updates:{b}"
+	config := ConsumerConfig{
+		StreamKeys:    []string{keyA, keyB},
+		ConsumerGroup: "group",
+		ConsumerName:  "consumer",
+		BatchSize:     10,
+	}
+
+	mock.ExpectXGroupCreateMkStream(keyA, "group", "$").SetVal("OK")
+	mock.ExpectXGroupCreateMkStream(keyB, "group", "$").SetVal("OK")
+	mock.ExpectXReadGroup(&redis.XReadGroupArgs{
+		Group: "group", Consumer: "consumer", Streams: []string{keyA, ">"}, Count: 10, Block: noBlock,
+	}).SetVal([]redis.XStream{{
+		Stream:   keyA,
+		Messages: []redis.XMessage{{ID: "1-0", Values: map[string]interface{}{"key": "radius:acct:{a}:s1", "username": "a"}}},
+	}})
+	mock.ExpectXAck(keyA, "group", "1-0").SetVal(1)
+	mock.ExpectXReadGroup(&redis.XReadGroupArgs{
+		Group: "group", Consumer: "consumer", Streams: []string{keyB, ">"}, Count: 10, Block: noBlock,
+	}).RedisNil()
+
+	rs := NewRedisStream(redisClient)
+	// Behave like a cluster client, the mock only speaks to a single node
+	rs.cluster = true
+
+	messages, err := rs.Pull(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+
+	expected := []Message{{ID: "1-0", StreamKey: keyA, Key: "radius:acct:{a}:s1", Username: "a"}}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected %v, got %v", expected, messages)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled Redis expectations: %s", err)
+	}
+}
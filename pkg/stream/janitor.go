@@ -0,0 +1,139 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	clock "go.llib.dev/testcase/clock"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Janitor periodically trims streams and deletes the ones that went idle
+type Janitor struct {
+	client    redis.UniversalClient
+	pattern   string
+	retention RetentionPolicy
+	idleTTL   time.Duration
+	interval  time.Duration
+}
+
+// NewJanitor creates a Janitor for all streams matching pattern.
+// Streams with no new entries for idleTTL are deleted, a zero idleTTL keeps them.
+func NewJanitor(client redis.UniversalClient, pattern string, retention RetentionPolicy, idleTTL, interval time.Duration) *Janitor {
+	return &Janitor{
+		client:    client,
+		pattern:   pattern,
+		retention: retention,
+		idleTTL:   idleTTL,
+		interval:  interval,
+	}
+}
+
+// Run sweeps streams every interval until the context is cancelled
+func (j *Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := j.Sweep(ctx); err != nil {
+				log.Printf("[JANITOR] Sweep failed: %v", err)
+			}
+		}
+	}
+}
+
+// Sweep performs a single trimming pass over all matching streams
+func (j *Janitor) Sweep(ctx context.Context) error {
+	keys, err := scanStreams(ctx, j.client, j.pattern)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := j.sweepStream(ctx, key); err != nil {
+			log.Printf("[JANITOR] %v", err)
+		}
+	}
+	return nil
+}
+
+func (j *Janitor) sweepStream(ctx context.Context, key string) error {
+	if j.idleTTL > 0 {
+		info, err := j.client.XInfoStream(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("failed to inspect stream %s: %v", key, err)
+		}
+
+		lastActivity, err := streamIDTime(info.LastGeneratedID)
+		if err != nil {
+			return err
+		}
+		if clock.Now().Sub(lastActivity) > j.idleTTL {
+			lastActivity, err = j.groupActivity(ctx, key, info.LastGeneratedID, lastActivity)
+			if err != nil {
+				return err
+			}
+		}
+
+		if clock.Now().Sub(lastActivity) > j.idleTTL {
+			if err := j.client.Del(ctx, key).Err(); err != nil {
+				return fmt.Errorf("failed to delete idle stream %s: %v", key, err)
+			}
+			log.Printf("[JANITOR] Deleted idle stream %s", key)
+			return nil
+		}
+	}
+
+	if j.retention.MaxLen > 0 {
+		if err := j.client.XTrimMaxLenApprox(ctx, key, j.retention.MaxLen, 0).Err(); err != nil {
+			return fmt.Errorf("failed to trim stream %s by length: %v", key, err)
+		}
+	}
+
+	if j.retention.MaxAge > 0 {
+		if err := j.client.XTrimMinIDApprox(ctx, key, minIDForAge(j.retention.MaxAge), 0).Err(); err != nil {
+			return fmt.Errorf("failed to trim stream %s by age: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+// groupActivity returns when the consumers of a stream last read from it, if that was after
+// lastActivity. A stream created empty by XGROUP CREATE MKSTREAM has no entries to date
+// it by, but its consumers keep it active. A group with entries not yet delivered to it or
+// not yet acknowledged keeps the stream as well, deleting it would lose them.
+func (j *Janitor) groupActivity(ctx context.Context, key, lastID string, lastActivity time.Time) (time.Time, error) {
+	groups, err := xinfo(ctx, j.client, "GROUPS", key)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to inspect groups of %s: %v", key, err)
+	}
+
+	now := clock.Now()
+	for _, group := range groups {
+		pending, _ := group["pending"].(int64)
+		if pending > 0 || group["last-delivered-id"] != lastID {
+			return now, nil
+		}
+
+		name, _ := group["name"].(string)
+		consumers, err := xinfo(ctx, j.client, "CONSUMERS", key, name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to inspect consumers of %s: %v", key, err)
+		}
+		for _, consumer := range consumers {
+			idle, _ := consumer["idle"].(int64)
+			if seen := now.Add(-time.Duration(idle) * time.Millisecond); seen.After(lastActivity) {
+				lastActivity = seen
+			}
+		}
+	}
+	return lastActivity, nil
+}
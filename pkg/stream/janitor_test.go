@@ -0,0 +1,210 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/go-redis/redismock/v8"
+	"go.llib.dev/testcase/clock"
+	"go.llib.dev/testcase/clock/timecop"
+)
+
+func TestJanitor_Sweep(t *testing.T) {
+	// freezing time to avoid flaky tests
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+
+	retention := RetentionPolicy{MaxLen: 1000, MaxAge: time.Hour}
+	activeID := fmt.Sprintf("%d-0", clock.Now().Add(-time.Minute).UnixMilli())
+	idleID := fmt.Sprintf("%d-0", clock.Now().Add(-2*time.Hour).UnixMilli())
+	minID := fmt.Sprintf("%d-0", clock.Now().Add(-time.Hour).UnixMilli())
+
+	redisClient, mock := redismock.NewClientMock()
+	defer redisClient.Close()
+
+	mock.ExpectScanType(0, "radius:updates:*", 100, "stream").
+		SetVal([]string{"radius:updates:active", "radius:updates:idle"}, 0)
+
+	mock.ExpectXInfoStream("radius:updates:active").SetVal(&redis.XInfoStream{LastGeneratedID: activeID})
+	mock.ExpectXTrimMaxLenApprox("radius:updates:active", 1000, 0).SetVal(0)
+	mock.ExpectXTrimMinIDApprox("radius:updates:active", minID, 0).SetVal(0)
+
+	mock.ExpectXInfoStream("radius:updates:idle").SetVal(&redis.XInfoStream{LastGeneratedID: idleID})
+	mock.ExpectDo("XINFO", "GROUPS", "radius:updates:idle").SetVal([]interface{}{})
+	mock.ExpectDel("radius:updates:idle").SetVal(1)
+
+	janitor := NewJanitor(redisClient, "radius:updates:*", retention, time.Hour, time.Minute)
+	if err := janitor.Sweep(context.Background()); err != nil {
+		t.Fatalf("Sweep returned error: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled Redis expectations: %s", err)
+	}
+}
+
+func TestJanitor_Sweep_StreamsWithGroups(t *testing.T) {
+	// freezing time to avoid flaky tests
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+
+	idleID := fmt.Sprintf("%d-0", clock.Now().Add(-2*time.Hour).UnixMilli())
+	group := func(lastDelivered string, pending int64) []interface{} {
+		return []interface{}{"name", "group", "consumers", int64(1), "pending", pending, "last-delivered-id", lastDelivered}
+	}
+	consumer := func(idle time.Duration) []interface{} {
+		return []interface{}{"name", "consumer", "pending", int64(0), "idle", idle.Milliseconds()}
+	}
+
+	tests := []struct {
+		name      string
+		lastID    string
+		groups    []interface{}
+		consumers []interface{}
+		deleted   bool
+	}{
+		{
+			// XGROUP CREATE MKSTREAM made an empty stream a consumer is reading
+			name:      "empty stream read by a consumer",
+			lastID:    "0-0",
+			groups:    []interface{}{group("0-0", 0)},
+			consumers: []interface{}{consumer(time.Second)},
+		},
+		{
+			name:      "consumers gone for longer than the idle TTL",
+			lastID:    idleID,
+			groups:    []interface{}{group(idleID, 0)},
+			consumers: []interface{}{consumer(3 * time.Hour)},
+			deleted:   true,
+		},
+		{
+			name:   "entries not delivered to the group",
+			lastID: idleID,
+			groups: []interface{}{group("0-0", 0)},
+		},
+		{
+			name:   "entries not acknowledged by the group",
+			lastID: idleID,
+			groups: []interface{}{group(idleID, 2)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redisClient, mock := redismock.NewClientMock()
+			defer redisClient.Close()
+
+			key := "radius:updates:testuser"
+			mock.ExpectScanType(0, "radius:updates:*", 100, "stream").SetVal([]string{key}, 0)
+			mock.ExpectXInfoStream(key).SetVal(&redis.XInfoStream{LastGeneratedID: tt.lastID})
+			mock.ExpectDo("XINFO", "GROUPS", key).SetVal(tt.groups)
+			if tt.consumers != nil {
+				mock.ExpectDo("XINFO", "CONSUMERS", key, "group").SetVal(tt.consumers)
+			}
+			if tt.deleted {
+				mock.ExpectDel(key).SetVal(1)
+			} else {
+				mock.ExpectXTrimMaxLenApprox(key, 1000, 0).SetVal(0)
+			}
+
+			janitor := NewJanitor(redisClient, "radius:updates:*", RetentionPolicy{MaxLen: 1000}, time.Hour, time.Minute)
+			if err := janitor.Sweep(context.Background()); err != nil {
+				t.Fatalf("Sweep returned error: %v", err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("There were unfulfilled Redis expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestRedisStream_Push_Retention(t *testing.T) {
+	// freezing time to avoid flaky tests
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+
+	tests := []struct {
+		name      string
+		retention RetentionPolicy
+		expected  *redis.XAddArgs
+	}{
+		{
+			name:      "max length",
+			retention: RetentionPolicy{MaxLen: 500, MaxAge: time.Hour},
+			expected:  &redis.XAddArgs{MaxLen: 500, Approx: true},
+		},
+		{
+			name:      "max age",
+			retention: RetentionPolicy{MaxAge: time.Hour},
+			expected: &redis.XAddArgs{
+				MinID:  fmt.Sprintf("%d-0", clock.Now().Add(-time.Hour).UnixMilli()),
+				Approx: true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redisClient, mock := redismock.NewClientMock()
+			defer redisClient.Close()
+
+			tt.expected.Stream = "radius:updates:testuser"
+			tt.expected.Values = []interface{}{
+				"key", "radius:acct:testuser:session123",
+				"timestamp", clock.Now().Unix(),
+				"username", "testuser",
+			}
+			mock.ExpectXAdd(tt.expected).SetVal("1-0")
+
+			rs := NewRedisStreamWithRetention(redisClient, tt.retention)
+			err := rs.Push(context.Background(), "radius:updates:testuser", StreamMessage{
+				Key:      "radius:acct:testuser:session123",
+				Username: "testuser",
+			})
+			if err != nil {
+				t.Fatalf("Push returned error: %v", err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("There were unfulfilled Redis expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestRedisStream_Pull_SkipsDeletedDiscoveredStreams(t *testing.T) {
+	redisClient, mock := redismock.NewClientMock()
+	defer redisClient.Close()
+
+	configured, deleted := "radius:updates:testuser-1", "radius:updates:testuser-2"
+	config := ConsumerConfig{
+		StreamKeys:     []string{configured, deleted},
+		DiscoveredKeys: []string{deleted},
+		ConsumerGroup:  "group",
+		ConsumerName:   "consumer",
+		BatchSize:      10,
+		BlockTimeout:   time.Second,
+	}
+
+	// The janitor deleted the discovered stream, its group must not recreate it
+	mock.ExpectXGroupCreateMkStream(configured, "group", "$").SetVal("OK")
+	mock.ExpectXGroupCreate(deleted, "group", "$").SetErr(fmt.Errorf(
+		"ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."))
+	mock.ExpectXReadGroup(&redis.XReadGroupArgs{
+		Group: "group", Consumer: "consumer", Streams: []string{configured, ">"}, Count: 10, Block: time.Second,
+	}).RedisNil()
+
+	rs := NewRedisStream(redisClient)
+	messages, err := rs.Pull(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("Expected no messages, got %v", messages)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled Redis expectations: %s", err)
+	}
+}
@@ -0,0 +1,475 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	clock "go.llib.dev/testcase/clock"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// DefaultKafkaTopic receives the accounting events when no topic is configured
+const DefaultKafkaTopic = "radius-accounting"
+
+// kafkaStreamHeader carries the stream key of an event, consumers filter on it
+const kafkaStreamHeader = "stream"
+
+// KafkaStream implements the Stream interface on a Kafka topic. Every stream key is
+// published to the same topic with the username as record key, so the events of a user
+// stay in one partition and in order. The stream key travels in a record header and
+// Pull only returns records of the requested stream keys.
+type KafkaStream struct {
+	// ManualAck commits a record's offset only once it and the earlier records of its
+	// partition were acknowledged, so a restarted consumer reads unacknowledged records
+	// again. Records left unacknowledged for ClaimIdle are also delivered again in process.
+	// By default offsets are committed as records are read.
+	ManualAck bool
+	// PendingWindow caps the unacknowledged records held per partition with ManualAck.
+	// A full partition is paused until its oldest record is acknowledged, so one record
+	// that keeps failing holds back its partition rather than filling memory.
+	// Zero uses DefaultKafkaPendingWindow.
+	PendingWindow int
+
+	brokers  []string
+	topic    string
+	producer *kgo.Client
+
+	mu sync.Mutex
+	// consumers holds a group member per consumer group, created on the first Pull
+	consumers map[string]*kgo.Client
+	// pending holds the uncommitted records of each group by partition, with ManualAck
+	pending map[string]map[int32]*kafkaPartition
+}
+
+// DefaultKafkaPendingWindow is used when KafkaStream.PendingWindow is not set
+const DefaultKafkaPendingWindow = 1000
+
+// kafkaPartition holds the records of one partition handed out to a group and not yet
+// committed, in offset order, whether each of them was acknowledged and when the
+// unacknowledged ones were last delivered
+type kafkaPartition struct {
+	records   []*kgo.Record
+	acked     map[int64]bool
+	delivered map[int64]time.Time
+	paused    bool
+}
+
+// NewKafkaStream connects a producer to brokers. Topic retention and partition count are
+// managed on the brokers; topics that do not exist are created with the broker defaults.
+func NewKafkaStream(brokers []string, topic string) (*KafkaStream, error) {
+	if topic == "" {
+		topic = DefaultKafkaTopic
+	}
+
+	producer, err := kgo.NewClient(
+		kgo.SeedBrokers(brokers...),
+		kgo.DefaultProduceTopic(topic),
+		kgo.AllowAutoTopicCreation(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kafka producer: %v", err)
+	}
+
+	return &KafkaStream{
+		brokers:   brokers,
+		topic:     topic,
+		producer:  producer,
+		consumers: make(map[string]*kgo.Client),
+		pending:   make(map[string]map[int32]*kafkaPartition),
+	}, nil
+}
+
+// Push publishes a message to the topic and waits for the brokers to acknowledge it
+func (ks *KafkaStream) Push(ctx context.Context, streamKey string, message StreamMessage) error {
+	value, err := json.Marshal(eventPayload{
+		Key:       message.Key,
+		Username:  message.Username,
+		Timestamp: clock.Now().Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode message for stream %s: %v", streamKey, err)
+	}
+
+	record := &kgo.Record{
+		Key:     []byte(message.Username),
+		Value:   value,
+		Headers: []kgo.RecordHeader{{Key: kafkaStreamHeader, Value: []byte(streamKey)}},
+	}
+	if err := ks.producer.ProduceSync(ctx, record).FirstErr(); err != nil {
+		return fmt.Errorf("failed to publish to stream %s: %v", streamKey, err)
+	}
+	return nil
+}
+
+// Pull reads up to BatchSize records as a member of the consumer group, waiting up to
+// BlockTimeout. Without ManualAck offsets are committed before returning. Members of a
+// group share the topic's partitions, so consumers following different stream keys need
+// different groups.
+func (ks *KafkaStream) Pull(ctx context.Context, config ConsumerConfig) ([]Message, error) {
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	blockTimeout := config.BlockTimeout
+	if blockTimeout <= 0 {
+		blockTimeout = DefaultBlockTimeout
+	}
+
+	consumer, err := ks.consumer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Records delivered before but never acknowledged come first
+	if ks.ManualAck {
+		if messages := ks.redeliver(config, batchSize); len(messages) > 0 {
+			return messages, nil
+		}
+	}
+
+	pollCtx, cancel := context.WithTimeout(ctx, blockTimeout)
+	defer cancel()
+
+	fetches := consumer.PollRecords(pollCtx, int(batchSize))
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read from stream: %v", err)
+	}
+	for _, fetchErr := range fetches.Errors() {
+		// The poll deadline only means nothing arrived within BlockTimeout
+		if errors.Is(fetchErr.Err, context.DeadlineExceeded) {
+			continue
+		}
+		return nil, fmt.Errorf("failed to read from topic %s: %v", ks.topic, fetchErr.Err)
+	}
+
+	records := fetches.Records()
+	if len(records) == 0 {
+		return []Message{}, nil
+	}
+
+	streamKeys := make(map[string]bool, len(config.StreamKeys))
+	for _, key := range config.StreamKeys {
+		streamKeys[key] = true
+	}
+
+	messages := make([]Message, 0, len(records))
+	delivered := make(map[*kgo.Record]bool, len(records))
+	for _, record := range records {
+		streamKey := kafkaHeader(record, kafkaStreamHeader)
+		if !streamKeys[streamKey] {
+			continue
+		}
+
+		message, err := kafkaMessage(record)
+		if err != nil {
+			log.Printf("[KAFKA] Skipping malformed record %d-%d: %v", record.Partition, record.Offset, err)
+			continue
+		}
+		if !matchesUser(config.Usernames, message.Username) {
+			continue
+		}
+
+		messages = append(messages, message)
+		delivered[record] = true
+	}
+
+	// Skipped records count as acknowledged, delivered ones wait for Ack with ManualAck
+	commit := records
+	if ks.ManualAck {
+		commit = ks.track(consumer, config.ConsumerGroup, records, delivered)
+	}
+
+	// The records are already handed out, a failed commit only means they may be read again
+	if len(commit) > 0 {
+		if err := consumer.CommitRecords(ctx, commit...); err != nil {
+			log.Printf("[KAFKA] Failed to commit offsets of group %s: %v", config.ConsumerGroup, err)
+		}
+	}
+
+	return messages, nil
+}
+
+// kafkaMessage decodes the event of a record
+func kafkaMessage(record *kgo.Record) (Message, error) {
+	var value eventPayload
+	if err := json.Unmarshal(record.Value, &value); err != nil {
+		return Message{}, err
+	}
+	return Message{
+		ID:        fmt.Sprintf("%d-%d", record.Partition, record.Offset),
+		StreamKey: kafkaHeader(record, kafkaStreamHeader),
+		Key:       value.Key,
+		Username:  value.Username,
+	}, nil
+}
+
+// track remembers the records handed out to a group until they are acknowledged, pausing
+// partitions whose window is full, and returns the records whose offsets can be committed
+func (ks *KafkaStream) track(client *kgo.Client, group string, records []*kgo.Record, delivered map[*kgo.Record]bool) []*kgo.Record {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	partitions := ks.pending[group]
+	if partitions == nil {
+		partitions = make(map[int32]*kafkaPartition)
+		ks.pending[group] = partitions
+	}
+
+	now := clock.Now()
+	touched := make(map[int32]*kafkaPartition)
+	for _, record := range records {
+		p := partitions[record.Partition]
+		if p == nil {
+			p = &kafkaPartition{acked: make(map[int64]bool), delivered: make(map[int64]time.Time)}
+			partitions[record.Partition] = p
+		}
+		p.records = append(p.records, record)
+		p.acked[record.Offset] = !delivered[record]
+		if delivered[record] {
+			p.delivered[record.Offset] = now
+		}
+		touched[record.Partition] = p
+	}
+	commit := committable(touched)
+	ks.throttle(client, touched)
+	return commit
+}
+
+// throttle pauses fetching the partitions holding PendingWindow records or more and resumes
+// the paused ones that dropped below it. Callers hold mu.
+func (ks *KafkaStream) throttle(client *kgo.Client, partitions map[int32]*kafkaPartition) {
+	window := ks.PendingWindow
+	if window <= 0 {
+		window = DefaultKafkaPendingWindow
+	}
+
+	var pause, resume []int32
+	for partition, p := range partitions {
+		switch full := len(p.records) >= window; {
+		case full && !p.paused:
+			p.paused = true
+			pause = append(pause, partition)
+		case !full && p.paused:
+			p.paused = false
+			resume = append(resume, partition)
+		}
+	}
+	if len(pause) > 0 {
+		client.PauseFetchPartitions(map[string][]int32{ks.topic: pause})
+		log.Printf("[KAFKA] Paused partitions %v of %s, %d records await acknowledgement", pause, ks.topic, window)
+	}
+	if len(resume) > 0 {
+		client.ResumeFetchPartitions(map[string][]int32{ks.topic: resume})
+	}
+}
+
+// redeliver returns up to batchSize records of a group that stayed unacknowledged for
+// longer than ClaimIdle, because a sink failed, and hands them out again
+func (ks *KafkaStream) redeliver(config ConsumerConfig, batchSize int64) []Message {
+	claimIdle := config.ClaimIdle
+	if claimIdle <= 0 {
+		claimIdle = DefaultClaimIdle
+	}
+	now := clock.Now()
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	var messages []Message
+	for _, p := range ks.pending[config.ConsumerGroup] {
+		for _, record := range p.records {
+			if int64(len(messages)) >= batchSize {
+				return messages
+			}
+			deliveredAt, ok := p.delivered[record.Offset]
+			if !ok || p.acked[record.Offset] || now.Sub(deliveredAt) < claimIdle {
+				continue
+			}
+			message, err := kafkaMessage(record)
+			if err != nil {
+				continue
+			}
+			p.delivered[record.Offset] = now
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+// Ack acknowledges delivered records of a group and returns how many were pending.
+// Offsets are committed up to the first record of each partition that is still pending.
+func (ks *KafkaStream) Ack(ctx context.Context, streamKey, group string, ids ...string) (int64, error) {
+	ks.mu.Lock()
+	client := ks.consumers[group]
+	var acked int64
+	touched := make(map[int32]*kafkaPartition)
+	for _, id := range ids {
+		partition, offset, err := parseKafkaID(id)
+		if err != nil {
+			ks.mu.Unlock()
+			return acked, err
+		}
+		p := ks.pending[group][partition]
+		if p == nil {
+			continue
+		}
+		if done, ok := p.acked[offset]; ok && !done {
+			p.acked[offset] = true
+			delete(p.delivered, offset)
+			acked++
+			touched[partition] = p
+		}
+	}
+	commit := committable(touched)
+	if client != nil {
+		ks.throttle(client, touched)
+	}
+	ks.mu.Unlock()
+
+	if client != nil && len(commit) > 0 {
+		if err := client.CommitRecords(ctx, commit...); err != nil {
+			return acked, fmt.Errorf("failed to commit offsets on %s: %v", streamKey, err)
+		}
+	}
+	return acked, nil
+}
+
+// committable drops the acknowledged records at the head of each partition and returns
+// the last of them, the record up to which the partition's offset can be committed
+func committable(partitions map[int32]*kafkaPartition) []*kgo.Record {
+	var commit []*kgo.Record
+	for _, p := range partitions {
+		var last *kgo.Record
+		for len(p.records) > 0 && p.acked[p.records[0].Offset] {
+			last = p.records[0]
+			delete(p.acked, last.Offset)
+			p.records = p.records[1:]
+		}
+		if last != nil {
+			commit = append(commit, last)
+		}
+	}
+	return commit
+}
+
+// parseKafkaID splits a message ID made by Pull into partition and offset
+func parseKafkaID(id string) (int32, int64, error) {
+	partition, offset, ok := strings.Cut(id, "-")
+	p, err := strconv.ParseInt(partition, 10, 32)
+	if !ok || err != nil {
+		return 0, 0, fmt.Errorf("invalid Kafka message ID %q", id)
+	}
+	o, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Kafka message ID %q", id)
+	}
+	return int32(p), o, nil
+}
+
+// consumer returns the group member of config.ConsumerGroup, joining the group on first use
+func (ks *KafkaStream) consumer(config ConsumerConfig) (*kgo.Client, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if client, ok := ks.consumers[config.ConsumerGroup]; ok {
+		return client, nil
+	}
+
+	offset, err := kafkaStartOffset(config.StartID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize consumer group: %v", err)
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(ks.brokers...),
+		kgo.ConsumeTopics(ks.topic),
+		kgo.ConsumerGroup(config.ConsumerGroup),
+		kgo.ConsumeResetOffset(offset),
+		kgo.DisableAutoCommit(),
+		// Records of partitions moved to another member are read again by that member
+		kgo.OnPartitionsRevoked(ks.forget(config.ConsumerGroup)),
+		kgo.OnPartitionsLost(ks.forget(config.ConsumerGroup)),
+	}
+	if config.ConsumerName != "" {
+		opts = append(opts, kgo.ClientID(config.ConsumerName))
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kafka consumer: %v", err)
+	}
+	ks.consumers[config.ConsumerGroup] = client
+	return client, nil
+}
+
+// forget returns a rebalance callback dropping the pending records of a group's lost
+// partitions and resuming them, in case they are assigned to this member again
+func (ks *KafkaStream) forget(group string) func(context.Context, *kgo.Client, map[string][]int32) {
+	return func(_ context.Context, client *kgo.Client, partitions map[string][]int32) {
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+		for _, lost := range partitions {
+			for _, partition := range lost {
+				delete(ks.pending[group], partition)
+			}
+		}
+		client.ResumeFetchPartitions(partitions)
+	}
+}
+
+// kafkaStartOffset maps a group start position to a Kafka offset: "$" is the end of
+// the topic, "0" the beginning and an entry ID the first record after its timestamp
+func kafkaStartOffset(startID string) (kgo.Offset, error) {
+	switch startID {
+	case "", "$":
+		return kgo.NewOffset().AtEnd(), nil
+	case "0", "0-0":
+		return kgo.NewOffset().AtStart(), nil
+	}
+
+	ms, _, err := parseEntryID(startID)
+	if err != nil {
+		return kgo.Offset{}, err
+	}
+	return kgo.NewOffset().AfterMilli(ms), nil
+}
+
+// kafkaHeader returns the value of a record header, empty when it is missing
+func kafkaHeader(record *kgo.Record, key string) string {
+	for _, header := range record.Headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+// Ping checks that a broker answers
+func (ks *KafkaStream) Ping(ctx context.Context) error {
+	if err := ks.producer.Ping(ctx); err != nil {
+		return fmt.Errorf("failed to reach Kafka: %v", err)
+	}
+	return nil
+}
+
+// Close leaves the consumer groups and closes the producer
+func (ks *KafkaStream) Close() {
+	ks.mu.Lock()
+	consumers := ks.consumers
+	ks.consumers = make(map[string]*kgo.Client)
+	ks.mu.Unlock()
+
+	// Leaving a group revokes its partitions, which calls forget
+	for _, client := range consumers {
+		client.Close()
+	}
+	ks.producer.Close()
+}
@@ -0,0 +1,252 @@
+package stream
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.llib.dev/testcase/clock/timecop"
+)
+
+func newTestKafkaStream(t *testing.T) (*KafkaStream, []string) {
+	t.Helper()
+
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(4, DefaultKafkaTopic))
+	if err != nil {
+		t.Fatalf("Failed to start fake Kafka cluster: %v", err)
+	}
+	t.Cleanup(cluster.Close)
+
+	ks, err := NewKafkaStream(cluster.ListenAddrs(), "")
+	if err != nil {
+		t.Fatalf("NewKafkaStream returned error: %v", err)
+	}
+	t.Cleanup(ks.Close)
+	return ks, cluster.ListenAddrs()
+}
+
+// pullN pulls until n messages arrived, joining a group takes a few polls
+func pullN(t *testing.T, ks *KafkaStream, config ConsumerConfig, n int) []Message {
+	t.Helper()
+
+	var messages []Message
+	deadline := time.Now().Add(10 * time.Second)
+	for len(messages) < n && time.Now().Before(deadline) {
+		batch, err := ks.Pull(context.Background(), config)
+		if err != nil {
+			t.Fatalf("Pull returned error: %v", err)
+		}
+		messages = append(messages, batch...)
+	}
+	if len(messages) != n {
+		t.Fatalf("Expected %d messages, got %+v", n, messages)
+	}
+	return messages
+}
+
+func TestKafkaStream_PushPull(t *testing.T) {
+	ctx := context.Background()
+	ks, _ := newTestKafkaStream(t)
+
+	for _, push := range []struct{ streamKey, key, username string }{
+		{"radius:updates:alice", "radius:acct:alice:s1", "alice"},
+		{"radius:updates:bob", "radius:acct:bob:s1", "bob"},
+		{"radius:updates:alice", "radius:acct:alice:s2", "alice"},
+		{"radius:updates:carol", "radius:acct:carol:s1", "carol"},
+	} {
+		if err := ks.Push(ctx, push.streamKey, StreamMessage{Key: push.key, Username: push.username}); err != nil {
+			t.Fatalf("Push returned error: %v", err)
+		}
+	}
+
+	config := ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:alice", "radius:updates:bob"},
+		ConsumerGroup: "group",
+		ConsumerName:  "consumer",
+		StartID:       "0",
+		BlockTimeout:  200 * time.Millisecond,
+	}
+	messages := pullN(t, ks, config, 3)
+
+	var alice []Message
+	for _, msg := range messages {
+		if msg.StreamKey == "radius:updates:carol" {
+			t.Errorf("Expected records of other streams to be skipped, got %+v", msg)
+		}
+		if msg.Username == "alice" {
+			alice = append(alice, msg)
+		}
+	}
+
+	// Records are keyed by username, so a user's events share a partition and keep their order
+	if len(alice) != 2 || alice[0].Key != "radius:acct:alice:s1" || alice[1].Key != "radius:acct:alice:s2" {
+		t.Fatalf("Expected alice's sessions in publish order, got %+v", alice)
+	}
+	partition := func(id string) string { return id[:strings.Index(id, "-")] }
+	if partition(alice[0].ID) != partition(alice[1].ID) {
+		t.Errorf("Expected alice's events in one partition, got %s and %s", alice[0].ID, alice[1].ID)
+	}
+
+	// Another group reads the topic independently and only sees its own users
+	other := config
+	other.ConsumerGroup = "other"
+	other.Usernames = []string{"bob"}
+	messages = pullN(t, ks, other, 1)
+	if messages[0].Key != "radius:acct:bob:s1" {
+		t.Errorf("Expected bob's session, got %+v", messages)
+	}
+}
+
+func TestKafkaStream_CommitsOffsets(t *testing.T) {
+	ctx := context.Background()
+	ks, brokers := newTestKafkaStream(t)
+
+	config := ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:alice"},
+		ConsumerGroup: "group",
+		StartID:       "0",
+		BlockTimeout:  200 * time.Millisecond,
+	}
+	ks.Push(ctx, "radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s1", Username: "alice"})
+	pullN(t, ks, config, 1)
+	ks.Close()
+
+	// A restarted consumer continues after the committed offset
+	restarted, err := NewKafkaStream(brokers, "")
+	if err != nil {
+		t.Fatalf("NewKafkaStream returned error: %v", err)
+	}
+	defer restarted.Close()
+
+	restarted.Push(ctx, "radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s2", Username: "alice"})
+	messages := pullN(t, restarted, config, 1)
+	if messages[0].Key != "radius:acct:alice:s2" {
+		t.Errorf("Expected only the new session after a restart, got %+v", messages)
+	}
+}
+
+func TestKafkaStream_ManualAck(t *testing.T) {
+	ctx := context.Background()
+	ks, brokers := newTestKafkaStream(t)
+	ks.ManualAck = true
+
+	config := ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:alice"},
+		ConsumerGroup: "group",
+		StartID:       "0",
+		BlockTimeout:  200 * time.Millisecond,
+	}
+	for _, key := range []string{"radius:acct:alice:s1", "radius:acct:alice:s2", "radius:acct:alice:s3"} {
+		ks.Push(ctx, "radius:updates:alice", StreamMessage{Key: key, Username: "alice"})
+	}
+	messages := pullN(t, ks, config, 3)
+
+	// The second record failed, so only the first one's offset can be committed
+	for _, msg := range []Message{messages[0], messages[2]} {
+		if acked, err := ks.Ack(ctx, msg.StreamKey, config.ConsumerGroup, msg.ID); err != nil || acked != 1 {
+			t.Fatalf("Expected %s to be acknowledged, got %d, %v", msg.ID, acked, err)
+		}
+	}
+	if acked, _ := ks.Ack(ctx, messages[0].StreamKey, config.ConsumerGroup, messages[0].ID); acked != 0 {
+		t.Errorf("Expected a second Ack to find nothing pending, got %d", acked)
+	}
+	ks.Close()
+
+	// A restarted consumer reads again from the unacknowledged record
+	restarted, err := NewKafkaStream(brokers, "")
+	if err != nil {
+		t.Fatalf("NewKafkaStream returned error: %v", err)
+	}
+	defer restarted.Close()
+
+	messages = pullN(t, restarted, config, 2)
+	if messages[0].Key != "radius:acct:alice:s2" || messages[1].Key != "radius:acct:alice:s3" {
+		t.Errorf("Expected the records from the failed one on, got %+v", messages)
+	}
+}
+
+func TestKafkaStream_ManualAckRedeliversFailedRecord(t *testing.T) {
+	ctx := context.Background()
+	ks, _ := newTestKafkaStream(t)
+	ks.ManualAck = true
+	ks.PendingWindow = 3
+
+	config := ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:alice"},
+		ConsumerGroup: "group",
+		StartID:       "0",
+		BlockTimeout:  200 * time.Millisecond,
+		ClaimIdle:     time.Minute,
+	}
+	for _, key := range []string{"radius:acct:alice:s1", "radius:acct:alice:s2", "radius:acct:alice:s3"} {
+		ks.Push(ctx, "radius:updates:alice", StreamMessage{Key: key, Username: "alice"})
+	}
+	messages := pullN(t, ks, config, 3)
+
+	// The first record failed, the window of its partition is full
+	for _, msg := range messages[1:] {
+		ks.Ack(ctx, msg.StreamKey, config.ConsumerGroup, msg.ID)
+	}
+	ks.Push(ctx, "radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s4", Username: "alice"})
+	if batch, err := ks.Pull(ctx, config); err != nil || len(batch) != 0 {
+		t.Fatalf("Expected the full partition to be paused, got %+v, %v", batch, err)
+	}
+
+	// Once idle for ClaimIdle the failed record is delivered again
+	timecop.Travel(t, config.ClaimIdle)
+	batch, err := ks.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(batch) != 1 || batch[0].ID != messages[0].ID || batch[0].Key != "radius:acct:alice:s1" {
+		t.Fatalf("Expected the failed record again, got %+v", batch)
+	}
+
+	// Acknowledging it frees the window and the partition is read again
+	if acked, err := ks.Ack(ctx, batch[0].StreamKey, config.ConsumerGroup, batch[0].ID); err != nil || acked != 1 {
+		t.Fatalf("Expected %s to be acknowledged, got %d, %v", batch[0].ID, acked, err)
+	}
+	partition, _, _ := parseKafkaID(batch[0].ID)
+	if pending := ks.pending[config.ConsumerGroup][partition]; len(pending.records) != 0 || pending.paused {
+		t.Fatalf("Expected the partition to be committed and resumed, got %d records pending", len(pending.records))
+	}
+	messages = pullN(t, ks, config, 1)
+	if messages[0].Key != "radius:acct:alice:s4" {
+		t.Errorf("Expected the record held back by the pause, got %+v", messages)
+	}
+}
+
+func TestKafkaStartOffset(t *testing.T) {
+	tests := []struct {
+		startID   string
+		expected  kgo.Offset
+		expectErr bool
+	}{
+		{startID: "", expected: kgo.NewOffset().AtEnd()},
+		{startID: "$", expected: kgo.NewOffset().AtEnd()},
+		{startID: "0", expected: kgo.NewOffset().AtStart()},
+		{startID: "1700000000000-0", expected: kgo.NewOffset().AfterMilli(1700000000000)},
+		{startID: "yesterday", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.startID, func(t *testing.T) {
+			offset, err := kafkaStartOffset(tt.startID)
+			if tt.expectErr {
+				if err == nil {
+					t.Error("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("kafkaStartOffset returned error: %v", err)
+			}
+			if offset != tt.expected {
+				t.Errorf("Expected offset %v, got %v", tt.expected, offset)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	clock "go.llib.dev/testcase/clock"
+)
+
+// PendingEntry is a message delivered to a consumer and not yet acknowledged
+type PendingEntry struct {
+	ID          string
+	Consumer    string
+	DeliveredAt time.Time
+}
+
+// MemoryStream implements the Stream interface in process memory, for tests and development.
+// It assigns Redis style IDs from the testcase clock and keeps consumer groups with their
+// pending lists, so the same positions, replay ranges and group semantics apply.
+type MemoryStream struct {
+	// ManualAck leaves delivered entries pending until Ack. By default they are
+	// acknowledged as they are read, like RedisStream does.
+	ManualAck bool
+
+	retention RetentionPolicy
+
+	mu      sync.Mutex
+	streams map[string]*memoryLog
+	// pushed is closed and replaced on every Push to wake up waiting pulls
+	pushed chan struct{}
+}
+
+type memoryLog struct {
+	entries []memoryEntry
+	// lastMs and lastSeq are the last generated ID, kept when entries are trimmed
+	lastMs, lastSeq int64
+	groups          map[string]*memoryGroup
+}
+
+type memoryEntry struct {
+	ms, seq int64
+	message Message
+}
+
+type memoryGroup struct {
+	lastMs, lastSeq int64
+	pending         map[string]PendingEntry
+}
+
+// NewMemoryStream creates an empty MemoryStream
+func NewMemoryStream() *MemoryStream {
+	return &MemoryStream{
+		streams: make(map[string]*memoryLog),
+		pushed:  make(chan struct{}),
+	}
+}
+
+// NewMemoryStreamWithRetention creates a MemoryStream that trims streams on every publish
+func NewMemoryStreamWithRetention(retention RetentionPolicy) *MemoryStream {
+	ms := NewMemoryStream()
+	ms.retention = retention
+	return ms
+}
+
+// Push appends a message to a stream
+func (ms *MemoryStream) Push(ctx context.Context, streamKey string, message StreamMessage) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to publish to stream %s: %v", streamKey, err)
+	}
+
+	now := clock.Now()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	log := ms.stream(streamKey)
+
+	// IDs never go backwards, entries within the same millisecond get increasing sequence numbers
+	idMs, seq := now.UnixMilli(), int64(0)
+	if log.lastMs >= idMs {
+		idMs, seq = log.lastMs, log.lastSeq+1
+	}
+	log.lastMs, log.lastSeq = idMs, seq
+
+	log.entries = append(log.entries, memoryEntry{
+		ms:  idMs,
+		seq: seq,
+		message: Message{
+			ID:        fmt.Sprintf("%d-%d", idMs, seq),
+			StreamKey: streamKey,
+			Key:       message.Key,
+			Username:  message.Username,
+		},
+	})
+
+	if maxLen := ms.retention.MaxLen; maxLen > 0 && int64(len(log.entries)) > maxLen {
+		log.entries = append([]memoryEntry(nil), log.entries[int64(len(log.entries))-maxLen:]...)
+	}
+	if ms.retention.MaxAge > 0 {
+		cutoff := now.Add(-ms.retention.MaxAge).UnixMilli()
+		i := sort.Search(len(log.entries), func(i int) bool { return log.entries[i].ms >= cutoff })
+		log.entries = log.entries[i:]
+	}
+
+	close(ms.pushed)
+	ms.pushed = make(chan struct{})
+	return nil
+}
+
+// Pull delivers new entries to a consumer group, waiting up to BlockTimeout when none are waiting
+func (ms *MemoryStream) Pull(ctx context.Context, config ConsumerConfig) ([]Message, error) {
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	blockTimeout := config.BlockTimeout
+	if blockTimeout <= 0 {
+		blockTimeout = DefaultBlockTimeout
+	}
+
+	timer := time.NewTimer(blockTimeout)
+	defer timer.Stop()
+
+	for {
+		messages, pushed, err := ms.readGroup(config, batchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) > 0 {
+			return messages, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to read from stream: %v", ctx.Err())
+		case <-timer.C:
+			return []Message{}, nil
+		case <-pushed:
+		}
+	}
+}
+
+// readGroup delivers up to batchSize new entries per stream. It also returns the channel
+// closed by the next Push, taken under the same lock so no publish is missed.
+func (ms *MemoryStream) readGroup(config ConsumerConfig, batchSize int64) ([]Message, <-chan struct{}, error) {
+	now := clock.Now()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var messages []Message
+	for _, streamKey := range config.StreamKeys {
+		log := ms.stream(streamKey)
+		group, ok := log.groups[config.ConsumerGroup]
+		if !ok {
+			var err error
+			group, err = newMemoryGroup(log, config.StartID)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to initialize consumer group: %v", err)
+			}
+			log.groups[config.ConsumerGroup] = group
+		}
+
+		// Entries are ordered, so the new ones start after the group's last delivered ID
+		start := sort.Search(len(log.entries), func(i int) bool {
+			e := log.entries[i]
+			return e.ms > group.lastMs || (e.ms == group.lastMs && e.seq > group.lastSeq)
+		})
+		end := start + int(batchSize)
+		if end > len(log.entries) {
+			end = len(log.entries)
+		}
+
+		for _, entry := range log.entries[start:end] {
+			group.lastMs, group.lastSeq = entry.ms, entry.seq
+			if ms.ManualAck {
+				group.pending[entry.message.ID] = PendingEntry{
+					ID:          entry.message.ID,
+					Consumer:    config.ConsumerName,
+					DeliveredAt: now,
+				}
+			}
+			if matchesUser(config.Usernames, entry.message.Username) {
+				messages = append(messages, entry.message)
+			}
+		}
+	}
+
+	return messages, ms.pushed, nil
+}
+
+// newMemoryGroup positions a new group at startID, "$" (the last generated ID) when empty
+func newMemoryGroup(log *memoryLog, startID string) (*memoryGroup, error) {
+	group := &memoryGroup{pending: make(map[string]PendingEntry)}
+	switch startID {
+	case "", "$":
+		group.lastMs, group.lastSeq = log.lastMs, log.lastSeq
+	default:
+		idMs, seq, err := parseEntryID(startID)
+		if err != nil {
+			return nil, err
+		}
+		group.lastMs, group.lastSeq = idMs, seq
+	}
+	return group, nil
+}
+
+// Ack removes entries from a group's pending list and returns how many were pending
+func (ms *MemoryStream) Ack(ctx context.Context, streamKey, group string, ids ...string) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	g, err := ms.group(streamKey, group)
+	if err != nil {
+		return 0, err
+	}
+
+	var acked int64
+	for _, id := range ids {
+		if _, ok := g.pending[id]; ok {
+			delete(g.pending, id)
+			acked++
+		}
+	}
+	return acked, nil
+}
+
+// Pending lists a group's delivered but unacknowledged entries in ID order
+func (ms *MemoryStream) Pending(ctx context.Context, streamKey, group string) ([]PendingEntry, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	g, err := ms.group(streamKey, group)
+	if err != nil {
+		return nil, err
+	}
+
+	type position struct {
+		ms, seq int64
+		entry   PendingEntry
+	}
+	positions := make([]position, 0, len(g.pending))
+	for id, entry := range g.pending {
+		idMs, seq, _ := parseEntryID(id)
+		positions = append(positions, position{ms: idMs, seq: seq, entry: entry})
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		return compareIDs(positions[i].ms, positions[i].seq, positions[j].ms, positions[j].seq) < 0
+	})
+
+	pending := make([]PendingEntry, 0, len(positions))
+	for _, p := range positions {
+		pending = append(pending, p.entry)
+	}
+	return pending, nil
+}
+
+// Discover returns all streams matching a glob pattern
+func (ms *MemoryStream) Discover(ctx context.Context, pattern string) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var keys []string
+	for key := range ms.streams {
+		matched, err := path.Match(pattern, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stream pattern %q: %v", pattern, err)
+		}
+		if matched {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Replay reads a range of a stream without a consumer group, leaving group offsets untouched.
+// Bounds follow XRANGE: "-" and "+" are the ends of the stream and "(" excludes an ID.
+func (ms *MemoryStream) Replay(ctx context.Context, streamKey, start, end string, count int64, usernames []string) ([]Message, string, error) {
+	startMs, startSeq, startOp, err := parseRangeBound(start, false)
+	if err != nil {
+		return nil, "", err
+	}
+	endMs, endSeq, endOp, err := parseRangeBound(end, true)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var entries []memoryEntry
+	if log, ok := ms.streams[streamKey]; ok {
+		for _, e := range log.entries {
+			if int64(len(entries)) == count {
+				break
+			}
+			if satisfies(compareIDs(e.ms, e.seq, startMs, startSeq), startOp) &&
+				satisfies(compareIDs(e.ms, e.seq, endMs, endSeq), endOp) {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	var result []Message
+	for _, e := range entries {
+		if matchesUser(usernames, e.message.Username) {
+			result = append(result, e.message)
+		}
+	}
+
+	// A short page means the range is exhausted, otherwise continue after the last ID
+	if int64(len(entries)) < count {
+		return result, "", nil
+	}
+	return result, "(" + entries[len(entries)-1].message.ID, nil
+}
+
+// Ping always succeeds, the stream lives in this process
+func (ms *MemoryStream) Ping(ctx context.Context) error {
+	return nil
+}
+
+// GroupStatus reports the pending entries and lag of a consumer group
+func (ms *MemoryStream) GroupStatus(ctx context.Context, streamKey, group string) (GroupStatus, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	g, err := ms.group(streamKey, group)
+	if err != nil {
+		return GroupStatus{}, err
+	}
+
+	status := GroupStatus{Pending: int64(len(g.pending))}
+	for _, e := range ms.streams[streamKey].entries {
+		if compareIDs(e.ms, e.seq, g.lastMs, g.lastSeq) > 0 {
+			status.Lag++
+		}
+	}
+	return status, nil
+}
+
+// stream returns the log of streamKey, creating it like XGROUP CREATE MKSTREAM. Callers hold mu.
+func (ms *MemoryStream) stream(streamKey string) *memoryLog {
+	log, ok := ms.streams[streamKey]
+	if !ok {
+		log = &memoryLog{groups: make(map[string]*memoryGroup)}
+		ms.streams[streamKey] = log
+	}
+	return log
+}
+
+// group returns an existing consumer group. Callers hold mu.
+func (ms *MemoryStream) group(streamKey, group string) (*memoryGroup, error) {
+	log, ok := ms.streams[streamKey]
+	if !ok {
+		return nil, ErrGroupNotFound
+	}
+	g, ok := log.groups[group]
+	if !ok {
+		return nil, ErrGroupNotFound
+	}
+	return g, nil
+}
+
+// compareIDs orders two stream IDs, returning -1, 0 or 1
+func compareIDs(ms1, seq1, ms2, seq2 int64) int {
+	switch {
+	case ms1 < ms2 || (ms1 == ms2 && seq1 < seq2):
+		return -1
+	case ms1 == ms2 && seq1 == seq2:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// satisfies applies a comparison operator returned by parseRangeBound to a compareIDs result
+func satisfies(cmp int, op string) bool {
+	switch op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	default:
+		return cmp <= 0
+	}
+}
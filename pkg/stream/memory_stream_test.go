@@ -0,0 +1,186 @@
+package stream
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.llib.dev/testcase/clock/timecop"
+)
+
+func TestMemoryStream_PushPull(t *testing.T) {
+	// freezing time to avoid flaky tests
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+	ctx := context.Background()
+	ms := NewMemoryStream()
+
+	ms.Push(ctx, "radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s1", Username: "alice"})
+	ms.Push(ctx, "radius:updates:bob", StreamMessage{Key: "radius:acct:bob:s1", Username: "bob"})
+	ms.Push(ctx, "radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s2", Username: "alice"})
+
+	config := ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:alice", "radius:updates:bob"},
+		ConsumerGroup: "group",
+		ConsumerName:  "consumer",
+		StartID:       "0",
+		BlockTimeout:  10 * time.Millisecond,
+	}
+	messages, err := ms.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+
+	expected := []Message{
+		{ID: "100000000-0", StreamKey: "radius:updates:alice", Key: "radius:acct:alice:s1", Username: "alice"},
+		{ID: "100000000-1", StreamKey: "radius:updates:alice", Key: "radius:acct:alice:s2", Username: "alice"},
+		{ID: "100000000-0", StreamKey: "radius:updates:bob", Key: "radius:acct:bob:s1", Username: "bob"},
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected messages %+v, got %+v", expected, messages)
+	}
+
+	messages, err = ms.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("Expected no messages on the second pull, got %+v", messages)
+	}
+
+	// A group created at $ only sees entries published afterwards
+	late := config
+	late.ConsumerGroup = "late"
+	late.StartID = ""
+	ms.Pull(ctx, late)
+	ms.Push(ctx, "radius:updates:bob", StreamMessage{Key: "radius:acct:bob:s2", Username: "bob"})
+	messages, err = ms.Pull(ctx, late)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Key != "radius:acct:bob:s2" {
+		t.Errorf("Expected only the new entry for a group at $, got %+v", messages)
+	}
+}
+
+func TestMemoryStream_PendingAndAck(t *testing.T) {
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+	ctx := context.Background()
+	ms := NewMemoryStream()
+	ms.ManualAck = true
+
+	for i := 0; i < 3; i++ {
+		ms.Push(ctx, "radius:updates:alice", StreamMessage{Key: "k", Username: "alice"})
+	}
+
+	config := ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:alice"},
+		ConsumerGroup: "group",
+		ConsumerName:  "consumer-1",
+		StartID:       "0",
+		BatchSize:     2,
+		BlockTimeout:  10 * time.Millisecond,
+	}
+	if _, err := ms.Pull(ctx, config); err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+
+	status, err := ms.GroupStatus(ctx, "radius:updates:alice", "group")
+	if err != nil {
+		t.Fatalf("GroupStatus returned error: %v", err)
+	}
+	if status != (GroupStatus{Pending: 2, Lag: 1}) {
+		t.Errorf("Expected 2 pending and a lag of 1, got %+v", status)
+	}
+
+	acked, err := ms.Ack(ctx, "radius:updates:alice", "group", "100000000-0", "100000000-5")
+	if err != nil {
+		t.Fatalf("Ack returned error: %v", err)
+	}
+	if acked != 1 {
+		t.Errorf("Expected 1 acknowledged entry, got %d", acked)
+	}
+
+	pending, err := ms.Pending(ctx, "radius:updates:alice", "group")
+	if err != nil {
+		t.Fatalf("Pending returned error: %v", err)
+	}
+	expected := []PendingEntry{{ID: "100000000-1", Consumer: "consumer-1", DeliveredAt: time.Unix(100000, 0)}}
+	if !reflect.DeepEqual(pending, expected) {
+		t.Errorf("Expected pending entries %+v, got %+v", expected, pending)
+	}
+
+	if _, err := ms.Pending(ctx, "radius:updates:alice", "other"); err != ErrGroupNotFound {
+		t.Errorf("Expected ErrGroupNotFound for an unknown group, got %v", err)
+	}
+}
+
+func TestMemoryStream_Pull_WaitsForPush(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemoryStream()
+
+	config := ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:alice"},
+		ConsumerGroup: "group",
+		BlockTimeout:  5 * time.Second,
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		ms.Push(ctx, "radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s1", Username: "alice"})
+	}()
+
+	start := time.Now()
+	messages, err := ms.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Errorf("Expected the published entry, got %+v", messages)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Expected the push to wake up the pull, waited %v", time.Since(start))
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := ms.Pull(cancelled, config); err == nil {
+		t.Error("Expected an error from a cancelled pull")
+	}
+}
+
+func TestMemoryStream_RetentionAndReplay(t *testing.T) {
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+	ctx := context.Background()
+	ms := NewMemoryStreamWithRetention(RetentionPolicy{MaxLen: 3, MaxAge: 150 * time.Second})
+
+	// One entry a minute, the first falls out by length and the second by age
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		ms.Push(ctx, "radius:updates:alice", StreamMessage{Key: key, Username: "alice"})
+		timecop.Travel(t, time.Minute, timecop.Freeze)
+	}
+
+	messages, next, err := ms.Replay(ctx, "radius:updates:alice", "-", "+", 2, nil)
+	if err != nil {
+		t.Fatalf("Replay returned error: %v", err)
+	}
+	if len(messages) != 2 || messages[0].Key != "k3" || messages[1].Key != "k4" {
+		t.Errorf("Expected k3 and k4, got %+v", messages)
+	}
+
+	messages, next, err = ms.Replay(ctx, "radius:updates:alice", next, "+", 2, nil)
+	if err != nil {
+		t.Fatalf("Replay returned error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Key != "k5" || next != "" {
+		t.Errorf("Expected only k5 and an exhausted range, got %+v next %q", messages, next)
+	}
+
+	keys, err := ms.Discover(ctx, "radius:updates:*")
+	if err != nil {
+		t.Fatalf("Discover returned error: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"radius:updates:alice"}) {
+		t.Errorf("Expected the alice stream, got %v", keys)
+	}
+}
@@ -0,0 +1,401 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	clock "go.llib.dev/testcase/clock"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// DefaultNATSStream is the JetStream stream holding the accounting events
+	DefaultNATSStream = "RADIUS_UPDATES"
+	// DefaultAckWait is how long a delivered message may stay unacknowledged before it is redelivered
+	DefaultAckWait = 30 * time.Second
+)
+
+// natsSubjects are the subjects of every stream key of the topologies, radius:updates:*
+const natsSubjects = "radius.updates.>"
+
+// NATSStream implements the Stream interface on NATS JetStream. Stream keys map to
+// subjects token by token, radius:updates:alice is published as radius.updates.alice,
+// and every consumer group is a durable pull consumer filtered on its stream keys.
+type NATSStream struct {
+	// ManualAck leaves delivered messages pending until Ack, they are redelivered after
+	// AckWait otherwise. By default they are acknowledged as they are read.
+	ManualAck bool
+	// AckWait and MaxDeliver apply to consumer groups created or updated afterwards,
+	// MaxDeliver 0 redelivers without limit
+	AckWait    time.Duration
+	MaxDeliver int
+
+	js     jetstream.JetStream
+	stream jetstream.Stream
+
+	mu sync.Mutex
+	// consumers caches the durable consumer of each group with the stream keys it filters on
+	consumers map[string]natsConsumer
+	// pending holds the manually acknowledged messages of each group by ID
+	pending map[string]map[string]jetstream.Msg
+}
+
+type natsConsumer struct {
+	consumer jetstream.Consumer
+	subjects string
+}
+
+// NewNATSStream creates or updates the JetStream stream on nc without retention limits
+func NewNATSStream(ctx context.Context, nc *nats.Conn) (*NATSStream, error) {
+	return NewNATSStreamWithRetention(ctx, nc, RetentionPolicy{})
+}
+
+// NewNATSStreamWithRetention creates or updates the JetStream stream on nc. MaxLen caps
+// the messages kept per subject, so like MAXLEN it applies to every stream key.
+func NewNATSStreamWithRetention(ctx context.Context, nc *nats.Conn, retention RetentionPolicy) (*NATSStream, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize JetStream: %v", err)
+	}
+
+	config := jetstream.StreamConfig{
+		Name:     DefaultNATSStream,
+		Subjects: []string{natsSubjects},
+		Storage:  jetstream.FileStorage,
+		MaxAge:   retention.MaxAge,
+	}
+	if retention.MaxLen > 0 {
+		config.MaxMsgsPerSubject = retention.MaxLen
+	}
+
+	stream, err := js.CreateOrUpdateStream(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream stream %s: %v", DefaultNATSStream, err)
+	}
+
+	return &NATSStream{
+		AckWait:   DefaultAckWait,
+		js:        js,
+		stream:    stream,
+		consumers: make(map[string]natsConsumer),
+		pending:   make(map[string]map[string]jetstream.Msg),
+	}, nil
+}
+
+// Push publishes a message to the subject of streamKey and waits for JetStream to store it
+func (ns *NATSStream) Push(ctx context.Context, streamKey string, message StreamMessage) error {
+	data, err := json.Marshal(eventPayload{
+		Key:       message.Key,
+		Username:  message.Username,
+		Timestamp: clock.Now().Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode message for stream %s: %v", streamKey, err)
+	}
+
+	if _, err := ns.js.Publish(ctx, NATSSubject(streamKey), data); err != nil {
+		return fmt.Errorf("failed to publish to stream %s: %v", streamKey, err)
+	}
+	return nil
+}
+
+// Pull fetches up to BatchSize messages for the consumer group, waiting up to BlockTimeout
+// for the first one
+func (ns *NATSStream) Pull(ctx context.Context, config ConsumerConfig) ([]Message, error) {
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	blockTimeout := config.BlockTimeout
+	if blockTimeout <= 0 {
+		blockTimeout = DefaultBlockTimeout
+	}
+
+	consumer, err := ns.consumer(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Take what is waiting, otherwise block for one message and top the batch up with
+	// whatever arrived with it, so a single event is not held back for BlockTimeout
+	msgs, err := fetch(consumer.FetchNoWait(int(batchSize)))
+	if err == nil && len(msgs) == 0 {
+		fetchCtx, cancel := context.WithTimeout(ctx, blockTimeout)
+		msgs, err = fetch(consumer.Fetch(1, jetstream.FetchContext(fetchCtx)))
+		cancel()
+		if err == nil && len(msgs) > 0 && batchSize > 1 {
+			var more []jetstream.Msg
+			more, err = fetch(consumer.FetchNoWait(int(batchSize) - 1))
+			msgs = append(msgs, more...)
+		}
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, fmt.Errorf("failed to read from stream: %v", ctxErr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from stream: %v", err)
+	}
+
+	messages := make([]Message, 0, len(msgs))
+	for _, msg := range msgs {
+		m, ok := natsMessage(msg)
+		if !ok {
+			log.Printf("[NATS] Skipping malformed message on %s", msg.Subject())
+			msg.Term()
+			continue
+		}
+
+		// Messages outside the user filter are acknowledged like the rest of the batch
+		if ns.ManualAck && matchesUser(config.Usernames, m.Username) {
+			ns.track(config.ConsumerGroup, m.ID, msg)
+		} else if err := msg.Ack(); err != nil {
+			log.Printf("[NATS] Failed to acknowledge %s on %s: %v", m.ID, m.StreamKey, err)
+		}
+
+		if matchesUser(config.Usernames, m.Username) {
+			messages = append(messages, m)
+		}
+	}
+
+	return messages, nil
+}
+
+// fetch drains a fetched batch. Expired waits and empty results are not errors.
+func fetch(batch jetstream.MessageBatch, err error) ([]jetstream.Msg, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []jetstream.Msg
+	for msg := range batch.Messages() {
+		msgs = append(msgs, msg)
+	}
+
+	if err := batch.Error(); err != nil &&
+		!errors.Is(err, context.DeadlineExceeded) &&
+		!errors.Is(err, nats.ErrTimeout) &&
+		!errors.Is(err, jetstream.ErrNoMessages) {
+		return msgs, err
+	}
+	return msgs, nil
+}
+
+// natsMessage decodes a JetStream message, its ID is the publish time and stream sequence
+func natsMessage(msg jetstream.Msg) (Message, bool) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return Message{}, false
+	}
+
+	var value eventPayload
+	if err := json.Unmarshal(msg.Data(), &value); err != nil {
+		return Message{}, false
+	}
+
+	return Message{
+		ID:        fmt.Sprintf("%d-%d", meta.Timestamp.UnixMilli(), meta.Sequence.Stream),
+		StreamKey: StreamKeyFromNATSSubject(msg.Subject()),
+		Key:       value.Key,
+		Username:  value.Username,
+	}, true
+}
+
+// consumer returns the durable consumer of config.ConsumerGroup, creating it at StartID
+// or updating its subject filter when the stream keys changed
+func (ns *NATSStream) consumer(ctx context.Context, config ConsumerConfig) (jetstream.Consumer, error) {
+	subjects := make([]string, 0, len(config.StreamKeys))
+	for _, streamKey := range config.StreamKeys {
+		subjects = append(subjects, NATSSubject(streamKey))
+	}
+	sort.Strings(subjects)
+	filter := strings.Join(subjects, ",")
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if cached, ok := ns.consumers[config.ConsumerGroup]; ok && cached.subjects == filter {
+		return cached.consumer, nil
+	}
+
+	name := natsToken(config.ConsumerGroup)
+	consumerConfig := jetstream.ConsumerConfig{
+		Durable:        name,
+		FilterSubjects: subjects,
+		AckPolicy:      jetstream.AckExplicitPolicy,
+		AckWait:        ns.AckWait,
+		MaxDeliver:     ns.MaxDeliver,
+	}
+	if consumerConfig.MaxDeliver == 0 {
+		consumerConfig.MaxDeliver = -1
+	}
+
+	// The start position of an existing group cannot change, like XGROUP CREATE on an existing group
+	existing, err := ns.stream.Consumer(ctx, name)
+	switch {
+	case err == nil:
+		info := existing.CachedInfo().Config
+		consumerConfig.DeliverPolicy = info.DeliverPolicy
+		consumerConfig.OptStartSeq = info.OptStartSeq
+		consumerConfig.OptStartTime = info.OptStartTime
+	case errors.Is(err, jetstream.ErrConsumerNotFound):
+		if err := natsStartPolicy(config.StartID, &consumerConfig); err != nil {
+			return nil, fmt.Errorf("failed to initialize consumer group: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("failed to initialize consumer group: %v", err)
+	}
+
+	consumer, err := ns.stream.CreateOrUpdateConsumer(ctx, consumerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize consumer group: %v", err)
+	}
+	ns.consumers[config.ConsumerGroup] = natsConsumer{consumer: consumer, subjects: filter}
+	return consumer, nil
+}
+
+// natsStartPolicy positions a new consumer at startID: "$" delivers new messages only,
+// "0" everything kept and an entry ID the messages published from its time on
+func natsStartPolicy(startID string, config *jetstream.ConsumerConfig) error {
+	switch startID {
+	case "", "$":
+		config.DeliverPolicy = jetstream.DeliverNewPolicy
+		return nil
+	case "0", "0-0":
+		config.DeliverPolicy = jetstream.DeliverAllPolicy
+		return nil
+	}
+
+	ms, _, err := parseEntryID(startID)
+	if err != nil {
+		return err
+	}
+	start := time.UnixMilli(ms)
+	config.DeliverPolicy = jetstream.DeliverByStartTimePolicy
+	config.OptStartTime = &start
+	return nil
+}
+
+// track keeps a delivered message until Ack. Callers must not hold mu.
+func (ns *NATSStream) track(group, id string, msg jetstream.Msg) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if ns.pending[group] == nil {
+		ns.pending[group] = make(map[string]jetstream.Msg)
+	}
+	ns.pending[group][id] = msg
+}
+
+// Ack acknowledges delivered messages of a group and returns how many were pending.
+// Messages that are not acknowledged within AckWait are delivered again.
+func (ns *NATSStream) Ack(ctx context.Context, streamKey, group string, ids ...string) (int64, error) {
+	ns.mu.Lock()
+	var msgs []jetstream.Msg
+	for _, id := range ids {
+		if msg, ok := ns.pending[group][id]; ok {
+			delete(ns.pending[group], id)
+			msgs = append(msgs, msg)
+		}
+	}
+	ns.mu.Unlock()
+
+	var acked int64
+	for _, msg := range msgs {
+		if err := msg.DoubleAck(ctx); err != nil {
+			return acked, fmt.Errorf("failed to acknowledge message on %s: %v", streamKey, err)
+		}
+		acked++
+	}
+	return acked, nil
+}
+
+// Discover returns the stream keys matching a glob pattern that have messages. Patterns
+// whose wildcards cover whole tokens, like radius:updates:*, are matched by JetStream.
+func (ns *NATSStream) Discover(ctx context.Context, pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid stream pattern %q: %v", pattern, err)
+	}
+
+	info, err := ns.stream.Info(ctx, jetstream.WithSubjectFilter(natsSubjectFilter(pattern)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subjects of %s: %v", DefaultNATSStream, err)
+	}
+
+	var keys []string
+	for subject := range info.State.Subjects {
+		key := StreamKeyFromNATSSubject(subject)
+		if matched, _ := path.Match(pattern, key); matched {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// natsSubjectFilter translates a glob to a subject filter, or ">" when it uses wildcards
+// inside a token, which subjects cannot express
+func natsSubjectFilter(pattern string) string {
+	tokens := strings.Split(pattern, ":")
+	for i, token := range tokens {
+		switch {
+		case token == "*":
+		case strings.ContainsAny(token, `*?[\`):
+			return ">"
+		default:
+			tokens[i] = natsToken(token)
+		}
+	}
+	return strings.Join(tokens, ".")
+}
+
+// Ping checks that JetStream answers
+func (ns *NATSStream) Ping(ctx context.Context) error {
+	if _, err := ns.js.AccountInfo(ctx); err != nil {
+		return fmt.Errorf("failed to reach JetStream: %v", err)
+	}
+	return nil
+}
+
+// NATSSubject maps a stream key to its subject, each colon separated part becomes a token
+func NATSSubject(streamKey string) string {
+	tokens := strings.Split(streamKey, ":")
+	for i, token := range tokens {
+		tokens[i] = natsToken(token)
+	}
+	return strings.Join(tokens, ".")
+}
+
+// StreamKeyFromNATSSubject reverses NATSSubject
+func StreamKeyFromNATSSubject(subject string) string {
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		tokens[i] = natsTokenReplacer.Replace(token)
+	}
+	return strings.Join(tokens, ":")
+}
+
+// natsToken escapes the characters subjects reserve, so usernames like john.doe stay one token
+func natsToken(value string) string {
+	var b strings.Builder
+	for _, r := range value {
+		switch r {
+		case '%', '.', '*', '>', ' ', '\t', '\r', '\n':
+			fmt.Fprintf(&b, "%%%02X", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+var natsTokenReplacer = strings.NewReplacer("%25", "%", "%2E", ".", "%2A", "*", "%3E", ">", "%20", " ", "%09", "\t", "%0D", "\r", "%0A", "\n")
@@ -0,0 +1,217 @@
+package stream
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// newTestNATSConn starts an embedded NATS server with JetStream and connects to it
+func newTestNATSConn(t *testing.T) *nats.Conn {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create NATS server: %v", err)
+	}
+	go ns.Start()
+	t.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("Failed to connect to NATS: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func newTestNATSStream(t *testing.T, nc *nats.Conn) *NATSStream {
+	t.Helper()
+
+	ns, err := NewNATSStream(context.Background(), nc)
+	if err != nil {
+		t.Fatalf("NewNATSStream returned error: %v", err)
+	}
+	return ns
+}
+
+func TestNATSSubject(t *testing.T) {
+	tests := []struct {
+		streamKey string
+		subject   string
+	}{
+		{"radius:updates:alice", "radius.updates.alice"},
+		{"radius:updates:p3", "radius.updates.p3"},
+		{"radius:updates:{alice}", "radius.updates.{alice}"},
+		{"radius:updates:john.doe", "radius.updates.john%2Edoe"},
+		{"radius:updates:50%>*", "radius.updates.50%25%3E%2A"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.streamKey, func(t *testing.T) {
+			if subject := NATSSubject(tt.streamKey); subject != tt.subject {
+				t.Errorf("Expected subject %s, got %s", tt.subject, subject)
+			}
+			if key := StreamKeyFromNATSSubject(tt.subject); key != tt.streamKey {
+				t.Errorf("Expected stream key %s, got %s", tt.streamKey, key)
+			}
+		})
+	}
+}
+
+func TestNATSStream_PushPull(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestNATSStream(t, newTestNATSConn(t))
+
+	ns.Push(ctx, "radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s1", Username: "alice"})
+	ns.Push(ctx, "radius:updates:john.doe", StreamMessage{Key: "radius:acct:john.doe:s1", Username: "john.doe"})
+	ns.Push(ctx, "radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s2", Username: "alice"})
+	ns.Push(ctx, "radius:updates:bob", StreamMessage{Key: "radius:acct:bob:s1", Username: "bob"})
+
+	config := ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:alice", "radius:updates:john.doe"},
+		ConsumerGroup: "group",
+		StartID:       "0",
+		BlockTimeout:  100 * time.Millisecond,
+	}
+	messages, err := ns.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+
+	var keys []string
+	for _, msg := range messages {
+		keys = append(keys, msg.StreamKey+" "+msg.Key)
+	}
+	expected := []string{
+		"radius:updates:alice radius:acct:alice:s1",
+		"radius:updates:john.doe radius:acct:john.doe:s1",
+		"radius:updates:alice radius:acct:alice:s2",
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+
+	// Following another stream key updates the durable consumer without rewinding it, so
+	// messages of the new key older than the group's position are not delivered
+	config.StreamKeys = append(config.StreamKeys, "radius:updates:bob")
+	ns.Push(ctx, "radius:updates:bob", StreamMessage{Key: "radius:acct:bob:s2", Username: "bob"})
+	messages, err = ns.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Key != "radius:acct:bob:s2" {
+		t.Errorf("Expected bob's new session once the filter covers it, got %+v", messages)
+	}
+
+	// A blocking pull returns as soon as a message arrives
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ns.Push(ctx, "radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s3", Username: "alice"})
+	}()
+	config.BlockTimeout = 5 * time.Second
+	start := time.Now()
+	messages, err = ns.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(messages) != 1 || time.Since(start) > 2*time.Second {
+		t.Errorf("Expected the new message without waiting for the timeout, got %+v after %v", messages, time.Since(start))
+	}
+}
+
+func TestNATSStream_ManualAckRedelivers(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestNATSStream(t, newTestNATSConn(t))
+	ns.ManualAck = true
+	ns.AckWait = 200 * time.Millisecond
+
+	ns.Push(ctx, "radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s1", Username: "alice"})
+
+	config := ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:alice"},
+		ConsumerGroup: "group",
+		StartID:       "0",
+		BlockTimeout:  time.Second,
+	}
+	first, err := ns.Pull(ctx, config)
+	if err != nil || len(first) != 1 {
+		t.Fatalf("Expected one message, got %+v (%v)", first, err)
+	}
+
+	// Not acknowledged within AckWait, so it comes back
+	redelivered, err := ns.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(redelivered) != 1 || redelivered[0].ID != first[0].ID {
+		t.Fatalf("Expected %s to be redelivered, got %+v", first[0].ID, redelivered)
+	}
+
+	acked, err := ns.Ack(ctx, "radius:updates:alice", "group", redelivered[0].ID, "0-99")
+	if err != nil {
+		t.Fatalf("Ack returned error: %v", err)
+	}
+	if acked != 1 {
+		t.Errorf("Expected 1 acknowledged message, got %d", acked)
+	}
+
+	config.BlockTimeout = 400 * time.Millisecond
+	if messages, _ := ns.Pull(ctx, config); len(messages) != 0 {
+		t.Errorf("Expected no redelivery after Ack, got %+v", messages)
+	}
+}
+
+func TestNATSStream_DurableAndDiscover(t *testing.T) {
+	ctx := context.Background()
+	nc := newTestNATSConn(t)
+	ns := newTestNATSStream(t, nc)
+
+	config := ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:alice"},
+		ConsumerGroup: "group",
+		BlockTimeout:  100 * time.Millisecond,
+	}
+	// The group starts at $ and only sees messages published after it was created
+	ns.Push(ctx, "radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s1", Username: "alice"})
+	ns.Pull(ctx, config)
+	ns.Push(ctx, "radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s2", Username: "alice"})
+	ns.Push(ctx, "radius:updates:bob", StreamMessage{Key: "radius:acct:bob:s1", Username: "bob"})
+
+	// A restarted process continues where the durable consumer left off
+	restarted := newTestNATSStream(t, nc)
+	messages, err := restarted.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Key != "radius:acct:alice:s2" {
+		t.Errorf("Expected only the message published after the group was created, got %+v", messages)
+	}
+
+	for pattern, expected := range map[string][]string{
+		"radius:updates:*":  {"radius:updates:alice", "radius:updates:bob"},
+		"radius:updates:a*": {"radius:updates:alice"},
+	} {
+		keys, err := restarted.Discover(ctx, pattern)
+		if err != nil {
+			t.Fatalf("Discover returned error: %v", err)
+		}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Expected %v for %s, got %v", expected, pattern, keys)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package stream
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var streamIDPattern = regexp.MustCompile(`^\d+(-\d+)?$`)
+
+// ParsePosition converts a user supplied stream position into a Redis stream ID.
+// It accepts the special IDs "$", "-" and "+", explicit IDs such as "1700000000000-0"
+// or "0", and RFC 3339 timestamps which map to the first ID at that instant.
+// "-" and "+" only bound replay ranges, consumer groups cannot start at them.
+func ParsePosition(value string) (string, error) {
+	switch value {
+	case "$", "-", "+":
+		return value, nil
+	}
+
+	if streamIDPattern.MatchString(value) {
+		return value, nil
+	}
+
+	ts, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", fmt.Errorf("invalid stream position %q: expected $, 0, a stream ID or an RFC 3339 timestamp", value)
+	}
+	return strconv.FormatInt(ts.UnixMilli(), 10) + "-0", nil
+}
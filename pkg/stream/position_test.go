@@ -0,0 +1,35 @@
+package stream
+
+import "testing"
+
+func TestParsePosition(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+		wantErr  bool
+	}{
+		{value: "$", expected: "$"},
+		{value: "0", expected: "0"},
+		{value: "1700000000000-3", expected: "1700000000000-3"},
+		{value: "2023-11-14T22:13:20Z", expected: "1700000000000-0"},
+		{value: "yesterday", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParsePosition(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for %q, got %q", tt.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePosition(%q) returned error: %v", tt.value, err)
+			}
+			if got != tt.expected {
+				t.Errorf("ParsePosition(%q) = %q, expected %q", tt.value, got, tt.expected)
+			}
+		})
+	}
+}
@@ -2,7 +2,12 @@ package stream
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	clock "go.llib.dev/testcase/clock"
@@ -12,20 +17,53 @@ import (
 
 // RedisStream implements the Stream interface using Redis streams
 type RedisStream struct {
-	client *redis.Client
-	ctx    context.Context
+	// ManualAck leaves delivered entries in the group's pending entries list until Ack.
+	// By default they are acknowledged as they are read.
+	ManualAck bool
+
+	client    redis.UniversalClient
+	retention RetentionPolicy
+	groups    sync.Map
+
+	// recovering holds the position in a consumer's own pending entries, read once after
+	// start; claims holds when a consumer next claims the idle entries of its group
+	recovering sync.Map
+	claims     sync.Map
+
+	// cluster reads streams living on different slots with separate commands
+	cluster bool
 }
 
-// NewRedisStream creates a new RedisStream instance
-func NewRedisStream(client *redis.Client) *RedisStream {
+// NewRedisStream creates a new RedisStream instance on a standalone, sentinel or cluster client
+func NewRedisStream(client redis.UniversalClient) *RedisStream {
+	_, cluster := client.(*redis.ClusterClient)
 	return &RedisStream{
-		client: client,
-		ctx:    context.Background(),
+		client:  client,
+		cluster: cluster,
 	}
 }
 
+// NewRedisStreamWithRetention creates a RedisStream that trims streams on every publish
+func NewRedisStreamWithRetention(client redis.UniversalClient, retention RetentionPolicy) *RedisStream {
+	rs := NewRedisStream(client)
+	rs.retention = retention
+	return rs
+}
+
 // Push publishes a message to a Redis stream
-func (rs *RedisStream) Push(streamKey string, message StreamMessage) error {
+func (rs *RedisStream) Push(ctx context.Context, streamKey string, message StreamMessage) error {
+	// Add message to stream
+	_, err := rs.client.XAdd(ctx, rs.AddArgs(streamKey, message)).Result()
+
+	if err != nil {
+		return fmt.Errorf("failed to publish to stream %s: %v", streamKey, err)
+	}
+
+	return nil
+}
+
+// AddArgs builds the XADD published by Push, so datastores can queue it in their own transaction
+func (rs *RedisStream) AddArgs(streamKey string, message StreamMessage) *redis.XAddArgs {
 	// Create stream message with Redis-compatible values
 	values := []interface{}{
 		"key", message.Key,
@@ -33,72 +71,474 @@ func (rs *RedisStream) Push(streamKey string, message StreamMessage) error {
 		"username", message.Username,
 	}
 
-	// Add message to stream
-	_, err := rs.client.XAdd(rs.ctx, &redis.XAddArgs{
+	args := &redis.XAddArgs{
 		Stream: streamKey,
 		Values: values,
-	}).Result()
+	}
 
-	if err != nil {
-		return fmt.Errorf("failed to publish to stream %s: %v", streamKey, err)
+	// XADD accepts only one trimming strategy, MAXLEN takes precedence;
+	// the janitor applies the other one in the background
+	if rs.retention.MaxLen > 0 {
+		args.MaxLen = rs.retention.MaxLen
+		args.Approx = true
+	} else if rs.retention.MaxAge > 0 {
+		args.MinID = minIDForAge(rs.retention.MaxAge)
+		args.Approx = true
 	}
 
-	return nil
+	return args
 }
 
-// Pull consumes messages from a Redis stream using consumer groups and returns keys
-func (rs *RedisStream) Pull(config ConsumerConfig) ([]string, error) {
-	// Initialize the consumer group (create stream and consumer group if they don't exist)
-	err := rs.initializeConsumerGroup(config.StreamKey, config.ConsumerGroup)
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize consumer group: %v", err)
+// Pull consumes messages from Redis streams using consumer groups
+func (rs *RedisStream) Pull(ctx context.Context, config ConsumerConfig) ([]Message, error) {
+	discovered := make(map[string]bool, len(config.DiscoveredKeys))
+	for _, streamKey := range config.DiscoveredKeys {
+		discovered[streamKey] = true
+	}
+
+	// Initialize the consumer group on every stream, creating configured streams that
+	// don't exist yet. Discovered streams that were deleted since are left out.
+	keys := make([]string, 0, len(config.StreamKeys))
+	for _, streamKey := range config.StreamKeys {
+		err := rs.initializeConsumerGroup(ctx, streamKey, config.ConsumerGroup, config.StartID, !discovered[streamKey])
+		if err == errStreamNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize consumer group: %v", err)
+		}
+		keys = append(keys, streamKey)
+	}
+
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	blockTimeout := config.BlockTimeout
+	if blockTimeout <= 0 {
+		blockTimeout = DefaultBlockTimeout
+	}
+
+	// Nothing left to read until the next discovery, wait like an empty XREADGROUP would
+	if len(keys) == 0 {
+		timer := time.NewTimer(blockTimeout)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to read from stream: %v", ctx.Err())
+		case <-timer.C:
+			return []Message{}, nil
+		}
+	}
+
+	// Entries delivered before but never acknowledged come first
+	if rs.ManualAck {
+		messages, err := rs.redeliver(ctx, config, keys, batchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) > 0 {
+			return messages, nil
+		}
+	}
+
+	// A cluster rejects multi-key commands spanning slots, so those are read slot by slot
+	if rs.cluster {
+		if slots := groupBySlot(keys); len(slots) > 1 {
+			return rs.readSlots(ctx, config, slots, batchSize, blockTimeout)
+		}
+	}
+	return rs.readGroup(ctx, config, keys, batchSize, blockTimeout)
+}
+
+// readSlots reads streams spread over several cluster slots. Entries that are already
+// waiting are returned without blocking; otherwise every slot is read with a blocking
+// XREADGROUP in parallel and the results are merged.
+func (rs *RedisStream) readSlots(ctx context.Context, config ConsumerConfig, slots [][]string, batchSize int64, blockTimeout time.Duration) ([]Message, error) {
+	var messages []Message
+	for _, keys := range slots {
+		batch, err := rs.readGroup(ctx, config, keys, batchSize, noBlock)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, batch...)
+	}
+	if len(messages) > 0 {
+		return messages, nil
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	for _, keys := range slots {
+		wg.Add(1)
+		go func(keys []string) {
+			defer wg.Done()
+			batch, err := rs.readGroup(ctx, config, keys, batchSize, blockTimeout)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			messages = append(messages, batch...)
+		}(keys)
+	}
+	wg.Wait()
+
+	if len(messages) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	return messages, nil
+}
+
+// noBlock makes XREADGROUP return immediately, go-redis omits BLOCK for negative durations
+const noBlock = -1
+
+// readGroup runs one XREADGROUP over keys for new entries
+func (rs *RedisStream) readGroup(ctx context.Context, config ConsumerConfig, keys []string, batchSize int64, block time.Duration) ([]Message, error) {
+	// XREADGROUP expects all stream keys followed by one ID per stream
+	streamArgs := make([]string, 0, 2*len(keys))
+	streamArgs = append(streamArgs, keys...)
+	for range keys {
+		streamArgs = append(streamArgs, ">")
 	}
 
 	// Read messages from the consumer group
-	streams, err := rs.client.XReadGroup(rs.ctx, &redis.XReadGroupArgs{
+	streams, err := rs.client.XReadGroup(ctx, &redis.XReadGroupArgs{
 		Group:    config.ConsumerGroup,
 		Consumer: config.ConsumerName,
-		Streams:  []string{config.StreamKey, ">"},
-		Count:    10,              // Read up to 10 messages at once
-		Block:    time.Second * 5, // Block for 5 seconds if no messages
+		Streams:  streamArgs,
+		Count:    batchSize,
+		Block:    block,
 	}).Result()
 
 	if err != nil {
 		if err == redis.Nil {
 			// No messages available
-			return []string{}, nil
+			return []Message{}, nil
 		}
+		rs.checkGroups(err)
 		return nil, fmt.Errorf("failed to read from stream: %v", err)
 	}
 
-	var keys []string
-
-	// Process each stream (should only be one in our case)
+	var messages []Message
 	for _, stream := range streams {
-		for _, msg := range stream.Messages {
-			// Extract the key from the message
-			if key, ok := msg.Values["key"].(string); ok {
-				keys = append(keys, key)
-			}
+		messages = append(messages, rs.deliver(ctx, config, stream.Stream, stream.Messages)...)
+	}
+	return messages, nil
+}
 
-			// Acknowledge the message
-			err = rs.client.XAck(rs.ctx, config.StreamKey, config.ConsumerGroup, msg.ID).Err()
-			if err != nil {
-				fmt.Printf("Failed to acknowledge message %s: %v\n", msg.ID, err)
+// checkGroups forgets the groups known to exist when err says a stream was deleted
+// underneath us, so they are recreated on the next pull
+func (rs *RedisStream) checkGroups(err error) {
+	if !strings.HasPrefix(err.Error(), "NOGROUP") {
+		return
+	}
+	rs.groups.Range(func(key, _ interface{}) bool {
+		rs.groups.Delete(key)
+		return true
+	})
+}
+
+// deliver converts the entries read from streamKey. Entries that are not delivered, because
+// they are malformed, deleted or outside the user filter, are acknowledged at once; the
+// delivered ones only without ManualAck.
+func (rs *RedisStream) deliver(ctx context.Context, config ConsumerConfig, streamKey string, entries []redis.XMessage) []Message {
+	var messages []Message
+	ids := make([]string, 0, len(entries))
+	for _, msg := range entries {
+		// Extract the key from the message, skipping users outside the filter
+		m, ok := toMessage(streamKey, msg)
+		if ok && matchesUser(config.Usernames, m.Username) {
+			messages = append(messages, m)
+			if rs.ManualAck {
+				continue
 			}
 		}
+		ids = append(ids, msg.ID)
 	}
 
-	return keys, nil
+	// Acknowledge the skipped entries for this stream at once
+	if len(ids) > 0 {
+		err := rs.client.XAck(ctx, streamKey, config.ConsumerGroup, ids...).Err()
+		if err != nil {
+			log.Printf("[REDIS] Failed to acknowledge %d messages on %s: %v", len(ids), streamKey, err)
+		}
+	}
+	return messages
 }
 
-// initializeConsumerGroup creates the consumer group if it doesn't exist
-func (rs *RedisStream) initializeConsumerGroup(streamKey, consumerGroup string) error {
-	// Try to create the consumer group with MKSTREAM option
-	// This will create the stream if it doesn't exist
-	err := rs.client.XGroupCreateMkStream(rs.ctx, streamKey, consumerGroup, "$").Err()
+// redeliver returns entries that were delivered but never acknowledged. After a start the
+// consumer first reads back its own pending entries from 0. Every ClaimIdle it then takes
+// over the entries of any consumer in the group that stayed pending for longer than that,
+// left by a failed sink write or by a consumer that died. XAUTOCLAIM needs Redis 6.2.
+func (rs *RedisStream) redeliver(ctx context.Context, config ConsumerConfig, keys []string, batchSize int64) ([]Message, error) {
+	var messages []Message
+	for _, streamKey := range keys {
+		recoveryKey := streamKey + "\x00" + config.ConsumerGroup + "\x00" + config.ConsumerName
+		cursor, _ := rs.recovering.LoadOrStore(recoveryKey, "0")
+		if cursor == "" {
+			continue
+		}
+
+		streams, err := rs.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    config.ConsumerGroup,
+			Consumer: config.ConsumerName,
+			Streams:  []string{streamKey, cursor.(string)},
+			Count:    batchSize,
+			Block:    noBlock,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			rs.checkGroups(err)
+			return nil, fmt.Errorf("failed to read pending entries of %s: %v", streamKey, err)
+		}
+
+		var entries []redis.XMessage
+		if len(streams) > 0 {
+			entries = streams[0].Messages
+		}
+		if len(entries) == 0 {
+			// Everything pending from before the start was handed out again
+			rs.recovering.Store(recoveryKey, "")
+			continue
+		}
+		rs.recovering.Store(recoveryKey, entries[len(entries)-1].ID)
+		messages = append(messages, rs.deliver(ctx, config, streamKey, entries)...)
+	}
+	if len(messages) > 0 {
+		return messages, nil
+	}
+
+	claimIdle := config.ClaimIdle
+	if claimIdle <= 0 {
+		claimIdle = DefaultClaimIdle
+	}
+	claimKey := config.ConsumerGroup + "\x00" + config.ConsumerName
+	now := clock.Now()
+	if next, ok := rs.claims.Load(claimKey); ok && now.Before(next.(time.Time)) {
+		return nil, nil
+	}
+
+	// A full batch may leave more idle entries behind, those are claimed on the next pull
+	next := now.Add(claimIdle)
+	for _, streamKey := range keys {
+		entries, err := rs.autoClaim(ctx, streamKey, config, claimIdle, batchSize)
+		if err != nil {
+			rs.checkGroups(err)
+			return nil, fmt.Errorf("failed to claim idle entries of %s: %v", streamKey, err)
+		}
+		if int64(len(entries)) == batchSize {
+			next = now
+		}
+		messages = append(messages, rs.deliver(ctx, config, streamKey, entries)...)
+	}
+	rs.claims.Store(claimKey, next)
+	return messages, nil
+}
+
+// Ack acknowledges delivered entries of a consumer group and returns how many were pending.
+// Entries that are never acknowledged stay in the pending entries list.
+func (rs *RedisStream) Ack(ctx context.Context, streamKey, group string, ids ...string) (int64, error) {
+	acked, err := rs.client.XAck(ctx, streamKey, group, ids...).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to acknowledge messages on %s: %v", streamKey, err)
+	}
+	return acked, nil
+}
+
+// Discover returns all stream keys matching a glob pattern, on every master of a cluster
+func (rs *RedisStream) Discover(ctx context.Context, pattern string) ([]string, error) {
+	return scanStreams(ctx, rs.client, pattern)
+}
+
+// Replay reads a range of a stream without a consumer group, leaving group offsets untouched
+func (rs *RedisStream) Replay(ctx context.Context, streamKey, start, end string, count int64, usernames []string) ([]Message, string, error) {
+	messages, err := rs.client.XRangeN(ctx, streamKey, start, end, count).Result()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read range from stream %s: %v", streamKey, err)
+	}
+
+	var result []Message
+	for _, msg := range messages {
+		if m, ok := toMessage(streamKey, msg); ok && matchesUser(usernames, m.Username) {
+			result = append(result, m)
+		}
+	}
+
+	// A short page means the range is exhausted, otherwise continue after the last ID
+	if int64(len(messages)) < count {
+		return result, "", nil
+	}
+	return result, "(" + messages[len(messages)-1].ID, nil
+}
+
+// Ping checks that Redis is reachable
+func (rs *RedisStream) Ping(ctx context.Context) error {
+	return rs.client.Ping(ctx).Err()
+}
+
+// GroupStatus reports pending messages and lag of a consumer group from XINFO GROUPS.
+// Lag is only reported by Redis 7 and later, older servers yield -1.
+func (rs *RedisStream) GroupStatus(ctx context.Context, streamKey, group string) (GroupStatus, error) {
+	groups, err := xinfo(ctx, rs.client, "GROUPS", streamKey)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return GroupStatus{}, ErrGroupNotFound
+		}
+		return GroupStatus{}, fmt.Errorf("failed to inspect groups of %s: %v", streamKey, err)
+	}
+
+	for _, info := range groups {
+		if info["name"] != group {
+			continue
+		}
+
+		status := GroupStatus{Lag: -1}
+		if pending, ok := info["pending"].(int64); ok {
+			status.Pending = pending
+		}
+		if lag, ok := info["lag"].(int64); ok {
+			status.Lag = lag
+		}
+		return status, nil
+	}
+
+	return GroupStatus{}, ErrGroupNotFound
+}
+
+// xinfo runs an XINFO subcommand replying with a list of objects, such as GROUPS or
+// CONSUMERS, and returns their fields. It is sent as a raw command because go-redis v8
+// rejects the fields added by Redis 7.
+func xinfo(ctx context.Context, client redis.UniversalClient, args ...interface{}) ([]map[string]interface{}, error) {
+	reply, err := client.Do(ctx, append([]interface{}{"XINFO"}, args...)...).Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]map[string]interface{}, 0, len(reply))
+	for _, entry := range reply {
+		fields, ok := entry.([]interface{})
+		if !ok {
+			continue
+		}
+		info := make(map[string]interface{}, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			if name, ok := fields[i].(string); ok {
+				info[name] = fields[i+1]
+			}
+		}
+		objects = append(objects, info)
+	}
+	return objects, nil
+}
+
+// errStreamNotFound is returned by initializeConsumerGroup for a missing stream it may not create
+var errStreamNotFound = errors.New("stream not found")
+
+// initializeConsumerGroup creates the consumer group if it doesn't exist, and with mkStream
+// the stream as well; otherwise a missing stream yields errStreamNotFound.
+// Groups known to exist are remembered to save a round trip per stream on every pull.
+func (rs *RedisStream) initializeConsumerGroup(ctx context.Context, streamKey, consumerGroup, startID string, mkStream bool) error {
+	groupKey := streamKey + "\x00" + consumerGroup
+	if _, ok := rs.groups.Load(groupKey); ok {
+		return nil
+	}
+
+	if startID == "" {
+		startID = "$"
+	}
+
+	var err error
+	if mkStream {
+		err = rs.client.XGroupCreateMkStream(ctx, streamKey, consumerGroup, startID).Err()
+	} else {
+		err = rs.client.XGroupCreate(ctx, streamKey, consumerGroup, startID).Err()
+		if err != nil && strings.Contains(err.Error(), "requires the key to exist") {
+			return errStreamNotFound
+		}
+	}
 	if err != nil && err.Error() != "BUSYGROUP Consumer Group name already exists" {
 		return fmt.Errorf("failed to create consumer group %s for stream %s: %v", consumerGroup, streamKey, err)
 	}
+	rs.groups.Store(groupKey, struct{}{})
 	return nil
 }
+
+// autoClaim runs XAUTOCLAIM from the start of the pending entries list. It is sent as a
+// raw command because go-redis v8 rejects the three element reply of Redis 7.
+func (rs *RedisStream) autoClaim(ctx context.Context, streamKey string, config ConsumerConfig, minIdle time.Duration, count int64) ([]redis.XMessage, error) {
+	reply, err := rs.client.Do(ctx, "XAUTOCLAIM", streamKey, config.ConsumerGroup, config.ConsumerName,
+		minIdle.Milliseconds(), "0-0", "COUNT", count).Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 2 {
+		return nil, fmt.Errorf("unexpected XAUTOCLAIM reply %v", reply)
+	}
+	claimed, _ := reply[1].([]interface{})
+
+	entries := make([]redis.XMessage, 0, len(claimed))
+	for _, item := range claimed {
+		// Redis 6.2 returns entries deleted from the stream as nil, Redis 7 drops them itself
+		entry, ok := item.([]interface{})
+		if !ok || len(entry) != 2 {
+			continue
+		}
+		id, _ := entry[0].(string)
+		fields, _ := entry[1].([]interface{})
+		values := make(map[string]interface{}, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			if name, ok := fields[i].(string); ok {
+				values[name] = fields[i+1]
+			}
+		}
+		entries = append(entries, redis.XMessage{ID: id, Values: values})
+	}
+	return entries, nil
+}
+
+// toMessage converts a raw stream entry, reporting false for entries without a key
+func toMessage(streamKey string, msg redis.XMessage) (Message, bool) {
+	key, ok := msg.Values["key"].(string)
+	if !ok {
+		return Message{}, false
+	}
+	username, _ := msg.Values["username"].(string)
+	return Message{
+		ID:        msg.ID,
+		StreamKey: streamKey,
+		Key:       key,
+		Username:  username,
+	}, true
+}
+
+// matchesUser reports whether username passes the filter, an empty filter matches everyone
+func matchesUser(filter []string, username string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, u := range filter {
+		if u == username {
+			return true
+		}
+	}
+	return false
+}
+
+// minIDForAge returns the smallest stream ID younger than maxAge
+func minIDForAge(maxAge time.Duration) string {
+	return fmt.Sprintf("%d-0", clock.Now().Add(-maxAge).UnixMilli())
+}
+
+// streamIDTime extracts the creation time encoded in a stream entry ID
+func streamIDTime(id string) (time.Time, error) {
+	ms, _, _ := strings.Cut(id, "-")
+	millis, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid stream ID %q: %v", id, err)
+	}
+	return time.UnixMilli(millis), nil
+}
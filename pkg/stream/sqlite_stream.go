@@ -0,0 +1,717 @@
+package stream
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	clock "go.llib.dev/testcase/clock"
+)
+
+// DefaultPollInterval is how often a blocking SQLiteStream.Pull checks for new entries
+const DefaultPollInterval = 100 * time.Millisecond
+
+// Entries are ordered by (ms, seq) like Redis stream IDs, so positions parsed by
+// ParsePosition work the same on both backends. Consumer groups keep the last delivered
+// position and, like a Redis pending entries list, the delivered entries not yet acknowledged.
+const sqliteStreamSchema = `
+CREATE TABLE IF NOT EXISTS stream_entries (
+	stream_key TEXT NOT NULL,
+	ms         INTEGER NOT NULL,
+	seq        INTEGER NOT NULL,
+	record_key TEXT NOT NULL,
+	username   TEXT NOT NULL,
+	PRIMARY KEY (stream_key, ms, seq)
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS stream_groups (
+	stream_key TEXT NOT NULL,
+	group_name TEXT NOT NULL,
+	last_ms    INTEGER NOT NULL,
+	last_seq   INTEGER NOT NULL,
+	PRIMARY KEY (stream_key, group_name)
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS stream_pending (
+	stream_key   TEXT NOT NULL,
+	group_name   TEXT NOT NULL,
+	ms           INTEGER NOT NULL,
+	seq          INTEGER NOT NULL,
+	consumer     TEXT NOT NULL,
+	delivered_at INTEGER NOT NULL,
+	PRIMARY KEY (stream_key, group_name, ms, seq)
+) WITHOUT ROWID;
+`
+
+// SQLiteStream implements the Stream interface as an event log in a local SQLite file.
+// The API appends to it and consumers in other processes tail it.
+type SQLiteStream struct {
+	// ManualAck leaves delivered entries pending until Ack. By default they are
+	// acknowledged as they are read.
+	ManualAck bool
+
+	db           *sql.DB
+	retention    RetentionPolicy
+	groups       sync.Map
+	pollInterval time.Duration
+}
+
+// NewSQLiteStream creates the event log tables in db if needed
+func NewSQLiteStream(ctx context.Context, db *sql.DB) (*SQLiteStream, error) {
+	if _, err := db.ExecContext(ctx, sqliteStreamSchema); err != nil {
+		return nil, fmt.Errorf("failed to create stream tables: %v", err)
+	}
+
+	return &SQLiteStream{
+		db:           db,
+		pollInterval: DefaultPollInterval,
+	}, nil
+}
+
+// NewSQLiteStreamWithRetention creates a SQLiteStream that trims streams on every publish
+func NewSQLiteStreamWithRetention(ctx context.Context, db *sql.DB, retention RetentionPolicy) (*SQLiteStream, error) {
+	ss, err := NewSQLiteStream(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	ss.retention = retention
+	return ss, nil
+}
+
+// Push appends a message to a stream
+func (ss *SQLiteStream) Push(ctx context.Context, streamKey string, message StreamMessage) error {
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to publish to stream %s: %v", streamKey, err)
+	}
+	defer tx.Rollback()
+
+	if err := ss.AppendTx(ctx, tx, streamKey, message); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to publish to stream %s: %v", streamKey, err)
+	}
+	return nil
+}
+
+// AppendTx appends a message within tx, so datastores sharing the database can publish
+// in the transaction that stores the record. Both retention limits are applied exactly,
+// trimming an indexed table is cheap enough to do on every publish.
+func (ss *SQLiteStream) AppendTx(ctx context.Context, tx *sql.Tx, streamKey string, message StreamMessage) error {
+	// IDs never go backwards, entries within the same millisecond get increasing sequence numbers
+	ms, seq := clock.Now().UnixMilli(), int64(0)
+	var lastMs, lastSeq int64
+	err := tx.QueryRowContext(ctx,
+		`SELECT ms, seq FROM stream_entries WHERE stream_key = ? ORDER BY ms DESC, seq DESC LIMIT 1`,
+		streamKey,
+	).Scan(&lastMs, &lastSeq)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to publish to stream %s: %v", streamKey, err)
+	}
+	if err == nil && lastMs >= ms {
+		ms, seq = lastMs, lastSeq+1
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO stream_entries (stream_key, ms, seq, record_key, username) VALUES (?, ?, ?, ?, ?)`,
+		streamKey, ms, seq, message.Key, message.Username,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to publish to stream %s: %v", streamKey, err)
+	}
+
+	if ss.retention.MaxLen > 0 {
+		_, err = tx.ExecContext(ctx, `
+DELETE FROM stream_entries WHERE stream_key = ?1 AND (ms, seq) <= (
+	SELECT ms, seq FROM stream_entries WHERE stream_key = ?1 ORDER BY ms DESC, seq DESC LIMIT 1 OFFSET ?2
+)`, streamKey, ss.retention.MaxLen)
+		if err != nil {
+			return fmt.Errorf("failed to trim stream %s by length: %v", streamKey, err)
+		}
+	}
+
+	if ss.retention.MaxAge > 0 {
+		_, err = tx.ExecContext(ctx,
+			`DELETE FROM stream_entries WHERE stream_key = ? AND ms < ?`,
+			streamKey, clock.Now().Add(-ss.retention.MaxAge).UnixMilli(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to trim stream %s by age: %v", streamKey, err)
+		}
+	}
+
+	return nil
+}
+
+// Pull reads new entries for a consumer group, polling until BlockTimeout when none are waiting
+func (ss *SQLiteStream) Pull(ctx context.Context, config ConsumerConfig) ([]Message, error) {
+	for _, streamKey := range config.StreamKeys {
+		err := ss.initializeConsumerGroup(ctx, streamKey, config.ConsumerGroup, config.StartID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize consumer group: %v", err)
+		}
+	}
+
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	blockTimeout := config.BlockTimeout
+	if blockTimeout <= 0 {
+		blockTimeout = DefaultBlockTimeout
+	}
+
+	deadline := time.Now().Add(blockTimeout)
+	for {
+		messages, err := ss.readGroup(ctx, config, batchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) > 0 {
+			return messages, nil
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return []Message{}, nil
+		}
+		if wait > ss.pollInterval {
+			wait = ss.pollInterval
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("failed to read from stream: %v", ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// readGroup delivers up to batchSize entries per stream and moves the group past them.
+// Streams without new entries are found without a transaction, so idle polls neither
+// take nor wait for the write lock the publisher needs.
+func (ss *SQLiteStream) readGroup(ctx context.Context, config ConsumerConfig, batchSize int64) ([]Message, error) {
+	// Entries delivered before but never acknowledged come first
+	if ss.ManualAck {
+		messages, err := ss.claimIdle(ctx, config, batchSize)
+		if err != nil || len(messages) > 0 {
+			return messages, err
+		}
+	}
+
+	waiting, err := ss.waitingStreams(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	if len(waiting) == 0 {
+		return []Message{}, nil
+	}
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from stream: %v", err)
+	}
+	defer tx.Rollback()
+
+	var messages []Message
+	for _, streamKey := range waiting {
+		var lastMs, lastSeq int64
+		err := tx.QueryRowContext(ctx,
+			`SELECT last_ms, last_seq FROM stream_groups WHERE stream_key = ? AND group_name = ?`,
+			streamKey, config.ConsumerGroup,
+		).Scan(&lastMs, &lastSeq)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ss.groupRemoved(config.ConsumerGroup, streamKey)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from stream: %v", err)
+		}
+
+		entries, err := queryEntries(ctx, tx, streamKey,
+			`(ms, seq) > (?, ?) ORDER BY ms, seq LIMIT ?`, lastMs, lastSeq, batchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			continue
+		}
+
+		// Move the group past the whole batch for this stream at once
+		last := entries[len(entries)-1]
+		_, err = tx.ExecContext(ctx,
+			`UPDATE stream_groups SET last_ms = ?, last_seq = ? WHERE stream_key = ? AND group_name = ?`,
+			last.ms, last.seq, streamKey, config.ConsumerGroup,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from stream %s: %v", streamKey, err)
+		}
+
+		for _, entry := range entries {
+			// Entries outside the user filter are acknowledged right away
+			if !matchesUser(config.Usernames, entry.message.Username) {
+				continue
+			}
+			messages = append(messages, entry.message)
+
+			if ss.ManualAck {
+				_, err = tx.ExecContext(ctx,
+					`INSERT OR REPLACE INTO stream_pending (stream_key, group_name, ms, seq, consumer, delivered_at) VALUES (?, ?, ?, ?, ?, ?)`,
+					streamKey, config.ConsumerGroup, entry.ms, entry.seq, config.ConsumerName, clock.Now().UnixMilli(),
+				)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read from stream %s: %v", streamKey, err)
+				}
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to read from stream: %v", err)
+	}
+	return messages, nil
+}
+
+// claimIdle delivers up to batchSize entries per stream again that stayed pending for
+// longer than ClaimIdle, because a sink failed or the consumer they were delivered to died.
+// They move to this consumer. Like new entries, they are looked for without a transaction.
+func (ss *SQLiteStream) claimIdle(ctx context.Context, config ConsumerConfig, batchSize int64) ([]Message, error) {
+	claimIdle := config.ClaimIdle
+	if claimIdle <= 0 {
+		claimIdle = DefaultClaimIdle
+	}
+	now := clock.Now()
+	cutoff := now.Add(-claimIdle).UnixMilli()
+
+	var idle []string
+	for _, streamKey := range config.StreamKeys {
+		var found bool
+		err := ss.db.QueryRowContext(ctx, `
+SELECT EXISTS (
+	SELECT 1 FROM stream_pending WHERE stream_key = ? AND group_name = ? AND delivered_at <= ?
+)`, streamKey, config.ConsumerGroup, cutoff).Scan(&found)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pending entries of %s: %v", streamKey, err)
+		}
+		if found {
+			idle = append(idle, streamKey)
+		}
+	}
+	if len(idle) == 0 {
+		return nil, nil
+	}
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pending entries: %v", err)
+	}
+	defer tx.Rollback()
+
+	var messages []Message
+	for _, streamKey := range idle {
+		// Entries trimmed from the stream can't be delivered again
+		_, err := tx.ExecContext(ctx, `
+DELETE FROM stream_pending
+WHERE stream_key = ?1 AND group_name = ?2 AND delivered_at <= ?3 AND NOT EXISTS (
+	SELECT 1 FROM stream_entries e
+	WHERE e.stream_key = ?1 AND e.ms = stream_pending.ms AND e.seq = stream_pending.seq
+)`, streamKey, config.ConsumerGroup, cutoff)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pending entries of %s: %v", streamKey, err)
+		}
+
+		entries, err := queryEntries(ctx, tx, streamKey, `(ms, seq) IN (
+	SELECT ms, seq FROM stream_pending WHERE stream_key = ?1 AND group_name = ?2 AND delivered_at <= ?3
+) ORDER BY ms, seq LIMIT ?4`, config.ConsumerGroup, cutoff, batchSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			_, err = tx.ExecContext(ctx,
+				`UPDATE stream_pending SET consumer = ?, delivered_at = ? WHERE stream_key = ? AND group_name = ? AND ms = ? AND seq = ?`,
+				config.ConsumerName, now.UnixMilli(), streamKey, config.ConsumerGroup, entry.ms, entry.seq,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read pending entries of %s: %v", streamKey, err)
+			}
+			messages = append(messages, entry.message)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to read pending entries: %v", err)
+	}
+	return messages, nil
+}
+
+// waitingStreams returns the streams with entries not yet delivered to the group
+func (ss *SQLiteStream) waitingStreams(ctx context.Context, config ConsumerConfig) ([]string, error) {
+	var waiting []string
+	for _, streamKey := range config.StreamKeys {
+		var hasNew bool
+		err := ss.db.QueryRowContext(ctx, `
+SELECT EXISTS (
+	SELECT 1 FROM stream_entries e
+	WHERE e.stream_key = g.stream_key AND (e.ms, e.seq) > (g.last_ms, g.last_seq)
+) FROM stream_groups g WHERE g.stream_key = ? AND g.group_name = ?`,
+			streamKey, config.ConsumerGroup,
+		).Scan(&hasNew)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ss.groupRemoved(config.ConsumerGroup, streamKey)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from stream: %v", err)
+		}
+		if hasNew {
+			waiting = append(waiting, streamKey)
+		}
+	}
+	return waiting, nil
+}
+
+// groupRemoved forgets the known groups, so they are recreated on the next pull, and
+// returns the error for a group removed underneath us
+func (ss *SQLiteStream) groupRemoved(group, streamKey string) error {
+	ss.groups.Range(func(key, _ interface{}) bool {
+		ss.groups.Delete(key)
+		return true
+	})
+	return fmt.Errorf("failed to read from stream: consumer group %s on %s: %v", group, streamKey, ErrGroupNotFound)
+}
+
+// Ack removes entries from a group's pending list and returns how many were pending
+func (ss *SQLiteStream) Ack(ctx context.Context, streamKey, group string, ids ...string) (int64, error) {
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to acknowledge messages on %s: %v", streamKey, err)
+	}
+	defer tx.Rollback()
+
+	var acked int64
+	for _, id := range ids {
+		ms, seq, err := parseEntryID(id)
+		if err != nil {
+			return 0, err
+		}
+		result, err := tx.ExecContext(ctx,
+			`DELETE FROM stream_pending WHERE stream_key = ? AND group_name = ? AND ms = ? AND seq = ?`,
+			streamKey, group, ms, seq,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to acknowledge messages on %s: %v", streamKey, err)
+		}
+		n, _ := result.RowsAffected()
+		acked += n
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to acknowledge messages on %s: %v", streamKey, err)
+	}
+	return acked, nil
+}
+
+// Discover returns all streams with entries or consumer groups matching a glob pattern
+func (ss *SQLiteStream) Discover(ctx context.Context, pattern string) ([]string, error) {
+	rows, err := ss.db.QueryContext(ctx, `
+SELECT stream_key FROM stream_entries WHERE stream_key GLOB ?1
+UNION
+SELECT stream_key FROM stream_groups WHERE stream_key GLOB ?1
+ORDER BY stream_key`, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan streams: %v", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("failed to scan streams: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan streams: %v", err)
+	}
+	return keys, nil
+}
+
+// Replay reads a range of a stream without a consumer group, leaving group offsets untouched.
+// Bounds follow XRANGE: "-" and "+" are the ends of the stream and "(" excludes an ID.
+func (ss *SQLiteStream) Replay(ctx context.Context, streamKey, start, end string, count int64, usernames []string) ([]Message, string, error) {
+	startMs, startSeq, startOp, err := parseRangeBound(start, false)
+	if err != nil {
+		return nil, "", err
+	}
+	endMs, endSeq, endOp, err := parseRangeBound(end, true)
+	if err != nil {
+		return nil, "", err
+	}
+
+	entries, err := queryEntries(ctx, ss.db, streamKey,
+		fmt.Sprintf(`(ms, seq) %s (?, ?) AND (ms, seq) %s (?, ?) ORDER BY ms, seq LIMIT ?`, startOp, endOp),
+		startMs, startSeq, endMs, endSeq, count)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read range from stream %s: %v", streamKey, err)
+	}
+
+	var result []Message
+	for _, entry := range entries {
+		if matchesUser(usernames, entry.message.Username) {
+			result = append(result, entry.message)
+		}
+	}
+
+	// A short page means the range is exhausted, otherwise continue after the last ID
+	if int64(len(entries)) < count {
+		return result, "", nil
+	}
+	return result, "(" + entries[len(entries)-1].message.ID, nil
+}
+
+// Ping checks that the database is reachable
+func (ss *SQLiteStream) Ping(ctx context.Context) error {
+	return ss.db.PingContext(ctx)
+}
+
+// GroupStatus reports the pending entries and lag of a consumer group
+func (ss *SQLiteStream) GroupStatus(ctx context.Context, streamKey, group string) (GroupStatus, error) {
+	var lastMs, lastSeq int64
+	err := ss.db.QueryRowContext(ctx,
+		`SELECT last_ms, last_seq FROM stream_groups WHERE stream_key = ? AND group_name = ?`,
+		streamKey, group,
+	).Scan(&lastMs, &lastSeq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return GroupStatus{}, ErrGroupNotFound
+	}
+	if err != nil {
+		return GroupStatus{}, fmt.Errorf("failed to inspect groups of %s: %v", streamKey, err)
+	}
+
+	var status GroupStatus
+	err = ss.db.QueryRowContext(ctx, `
+SELECT
+	(SELECT COUNT(*) FROM stream_pending WHERE stream_key = ?1 AND group_name = ?2),
+	(SELECT COUNT(*) FROM stream_entries WHERE stream_key = ?1 AND (ms, seq) > (?3, ?4))`,
+		streamKey, group, lastMs, lastSeq,
+	).Scan(&status.Pending, &status.Lag)
+	if err != nil {
+		return GroupStatus{}, fmt.Errorf("failed to inspect groups of %s: %v", streamKey, err)
+	}
+	return status, nil
+}
+
+// initializeConsumerGroup creates the consumer group if it doesn't exist, positioned at startID
+func (ss *SQLiteStream) initializeConsumerGroup(ctx context.Context, streamKey, consumerGroup, startID string) error {
+	groupKey := streamKey + "\x00" + consumerGroup
+	if _, ok := ss.groups.Load(groupKey); ok {
+		return nil
+	}
+
+	var err error
+	switch startID {
+	case "", "$":
+		// Start after the newest entry, 0-0 when the stream is still empty
+		_, err = ss.db.ExecContext(ctx, `
+INSERT OR IGNORE INTO stream_groups (stream_key, group_name, last_ms, last_seq)
+SELECT ?1, ?2, COALESCE(MAX(ms), 0), COALESCE(MAX(seq), 0) FROM (
+	SELECT ms, seq FROM stream_entries WHERE stream_key = ?1 ORDER BY ms DESC, seq DESC LIMIT 1
+)`, streamKey, consumerGroup)
+	default:
+		var ms, seq int64
+		ms, seq, err = parseEntryID(startID)
+		if err != nil {
+			return err
+		}
+		_, err = ss.db.ExecContext(ctx,
+			`INSERT OR IGNORE INTO stream_groups (stream_key, group_name, last_ms, last_seq) VALUES (?, ?, ?, ?)`,
+			streamKey, consumerGroup, ms, seq,
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create consumer group %s for stream %s: %v", consumerGroup, streamKey, err)
+	}
+
+	ss.groups.Store(groupKey, struct{}{})
+	return nil
+}
+
+// sqliteEntry is a stream entry with its position
+type sqliteEntry struct {
+	ms, seq int64
+	message Message
+}
+
+// querier is implemented by *sql.DB and *sql.Tx
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryEntries loads the entries of streamKey matching condition
+func queryEntries(ctx context.Context, q querier, streamKey, condition string, args ...interface{}) ([]sqliteEntry, error) {
+	rows, err := q.QueryContext(ctx,
+		`SELECT ms, seq, record_key, username FROM stream_entries WHERE stream_key = ? AND `+condition,
+		append([]interface{}{streamKey}, args...)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from stream %s: %v", streamKey, err)
+	}
+	defer rows.Close()
+
+	var entries []sqliteEntry
+	for rows.Next() {
+		entry := sqliteEntry{message: Message{StreamKey: streamKey}}
+		if err := rows.Scan(&entry.ms, &entry.seq, &entry.message.Key, &entry.message.Username); err != nil {
+			return nil, fmt.Errorf("failed to read from stream %s: %v", streamKey, err)
+		}
+		entry.message.ID = fmt.Sprintf("%d-%d", entry.ms, entry.seq)
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read from stream %s: %v", streamKey, err)
+	}
+	return entries, nil
+}
+
+// parseEntryID splits an ID such as "1700000000000-3", a missing sequence number is 0
+func parseEntryID(id string) (int64, int64, error) {
+	msPart, seqPart, hasSeq := strings.Cut(id, "-")
+	ms, err := strconv.ParseInt(msPart, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid stream ID %q: %v", id, err)
+	}
+	if !hasSeq {
+		return ms, 0, nil
+	}
+	seq, err := strconv.ParseInt(seqPart, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid stream ID %q: %v", id, err)
+	}
+	return ms, seq, nil
+}
+
+// parseRangeBound converts an XRANGE bound into a position and the comparison to apply.
+// As in Redis, an end ID without a sequence number includes the whole millisecond.
+func parseRangeBound(value string, end bool) (int64, int64, string, error) {
+	switch {
+	case value == "-":
+		return 0, 0, ">=", nil
+	case value == "+":
+		return maxInt64, maxInt64, "<=", nil
+	}
+
+	op := ">="
+	if end {
+		op = "<="
+	}
+	if strings.HasPrefix(value, "(") {
+		value = value[1:]
+		op = op[:1]
+	}
+
+	ms, seq, err := parseEntryID(value)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if end && !strings.Contains(value, "-") {
+		seq = maxInt64
+	}
+	return ms, seq, op, nil
+}
+
+const maxInt64 = 1<<63 - 1
+
+// SQLiteJanitor periodically trims SQLite streams and deletes the ones that went idle
+type SQLiteJanitor struct {
+	stream   *SQLiteStream
+	idleTTL  time.Duration
+	interval time.Duration
+}
+
+// NewSQLiteJanitor creates a janitor for every stream in ss.
+// Streams with no new entries for idleTTL are deleted, a zero idleTTL keeps them.
+func NewSQLiteJanitor(ss *SQLiteStream, idleTTL, interval time.Duration) *SQLiteJanitor {
+	return &SQLiteJanitor{
+		stream:   ss,
+		idleTTL:  idleTTL,
+		interval: interval,
+	}
+}
+
+// Run sweeps streams every interval until the context is cancelled
+func (j *SQLiteJanitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := j.Sweep(ctx); err != nil {
+				log.Printf("[JANITOR] Sweep failed: %v", err)
+			}
+		}
+	}
+}
+
+// Sweep drops entries older than the retention age and deletes idle streams with their groups
+func (j *SQLiteJanitor) Sweep(ctx context.Context) error {
+	// Idle streams go first, so their groups are found while the streams still have entries
+	if j.idleTTL > 0 {
+		if err := j.deleteIdle(ctx); err != nil {
+			return err
+		}
+	}
+
+	if maxAge := j.stream.retention.MaxAge; maxAge > 0 {
+		_, err := j.stream.db.ExecContext(ctx, `DELETE FROM stream_entries WHERE ms < ?`, clock.Now().Add(-maxAge).UnixMilli())
+		if err != nil {
+			return fmt.Errorf("failed to trim streams by age: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// deleteIdle removes streams without new entries for idleTTL and their consumer groups
+func (j *SQLiteJanitor) deleteIdle(ctx context.Context) error {
+	db := j.stream.db
+
+	cutoff := clock.Now().Add(-j.idleTTL).UnixMilli()
+	result, err := db.ExecContext(ctx, `
+DELETE FROM stream_groups WHERE stream_key IN (
+	SELECT stream_key FROM stream_entries GROUP BY stream_key HAVING MAX(ms) < ?
+)`, cutoff)
+	if err != nil {
+		return fmt.Errorf("failed to delete idle streams: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, `
+DELETE FROM stream_pending WHERE stream_key IN (
+	SELECT stream_key FROM stream_entries GROUP BY stream_key HAVING MAX(ms) < ?
+)`, cutoff); err != nil {
+		return fmt.Errorf("failed to delete idle streams: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, `
+DELETE FROM stream_entries WHERE stream_key IN (
+	SELECT stream_key FROM stream_entries GROUP BY stream_key HAVING MAX(ms) < ?
+)`, cutoff); err != nil {
+		return fmt.Errorf("failed to delete idle streams: %v", err)
+	}
+
+	// Consumers recreate their groups on the next pull
+	if groups, _ := result.RowsAffected(); groups > 0 {
+		log.Printf("[JANITOR] Deleted %d consumer groups of idle streams", groups)
+	}
+	return nil
+}
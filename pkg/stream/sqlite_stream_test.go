@@ -0,0 +1,459 @@
+package stream
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"dni/pkg/sqliteconn"
+
+	"go.llib.dev/testcase/clock/timecop"
+)
+
+// newTestSQLite opens the same database file twice, like the API and a consumer process
+func newTestSQLite(t *testing.T) (*sql.DB, *sql.DB) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "radius.db")
+
+	open := func() *sql.DB {
+		db, err := sqliteconn.Open(context.Background(), path)
+		if err != nil {
+			t.Fatalf("Failed to open SQLite: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	return open(), open()
+}
+
+func newTestSQLiteStreams(t *testing.T, retention RetentionPolicy) (*SQLiteStream, *SQLiteStream) {
+	t.Helper()
+	apiDB, consumerDB := newTestSQLite(t)
+
+	publisher, err := NewSQLiteStreamWithRetention(context.Background(), apiDB, retention)
+	if err != nil {
+		t.Fatalf("NewSQLiteStreamWithRetention returned error: %v", err)
+	}
+	reader, err := NewSQLiteStream(context.Background(), consumerDB)
+	if err != nil {
+		t.Fatalf("NewSQLiteStream returned error: %v", err)
+	}
+	reader.pollInterval = 10 * time.Millisecond
+	return publisher, reader
+}
+
+func TestSQLiteStream_PushPull(t *testing.T) {
+	// freezing time to avoid flaky tests
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+	ctx := context.Background()
+	publisher, reader := newTestSQLiteStreams(t, RetentionPolicy{})
+
+	pushes := []struct {
+		streamKey string
+		message   StreamMessage
+	}{
+		{"radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s1", Username: "alice"}},
+		{"radius:updates:bob", StreamMessage{Key: "radius:acct:bob:s1", Username: "bob"}},
+		{"radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s2", Username: "alice"}},
+	}
+	for _, p := range pushes {
+		if err := publisher.Push(ctx, p.streamKey, p.message); err != nil {
+			t.Fatalf("Push returned error: %v", err)
+		}
+	}
+
+	config := ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:alice", "radius:updates:bob"},
+		ConsumerGroup: "group",
+		ConsumerName:  "consumer",
+		StartID:       "0",
+		BlockTimeout:  20 * time.Millisecond,
+	}
+	messages, err := reader.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+
+	expected := []Message{
+		{ID: "100000000-0", StreamKey: "radius:updates:alice", Key: "radius:acct:alice:s1", Username: "alice"},
+		{ID: "100000000-1", StreamKey: "radius:updates:alice", Key: "radius:acct:alice:s2", Username: "alice"},
+		{ID: "100000000-0", StreamKey: "radius:updates:bob", Key: "radius:acct:bob:s1", Username: "bob"},
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected messages %+v, got %+v", expected, messages)
+	}
+
+	// Delivered entries are acknowledged, so the group has caught up
+	messages, err = reader.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("Expected no messages on the second pull, got %+v", messages)
+	}
+
+	status, err := reader.GroupStatus(ctx, "radius:updates:alice", "group")
+	if err != nil {
+		t.Fatalf("GroupStatus returned error: %v", err)
+	}
+	if status != (GroupStatus{}) {
+		t.Errorf("Expected an empty group status, got %+v", status)
+	}
+
+	if _, err := reader.GroupStatus(ctx, "radius:updates:alice", "other"); err != ErrGroupNotFound {
+		t.Errorf("Expected ErrGroupNotFound for an unknown group, got %v", err)
+	}
+}
+
+func TestSQLiteStream_Pull_StartID(t *testing.T) {
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+	ctx := context.Background()
+	publisher, reader := newTestSQLiteStreams(t, RetentionPolicy{})
+
+	publisher.Push(ctx, "radius:updates:alice", StreamMessage{Key: "old", Username: "alice"})
+
+	config := ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:alice"},
+		ConsumerGroup: "group",
+		BlockTimeout:  20 * time.Millisecond,
+	}
+	// "$" only delivers entries published after the group was created
+	messages, err := reader.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Fatalf("Expected no messages for a new group at $, got %+v", messages)
+	}
+
+	publisher.Push(ctx, "radius:updates:alice", StreamMessage{Key: "new", Username: "alice"})
+
+	messages, err = reader.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Key != "new" {
+		t.Errorf("Expected only the new entry, got %+v", messages)
+	}
+}
+
+func TestSQLiteStream_Pull_WaitsForPush(t *testing.T) {
+	ctx := context.Background()
+	publisher, reader := newTestSQLiteStreams(t, RetentionPolicy{})
+
+	config := ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:alice"},
+		ConsumerGroup: "group",
+		BlockTimeout:  5 * time.Second,
+	}
+	// Create the group before publishing, so the entry is new to it
+	if _, err := reader.Pull(ctx, ConsumerConfig{StreamKeys: config.StreamKeys, ConsumerGroup: "group", BlockTimeout: time.Millisecond}); err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		publisher.Push(ctx, "radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s1", Username: "alice"})
+	}()
+
+	messages, err := reader.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Key != "radius:acct:alice:s1" {
+		t.Errorf("Expected the published entry, got %+v", messages)
+	}
+
+	// Cancelling the context interrupts a waiting pull
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := reader.Pull(cancelled, config); err == nil {
+		t.Error("Expected an error from a cancelled pull")
+	}
+}
+
+func TestSQLiteStream_IdlePullSkipsWriteLock(t *testing.T) {
+	ctx := context.Background()
+	publisher, reader := newTestSQLiteStreams(t, RetentionPolicy{})
+
+	config := ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:alice"},
+		ConsumerGroup: "group",
+		BlockTimeout:  50 * time.Millisecond,
+	}
+	if _, err := reader.Pull(ctx, config); err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+
+	// The publisher holds the write lock, polls finding nothing new must not wait for it
+	tx, err := publisher.db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	start := time.Now()
+	messages, err := reader.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("Expected no messages, got %+v", messages)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected an idle pull to return after the block timeout, took %v", elapsed)
+	}
+}
+
+func TestSQLiteStream_ManualAck(t *testing.T) {
+	ctx := context.Background()
+	publisher, reader := newTestSQLiteStreams(t, RetentionPolicy{})
+	reader.ManualAck = true
+
+	config := ConsumerConfig{
+		StreamKeys:    []string{"radius:updates:alice"},
+		ConsumerGroup: "group",
+		ConsumerName:  "consumer",
+		StartID:       "0",
+		BlockTimeout:  10 * time.Millisecond,
+	}
+	publisher.Push(ctx, "radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s1", Username: "alice"})
+	publisher.Push(ctx, "radius:updates:alice", StreamMessage{Key: "radius:acct:alice:s2", Username: "alice"})
+
+	messages, err := reader.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %+v", messages)
+	}
+
+	if acked, err := reader.Ack(ctx, "radius:updates:alice", "group", messages[0].ID); err != nil || acked != 1 {
+		t.Fatalf("Expected one acknowledged entry, got %d, %v", acked, err)
+	}
+	if acked, _ := reader.Ack(ctx, "radius:updates:alice", "group", messages[0].ID); acked != 0 {
+		t.Errorf("Expected a second Ack to find nothing pending, got %d", acked)
+	}
+
+	// The unacknowledged entry stays pending, and delivered entries are not read again
+	status, err := reader.GroupStatus(ctx, "radius:updates:alice", "group")
+	if err != nil {
+		t.Fatalf("GroupStatus returned error: %v", err)
+	}
+	if status != (GroupStatus{Pending: 1, Lag: 0}) {
+		t.Errorf("Expected one pending entry and no lag, got %+v", status)
+	}
+	if messages, _ := reader.Pull(ctx, config); len(messages) != 0 {
+		t.Errorf("Expected no new messages, got %+v", messages)
+	}
+
+	// Once idle for ClaimIdle, the unacknowledged entry is delivered again, to any consumer
+	timecop.Travel(t, DefaultClaimIdle)
+	config.ConsumerName = "other-consumer"
+	redelivered, err := reader.Pull(ctx, config)
+	if err != nil {
+		t.Fatalf("Pull returned error: %v", err)
+	}
+	if len(redelivered) != 1 || redelivered[0] != messages[1] {
+		t.Fatalf("Expected %+v to be delivered again, got %+v", messages[1], redelivered)
+	}
+	if messages, _ := reader.Pull(ctx, config); len(messages) != 0 {
+		t.Errorf("Expected the redelivered entry to wait for ClaimIdle again, got %+v", messages)
+	}
+	if acked, _ := reader.Ack(ctx, "radius:updates:alice", "group", redelivered[0].ID); acked != 1 {
+		t.Errorf("Expected the redelivered entry to be acknowledged, got %d", acked)
+	}
+}
+
+func TestSQLiteStream_Retention(t *testing.T) {
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		retention RetentionPolicy
+		expected  []string
+	}{
+		{
+			name:      "max length",
+			retention: RetentionPolicy{MaxLen: 2},
+			expected:  []string{"k3", "k4"},
+		},
+		{
+			name:      "max age",
+			retention: RetentionPolicy{MaxAge: 90 * time.Second},
+			expected:  []string{"k3", "k4"},
+		},
+		{
+			name:     "unlimited",
+			expected: []string{"k1", "k2", "k3", "k4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher, reader := newTestSQLiteStreams(t, tt.retention)
+
+			// One entry a minute
+			for _, key := range []string{"k1", "k2", "k3", "k4"} {
+				if err := publisher.Push(ctx, "radius:updates:alice", StreamMessage{Key: key}); err != nil {
+					t.Fatalf("Push returned error: %v", err)
+				}
+				timecop.Travel(t, time.Minute, timecop.Freeze)
+			}
+
+			messages, _, err := reader.Replay(ctx, "radius:updates:alice", "-", "+", 10, nil)
+			if err != nil {
+				t.Fatalf("Replay returned error: %v", err)
+			}
+			var keys []string
+			for _, m := range messages {
+				keys = append(keys, m.Key)
+			}
+			if !reflect.DeepEqual(keys, tt.expected) {
+				t.Errorf("Expected remaining entries %v, got %v", tt.expected, keys)
+			}
+		})
+	}
+}
+
+func TestSQLiteStream_Replay(t *testing.T) {
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+	ctx := context.Background()
+	publisher, reader := newTestSQLiteStreams(t, RetentionPolicy{})
+
+	for _, user := range []string{"alice", "bob", "alice", "alice"} {
+		publisher.Push(ctx, "radius:updates:all", StreamMessage{Key: "radius:acct:" + user, Username: user})
+	}
+
+	// Pages continue after the last ID and skip users outside the filter
+	messages, next, err := reader.Replay(ctx, "radius:updates:all", "100000000-1", "+", 2, []string{"alice"})
+	if err != nil {
+		t.Fatalf("Replay returned error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].ID != "100000000-2" {
+		t.Errorf("Expected entry 100000000-2, got %+v", messages)
+	}
+	if next != "(100000000-2" {
+		t.Errorf("Expected next position (100000000-2, got %q", next)
+	}
+
+	messages, next, err = reader.Replay(ctx, "radius:updates:all", next, "+", 2, []string{"alice"})
+	if err != nil {
+		t.Fatalf("Replay returned error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].ID != "100000000-3" {
+		t.Errorf("Expected entry 100000000-3, got %+v", messages)
+	}
+	if next != "" {
+		t.Errorf("Expected the range to be exhausted, got next %q", next)
+	}
+
+	// An end ID without a sequence number covers the whole millisecond
+	messages, _, err = reader.Replay(ctx, "radius:updates:all", "-", "100000000", 10, nil)
+	if err != nil {
+		t.Fatalf("Replay returned error: %v", err)
+	}
+	if len(messages) != 4 {
+		t.Errorf("Expected all 4 entries, got %d", len(messages))
+	}
+
+	if _, _, err := reader.Replay(ctx, "radius:updates:all", "yesterday", "+", 10, nil); err == nil {
+		t.Error("Expected an error for an invalid start")
+	}
+}
+
+func TestSQLiteStream_Discover(t *testing.T) {
+	ctx := context.Background()
+	publisher, reader := newTestSQLiteStreams(t, RetentionPolicy{})
+
+	publisher.Push(ctx, "radius:updates:alice", StreamMessage{Key: "k"})
+	publisher.Push(ctx, "radius:updates:bob", StreamMessage{Key: "k"})
+	publisher.Push(ctx, "other:stream", StreamMessage{Key: "k"})
+	// Streams a consumer is waiting on are found before anything is published to them
+	reader.Pull(ctx, ConsumerConfig{StreamKeys: []string{"radius:updates:carol"}, ConsumerGroup: "group", BlockTimeout: time.Millisecond})
+
+	keys, err := reader.Discover(ctx, "radius:updates:*")
+	if err != nil {
+		t.Fatalf("Discover returned error: %v", err)
+	}
+	expected := []string{"radius:updates:alice", "radius:updates:bob", "radius:updates:carol"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected streams %v, got %v", expected, keys)
+	}
+}
+
+func TestSQLiteJanitor_Sweep(t *testing.T) {
+	timecop.Travel(t, time.Unix(100000, 0), timecop.Freeze)
+	ctx := context.Background()
+	publisher, reader := newTestSQLiteStreams(t, RetentionPolicy{MaxAge: time.Hour})
+
+	publisher.Push(ctx, "radius:updates:idle", StreamMessage{Key: "k1"})
+	reader.Pull(ctx, ConsumerConfig{StreamKeys: []string{"radius:updates:idle"}, ConsumerGroup: "group", BlockTimeout: time.Millisecond})
+	timecop.Travel(t, 30*time.Minute, timecop.Freeze)
+	publisher.Push(ctx, "radius:updates:active", StreamMessage{Key: "k2"})
+	timecop.Travel(t, 30*time.Minute, timecop.Freeze)
+	publisher.Push(ctx, "radius:updates:active", StreamMessage{Key: "k3"})
+	timecop.Travel(t, 31*time.Minute, timecop.Freeze)
+
+	janitor := NewSQLiteJanitor(publisher, 45*time.Minute, time.Minute)
+	if err := janitor.Sweep(ctx); err != nil {
+		t.Fatalf("Sweep returned error: %v", err)
+	}
+
+	keys, err := reader.Discover(ctx, "*")
+	if err != nil {
+		t.Fatalf("Discover returned error: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"radius:updates:active"}) {
+		t.Errorf("Expected only the active stream to remain, got %v", keys)
+	}
+
+	messages, _, err := reader.Replay(ctx, "radius:updates:active", "-", "+", 10, nil)
+	if err != nil {
+		t.Fatalf("Replay returned error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Key != "k3" {
+		t.Errorf("Expected entries older than an hour to be trimmed, got %+v", messages)
+	}
+}
+
+func TestParseRangeBound(t *testing.T) {
+	tests := []struct {
+		value     string
+		end       bool
+		ms, seq   int64
+		op        string
+		expectErr bool
+	}{
+		{value: "-", ms: 0, seq: 0, op: ">="},
+		{value: "+", end: true, ms: maxInt64, seq: maxInt64, op: "<="},
+		{value: "1700000000000-5", ms: 1700000000000, seq: 5, op: ">="},
+		{value: "(1700000000000-5", ms: 1700000000000, seq: 5, op: ">"},
+		{value: "1700000000000", ms: 1700000000000, seq: 0, op: ">="},
+		{value: "1700000000000", end: true, ms: 1700000000000, seq: maxInt64, op: "<="},
+		{value: "(1700000000000-5", end: true, ms: 1700000000000, seq: 5, op: "<"},
+		{value: "now", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			ms, seq, op, err := parseRangeBound(tt.value, tt.end)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("Expected an error for %q", tt.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRangeBound returned error: %v", err)
+			}
+			if ms != tt.ms || seq != tt.seq || op != tt.op {
+				t.Errorf("Expected %d-%d %s, got %d-%d %s", tt.ms, tt.seq, tt.op, ms, seq, op)
+			}
+		})
+	}
+}
@@ -1,5 +1,14 @@
 package stream
 
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrGroupNotFound is returned when a consumer group does not exist on a stream
+var ErrGroupNotFound = errors.New("consumer group not found")
+
 // StreamMessage represents a message to be sent to a stream
 type StreamMessage struct {
 	Key      string
@@ -7,15 +16,98 @@ type StreamMessage struct {
 	Data     map[string]interface{}
 }
 
+// eventPayload is the JSON body of an event on brokers that carry opaque payloads, Kafka and NATS
+type eventPayload struct {
+	Key      string `json:"key"`
+	Username string `json:"username"`
+	// Timestamp is the publish time in seconds, like the timestamp field of the Redis entries
+	Timestamp int64 `json:"timestamp"`
+}
+
+const (
+	// DefaultBatchSize is used when ConsumerConfig.BatchSize is not set
+	DefaultBatchSize = 10
+	// DefaultBlockTimeout is used when ConsumerConfig.BlockTimeout is not set
+	DefaultBlockTimeout = 5 * time.Second
+	// DefaultClaimIdle is used when ConsumerConfig.ClaimIdle is not set
+	DefaultClaimIdle = 30 * time.Second
+)
+
+// Message is an accounting event read back from a stream
+type Message struct {
+	ID        string
+	StreamKey string
+	Key       string
+	Username  string
+}
+
 // ConsumerConfig holds configuration for stream consumers
 type ConsumerConfig struct {
-	StreamKey     string
-	ConsumerGroup string
-	ConsumerName  string
+	// StreamKeys are read together with a single XREADGROUP
+	StreamKeys []string
+	// DiscoveredKeys are the StreamKeys found by Discover. Their groups are only created
+	// while the stream exists, so a stream deleted by the janitor is skipped, not recreated.
+	DiscoveredKeys []string
+	ConsumerGroup  string
+	ConsumerName   string
+	// Usernames restricts delivered keys to these users, empty delivers everything
+	Usernames []string
+	// StartID is where a newly created group starts reading, "$" (new events only) when empty.
+	// It has no effect on groups that already exist.
+	StartID string
+	// BatchSize is the maximum number of messages returned by one Pull
+	BatchSize int64
+	// BlockTimeout is how long Pull waits for new messages
+	BlockTimeout time.Duration
+	// ClaimIdle is how long a delivered entry stays unacknowledged before streams with
+	// manual acknowledgements deliver it again, to this or another consumer of the group
+	ClaimIdle time.Duration
+}
+
+// RetentionPolicy bounds how much history a stream keeps.
+// A zero value keeps everything.
+type RetentionPolicy struct {
+	// MaxLen caps each stream at approximately this many entries
+	MaxLen int64
+	// MaxAge drops entries older than this duration (MINID trimming)
+	MaxAge time.Duration
 }
 
 // Stream interface defines methods for publishing and consuming messages from streams
 type Stream interface {
-	Push(streamKey string, message StreamMessage) error
-	Pull(config ConsumerConfig) ([]string, error)
+	Push(ctx context.Context, streamKey string, message StreamMessage) error
+	Pull(ctx context.Context, config ConsumerConfig) ([]Message, error)
+}
+
+// Discoverer is implemented by streams that can list existing stream keys
+type Discoverer interface {
+	Discover(ctx context.Context, pattern string) ([]string, error)
+}
+
+// Replayer is implemented by streams that can re-read history without touching consumer group offsets
+type Replayer interface {
+	// Replay returns up to count messages between start and end (inclusive) and the
+	// position to continue from, which is empty once the range is exhausted
+	Replay(ctx context.Context, streamKey, start, end string, count int64, usernames []string) ([]Message, string, error)
+}
+
+// Acker is implemented by streams that keep delivered messages pending until they are
+// acknowledged, redelivering them otherwise
+type Acker interface {
+	// Ack acknowledges messages of a consumer group and returns how many were pending
+	Ack(ctx context.Context, streamKey, group string, ids ...string) (int64, error)
+}
+
+// GroupStatus describes a consumer group on one stream
+type GroupStatus struct {
+	// Pending is the number of delivered but unacknowledged messages
+	Pending int64
+	// Lag is the number of entries not yet delivered to the group, -1 when unknown
+	Lag int64
+}
+
+// GroupInspector is implemented by streams that can report consumer group state
+type GroupInspector interface {
+	Ping(ctx context.Context) error
+	GroupStatus(ctx context.Context, streamKey, group string) (GroupStatus, error)
 }
@@ -0,0 +1,68 @@
+package stream
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+const (
+	// TopologyPerUser publishes every user's events on a dedicated stream
+	TopologyPerUser = "per-user"
+	// TopologyPartitioned hashes users onto a fixed number of shared streams
+	TopologyPartitioned = "partitioned"
+
+	// partitionStreamPrefix starts the key of every partition stream
+	partitionStreamPrefix = "radius:updates:partition:"
+)
+
+// Topology decides which stream a user's events are published to
+type Topology interface {
+	StreamKey(username string) string
+}
+
+// PerUserTopology publishes to radius:updates:<username>, or radius:updates:{<username>}
+// with HashTag so the stream shares a cluster slot with the user's records
+type PerUserTopology struct {
+	HashTag bool
+}
+
+// StreamKey returns the dedicated stream for username
+func (t PerUserTopology) StreamKey(username string) string {
+	if t.HashTag {
+		return fmt.Sprintf("radius:updates:{%s}", username)
+	}
+	return fmt.Sprintf("radius:updates:%s", username)
+}
+
+// PartitionedTopology publishes to radius:updates:partition:<n> where n is
+// derived from a hash of the username, so a user always lands on the same partition
+type PartitionedTopology struct {
+	Partitions int
+}
+
+// StreamKey returns the partition stream that owns username
+func (t PartitionedTopology) StreamKey(username string) string {
+	return PartitionStreamKey(PartitionFor(username, t.Partitions))
+}
+
+// PartitionFor returns the partition index for username
+func PartitionFor(username string, partitions int) int {
+	if partitions <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(username))
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// PartitionStreamKey returns the stream key of a partition
+func PartitionStreamKey(partition int) string {
+	return fmt.Sprintf("%s%d", partitionStreamPrefix, partition)
+}
+
+// IsPartitionStreamKey reports whether key, or a glob over keys, names partition streams.
+// Per-user patterns such as radius:updates:* also match them.
+func IsPartitionStreamKey(key string) bool {
+	return strings.HasPrefix(key, partitionStreamPrefix)
+}
@@ -0,0 +1,502 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	clock "go.llib.dev/testcase/clock"
+)
+
+const (
+	// WebhookEventStart is posted when a session starts (Acct-Status-Type Start)
+	WebhookEventStart = "start"
+	// WebhookEventStop is posted when a session stops (Acct-Status-Type Stop)
+	WebhookEventStop = "stop"
+
+	// WebhookSignatureHeader carries "sha256=" followed by the hex HMAC-SHA256 of the body
+	WebhookSignatureHeader = "X-Signature-256"
+	// WebhookDeliveryHeader carries the delivery ID, unchanged across retries so
+	// receivers can drop duplicates
+	WebhookDeliveryHeader = "X-Webhook-Delivery"
+)
+
+// Deliveries are kept until an endpoint accepted them or they ran out of attempts, so
+// they survive restarts. Each endpoint receives its deliveries in insertion order.
+const webhookSchema = `
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	url      TEXT NOT NULL,
+	body     BLOB NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_ms  INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_url ON webhook_deliveries (url, id);
+`
+
+// WebhookRoutes selects the callback URLs of an event. Users is keyed by username,
+// where "*" matches every user, and NAS by NAS-IP-Address.
+type WebhookRoutes struct {
+	Users map[string][]string
+	NAS   map[string][]string
+}
+
+// Empty reports whether no URL is configured
+func (r WebhookRoutes) Empty() bool {
+	return len(r.Users) == 0 && len(r.NAS) == 0
+}
+
+// urls returns the distinct URLs routed to a user's event on a NAS
+func (r WebhookRoutes) urls(username, nasIPAddress string) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	for _, candidates := range [][]string{r.Users["*"], r.Users[username], r.NAS[nasIPAddress]} {
+		for _, url := range candidates {
+			if !seen[url] {
+				seen[url] = true
+				urls = append(urls, url)
+			}
+		}
+	}
+	return urls
+}
+
+// WebhookOptions configures the delivery of a WebhookStream
+type WebhookOptions struct {
+	// Secret signs every body, see WebhookSignatureHeader
+	Secret string
+	// Timeout bounds each delivery attempt
+	Timeout time.Duration
+	// MaxAttempts is how often a delivery is tried before it is dropped
+	MaxAttempts int
+	// RetryBackoff is the delay before the first retry, doubling up to MaxBackoff
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+	// BreakerThreshold consecutive failures open an endpoint's circuit for BreakerCooldown,
+	// after which a single delivery probes whether it recovered
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// PollInterval is how often the queue is checked for due retries
+	PollInterval time.Duration
+}
+
+// DefaultWebhookOptions returns the options used for unset WebhookOptions fields
+func DefaultWebhookOptions() WebhookOptions {
+	return WebhookOptions{
+		Timeout:          5 * time.Second,
+		MaxAttempts:      10,
+		RetryBackoff:     time.Second,
+		MaxBackoff:       5 * time.Minute,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+		PollInterval:     time.Second,
+	}
+}
+
+// WebhookEvent is the JSON body posted for a session start or stop
+type WebhookEvent struct {
+	Event     string `json:"event"`
+	StreamKey string `json:"stream"`
+	Key       string `json:"key"`
+	Username  string `json:"username"`
+	Timestamp int64  `json:"timestamp"`
+	// Attributes are the accounting attributes passed in StreamMessage.Data
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// webhookEndpoint is the circuit breaker state of one URL
+type webhookEndpoint struct {
+	// busy is set while a worker delivers to the endpoint
+	busy      bool
+	failures  int
+	openUntil time.Time
+}
+
+// WebhookStream is a publish-only Stream that POSTs session starts and stops to HTTP
+// endpoints. Push only queues the deliveries in a local SQLite database, a background
+// dispatcher sends them, so a slow or failing endpoint never blocks the caller.
+//
+// Push routes on the "acct_status_type" and "nas_ip_address" entries of the message Data;
+// events other than starts and stops are not posted.
+type WebhookStream struct {
+	db     *sql.DB
+	routes WebhookRoutes
+	opts   WebhookOptions
+	client *http.Client
+
+	// mu guards routes and endpoints
+	mu        sync.Mutex
+	endpoints map[string]*webhookEndpoint
+
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
+	// ctx is cancelled when Close runs out of time, aborting requests in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewWebhookStream creates the delivery queue in db if needed and starts the dispatcher,
+// which resumes deliveries left over from a previous run. Stop it with Close.
+func NewWebhookStream(ctx context.Context, db *sql.DB, routes WebhookRoutes, opts WebhookOptions) (*WebhookStream, error) {
+	defaults := DefaultWebhookOptions()
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaults.Timeout
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaults.MaxAttempts
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = defaults.RetryBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaults.MaxBackoff
+	}
+	if opts.BreakerThreshold <= 0 {
+		opts.BreakerThreshold = defaults.BreakerThreshold
+	}
+	if opts.BreakerCooldown <= 0 {
+		opts.BreakerCooldown = defaults.BreakerCooldown
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaults.PollInterval
+	}
+
+	if _, err := db.ExecContext(ctx, webhookSchema); err != nil {
+		return nil, fmt.Errorf("failed to create webhook queue: %v", err)
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	ws := &WebhookStream{
+		db:        db,
+		routes:    routes,
+		opts:      opts,
+		client:    &http.Client{Timeout: opts.Timeout},
+		endpoints: make(map[string]*webhookEndpoint),
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		ctx:       runCtx,
+		cancel:    cancel,
+	}
+	ws.workers.Add(1)
+	go ws.run()
+
+	return ws, nil
+}
+
+// SetRoutes replaces the routes of later events, deliveries already queued are still made
+func (ws *WebhookStream) SetRoutes(routes WebhookRoutes) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.routes = routes
+}
+
+// Push queues a delivery of the event to every URL routed to it
+func (ws *WebhookStream) Push(ctx context.Context, streamKey string, message StreamMessage) error {
+	event := webhookEventType(dataString(message.Data, "acct_status_type"))
+	if event == "" {
+		return nil
+	}
+	ws.mu.Lock()
+	urls := ws.routes.urls(message.Username, dataString(message.Data, "nas_ip_address"))
+	ws.mu.Unlock()
+	if len(urls) == 0 {
+		return nil
+	}
+
+	now := clock.Now()
+	body, err := json.Marshal(WebhookEvent{
+		Event:      event,
+		StreamKey:  streamKey,
+		Key:        message.Key,
+		Username:   message.Username,
+		Timestamp:  now.Unix(),
+		Attributes: message.Data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook event for %s: %v", message.Key, err)
+	}
+
+	tx, err := ws.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to queue webhook event for %s: %v", message.Key, err)
+	}
+	defer tx.Rollback()
+
+	for _, url := range urls {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO webhook_deliveries (url, body, next_ms) VALUES (?, ?, ?)`, url, body, now.UnixMilli()); err != nil {
+			return fmt.Errorf("failed to queue webhook event for %s: %v", message.Key, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to queue webhook event for %s: %v", message.Key, err)
+	}
+
+	select {
+	case ws.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pull is not supported, webhook events are only delivered over HTTP
+func (ws *WebhookStream) Pull(ctx context.Context, config ConsumerConfig) ([]Message, error) {
+	return nil, errors.New("webhook stream cannot be consumed")
+}
+
+// Pending returns the number of queued deliveries
+func (ws *WebhookStream) Pending(ctx context.Context) (int64, error) {
+	var pending int64
+	if err := ws.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM webhook_deliveries`).Scan(&pending); err != nil {
+		return 0, fmt.Errorf("failed to count webhook deliveries: %v", err)
+	}
+	return pending, nil
+}
+
+// Close stops the dispatcher and waits for deliveries in flight until ctx is done, then
+// aborts them. Queued deliveries stay in the database for the next run. Closing again
+// only waits for the workers.
+func (ws *WebhookStream) Close(ctx context.Context) error {
+	ws.stopOnce.Do(func() { close(ws.stop) })
+
+	done := make(chan struct{})
+	go func() {
+		ws.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		ws.cancel()
+		return nil
+	case <-ctx.Done():
+		ws.cancel()
+		<-done
+		return fmt.Errorf("aborted webhook deliveries in flight: %v", ctx.Err())
+	}
+}
+
+// run starts a worker for every endpoint with queued deliveries, whenever Push queued
+// new ones and every PollInterval for retries
+func (ws *WebhookStream) run() {
+	defer ws.workers.Done()
+
+	ticker := time.NewTicker(ws.opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		ws.dispatch()
+		select {
+		case <-ws.stop:
+			return
+		case <-ws.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ws *WebhookStream) dispatch() {
+	rows, err := ws.db.QueryContext(ws.ctx, `SELECT DISTINCT url FROM webhook_deliveries`)
+	if err != nil {
+		log.Printf("[WEBHOOK] Failed to read the delivery queue: %v", err)
+		return
+	}
+	var urls []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			rows.Close()
+			log.Printf("[WEBHOOK] Failed to read the delivery queue: %v", err)
+			return
+		}
+		urls = append(urls, url)
+	}
+	rows.Close()
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for _, url := range urls {
+		endpoint, ok := ws.endpoints[url]
+		if !ok {
+			endpoint = &webhookEndpoint{}
+			ws.endpoints[url] = endpoint
+		}
+		if endpoint.busy {
+			continue
+		}
+		endpoint.busy = true
+		ws.workers.Add(1)
+		go ws.deliver(url, endpoint)
+	}
+}
+
+// deliver sends the queued deliveries of url in order. It stops at the first one that is
+// not due yet or fails, so a later delivery never overtakes an earlier one.
+func (ws *WebhookStream) deliver(url string, endpoint *webhookEndpoint) {
+	defer ws.workers.Done()
+	defer func() {
+		ws.mu.Lock()
+		endpoint.busy = false
+		ws.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ws.stop:
+			return
+		default:
+		}
+
+		var id, nextMs int64
+		var attempts int
+		var body []byte
+		err := ws.db.QueryRowContext(ws.ctx, `SELECT id, body, attempts, next_ms FROM webhook_deliveries WHERE url = ? ORDER BY id LIMIT 1`, url).Scan(&id, &body, &attempts, &nextMs)
+		if errors.Is(err, sql.ErrNoRows) {
+			return
+		}
+		if err != nil {
+			log.Printf("[WEBHOOK] Failed to read the delivery queue of %s: %v", url, err)
+			return
+		}
+		if nextMs > clock.Now().UnixMilli() || !ws.allow(endpoint) {
+			return
+		}
+
+		retry, err := ws.post(url, id, body)
+		if ws.ctx.Err() != nil {
+			// Aborted by Close, the delivery stays queued
+			return
+		}
+		ws.observe(url, endpoint, retry, err)
+
+		attempts++
+		switch {
+		case err == nil:
+			ws.remove(id)
+		case !retry:
+			log.Printf("[WEBHOOK] Dropping delivery %d to %s: %v", id, url, err)
+			ws.remove(id)
+		case attempts >= ws.opts.MaxAttempts:
+			log.Printf("[WEBHOOK] Dropping delivery %d to %s after %d attempts: %v", id, url, attempts, err)
+			ws.remove(id)
+		default:
+			backoff := ws.backoff(attempts)
+			log.Printf("[WEBHOOK] Attempt %d of delivery %d to %s failed: %v, retrying in %v", attempts, id, url, err, backoff)
+			next := clock.Now().Add(backoff).UnixMilli()
+			if _, err := ws.db.ExecContext(ws.ctx, `UPDATE webhook_deliveries SET attempts = ?, next_ms = ? WHERE id = ?`, attempts, next, id); err != nil {
+				log.Printf("[WEBHOOK] Failed to reschedule delivery %d: %v", id, err)
+			}
+			return
+		}
+	}
+}
+
+// post sends one delivery and reports whether a failure is worth retrying
+func (ws *WebhookStream) post(url string, id int64, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ws.ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(id, 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(ws.opts.Secret, body))
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	// Client errors won't succeed on retry, except rate limiting
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+// allow reports whether the circuit of an endpoint lets a delivery through. Once the
+// cooldown passed, the next delivery is let through to probe the endpoint.
+func (ws *WebhookStream) allow(endpoint *webhookEndpoint) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return endpoint.failures < ws.opts.BreakerThreshold || !clock.Now().Before(endpoint.openUntil)
+}
+
+// observe updates the circuit of an endpoint with the outcome of a delivery. Rejected
+// deliveries count as answers, only retryable failures open the circuit.
+func (ws *WebhookStream) observe(url string, endpoint *webhookEndpoint, retry bool, err error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if err != nil && retry {
+		endpoint.failures++
+		if endpoint.failures >= ws.opts.BreakerThreshold {
+			endpoint.openUntil = clock.Now().Add(ws.opts.BreakerCooldown)
+			log.Printf("[WEBHOOK] Circuit of %s open for %v after %d failures", url, ws.opts.BreakerCooldown, endpoint.failures)
+		}
+		return
+	}
+	if endpoint.failures >= ws.opts.BreakerThreshold {
+		log.Printf("[WEBHOOK] Circuit of %s closed", url)
+	}
+	endpoint.failures = 0
+}
+
+// backoff returns the delay before attempt+1, doubling from RetryBackoff up to MaxBackoff
+func (ws *WebhookStream) backoff(attempts int) time.Duration {
+	backoff := ws.opts.RetryBackoff
+	for i := 1; i < attempts && backoff < ws.opts.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > ws.opts.MaxBackoff {
+		backoff = ws.opts.MaxBackoff
+	}
+	return backoff
+}
+
+func (ws *WebhookStream) remove(id int64) {
+	if _, err := ws.db.ExecContext(ws.ctx, `DELETE FROM webhook_deliveries WHERE id = ?`, id); err != nil {
+		log.Printf("[WEBHOOK] Failed to remove delivery %d: %v", id, err)
+	}
+}
+
+// SignWebhook returns the WebhookSignatureHeader value of body, receivers compute the
+// same value with the shared secret and compare it with hmac.Equal
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookEventType maps an Acct-Status-Type value to the posted event, empty for
+// interim updates and accounting on/off
+func webhookEventType(acctStatusType string) string {
+	switch acctStatusType {
+	case "1":
+		return WebhookEventStart
+	case "2":
+		return WebhookEventStop
+	}
+	return ""
+}
+
+// dataString returns a string entry of StreamMessage.Data, empty when it is missing
+func dataString(data map[string]interface{}, key string) string {
+	value, _ := data[key].(string)
+	return value
+}
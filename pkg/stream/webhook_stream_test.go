@@ -0,0 +1,302 @@
+package stream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"dni/pkg/sqliteconn"
+)
+
+// webhookRequest is a delivery received by a webhookReceiver
+type webhookRequest struct {
+	path      string
+	body      []byte
+	signature string
+	delivery  string
+}
+
+// webhookReceiver answers every request with the next of its statuses, then with 200
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests chan webhookRequest
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	t.Helper()
+	wr := &webhookReceiver{statuses: statuses, requests: make(chan webhookRequest, 100)}
+	wr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		wr.requests <- webhookRequest{
+			path:      r.URL.Path,
+			body:      body,
+			signature: r.Header.Get(WebhookSignatureHeader),
+			delivery:  r.Header.Get(WebhookDeliveryHeader),
+		}
+
+		wr.mu.Lock()
+		status := http.StatusOK
+		if len(wr.statuses) > 0 {
+			status, wr.statuses = wr.statuses[0], wr.statuses[1:]
+		}
+		wr.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(wr.Close)
+	return wr
+}
+
+// next returns the next received request, failing the test when none arrives
+func (wr *webhookReceiver) next(t *testing.T) webhookRequest {
+	t.Helper()
+	select {
+	case req := <-wr.requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a webhook delivery")
+		return webhookRequest{}
+	}
+}
+
+func newTestWebhookDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sqliteconn.Open(context.Background(), filepath.Join(t.TempDir(), "webhooks.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newTestWebhookStream(t *testing.T, db *sql.DB, routes WebhookRoutes, opts WebhookOptions) *WebhookStream {
+	t.Helper()
+	opts.Secret = "s3cret"
+	if opts.PollInterval == 0 {
+		opts.PollInterval = 10 * time.Millisecond
+	}
+	ws, err := NewWebhookStream(context.Background(), db, routes, opts)
+	if err != nil {
+		t.Fatalf("NewWebhookStream returned error: %v", err)
+	}
+	t.Cleanup(func() { ws.Close(context.Background()) })
+	return ws
+}
+
+func webhookMessage(username, acctStatusType, nasIPAddress string) StreamMessage {
+	return StreamMessage{
+		Key:      "radius:acct:" + username + ":s1",
+		Username: username,
+		Data: map[string]interface{}{
+			"acct_status_type": acctStatusType,
+			"nas_ip_address":   nasIPAddress,
+			"acct_session_id":  "s1",
+		},
+	}
+}
+
+func TestWebhookRoutes(t *testing.T) {
+	routes := WebhookRoutes{
+		Users: map[string][]string{"*": {"https://all"}, "alice": {"https://alice", "https://all"}},
+		NAS:   map[string][]string{"10.0.0.1": {"https://nas"}},
+	}
+
+	tests := []struct {
+		username string
+		nas      string
+		expected []string
+	}{
+		{"alice", "10.0.0.1", []string{"https://all", "https://alice", "https://nas"}},
+		{"bob", "10.0.0.1", []string{"https://all", "https://nas"}},
+		{"bob", "10.0.0.2", []string{"https://all"}},
+		{"", "", []string{"https://all"}},
+	}
+
+	for _, tt := range tests {
+		if urls := routes.urls(tt.username, tt.nas); !reflect.DeepEqual(urls, tt.expected) {
+			t.Errorf("Expected %v for %s on %s, got %v", tt.expected, tt.username, tt.nas, urls)
+		}
+	}
+	if !(WebhookRoutes{}).Empty() || routes.Empty() {
+		t.Error("Expected only routes without URLs to be empty")
+	}
+}
+
+func TestWebhookStream_DeliversSignedEvents(t *testing.T) {
+	ctx := context.Background()
+	receiver := newWebhookReceiver(t)
+	ws := newTestWebhookStream(t, newTestWebhookDB(t), WebhookRoutes{
+		Users: map[string][]string{"alice": {receiver.URL + "/alice"}},
+		NAS:   map[string][]string{"10.0.0.1": {receiver.URL + "/nas"}},
+	}, WebhookOptions{})
+
+	// Interim updates and unrouted events are not posted
+	ws.Push(ctx, "radius:updates:alice", webhookMessage("alice", "3", "10.0.0.1"))
+	ws.Push(ctx, "radius:updates:bob", webhookMessage("bob", "1", "10.0.0.2"))
+	if err := ws.Push(ctx, "radius:updates:alice", webhookMessage("alice", "2", "10.0.0.1")); err != nil {
+		t.Fatalf("Push returned error: %v", err)
+	}
+
+	paths := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		req := receiver.next(t)
+		paths[req.path] = true
+
+		if req.signature != SignWebhook("s3cret", req.body) {
+			t.Errorf("Expected the body signed with the secret, got %s", req.signature)
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal(req.body, &event); err != nil {
+			t.Fatalf("Failed to decode webhook body: %v", err)
+		}
+		if event.Event != WebhookEventStop || event.Username != "alice" || event.StreamKey != "radius:updates:alice" || event.Attributes["acct_session_id"] != "s1" {
+			t.Errorf("Unexpected event %+v", event)
+		}
+	}
+	if !paths["/alice"] || !paths["/nas"] {
+		t.Errorf("Expected deliveries to the user and NAS URLs, got %v", paths)
+	}
+
+	select {
+	case req := <-receiver.requests:
+		t.Errorf("Expected no other deliveries, got %s", req.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := ws.Pull(ctx, ConsumerConfig{}); err == nil {
+		t.Error("Expected Pull to fail on a webhook stream")
+	}
+
+	// Later events follow replaced routes
+	ws.SetRoutes(WebhookRoutes{Users: map[string][]string{"bob": {receiver.URL + "/bob"}}})
+	ws.Push(ctx, "radius:updates:alice", webhookMessage("alice", "1", "10.0.0.1"))
+	ws.Push(ctx, "radius:updates:bob", webhookMessage("bob", "1", "10.0.0.2"))
+	if req := receiver.next(t); req.path != "/bob" {
+		t.Errorf("Expected a delivery to the new route, got %s", req.path)
+	}
+}
+
+func TestWebhookStream_RetriesInOrder(t *testing.T) {
+	ctx := context.Background()
+	receiver := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK, http.StatusBadRequest)
+	ws := newTestWebhookStream(t, newTestWebhookDB(t), WebhookRoutes{
+		Users: map[string][]string{"*": {receiver.URL}},
+	}, WebhookOptions{RetryBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+
+	ws.Push(ctx, "radius:updates:alice", webhookMessage("alice", "1", "10.0.0.1"))
+	ws.Push(ctx, "radius:updates:bob", webhookMessage("bob", "1", "10.0.0.1"))
+	ws.Push(ctx, "radius:updates:carol", webhookMessage("carol", "1", "10.0.0.1"))
+
+	// alice fails twice and is retried before bob, who is rejected and not retried
+	var deliveries []string
+	for i := 0; i < 5; i++ {
+		var event WebhookEvent
+		req := receiver.next(t)
+		json.Unmarshal(req.body, &event)
+		deliveries = append(deliveries, event.Username+" "+req.delivery)
+	}
+	expected := []string{"alice 1", "alice 1", "alice 1", "bob 2", "carol 3"}
+	if !reflect.DeepEqual(deliveries, expected) {
+		t.Errorf("Expected deliveries %v, got %v", expected, deliveries)
+	}
+
+	waitForPending(t, ws, 0)
+}
+
+func TestWebhookStream_CircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	receiver := newWebhookReceiver(t, http.StatusBadGateway, http.StatusBadGateway)
+	cooldown := 300 * time.Millisecond
+	ws := newTestWebhookStream(t, newTestWebhookDB(t), WebhookRoutes{
+		Users: map[string][]string{"*": {receiver.URL}},
+	}, WebhookOptions{
+		RetryBackoff:     time.Millisecond,
+		MaxBackoff:       time.Millisecond,
+		BreakerThreshold: 2,
+		BreakerCooldown:  cooldown,
+	})
+
+	ws.Push(ctx, "radius:updates:alice", webhookMessage("alice", "1", "10.0.0.1"))
+	receiver.next(t)
+	failed := receiver.next(t)
+	opened := time.Now()
+
+	// The second failure opened the circuit, a single probe goes out after the cooldown
+	probe := receiver.next(t)
+	if waited := time.Since(opened); waited < cooldown-50*time.Millisecond {
+		t.Errorf("Expected the open circuit to hold deliveries for %v, probed after %v", cooldown, waited)
+	}
+	if probe.delivery != failed.delivery {
+		t.Errorf("Expected delivery %s to be probed, got %s", failed.delivery, probe.delivery)
+	}
+	waitForPending(t, ws, 0)
+}
+
+func TestWebhookStream_QueueSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	db := newTestWebhookDB(t)
+	receiver := newWebhookReceiver(t, http.StatusServiceUnavailable)
+	routes := WebhookRoutes{Users: map[string][]string{"alice": {receiver.URL}}}
+
+	ws, err := NewWebhookStream(ctx, db, routes, WebhookOptions{RetryBackoff: time.Hour, PollInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewWebhookStream returned error: %v", err)
+	}
+	ws.Push(ctx, "radius:updates:alice", webhookMessage("alice", "1", "10.0.0.1"))
+	receiver.next(t)
+	if err := ws.Close(ctx); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	// Shutdown paths may close it again
+	if err := ws.Close(ctx); err != nil {
+		t.Fatalf("Second Close returned error: %v", err)
+	}
+	if pending, _ := ws.Pending(ctx); pending != 1 {
+		t.Fatalf("Expected the failed delivery to stay queued, got %d", pending)
+	}
+
+	// A new process picks up the delivery once its backoff passed
+	db.ExecContext(ctx, `UPDATE webhook_deliveries SET next_ms = 0`)
+	restarted := newTestWebhookStream(t, db, routes, WebhookOptions{})
+	if req := receiver.next(t); req.delivery != "1" {
+		t.Errorf("Expected delivery 1 after the restart, got %s", req.delivery)
+	}
+	waitForPending(t, restarted, 0)
+}
+
+func TestWebhookStream_Backoff(t *testing.T) {
+	ws := &WebhookStream{opts: WebhookOptions{RetryBackoff: time.Second, MaxBackoff: 5 * time.Second}}
+	for attempts, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 40: 5 * time.Second} {
+		if backoff := ws.backoff(attempts); backoff != expected {
+			t.Errorf("Expected backoff %v after %d attempts, got %v", expected, attempts, backoff)
+		}
+	}
+}
+
+// waitForPending waits until the queue holds expected deliveries
+func waitForPending(t *testing.T, ws *WebhookStream, expected int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending, err := ws.Pending(context.Background())
+		if err != nil {
+			t.Fatalf("Pending returned error: %v", err)
+		}
+		if pending == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d pending deliveries, got %d", expected, pending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}